@@ -1,13 +1,14 @@
 module github.com/cronokirby/ripple
 
-go 1.12
+go 1.18
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/alecthomas/kingpin v2.2.6+incompatible
 	github.com/alecthomas/template v0.0.0-20160405071501-a0175ee3bccc // indirect
 	github.com/alecthomas/units v0.0.0-20151022065526-2efee857e7cf // indirect
 	github.com/jroimartin/gocui v0.4.0
-	github.com/mattn/go-runewidth v0.0.4 // indirect
+	github.com/mattn/go-runewidth v0.0.4
 	github.com/nsf/termbox-go v0.0.0-20190325093121-288510b9734e // indirect
 	github.com/stretchr/testify v1.3.0 // indirect
 )
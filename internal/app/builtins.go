@@ -0,0 +1,122 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cronokirby/ripple/internal/network"
+)
+
+// builtinCommands are the commands both the CLI and the TUI start with
+func builtinCommands() []Command {
+	return []Command{
+		{Name: "help", Params: []string{"[command]"}, Help: "Shows the commands, or how to use one", Run: help},
+		{Name: "nick", Params: []string{"name..."}, Help: "Changes our nickname", Run: nick},
+		{Name: "me", Params: []string{"action..."}, Help: "Sends an action, like \"/me waves\"", Run: me},
+		{Name: "msg", Params: []string{"nick", "text..."}, Help: "Sends a message to a single peer", Run: msg},
+		{Name: "who", Help: "Lists the peers we know about", Run: who},
+		{Name: "ring", Help: "Shows our place in the ring", Run: ring},
+		{Name: "quit", Help: "Leaves ripple", Run: func(env *Env, args []string) error {
+			env.Quit()
+			return nil
+		}},
+		{Name: "send", Params: []string{"path..."}, Help: "Offers a file to the other peers", Run: sendFile},
+		{Name: "get", Params: []string{"id"}, Help: "Downloads a file another peer offered", Run: getFile},
+		{Name: "edit", Params: []string{"text..."}, Help: "Changes our last message, or the Nth last with ^N", Run: chatCommand(network.EventEdit)},
+		{Name: "retract", Params: []string{"[^N]"}, Help: "Hides our last message, or the Nth last", Run: chatCommand(network.EventRetract)},
+		{Name: "react", Params: []string{"reaction..."}, Help: "Reacts to the last message, or the Nth last with ^N", Run: chatCommand(network.EventReact)},
+		{Name: "away", Help: "Tells the other peers we've stepped away", Run: signalCommand(network.SignalAway)},
+		{Name: "back", Help: "Tells the other peers we've returned", Run: signalCommand(network.SignalIdle)},
+	}
+}
+
+func help(env *Env, args []string) error {
+	if len(args) > 0 {
+		cmd, ok := env.commands.get(strings.TrimPrefix(args[0], "/"))
+		if !ok {
+			return fmt.Errorf("Unknown command %s", args[0])
+		}
+		env.Print(cmd.usage() + ": " + cmd.Help)
+		return nil
+	}
+	for _, cmd := range env.commands.list() {
+		env.Print(fmt.Sprintf("%-24s %s", cmd.usage(), cmd.Help))
+	}
+	env.Print("Anything else is sent as a message, with // sending a message starting with /")
+	return nil
+}
+
+func nick(env *Env, args []string) error {
+	if err := env.Swarm.ChangeNickname(args[0]); err != nil {
+		return fmt.Errorf("Couldn't change nickname: %v", err)
+	}
+	env.render.setNick(args[0])
+	env.Print("You're now known as " + args[0])
+	return nil
+}
+
+func me(env *Env, args []string) error {
+	env.say(actionPrefix + args[0])
+	return nil
+}
+
+func msg(env *Env, args []string) error {
+	addr, err := findPeer(env.Swarm, args[0])
+	if err != nil {
+		return err
+	}
+	if err := env.Swarm.SendDirect(addr, args[1]); err != nil {
+		return fmt.Errorf("Couldn't send: %v", err)
+	}
+	line := ownLine(network.MessageRef{Sender: addrString(env.Swarm.Addr())}, env.render.getNick(), args[1])
+	line.direct = true
+	line.to = args[0]
+	env.chat.add(line)
+	env.shown()
+	return nil
+}
+
+// findPeer finds the address of a peer from its nickname, or its address
+func findPeer(swarm Node, name string) (net.Addr, error) {
+	var found []net.Addr
+	for _, peer := range swarm.Peers() {
+		if peer.Addr.String() == name {
+			return peer.Addr, nil
+		}
+		if strings.EqualFold(peer.Nick, name) {
+			found = append(found, peer.Addr)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("No peer called %s, see /who", name)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("%d peers are called %s, use their address instead", len(found), name)
+	}
+}
+
+func who(env *Env, args []string) error {
+	peers := env.Swarm.Peers()
+	if len(peers) == 0 {
+		env.Print("Nobody else is here yet")
+	}
+	for _, peer := range peers {
+		env.Print(fmt.Sprintf("%s %v", peerLine(peer), peer.Addr))
+	}
+	return nil
+}
+
+func ring(env *Env, args []string) error {
+	env.Print(strings.TrimSpace(statusLine(env.Swarm, env.render.getNick())))
+	env.Print(fmt.Sprintf("id %v", env.Swarm.ID()))
+	if chords := env.Swarm.Chords(); len(chords) > 0 {
+		env.Print(fmt.Sprintf("chords %v", chords))
+	}
+	if fingers := env.Swarm.Fingers(); len(fingers) > 0 {
+		env.Print(fmt.Sprintf("fingers %v", fingers))
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/network"
+)
+
+// chatLine is a line shown in the chat, which may be changed later
+type chatLine struct {
+	// ref is the zero MessageRef for lines that aren't messages, or can't be referred to
+	ref network.MessageRef
+	// from is the address of the sender, which is empty for lines like errors
+	from      string
+	at        time.Time
+	nick      string
+	content   string
+	own       bool
+	edited    bool
+	retracted bool
+	// direct lines were sent to a single peer, which is to for our own
+	direct bool
+	to     string
+	// notice lines are for us alone, like errors and the output of commands
+	notice bool
+	// reactions are shown after the content, like "👍 bob"
+	reactions []string
+}
+
+// ownLine makes the line for a message we sent
+func ownLine(ref network.MessageRef, nick, content string) *chatLine {
+	if nick == "" {
+		nick = "me"
+	}
+	return &chatLine{ref: ref, from: ref.Sender, nick: nick, content: content, own: true}
+}
+
+// chatLog holds the lines shown so far, so that edits and reactions can find them
+type chatLog struct {
+	mu    sync.Mutex
+	lines []*chatLine
+	byRef map[network.MessageRef]*chatLine
+}
+
+func newChatLog() *chatLog {
+	return &chatLog{byRef: make(map[network.MessageRef]*chatLine)}
+}
+
+// add appends a line to the chat, as of now unless it says otherwise
+func (log *chatLog) add(line *chatLine) {
+	if line.at.IsZero() {
+		line.at = time.Now()
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.lines = append(log.lines, line)
+	if line.ref.ID != 0 {
+		log.byRef[line.ref] = line
+	}
+}
+
+// apply changes the chat according to an event, returning the line it touched
+//
+// Events about messages we never saw are ignored.
+func (log *chatLog) apply(event network.ChatEvent) (*chatLine, bool) {
+	switch event.Kind {
+	case network.EventMessage:
+		line := &chatLine{ref: event.Message, from: event.Message.Sender, nick: event.Nick, content: event.Content}
+		log.add(line)
+		return line, true
+	case network.EventDirect:
+		line := &chatLine{from: addrString(event.From), nick: event.Nick, content: event.Content, direct: true}
+		log.add(line)
+		return line, true
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	line, ok := log.byRef[event.Message]
+	if !ok {
+		return nil, false
+	}
+	switch event.Kind {
+	case network.EventEdit:
+		line.content = event.Content
+		line.edited = true
+	case network.EventRetract:
+		line.retracted = true
+	case network.EventReact:
+		line.reactions = append(line.reactions, event.Content+" "+event.Nick)
+	}
+	return line, true
+}
+
+// find returns the nth latest message, counting from 1, only counting ours if own is set
+func (log *chatLog) find(n int, own bool) (*chatLine, bool) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for i := len(log.lines) - 1; i >= 0; i-- {
+		line := log.lines[i]
+		if line.ref.ID == 0 || line.retracted || (own && !line.own) {
+			continue
+		}
+		n--
+		if n == 0 {
+			return line, true
+		}
+	}
+	return nil, false
+}
+
+// each calls f on every line, oldest first
+func (log *chatLog) each(f func(*chatLine)) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for _, line := range log.lines {
+		f(line)
+	}
+}
+
+// takeTarget reads the optional "^N" at the start of a command's argument
+//
+// It defaults to 1, meaning the latest message.
+func takeTarget(arg string) (int, string) {
+	if !strings.HasPrefix(arg, "^") {
+		return 1, arg
+	}
+	fields := strings.SplitN(arg, " ", 2)
+	n, err := strconv.Atoi(fields[0][1:])
+	if err != nil || n < 1 {
+		return 1, arg
+	}
+	if len(fields) == 1 {
+		return n, ""
+	}
+	return n, strings.TrimSpace(fields[1])
+}
+
+// chatCommand makes /edit, /retract or /react
+//
+// Edits and retractions apply to our own messages, while reactions can
+// go to any message. All of them go to the latest message, unless given
+// "^N" to go to the Nth latest.
+func chatCommand(kind network.EventKind) func(*Env, []string) error {
+	return func(env *Env, args []string) error {
+		arg := ""
+		if len(args) > 0 {
+			arg = args[0]
+		}
+		n, arg := takeTarget(arg)
+		line, ok := env.chat.find(n, kind != network.EventReact)
+		if !ok {
+			return fmt.Errorf("No such message")
+		}
+		var err error
+		switch {
+		case kind != network.EventRetract && arg == "":
+			return fmt.Errorf("Nothing to send")
+		case kind == network.EventEdit:
+			err = env.Swarm.EditMessage(line.ref.ID, arg)
+		case kind == network.EventRetract:
+			err = env.Swarm.RetractMessage(line.ref.ID)
+		default:
+			err = env.Swarm.React(line.ref, arg)
+		}
+		if err != nil {
+			return fmt.Errorf("Couldn't send: %v", err)
+		}
+		env.chat.apply(network.ChatEvent{Kind: kind, Message: line.ref, Nick: "me", Content: arg})
+		env.shown()
+		return nil
+	}
+}
+
+// printer is an EventReceiver printing everything to the terminal
+//
+// Lines can't be changed once printed, so edits, retractions and reactions
+// are printed as lines of their own.
+type printer struct {
+	log    *chatLog
+	render *renderer
+}
+
+func (p printer) ReceiveContent(name, content string) {
+	line := &chatLine{nick: name, content: content}
+	p.log.add(line)
+	fmt.Println(p.render.render(line))
+}
+
+func (p printer) ReceiveEvent(event network.ChatEvent) {
+	line, ok := p.log.apply(event)
+	switch {
+	case event.Kind == network.EventMessage || event.Kind == network.EventDirect:
+		fmt.Println(p.render.render(line))
+		p.render.notify(line)
+	case !ok:
+		// we never saw the message in question
+	case event.Kind == network.EventEdit:
+		fmt.Printf("* %s edited a message: %s\n", clean(event.Nick), clean(event.Content))
+	case event.Kind == network.EventRetract:
+		fmt.Printf("* %s retracted a message\n", clean(event.Nick))
+	case event.Kind == network.EventReact:
+		fmt.Printf("* %s reacted %s to %s\n", clean(event.Nick), clean(event.Content), clean(line.nick))
+	}
+}
@@ -2,45 +2,167 @@ package app
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/cronokirby/ripple/internal/config"
+	"github.com/cronokirby/ripple/internal/control"
 	"github.com/cronokirby/ripple/internal/network"
 )
 
 var (
 	// App provides the starting point for command parsing
-	App = kingpin.New("ripple", "A decentralized chat application")
+	App = kingpin.New("ripple", "A decentralized chat application").PreAction(recordFlags)
 
 	// Start handles the start command
 	Start = App.Command("start", "Start a new swarm")
 	// StartAddr is the address we need to start the swarm on
-	StartAddr = Start.Arg("addr", "The address to listen on").Required().String()
+	StartAddr = Start.Arg("addr", "The address to listen on, unless the profile has one").String()
 
 	// Connect is the command for joining an existing swarm
 	Connect = App.Command("connect", "Connect to an existing swarm")
 	// ConnectListenAddr is the address on which to listen after joining
-	ConnectListenAddr = Connect.Arg("listen-addr", "The address to listen on once connected").Required().String()
+	ConnectListenAddr = Connect.Arg("listen-addr", "The address to listen on once connected, unless the profile has one").String()
 	// ConnectAddr is the address to connect to
-	ConnectAddr = Connect.Arg("connect-addr", "The address to connect to").Required().String()
+	ConnectAddr = Connect.Arg("connect-addr", "The address to connect to, rather than the peers of the profile").String()
+
+	// Daemon runs a node without any ui, for clients to attach to
+	Daemon = App.Command("daemon", "Run a node in the background, which attach connects to")
+	// DaemonListenAddr is the address the node listens on
+	DaemonListenAddr = Daemon.Arg("listen-addr", "The address to listen on, unless the profile has one").String()
+	// DaemonConnectAddr is the address of a node in the swarm to join, if any
+	DaemonConnectAddr = Daemon.Arg("connect-addr", "The address to connect to, rather than the peers of the profile, with neither starting a new swarm").String()
+	// DaemonSocket is where the daemon serves the control API
+	DaemonSocket = Daemon.Flag("socket", "The Unix socket, or loopback address, to serve clients on").Default(control.DefaultSocket()).String()
+
+	// Attach connects to a node running as a daemon
+	Attach = App.Command("attach", "Attach to a node running as a daemon, leaving it running after detaching")
+	// AttachSocket is where the daemon serves the control API
+	AttachSocket = Attach.Flag("socket", "The Unix socket, or loopback address, the daemon serves clients on").Default(control.DefaultSocket()).String()
+
+	// Send sends a single message through a running node
+	Send = App.Command("send", "Send a message through a running node, without joining the swarm ourselves")
+	// SendVia is where the node serves the control API
+	SendVia = Send.Flag("via", "The Unix socket, or loopback address, the node serves the control API on").Default(control.DefaultSocket()).String()
+	// SendText is the message, with its words joined by spaces
+	SendText = Send.Arg("text", "The message to send").Required().Strings()
+
+	// Tail prints the messages a running node receives
+	Tail = App.Command("tail", "Print the messages a running node receives, until it stops")
+	// TailVia is where the node serves the control API
+	TailVia = Tail.Flag("via", "The Unix socket, or loopback address, the node serves the control API on").Default(control.DefaultSocket()).String()
+	// TailJSON prints the events of the control API rather than lines of chat
+	TailJSON = Tail.Flag("json", "Print every message as a line of JSON").Bool()
+
+	// ConfigCommand groups the commands about the config file
+	ConfigCommand = App.Command("config", "Look at the configuration")
+	// ConfigShow prints the configuration we end up with
+	ConfigShow = ConfigCommand.Command("show", "Print the configuration the config file and the flags add up to")
+
+	// ConfigPath is the config file, holding the profiles we can use
+	ConfigPath = App.Flag("config", "The config file to read the profile from").Default(config.DefaultPath()).String()
+	// Profile is the profile of the config file we use
+	Profile = App.Flag("profile", "The profile of the config file to use, rather than the one it picks").String()
+	// Nick is the nickname we pick once in the swarm
+	Nick = App.Flag("nick", "The nickname to pick once in the swarm").String()
+
+	// Advertise is the address other peers should use to contact us
+	Advertise = App.Flag("advertise", "The address other peers should contact us with, if different from the one we listen on").String()
+
+	// Downloads is the directory the files we get from other nodes are saved in
+	Downloads = App.Flag("downloads", "The directory to save downloaded files in").Default(".").String()
+
+	// Bell rings the terminal bell for messages mentioning our nickname
+	Bell = App.Flag("bell", "Ring the terminal bell when a message mentions our nickname").Bool()
+
+	// CodeBlocks shows the text of messages fenced with ``` as code
+	CodeBlocks = App.Flag("code-blocks", "Show text fenced with ``` as code, which --no-code-blocks turns off").Default("true").Bool()
+
+	// Control is where the local control API is served, if anywhere
+	Control = App.Flag("control", "Serve the local control API on a Unix socket, or a loopback address like 127.0.0.1:7070").String()
 
 	// TUI allows us to start the interactive terminal ui instead
 	TUI = App.Flag("tui", "Run the application in terminal UI mode").Bool()
+	// Faults injects failures into our connections, which is useful for testing
+	Faults = App.Flag("faults", "Inject faults into connections, e.g. delay=10ms,split,drop=ConfirmReferral").Hidden().String()
 )
 
-// Interact allows us to interact in a terminal way with a SwarmHandle
-func Interact(swarm *network.SwarmHandle) {
+// Interact allows us to interact in a terminal way with a node
+//
+// It returns once we quit, with true, or once there's no more input.
+func Interact(swarm Node) bool {
+	report := func(text string) {
+		fmt.Println(text)
+	}
+	chat := newChatLog()
+	render := terminalRenderer(*Bell, *CodeBlocks)
+	render.setNick(ownNick(swarm))
+	swarm.SetReceiver(printer{chat, render})
+	swarm.HandleFileOffers(func(offer network.FileOffer) {
+		report(describeOffer(swarm, offer))
+	})
+	// typing would be too noisy here, without a status line to show it in
+	swarm.HandleSignals(func(event network.SignalEvent) {
+		if event.Signal == network.SignalAway {
+			report("* " + clean(event.Nick) + " is away")
+		}
+	})
+	quit := false
+	env := &Env{
+		Swarm:    swarm,
+		Print:    report,
+		Quit:     func() { quit = true },
+		chat:     chat,
+		render:   render,
+		commands: commands,
+		shown:    func() {},
+	}
 	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		scanner.Scan()
-		text := scanner.Text()
-		var name string
-		_, err := fmt.Sscanf(text, "!nick %s", &name)
-		if err == nil {
-			swarm.ChangeNickname(name)
+	for scanner.Scan() {
+		commands.handle(env, scanner.Text())
+		if quit {
+			return true
+		}
+	}
+	return false
+}
+
+// SendOnce sends a message through a running node
+func SendOnce(addr string, text string) error {
+	client, err := control.Dial(addr)
+	if err != nil {
+		return err
+	}
+	_, err = client.SendMessage(text)
+	return err
+}
+
+// Follow prints the messages a running node receives from now on, until it stops
+//
+// These are printed like in the terminal, or as the JSON the control API uses.
+func Follow(addr string, asJSON bool) error {
+	client, err := control.Dial(addr)
+	if err != nil {
+		return err
+	}
+	p := printer{newChatLog(), terminalRenderer(false, *CodeBlocks)}
+	encoder := json.NewEncoder(os.Stdout)
+	err = client.Events(0, func(event control.Event) {
+		chat, ok := event.ChatEvent()
+		if !ok {
+			return
+		}
+		if asJSON {
+			encoder.Encode(event)
 		} else {
-			swarm.SendContent(text)
+			p.ReceiveEvent(chat)
 		}
+	})
+	if err != nil {
+		return err
 	}
+	return errors.New("The node stopped")
 }
@@ -0,0 +1,264 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Command is something we run by typing a slash and its name, like "/nick alice"
+type Command struct {
+	Name string
+	// Params name the arguments, like "nick", with "[nick]" being optional,
+	// and a last one like "text..." taking the rest of the line
+	Params []string
+	// Help is a short description, shown by /help
+	Help string
+	// Run does the work, with an argument for each of Params that was given
+	Run func(env *Env, args []string) error
+}
+
+// usage shows how a command is used, like "/msg <nick> <text...>"
+func (cmd Command) usage() string {
+	parts := []string{"/" + cmd.Name}
+	for _, param := range cmd.Params {
+		if strings.HasPrefix(param, "[") {
+			parts = append(parts, param)
+		} else {
+			parts = append(parts, "<"+param+">")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// parse splits what follows the name of a command into its arguments
+func (cmd Command) parse(text string) ([]string, error) {
+	var args []string
+	rest := strings.TrimSpace(text)
+	for i, param := range cmd.Params {
+		if rest == "" {
+			if strings.HasPrefix(param, "[") {
+				break
+			}
+			return nil, fmt.Errorf("Usage: %s", cmd.usage())
+		}
+		if i == len(cmd.Params)-1 && strings.HasSuffix(strings.Trim(param, "[]"), "...") {
+			args = append(args, rest)
+			rest = ""
+			break
+		}
+		var arg string
+		arg, rest = cutWord(rest)
+		args = append(args, arg)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("Usage: %s", cmd.usage())
+	}
+	return args, nil
+}
+
+// cutWord splits text at its first run of spaces
+func cutWord(text string) (string, string) {
+	i := strings.IndexFunc(text, unicode.IsSpace)
+	if i < 0 {
+		return text, ""
+	}
+	return text[:i], strings.TrimLeftFunc(text[i:], unicode.IsSpace)
+}
+
+// Env is what commands work with
+type Env struct {
+	Swarm Node
+	// Print shows a line to us alone, and can be called from any goroutine
+	Print func(string)
+	// Quit leaves the app
+	Quit func()
+	// chat holds the lines shown, and render how they're shown
+	chat     *chatLog
+	render   *renderer
+	commands *commandSet
+	// shown is called after we add to the chat, so that it can be shown again
+	shown func()
+}
+
+// say sends a message, adding it to the chat
+func (env *Env) say(content string) {
+	ref, err := env.Swarm.SendMessage(content)
+	if err != nil {
+		env.Print("Couldn't send: " + err.Error())
+		return
+	}
+	env.chat.add(ownLine(ref, env.render.getNick(), content))
+	env.shown()
+}
+
+// commandSet holds commands by name
+type commandSet struct {
+	mu     sync.Mutex
+	byName map[string]Command
+}
+
+func newCommandSet(cmds ...Command) *commandSet {
+	set := &commandSet{byName: make(map[string]Command)}
+	for _, cmd := range cmds {
+		if err := set.register(cmd); err != nil {
+			panic(err)
+		}
+	}
+	return set
+}
+
+// commands are those of both the CLI and the TUI
+var commands = newCommandSet(builtinCommands()...)
+
+// RegisterCommand adds a command to both the CLI and the TUI
+//
+// This fails if the name is taken, or isn't a single word.
+func RegisterCommand(cmd Command) error {
+	return commands.register(cmd)
+}
+
+func (set *commandSet) register(cmd Command) error {
+	if cmd.Name == "" || strings.ContainsAny(cmd.Name, " /") || cmd.Run == nil {
+		return fmt.Errorf("Invalid command %q", cmd.Name)
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if _, ok := set.byName[cmd.Name]; ok {
+		return fmt.Errorf("The command /%s already exists", cmd.Name)
+	}
+	set.byName[cmd.Name] = cmd
+	return nil
+}
+
+// with returns a copy of the set, with more commands
+func (set *commandSet) with(cmds ...Command) *commandSet {
+	set.mu.Lock()
+	copied := newCommandSet()
+	for _, cmd := range set.byName {
+		copied.byName[cmd.Name] = cmd
+	}
+	set.mu.Unlock()
+	for _, cmd := range cmds {
+		if err := copied.register(cmd); err != nil {
+			panic(err)
+		}
+	}
+	return copied
+}
+
+func (set *commandSet) get(name string) (Command, bool) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	cmd, ok := set.byName[name]
+	return cmd, ok
+}
+
+// list returns every command, sorted by name
+func (set *commandSet) list() []Command {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	cmds := make([]Command, 0, len(set.byName))
+	for _, cmd := range set.byName {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// handle runs text as a command, or sends it as a message otherwise
+//
+// A message starting with a slash can be sent by doubling it, as in "//shrug".
+// "!nick name" still works, for those used to it.
+func (set *commandSet) handle(env *Env, text string) {
+	if strings.HasPrefix(text, "!nick ") {
+		text = "/nick " + text[len("!nick "):]
+	}
+	if strings.HasPrefix(text, "//") {
+		env.say(text[1:])
+		return
+	}
+	if !strings.HasPrefix(text, "/") {
+		env.say(text)
+		return
+	}
+	name, rest := cutWord(text[1:])
+	cmd, ok := set.get(name)
+	if !ok {
+		env.Print(fmt.Sprintf("Unknown command /%s, see /help", name))
+		return
+	}
+	args, err := cmd.parse(rest)
+	if err == nil {
+		err = cmd.Run(env, args)
+	}
+	if err != nil {
+		env.Print(err.Error())
+	}
+}
+
+// complete fills in the word before pos, returning the new line and position
+//
+// The first word of a command completes to command names, and any other to
+// nicknames. When several of those fit, they're returned as well.
+func (set *commandSet) complete(line []rune, pos int, nicks []string) ([]rune, int, []string) {
+	if pos > len(line) {
+		pos = len(line)
+	}
+	start := pos
+	for start > 0 && !unicode.IsSpace(line[start-1]) {
+		start--
+	}
+	word := string(line[start:pos])
+	candidates := nicks
+	if start == 0 && strings.HasPrefix(word, "/") {
+		candidates = nil
+		for _, cmd := range set.list() {
+			candidates = append(candidates, "/"+cmd.Name)
+		}
+	}
+	var matches []string
+	for _, candidate := range candidates {
+		if hasPrefixFold(candidate, word) {
+			matches = append(matches, candidate)
+		}
+	}
+	if len(matches) == 0 || word == "" {
+		return line, pos, nil
+	}
+	completion := matches[0] + " "
+	var options []string
+	if len(matches) > 1 {
+		completion = commonPrefix(matches)
+		options = matches
+	}
+	out := append(append(append([]rune{}, line[:start]...), []rune(completion)...), line[pos:]...)
+	return out, start + len([]rune(completion)), options
+}
+
+// hasPrefixFold checks if s starts with prefix, ignoring case
+//
+// Runes are compared rather than bytes, since a rune can be written
+// with a different number of bytes in another case.
+func hasPrefixFold(s, prefix string) bool {
+	runes, start := []rune(s), []rune(prefix)
+	return len(runes) >= len(start) && strings.EqualFold(string(runes[:len(start)]), prefix)
+}
+
+// commonPrefix returns the longest start all the words share, ignoring case
+//
+// The prefix is spelled like the first word.
+func commonPrefix(words []string) string {
+	prefix := []rune(words[0])
+	for _, word := range words[1:] {
+		runes := []rune(word)
+		n := 0
+		for n < len(prefix) && n < len(runes) && strings.EqualFold(string(prefix[n]), string(runes[n])) {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return string(prefix)
+}
@@ -0,0 +1,143 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cronokirby/ripple/internal/network"
+)
+
+// chatNode records the messages and nicknames sent through it
+type chatNode struct {
+	Node
+	said []string
+	nick string
+}
+
+func (n *chatNode) SendMessage(content string) (network.MessageRef, error) {
+	n.said = append(n.said, content)
+	return network.MessageRef{Sender: "me", ID: uint64(len(n.said))}, nil
+}
+
+func (n *chatNode) ChangeNickname(name string) error {
+	n.nick = name
+	return nil
+}
+
+// testEnv returns an Env over a chatNode, and the lines it printed
+func testEnv() (*Env, *chatNode, *[]string) {
+	node := &chatNode{}
+	var printed []string
+	env := &Env{
+		Swarm:    node,
+		Print:    func(text string) { printed = append(printed, text) },
+		Quit:     func() {},
+		chat:     newChatLog(),
+		render:   &renderer{},
+		commands: newCommandSet(builtinCommands()...),
+		shown:    func() {},
+	}
+	return env, node, &printed
+}
+
+func TestCommandParse(t *testing.T) {
+	msg := Command{Name: "msg", Params: []string{"nick", "text..."}}
+	nick := Command{Name: "nick", Params: []string{"name..."}}
+	get := Command{Name: "get", Params: []string{"id"}}
+	retract := Command{Name: "retract", Params: []string{"[^N]"}}
+	cases := []struct {
+		cmd      Command
+		text     string
+		expected []string
+		fails    bool
+	}{
+		{msg, "bob hi there", []string{"bob", "hi there"}, false},
+		{msg, "  bob   hi  there  ", []string{"bob", "hi  there"}, false},
+		{msg, "bob\thi", []string{"bob", "hi"}, false},
+		{msg, "bob", nil, true},
+		{msg, "", nil, true},
+		{nick, "Jane Doe", []string{"Jane Doe"}, false},
+		{get, "abc", []string{"abc"}, false},
+		{get, "abc def", nil, true},
+		{retract, "", nil, false},
+		{retract, "^2", []string{"^2"}, false},
+		{retract, "^2 ^3", nil, true},
+	}
+	for _, c := range cases {
+		args, err := c.cmd.parse(c.text)
+		if c.fails {
+			if err == nil {
+				t.Errorf("Expected /%s %q to be refused got %q", c.cmd.Name, c.text, args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for /%s %q: %v", c.cmd.Name, c.text, err)
+		} else if !reflect.DeepEqual(args, c.expected) {
+			t.Errorf("Expected %q got %q", c.expected, args)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	cases := []struct {
+		text    string
+		said    []string
+		nick    string
+		printed []string
+	}{
+		{"hello", []string{"hello"}, "", nil},
+		{"//shrug", []string{"/shrug"}, "", nil},
+		{"/me waves", []string{"/me waves"}, "", nil},
+		{"/nick Jane Doe", nil, "Jane Doe", []string{"You're now known as Jane Doe"}},
+		{"/nick\tJane", nil, "Jane", []string{"You're now known as Jane"}},
+		{"/nick   Jane  ", nil, "Jane", []string{"You're now known as Jane"}},
+		{"!nick bob", nil, "bob", []string{"You're now known as bob"}},
+		{"/frobnicate now", nil, "", []string{"Unknown command /frobnicate, see /help"}},
+		{"/nick", nil, "", []string{"Usage: /nick <name...>"}},
+		{"/", nil, "", []string{"Unknown command /, see /help"}},
+	}
+	for _, c := range cases {
+		env, node, printed := testEnv()
+		env.commands.handle(env, c.text)
+		if !reflect.DeepEqual(node.said, c.said) {
+			t.Errorf("Expected %q to send %q got %q", c.text, c.said, node.said)
+		}
+		if node.nick != c.nick {
+			t.Errorf("Expected %q to change the nickname to %q got %q", c.text, c.nick, node.nick)
+		}
+		if !reflect.DeepEqual(*printed, c.printed) {
+			t.Errorf("Expected %q to print %q got %q", c.text, c.printed, *printed)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	set := newCommandSet(builtinCommands()...)
+	nicks := []string{"alice", "Bob", "bobby", "\u212aai"}
+	cases := []struct {
+		line    string
+		pos     int
+		out     string
+		outPos  int
+		options []string
+	}{
+		{"/ni", 3, "/nick ", 6, nil},
+		{"/re", 3, "/re", 3, []string{"/react", "/retract"}},
+		{"/nick al", 8, "/nick alice ", 12, nil},
+		{"hi AL", 5, "hi alice ", 9, nil},
+		{"hi\tal", 5, "hi\talice ", 9, nil},
+		{"hi bo", 5, "hi Bob", 6, []string{"Bob", "bobby"}},
+		{"al and me", 2, "alice  and me", 6, nil},
+		// the Kelvin sign folds to a k, but is written with more bytes
+		{"hi ka", 5, "hi \u212aai ", 7, nil},
+		{"hi ", 3, "hi ", 3, nil},
+		{"hi zed", 6, "hi zed", 6, nil},
+	}
+	for _, c := range cases {
+		out, pos, options := set.complete([]rune(c.line), c.pos, nicks)
+		if string(out) != c.out || pos != c.outPos || !reflect.DeepEqual(options, c.options) {
+			t.Errorf("Expected %q at %d with %q got %q at %d with %q", c.out, c.outPos, c.options, string(out), pos, options)
+		}
+	}
+}
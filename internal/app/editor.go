@@ -0,0 +1,245 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/jroimartin/gocui"
+)
+
+// draft is what's being written in the input view, which can span several lines
+type draft struct {
+	text []rune
+	// pos is where the cursor is in text
+	pos int
+}
+
+func (d *draft) String() string {
+	return string(d.text)
+}
+
+// insert writes runes at the cursor, moving it past them
+func (d *draft) insert(runes ...rune) {
+	text := make([]rune, 0, len(d.text)+len(runes))
+	text = append(append(append(text, d.text[:d.pos]...), runes...), d.text[d.pos:]...)
+	d.text = text
+	d.pos += len(runes)
+}
+
+// delete removes the rune before the cursor if back is set, or the one under it
+func (d *draft) delete(back bool) {
+	at := d.pos
+	if back {
+		at--
+	}
+	if at < 0 || at >= len(d.text) {
+		return
+	}
+	d.text = append(d.text[:at], d.text[at+1:]...)
+	d.pos = at
+}
+
+// move puts the cursor at pos, staying within the text
+func (d *draft) move(pos int) {
+	if pos > len(d.text) {
+		pos = len(d.text)
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	d.pos = pos
+}
+
+// set replaces the text, with the cursor at the end
+func (d *draft) set(text string) {
+	d.text = []rune(text)
+	d.pos = len(d.text)
+}
+
+// lines counts the lines of the text
+func (d *draft) lines() int {
+	lines := 1
+	for _, r := range d.text {
+		if r == '\n' {
+			lines++
+		}
+	}
+	return lines
+}
+
+// cursor returns the line and column of the cursor
+func (d *draft) cursor() (int, int) {
+	line, col := 0, 0
+	for _, r := range d.text[:d.pos] {
+		col++
+		if r == '\n' {
+			line++
+			col = 0
+		}
+	}
+	return line, col
+}
+
+// lineStart finds where the line containing pos starts
+func (d *draft) lineStart(pos int) int {
+	for pos > 0 && d.text[pos-1] != '\n' {
+		pos--
+	}
+	return pos
+}
+
+// lineEnd finds where the line containing pos ends
+func (d *draft) lineEnd(pos int) int {
+	for pos < len(d.text) && d.text[pos] != '\n' {
+		pos++
+	}
+	return pos
+}
+
+// moveLine moves the cursor to the line above if up is set, or the one below, keeping its column
+//
+// This returns false if there's no such line.
+func (d *draft) moveLine(up bool) bool {
+	start := d.lineStart(d.pos)
+	col := d.pos - start
+	var target int
+	if up {
+		if start == 0 {
+			return false
+		}
+		target = d.lineStart(start - 1)
+	} else {
+		end := d.lineEnd(d.pos)
+		if end == len(d.text) {
+			return false
+		}
+		target = end + 1
+	}
+	if end := d.lineEnd(target); target+col > end {
+		col = end - target
+	}
+	d.pos = target + col
+	return true
+}
+
+// edit changes the draft according to a key
+//
+// Besides writing and deleting, it moves with Left and Right, Home and End
+// (or Ctrl-A and Ctrl-E), and jumps over words with Alt-B and Alt-F.
+// Alt-Enter and Ctrl-J start a new line.
+func (d *draft) edit(key gocui.Key, ch rune, mod gocui.Modifier) {
+	switch {
+	case ch != 0 && ch != '\n' && mod == 0:
+		d.insert(ch)
+	case key == gocui.KeySpace:
+		d.insert(' ')
+	case key == gocui.KeyEnter && mod == gocui.ModAlt || key == gocui.KeyCtrlJ:
+		d.insert('\n')
+	case key == gocui.KeyBackspace || key == gocui.KeyBackspace2:
+		d.delete(true)
+	case key == gocui.KeyDelete:
+		d.delete(false)
+	case key == gocui.KeyArrowLeft:
+		d.move(d.pos - 1)
+	case key == gocui.KeyArrowRight:
+		d.move(d.pos + 1)
+	case key == gocui.KeyHome || key == gocui.KeyCtrlA:
+		d.move(d.lineStart(d.pos))
+	case key == gocui.KeyEnd || key == gocui.KeyCtrlE:
+		d.move(d.lineEnd(d.pos))
+	case mod == gocui.ModAlt && (ch == 'b' || ch == 'B'):
+		d.move(wordLeft(d.text, d.pos))
+	case mod == gocui.ModAlt && (ch == 'f' || ch == 'F'):
+		d.move(wordRight(d.text, d.pos))
+	}
+}
+
+// draw shows the draft in a view, scrolling it so that the cursor can be seen
+func (d *draft) draw(v *gocui.View) {
+	v.Clear()
+	fmt.Fprint(v, string(d.text))
+	line, col := d.cursor()
+	width, height := v.Size()
+	ox, oy := 0, 0
+	if col >= width {
+		ox = col - width + 1
+	}
+	if line >= height {
+		oy = line - height + 1
+	}
+	v.SetOrigin(ox, oy)
+	v.SetCursor(col-ox, line-oy)
+}
+
+// pasteStart and pasteEnd mark a bracketed paste, once the escape is taken out
+//
+// The terminal sends "\x1b[200~" before pasted text and "\x1b[201~" after it,
+// which gocui passes on as Alt-[ followed by the rest of the sequence.
+const (
+	pasteStart = "[200~"
+	pasteEnd   = "[201~"
+)
+
+// pasteDetector follows the keys passed to the editor, to tell if they're being pasted
+type pasteDetector struct {
+	// seq holds what we've seen of a sequence marking a paste
+	seq     []rune
+	pasting bool
+}
+
+// feed takes a key, returning the runes it held back if the key wasn't part of
+// a sequence marking a paste after all
+//
+// ok is false when the key was taken in.
+func (p *pasteDetector) feed(key gocui.Key, ch rune, mod gocui.Modifier) (held []rune, ok bool) {
+	if mod == gocui.ModAlt && ch == '[' {
+		p.seq = []rune{'['}
+		return nil, false
+	}
+	if len(p.seq) == 0 {
+		return nil, true
+	}
+	p.seq = append(p.seq, ch)
+	seq := string(p.seq)
+	switch {
+	case seq == pasteStart:
+		p.seq = nil
+		p.pasting = true
+		return nil, false
+	case seq == pasteEnd:
+		p.seq = nil
+		p.pasting = false
+		return nil, false
+	case mod == 0 && (strings.HasPrefix(pasteStart, seq) || strings.HasPrefix(pasteEnd, seq)):
+		return nil, false
+	}
+	held = p.seq[:len(p.seq)-1]
+	p.seq = nil
+	return held, true
+}
+
+// wordLeft finds where the word before x starts
+func wordLeft(line []rune, x int) int {
+	if x > len(line) {
+		x = len(line)
+	}
+	for x > 0 && unicode.IsSpace(line[x-1]) {
+		x--
+	}
+	for x > 0 && !unicode.IsSpace(line[x-1]) {
+		x--
+	}
+	return x
+}
+
+// wordRight finds where the word after x ends
+func wordRight(line []rune, x int) int {
+	for x < len(line) && unicode.IsSpace(line[x]) {
+		x++
+	}
+	for x < len(line) && !unicode.IsSpace(line[x]) {
+		x++
+	}
+	return x
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/jroimartin/gocui"
+)
+
+func TestDraftMoveLine(t *testing.T) {
+	var d draft
+	d.set("first line\nab\nthird")
+	d.move(8)
+	steps := []struct {
+		up   bool
+		ok   bool
+		line int
+		col  int
+	}{
+		// the column is kept where the line is long enough
+		{false, true, 1, 2},
+		{false, true, 2, 2},
+		{false, false, 2, 2},
+		{true, true, 1, 2},
+		{true, true, 0, 2},
+		{true, false, 0, 2},
+	}
+	for i, step := range steps {
+		ok := d.moveLine(step.up)
+		line, col := d.cursor()
+		if ok != step.ok || line != step.line || col != step.col {
+			t.Errorf("Expected %v at %d:%d at step %d got %v at %d:%d", step.ok, step.line, step.col, i, ok, line, col)
+		}
+	}
+	d.set("a\n\nbc")
+	if !d.moveLine(true) {
+		t.Fatalf("Expected to move up to the empty line")
+	}
+	if line, col := d.cursor(); line != 1 || col != 0 || d.lines() != 3 {
+		t.Errorf("Expected 1:0 of 3 lines got %d:%d of %d", line, col, d.lines())
+	}
+}
+
+func TestDraftEdit(t *testing.T) {
+	steps := []struct {
+		key  gocui.Key
+		ch   rune
+		mod  gocui.Modifier
+		text string
+		pos  int
+	}{
+		{0, 'h', 0, "h", 1},
+		{0, 'i', 0, "hi", 2},
+		{gocui.KeyCtrlJ, 0, 0, "hi\n", 3},
+		{gocui.KeyEnter, 0, gocui.ModAlt, "hi\n\n", 4},
+		{gocui.KeyBackspace2, 0, 0, "hi\n", 3},
+		{0, 'y', 0, "hi\ny", 4},
+		{0, 'o', 0, "hi\nyo", 5},
+		// Home and End stay on the line of the cursor
+		{gocui.KeyHome, 0, 0, "hi\nyo", 3},
+		{gocui.KeyArrowLeft, 0, 0, "hi\nyo", 2},
+		{gocui.KeyCtrlE, 0, 0, "hi\nyo", 2},
+		{gocui.KeyCtrlA, 0, 0, "hi\nyo", 0},
+		{gocui.KeyEnd, 0, 0, "hi\nyo", 2},
+		{gocui.KeyArrowRight, 0, 0, "hi\nyo", 3},
+		{gocui.KeyEnd, 0, 0, "hi\nyo", 5},
+		{gocui.KeySpace, 0, 0, "hi\nyo ", 6},
+		{gocui.KeyArrowRight, 0, 0, "hi\nyo ", 6},
+		// words end at newlines too
+		{0, 'b', gocui.ModAlt, "hi\nyo ", 3},
+		{0, 'b', gocui.ModAlt, "hi\nyo ", 0},
+		{0, 'f', gocui.ModAlt, "hi\nyo ", 2},
+		{gocui.KeyDelete, 0, 0, "hiyo ", 2},
+		{0, 'x', gocui.ModAlt, "hiyo ", 2},
+	}
+	var d draft
+	for i, step := range steps {
+		d.edit(step.key, step.ch, step.mod)
+		if d.String() != step.text || d.pos != step.pos {
+			t.Errorf("Expected %q at %d at step %d got %q at %d", step.text, step.pos, i, d.String(), d.pos)
+		}
+	}
+}
+
+func TestPasteDetector(t *testing.T) {
+	var p pasteDetector
+	feed := func(text string) {
+		for _, ch := range text {
+			if _, ok := p.feed(0, ch, 0); ok {
+				t.Errorf("Expected %q to be taken in", ch)
+			}
+		}
+	}
+	if _, ok := p.feed(0, '[', gocui.ModAlt); ok {
+		t.Errorf("Expected the start of a paste to be taken in")
+	}
+	feed("200~")
+	if !p.pasting {
+		t.Errorf("Expected a paste to start")
+	}
+	if held, ok := p.feed(0, 'a', 0); !ok || len(held) != 0 {
+		t.Errorf("Expected pasted text to go through got %q %v", held, ok)
+	}
+	p.feed(0, '[', gocui.ModAlt)
+	feed("201~")
+	if p.pasting {
+		t.Errorf("Expected the paste to end")
+	}
+	// Alt-[ followed by something else is given back
+	p.feed(0, '[', gocui.ModAlt)
+	if held, ok := p.feed(0, 'x', 0); !ok || string(held) != "[" {
+		t.Errorf("Expected [ to be given back got %q %v", held, ok)
+	}
+}
@@ -0,0 +1,69 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/cronokirby/ripple/internal/network"
+)
+
+// formatSize prints a number of bytes in a readable way
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size) / unit
+	for _, prefix := range "KMGT" {
+		if value < unit {
+			return fmt.Sprintf("%.1f %ciB", value, prefix)
+		}
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f PiB", value)
+}
+
+// describeOffer says who offered which file, and how to get it
+func describeOffer(swarm Node, offer network.FileOffer) string {
+	return fmt.Sprintf(
+		"%s offers %s (%s), /get %s to download it",
+		clean(swarm.Nickname(offer.Sender)), clean(offer.Name), formatSize(offer.Size), offer.ID(),
+	)
+}
+
+// progressReporter calls report every time a download gets another quarter done
+func progressReporter(report func(string)) func(network.FileProgress) {
+	reported := 0
+	return func(p network.FileProgress) {
+		if p.Offer.Size == 0 {
+			return
+		}
+		quarter := int(4 * p.Received / p.Offer.Size)
+		if quarter > reported && quarter < 4 {
+			reported = quarter
+			report(fmt.Sprintf("%s: %d%% of %s", clean(p.Offer.Name), 25*quarter, formatSize(p.Offer.Size)))
+		}
+	}
+}
+
+// sendFile runs /send, offering a file to the other nodes
+func sendFile(env *Env, args []string) error {
+	offer, err := env.Swarm.OfferFile(args[0])
+	if err != nil {
+		return fmt.Errorf("Couldn't offer file: %v", err)
+	}
+	env.Print(fmt.Sprintf("Offered %s (%s) as %s", offer.Name, formatSize(offer.Size), offer.ID()))
+	return nil
+}
+
+// getFile runs /get, downloading a file in the background
+func getFile(env *Env, args []string) error {
+	go func() {
+		path, err := env.Swarm.GetFile(args[0], *Downloads, progressReporter(env.Print))
+		if err != nil {
+			env.Print("Couldn't get file: " + err.Error())
+		} else {
+			env.Print("Saved " + path)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,47 @@
+package app
+
+import (
+	"net"
+
+	"github.com/cronokirby/ripple/internal/network"
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+// Node is what the app needs of a node in the swarm
+//
+// This is a SwarmHandle when the node runs in our process, or a control.Client
+// when we're attached to a node running as a daemon.
+type Node interface {
+	Addr() net.Addr
+	Predecessor() net.Addr
+	Successor() net.Addr
+	ID() protocol.ID
+	Chords() []net.Addr
+	Fingers() []net.Addr
+	QueueStats() []network.QueueStats
+	Peers() []network.Peer
+	Nickname(addr net.Addr) string
+	SetReceiver(receiver protocol.ContentReceiver)
+	SendMessage(content string) (network.MessageRef, error)
+	EditMessage(id uint64, content string) error
+	RetractMessage(id uint64) error
+	React(ref network.MessageRef, reaction string) error
+	ChangeNickname(name string) error
+	SendDirect(addr net.Addr, content string) error
+	SendSignal(signal network.Signal) error
+	ActiveSignals() []network.SignalEvent
+	HandleSignals(handler network.SignalHandler)
+	HandleRingChanges(handler network.RingHandler)
+	OfferFile(path string) (network.FileOffer, error)
+	HandleFileOffers(handler network.FileHandler)
+	GetFile(id string, dir string, progress func(network.FileProgress)) (string, error)
+}
+
+// ownNick returns the nickname of a node, or nothing if it hasn't picked one
+func ownNick(node Node) string {
+	nick := node.Nickname(node.Addr())
+	if nick == node.Addr().String() {
+		return ""
+	}
+	return nick
+}
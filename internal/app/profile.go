@@ -0,0 +1,86 @@
+package app
+
+import (
+	"github.com/alecthomas/kingpin"
+	"github.com/cronokirby/ripple/internal/config"
+	"github.com/cronokirby/ripple/internal/control"
+)
+
+// given holds the names of the flags on the command line, which win over the profile
+var given = make(map[string]bool)
+
+func recordFlags(context *kingpin.ParseContext) error {
+	for _, element := range context.Elements {
+		if flag, ok := element.Clause.(*kingpin.FlagClause); ok {
+			given[flag.Model().Name] = true
+		}
+	}
+	return nil
+}
+
+// merge makes a flag and a setting of the profile agree, keeping the flag if it was given
+func merge(name string, flag *string, setting *string) {
+	if given[name] || *setting == "" {
+		*setting = *flag
+	} else {
+		*flag = *setting
+	}
+}
+
+func mergeBool(name string, flag *bool, setting **bool) {
+	if given[name] || *setting == nil {
+		value := *flag
+		*setting = &value
+	} else {
+		*flag = **setting
+	}
+}
+
+// ApplyConfig fills in what the command line left out with the profile we use,
+// returning the configuration this adds up to
+//
+// The arguments of the command win over the profile, like the flags do.
+func ApplyConfig(command string) (config.Profile, error) {
+	file, err := config.Load(*ConfigPath, given["config"])
+	if err != nil {
+		return config.Profile{}, err
+	}
+	profile, err := file.Get(*Profile)
+	if err != nil {
+		return config.Profile{}, err
+	}
+	var listen, peer string
+	// only some commands have a socket, but the profile shows where it would be
+	socket, socketFlag := control.DefaultSocket(), ""
+	switch command {
+	case Start.FullCommand():
+		listen = *StartAddr
+	case Connect.FullCommand():
+		listen, peer = *ConnectListenAddr, *ConnectAddr
+	case Daemon.FullCommand():
+		listen, peer = *DaemonListenAddr, *DaemonConnectAddr
+		socket, socketFlag = *DaemonSocket, "socket"
+	case Attach.FullCommand():
+		socket, socketFlag = *AttachSocket, "socket"
+	case Send.FullCommand():
+		socket, socketFlag = *SendVia, "via"
+	case Tail.FullCommand():
+		socket, socketFlag = *TailVia, "via"
+	}
+	if listen != "" {
+		profile.Listen = listen
+	}
+	if peer != "" {
+		profile.Peers = []string{peer}
+	}
+	merge(socketFlag, &socket, &profile.Socket)
+	*DaemonSocket, *AttachSocket, *SendVia, *TailVia = socket, socket, socket, socket
+	merge("advertise", Advertise, &profile.Advertise)
+	merge("nick", Nick, &profile.Nick)
+	merge("control", Control, &profile.Control)
+	merge("downloads", Downloads, &profile.UI.Downloads)
+	mergeBool("tui", TUI, &profile.UI.TUI)
+	mergeBool("bell", Bell, &profile.UI.Bell)
+	mergeBool("code-blocks", CodeBlocks, &profile.UI.CodeBlocks)
+	return profile, nil
+}
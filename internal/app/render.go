@@ -0,0 +1,205 @@
+package app
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// ownStyle marks our own nickname
+	ownStyle = "\x1b[1m"
+	// mentionStyle marks the content of messages mentioning us
+	mentionStyle = "\x1b[1;33m"
+	// noticeStyle marks lines shown to us alone
+	noticeStyle = "\x1b[36m"
+	// codeStyle marks the lines of a message fenced with ```
+	codeStyle = "\x1b[32m"
+)
+
+// blockIndent starts each line of a message spanning several lines
+const blockIndent = "      │ "
+
+// actionPrefix starts the content of messages sent with /me
+const actionPrefix = "/me "
+
+// nickColors are the colors nicknames can get, picked by their sender
+var nickColors = []string{
+	"\x1b[32m", "\x1b[34m", "\x1b[35m", "\x1b[36m", "\x1b[31m", "\x1b[33m",
+}
+
+// renderer formats chat lines, the same way in the TUI and the plain CLI
+type renderer struct {
+	mu sync.Mutex
+	// nick is ours, which messages can mention
+	nick string
+	// colors is unset when the output isn't a terminal, to keep escape sequences out of it
+	colors bool
+	// bell rings the terminal when a message mentions us
+	bell bool
+	// code shows the lines fenced with ``` as code, which needs colors
+	code bool
+}
+
+// terminalRenderer makes a renderer for standard output, using colors only if it's a terminal
+func terminalRenderer(bell, code bool) *renderer {
+	colors := false
+	if info, err := os.Stdout.Stat(); err == nil {
+		colors = info.Mode()&os.ModeCharDevice != 0
+	}
+	return &renderer{colors: colors, bell: bell, code: code}
+}
+
+func (r *renderer) setNick(nick string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nick = nick
+}
+
+func (r *renderer) getNick() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.nick
+}
+
+// style wraps text in an escape sequence, if we use colors
+func (r *renderer) style(style, text string) string {
+	if !r.colors || style == "" {
+		return text
+	}
+	return style + text + resetStyle
+}
+
+// nickStyle picks the style of the nickname of a line
+//
+// Each sender gets a color of its own, which stays the same as its nickname changes.
+// Lines that don't come from anybody, like errors, have no color.
+func nickStyle(line *chatLine) string {
+	switch {
+	case line.own:
+		return ownStyle
+	case line.from == "":
+		return ""
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(line.from))
+	return nickColors[hash.Sum32()%uint32(len(nickColors))]
+}
+
+// mentions checks if a line from somebody else has our nickname as a word
+func (r *renderer) mentions(line *chatLine) bool {
+	nick := []rune(strings.ToLower(r.getNick()))
+	if line.own || line.retracted || len(nick) == 0 {
+		return false
+	}
+	content := []rune(strings.ToLower(line.content))
+	isWord := func(i int) bool {
+		return i >= 0 && i < len(content) && (unicode.IsLetter(content[i]) || unicode.IsDigit(content[i]))
+	}
+	for i := 0; i+len(nick) <= len(content); i++ {
+		if string(content[i:i+len(nick)]) == string(nick) && !isWord(i-1) && !isWord(i+len(nick)) {
+			return true
+		}
+	}
+	return false
+}
+
+// render formats a line, like "14:02 alice: hello"
+//
+// Actions look like "14:02 * alice waves", direct messages like
+// "14:02 alice → me: hello", and notices like "14:02 -!- Unknown command".
+// Messages spanning several lines have them indented below the nickname.
+func (r *renderer) render(line *chatLine) string {
+	at := line.at.Format("15:04")
+	if line.notice {
+		return at + " " + r.style(noticeStyle, "-!- "+clean(line.content))
+	}
+	content := line.content
+	action := strings.HasPrefix(content, actionPrefix)
+	switch {
+	case line.retracted:
+		content = "(retracted)"
+		action = false
+	case action:
+		content = content[len(actionPrefix):]
+	}
+	lines := r.block(content, r.mentions(line))
+	last := len(lines) - 1
+	if line.edited && !line.retracted {
+		lines[last] += " (edited)"
+	}
+	if len(line.reactions) > 0 {
+		lines[last] += " [" + clean(strings.Join(line.reactions, ", ")) + "]"
+	}
+	nick := r.style(nickStyle(line), clean(line.nick))
+	var head string
+	switch {
+	case action:
+		head = fmt.Sprintf("%s * %s", at, nick)
+	case line.direct && line.own:
+		head = fmt.Sprintf("%s %s → %s:", at, nick, clean(line.to))
+	case line.direct:
+		head = fmt.Sprintf("%s %s → me:", at, nick)
+	default:
+		head = fmt.Sprintf("%s %s:", at, nick)
+	}
+	if len(lines) == 1 {
+		return head + " " + lines[0]
+	}
+	return head + "\n" + blockIndent + strings.Join(lines, "\n"+blockIndent)
+}
+
+// block splits content into the lines it's shown as, marking mentions of us
+//
+// Lines fenced with ``` are shown as code, leaving out the fences, unless
+// that's turned off or we can't use colors.
+func (r *renderer) block(content string, mention bool) []string {
+	var lines []string
+	code := false
+	for _, text := range strings.Split(content, "\n") {
+		// the terminal would move the cursor on a tab, rather than fill a cell
+		text = clean(strings.Replace(text, "\t", "    ", -1))
+		switch {
+		case r.code && r.colors && isFence(text):
+			code = !code
+			continue
+		case code:
+			text = r.style(codeStyle, text)
+		case mention:
+			text = r.style(mentionStyle, text)
+		}
+		lines = append(lines, text)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+// clean replaces the control characters of text from other nodes, like ESC or BEL
+//
+// Otherwise, they could move our cursor, or ring the bell, by sending escape sequences.
+func clean(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return unicode.ReplacementChar
+		}
+		return r
+	}, text)
+}
+
+// isFence checks if a line starts or ends a code block, like "```" or "```go"
+func isFence(line string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasPrefix(line, "```") && !strings.Contains(line[3:], "`")
+}
+
+// notify rings the bell if a new line mentions us, or was sent to us alone, and we want that
+func (r *renderer) notify(line *chatLine) {
+	if r.bell && (r.mentions(line) || line.direct && !line.own) {
+		fmt.Fprint(os.Stdout, "\a")
+	}
+}
@@ -0,0 +1,189 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/network"
+)
+
+// at is when the lines rendered in tests were sent
+var at = time.Date(2026, 1, 2, 14, 2, 0, 0, time.Local)
+
+func TestMentions(t *testing.T) {
+	cases := []struct {
+		nick     string
+		line     chatLine
+		expected bool
+	}{
+		{"bob", chatLine{content: "hi bob"}, true},
+		{"bob", chatLine{content: "Hi BOB!"}, true},
+		{"bob", chatLine{content: "@bob: look"}, true},
+		{"bob", chatLine{content: "bob's turn"}, true},
+		{"bob", chatLine{content: "bobby"}, false},
+		{"bob", chatLine{content: "kabob"}, false},
+		{"bob", chatLine{content: "bob2"}, false},
+		{"bob", chatLine{content: "hi bob", own: true}, false},
+		{"bob", chatLine{content: "hi bob", retracted: true}, false},
+		{"", chatLine{content: "hi bob"}, false},
+		{"zoë", chatLine{content: "ZOË, hi"}, true},
+		{"zoë", chatLine{content: "zoëy"}, false},
+		{"zoë", chatLine{content: "éclairs for zoë"}, true},
+	}
+	for _, c := range cases {
+		r := &renderer{nick: c.nick}
+		if got := r.mentions(&c.line); got != c.expected {
+			t.Errorf("Expected %v for %q mentioning %q got %v", c.expected, c.line.content, c.nick, got)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	cases := []struct {
+		line     chatLine
+		expected string
+	}{
+		{chatLine{nick: "alice", content: "hello"}, "14:02 alice: hello"},
+		{chatLine{nick: "alice", content: "/me waves"}, "14:02 * alice waves"},
+		{chatLine{nick: "me", content: "hi", own: true, direct: true, to: "bob"}, "14:02 me → bob: hi"},
+		{chatLine{nick: "alice", content: "hi", direct: true}, "14:02 alice → me: hi"},
+		{chatLine{content: "Unknown command", notice: true}, "14:02 -!- Unknown command"},
+		{chatLine{nick: "alice", content: "/me waves", retracted: true, edited: true}, "14:02 alice: (retracted)"},
+		{chatLine{nick: "alice", content: "hi", edited: true, reactions: []string{"👍 bob", "🎉 carol"}}, "14:02 alice: hi (edited) [👍 bob, 🎉 carol]"},
+	}
+	r := &renderer{nick: "bob"}
+	for _, c := range cases {
+		c.line.at = at
+		if got := r.render(&c.line); got != c.expected {
+			t.Errorf("Expected %q got %q", c.expected, got)
+		}
+	}
+}
+
+func TestRenderStyles(t *testing.T) {
+	r := &renderer{colors: true, nick: "bob"}
+	line := &chatLine{from: "tcp 10.0.0.1:8080", nick: "alice", content: "hi bob", at: at}
+	expected := "14:02 " + nickStyle(line) + "alice" + resetStyle + ": " + mentionStyle + "hi bob" + resetStyle
+	if got := r.render(line); got != expected {
+		t.Errorf("Expected %q got %q", expected, got)
+	}
+	own := &chatLine{from: "me", nick: "bob", content: "hi bob", own: true, at: at}
+	expected = "14:02 " + ownStyle + "bob" + resetStyle + ": hi bob"
+	if got := r.render(own); got != expected {
+		t.Errorf("Expected %q got %q", expected, got)
+	}
+	notice := &chatLine{content: "hi bob", notice: true, at: at}
+	expected = "14:02 " + noticeStyle + "-!- hi bob" + resetStyle
+	if got := r.render(notice); got != expected {
+		t.Errorf("Expected %q got %q", expected, got)
+	}
+	if nickStyle(line) == "" || nickStyle(line) != nickStyle(&chatLine{from: line.from, nick: "alicia"}) {
+		t.Errorf("Expected the color of a nickname to follow its sender")
+	}
+}
+
+func TestIsFence(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected bool
+	}{
+		{"```", true},
+		{"```go", true},
+		{"  ```  ", true},
+		{"``", false},
+		{"```inline```", false},
+		{"see ```", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := isFence(c.line); got != c.expected {
+			t.Errorf("Expected %v for %q got %v", c.expected, c.line, got)
+		}
+	}
+}
+
+func TestBlock(t *testing.T) {
+	code := func(text string) string { return codeStyle + text + resetStyle }
+	mention := func(text string) string { return mentionStyle + text + resetStyle }
+	styled := &renderer{colors: true, code: true}
+	cases := []struct {
+		r        *renderer
+		content  string
+		mention  bool
+		expected []string
+	}{
+		{styled, "look:\n```go\nx := 1\n\ny := 2\n```\nok", false, []string{"look:", code("x := 1"), code(""), code("y := 2"), "ok"}},
+		// a block that's never closed goes on to the end
+		{styled, "```\nx\ny", false, []string{code("x"), code("y")}},
+		{styled, "```\nx\n```\n```\ny\n```", false, []string{code("x"), code("y")}},
+		{styled, "```\n```", false, []string{""}},
+		// code isn't marked as mentioning us
+		{styled, "```\nbob\n```\nhi bob", true, []string{code("bob"), mention("hi bob")}},
+		// without code blocks, or colors to show them, the fences stay
+		{&renderer{colors: true}, "```\nx\n```", false, []string{"```", "x", "```"}},
+		{&renderer{code: true}, "```\nx\n```", false, []string{"```", "x", "```"}},
+		{&renderer{}, "a\tb", false, []string{"a    b"}},
+		{&renderer{}, "", false, []string{""}},
+	}
+	for _, c := range cases {
+		if got := c.r.block(c.content, c.mention); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("Expected %q got %q", c.expected, got)
+		}
+	}
+}
+
+func TestRenderLines(t *testing.T) {
+	r := &renderer{}
+	line := &chatLine{nick: "alice", content: "one\ntwo", edited: true, at: at}
+	expected := "14:02 alice:\n" + blockIndent + "one\n" + blockIndent + "two (edited)"
+	if got := r.render(line); got != expected {
+		t.Errorf("Expected %q got %q", expected, got)
+	}
+	action := &chatLine{nick: "alice", content: "/me waves\nand leaves", at: at}
+	expected = "14:02 * alice\n" + blockIndent + "waves\n" + blockIndent + "and leaves"
+	if got := r.render(action); got != expected {
+		t.Errorf("Expected %q got %q", expected, got)
+	}
+}
+
+func TestRenderControlCharacters(t *testing.T) {
+	const replaced = "�"
+	cases := []struct {
+		line     chatLine
+		expected string
+	}{
+		{chatLine{nick: "alice", content: "\x1b[2J\x1b[Hgone\a"}, "14:02 alice: " + replaced + "[2J" + replaced + "[Hgone" + replaced},
+		{chatLine{nick: "al\x1b]0;pwned\x07ice", content: "hi"}, "14:02 al" + replaced + "]0;pwned" + replaced + "ice: hi"},
+		{chatLine{nick: "alice", content: "one\r\ntwo\u009b2J"}, "14:02 alice:\n" + blockIndent + "one" + replaced + "\n" + blockIndent + "two" + replaced + "2J"},
+		{chatLine{nick: "alice", content: "hi", reactions: []string{"\x1b[5m👍 bob"}}, "14:02 alice: hi [" + replaced + "[5m👍 bob]"},
+		{chatLine{nick: "me", content: "hi", own: true, direct: true, to: "b\bob"}, "14:02 me → b" + replaced + "ob: hi"},
+		// tabs and newlines are still laid out
+		{chatLine{nick: "alice", content: "a\tb"}, "14:02 alice: a    b"},
+	}
+	r := &renderer{}
+	for _, c := range cases {
+		c.line.at = at
+		if got := r.render(&c.line); got != c.expected {
+			t.Errorf("Expected %q got %q", c.expected, got)
+		}
+	}
+	// the styles we add ourselves are kept
+	styled := &renderer{colors: true, nick: "bob"}
+	line := &chatLine{nick: "alice", content: "\x1b[0mhi bob", at: at}
+	expected := "14:02 alice: " + mentionStyle + replaced + "[0mhi bob" + resetStyle
+	if got := styled.render(line); got != expected {
+		t.Errorf("Expected %q got %q", expected, got)
+	}
+}
+
+func TestCleanNicknames(t *testing.T) {
+	nick := "eve\x1b[8m"
+	if got := peerLine(network.Peer{Nick: nick, Online: true}); got != "● eve�[8m" {
+		t.Errorf("Expected the escape sequence to be replaced got %q", got)
+	}
+	events := []network.SignalEvent{{Nick: nick, Signal: network.SignalTyping}}
+	if got := typingLine(events); got != "eve�[8m is typing…" {
+		t.Errorf("Expected the escape sequence to be replaced got %q", got)
+	}
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cronokirby/ripple/internal/network"
+)
+
+// typingLine describes who is typing, like "alice and bob are typing…"
+//
+// It's empty if nobody is.
+func typingLine(events []network.SignalEvent) string {
+	var nicks []string
+	for _, event := range events {
+		if event.Signal == network.SignalTyping {
+			nicks = append(nicks, clean(event.Nick))
+		}
+	}
+	sort.Strings(nicks)
+	switch {
+	case len(nicks) == 0:
+		return ""
+	case len(nicks) == 1:
+		return nicks[0] + " is typing…"
+	case len(nicks) <= 3:
+		last := len(nicks) - 1
+		return strings.Join(nicks[:last], ", ") + " and " + nicks[last] + " are typing…"
+	default:
+		return fmt.Sprintf("%d people are typing…", len(nicks))
+	}
+}
+
+// signalCommand makes a command sending a signal, like /away
+func signalCommand(signal network.Signal) func(*Env, []string) error {
+	return func(env *Env, args []string) error {
+		if err := env.Swarm.SendSignal(signal); err != nil {
+			return fmt.Errorf("Couldn't send: %v", err)
+		}
+		return nil
+	}
+}
+
+// signalSender sends the signals we give off while typing, one at a time and in order
+//
+// Only the latest one matters, so a signal still waiting to be sent is
+// replaced by the next one, instead of piling up behind slow peers.
+type signalSender struct {
+	pending chan network.Signal
+	done    chan struct{}
+}
+
+func newSignalSender(node Node) *signalSender {
+	s := &signalSender{pending: make(chan network.Signal, 1), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		for signal := range s.pending {
+			node.SendSignal(signal)
+		}
+	}()
+	return s
+}
+
+// send queues a signal, which must only be called from a single goroutine
+func (s *signalSender) send(signal network.Signal) {
+	for {
+		select {
+		case s.pending <- signal:
+			return
+		default:
+		}
+		// the sender may have taken the older signal in the meantime
+		select {
+		case <-s.pending:
+		default:
+		}
+	}
+}
+
+// close sends the last signal queued, and stops
+func (s *signalSender) close() {
+	close(s.pending)
+	<-s.done
+}
@@ -0,0 +1,50 @@
+package app
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/network"
+)
+
+// signalNode records the signals sent through it, taking a while with each
+type signalNode struct {
+	Node
+	mu   sync.Mutex
+	sent []network.Signal
+}
+
+func (n *signalNode) SendSignal(signal network.Signal) error {
+	time.Sleep(time.Millisecond)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, signal)
+	return nil
+}
+
+func TestSignalSenderKeepsOrder(t *testing.T) {
+	node := &signalNode{}
+	sender := newSignalSender(node)
+	const count = 100
+	for i := 0; i < count; i++ {
+		sender.send(network.Signal(strconv.Itoa(i)))
+	}
+	sender.close()
+	if len(node.sent) == 0 || len(node.sent) > count {
+		t.Fatalf("Expected between 1 and %d signals got %d", count, len(node.sent))
+	}
+	previous := -1
+	for _, signal := range node.sent {
+		i, _ := strconv.Atoi(string(signal))
+		if i <= previous {
+			t.Errorf("Expected signals in order got %v", node.sent)
+			break
+		}
+		previous = i
+	}
+	if previous != count-1 {
+		t.Errorf("Expected the latest signal to be sent last got %d", previous)
+	}
+}
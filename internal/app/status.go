@@ -0,0 +1,62 @@
+package app
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cronokirby/ripple/internal/network"
+)
+
+// peerLine describes a peer in the sidebar, like "● alice" or "◐ bob (away)"
+func peerLine(peer network.Peer) string {
+	nick := clean(peer.Nick)
+	switch {
+	case peer.Away:
+		return "◐ " + nick + " (away)"
+	case peer.Online:
+		return "● " + nick
+	default:
+		return "○ " + nick
+	}
+}
+
+// health sums up our connections from their send queues
+func health(stats []network.QueueStats) string {
+	var depth int
+	var dropped uint64
+	for _, stat := range stats {
+		depth += stat.Depth
+		dropped += stat.Dropped
+	}
+	switch {
+	case dropped > 0:
+		return fmt.Sprintf("%d dropped", dropped)
+	case depth > 0:
+		return fmt.Sprintf("%d queued", depth)
+	default:
+		return "ok"
+	}
+}
+
+// statusLine describes where we are in the ring, and how our connections are doing
+func statusLine(swarm Node, nick string) string {
+	me := swarm.Addr().String()
+	if nick != "" {
+		me = nick + " @ " + me
+	}
+	return fmt.Sprintf(
+		" %s | pred %s | succ %s | %s",
+		me,
+		addrString(swarm.Predecessor()),
+		addrString(swarm.Successor()),
+		health(swarm.QueueStats()),
+	)
+}
+
+// addrString prints an address, which may not be known yet
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return "-"
+	}
+	return addr.String()
+}
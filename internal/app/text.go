@@ -0,0 +1,201 @@
+package app
+
+import (
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+)
+
+const (
+	// resetStyle goes back to the default colors of a view
+	resetStyle = "\x1b[0m"
+	// matchStyle marks search matches, with currentMatchStyle marking the one we're at
+	matchStyle        = "\x1b[30;43m"
+	currentMatchStyle = "\x1b[30;42m"
+)
+
+// styledRune is a rune of text, along with the escape sequences in effect for it
+type styledRune struct {
+	r     rune
+	style string
+}
+
+// parseStyled splits text into its runes, taking out the escape sequences setting colors
+func parseStyled(text string) []styledRune {
+	var out []styledRune
+	style := ""
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '\x1b' {
+			out = append(out, styledRune{runes[i], style})
+			continue
+		}
+		end := i
+		for end < len(runes)-1 && runes[end] != 'm' {
+			end++
+		}
+		seq := string(runes[i : end+1])
+		if seq == resetStyle {
+			style = ""
+		} else {
+			style += seq
+		}
+		i = end
+	}
+	return out
+}
+
+// joinStyled puts styled runes back into text, resetting the style at the end
+func joinStyled(runes []styledRune) string {
+	var out strings.Builder
+	style := ""
+	for _, r := range runes {
+		if r.style != style {
+			if strings.HasPrefix(r.style, style) {
+				out.WriteString(r.style[len(style):])
+			} else {
+				out.WriteString(resetStyle)
+				out.WriteString(r.style)
+			}
+			style = r.style
+		}
+		out.WriteRune(r.r)
+	}
+	if style != "" {
+		out.WriteString(resetStyle)
+	}
+	return out.String()
+}
+
+// plainText takes the escape sequences out of text
+func plainText(text string) string {
+	var out strings.Builder
+	for _, r := range parseStyled(text) {
+		out.WriteRune(r.r)
+	}
+	return out.String()
+}
+
+// cellWidth is how many cells the terminal gives a rune
+//
+// This follows termbox, which gives a single cell to ambiguous and zero width runes.
+func cellWidth(r rune) int {
+	w := runewidth.RuneWidth(r)
+	if w == 0 || w == 2 && runewidth.IsAmbiguousWidth(r) {
+		return 1
+	}
+	return w
+}
+
+// wrapText splits a line into rows at most width cells wide
+//
+// Escape sequences setting colors take no room, and carry over to the next row,
+// while newlines always start one.
+// gocui gives each rune a cell, while the terminal skips the cell after a wide
+// rune, so those are followed by a space which never gets shown.
+func wrapText(line string, width int) []string {
+	if width < 2 {
+		width = 2
+	}
+	var rows []string
+	var row []styledRune
+	used := 0
+	for _, r := range parseStyled(line) {
+		if r.r == '\n' {
+			rows = append(rows, joinStyled(row))
+			row = nil
+			used = 0
+			continue
+		}
+		w := cellWidth(r.r)
+		if used+w > width {
+			rows = append(rows, joinStyled(row))
+			row = nil
+			used = 0
+		}
+		row = append(row, r)
+		if w == 2 {
+			row = append(row, styledRune{' ', r.style})
+		}
+		used += w
+	}
+	return append(rows, joinStyled(row))
+}
+
+// highlight marks every place term appears in text, ignoring case
+func highlight(text, term, style string) string {
+	pattern := []rune(term)
+	runes := parseStyled(text)
+	if len(pattern) == 0 {
+		return text
+	}
+	for i := 0; i+len(pattern) <= len(runes); {
+		window := make([]rune, len(pattern))
+		for j := range pattern {
+			window[j] = runes[i+j].r
+		}
+		if !strings.EqualFold(string(window), term) {
+			i++
+			continue
+		}
+		for j := range pattern {
+			runes[i+j].style += style
+		}
+		i += len(pattern)
+	}
+	return joinStyled(runes)
+}
+
+// containsFold checks if term appears in text, ignoring case
+func containsFold(text, term string) bool {
+	return strings.Contains(strings.ToLower(text), strings.ToLower(term))
+}
+
+// inputHistory remembers what we entered, so that it can be recalled with Up and Down
+type inputHistory struct {
+	entries []string
+	// pos is the entry being shown, with len(entries) meaning the draft
+	pos int
+	// draft is what was being written before going back in the history
+	draft string
+}
+
+// maxHistory bounds how many entries the history keeps
+const maxHistory = 500
+
+// add remembers an entry, and goes back to an empty draft
+func (history *inputHistory) add(entry string) {
+	last := len(history.entries) - 1
+	if entry != "" && (last < 0 || history.entries[last] != entry) {
+		history.entries = append(history.entries, entry)
+		if len(history.entries) > maxHistory {
+			history.entries = history.entries[1:]
+		}
+	}
+	history.pos = len(history.entries)
+	history.draft = ""
+}
+
+// prev returns the entry before the one shown, keeping current as the draft if needed
+func (history *inputHistory) prev(current string) (string, bool) {
+	if history.pos == 0 {
+		return "", false
+	}
+	if history.pos == len(history.entries) {
+		history.draft = current
+	}
+	history.pos--
+	return history.entries[history.pos], true
+}
+
+// next returns the entry after the one shown, ending with the draft
+func (history *inputHistory) next() (string, bool) {
+	if history.pos >= len(history.entries) {
+		return "", false
+	}
+	history.pos++
+	if history.pos == len(history.entries) {
+		return history.draft, true
+	}
+	return history.entries[history.pos], true
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+const red = "\x1b[31m"
+
+func TestWrapText(t *testing.T) {
+	cases := []struct {
+		line     string
+		width    int
+		expected []string
+	}{
+		{"hello world", 5, []string{"hello", " worl", "d"}},
+		{"hello", 10, []string{"hello"}},
+		{"", 10, []string{""}},
+		{"ab\ncd", 10, []string{"ab", "cd"}},
+		{"abc", 1, []string{"ab", "c"}},
+		// wide runes take two cells, the second of which gocui needs a space for
+		{"日本語", 4, []string{"日 本 ", "語 "}},
+		{"a日本", 2, []string{"a", "日 ", "本 "}},
+		// ambiguous and zero width runes get a single cell
+		{"→→→", 2, []string{"→→", "→"}},
+		{"e\u0301e\u0301", 2, []string{"e\u0301", "e\u0301"}},
+		// styles carry over to the next row, and end with each one
+		{red + "abcd" + resetStyle + "ef", 2, []string{red + "ab" + resetStyle, red + "cd" + resetStyle, "ef"}},
+		{red + "ab\ncd", 10, []string{red + "ab" + resetStyle, red + "cd" + resetStyle}},
+	}
+	for _, c := range cases {
+		if rows := wrapText(c.line, c.width); !reflect.DeepEqual(rows, c.expected) {
+			t.Errorf("Expected %q got %q", c.expected, rows)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	const m = matchStyle
+	cases := []struct {
+		text     string
+		term     string
+		expected string
+	}{
+		{"Hello hello", "hello", m + "Hello" + resetStyle + " " + m + "hello" + resetStyle},
+		{"aaa", "aa", m + "aa" + resetStyle + "a"},
+		{"ÄÖ äö", "äö", m + "ÄÖ" + resetStyle + " " + m + "äö" + resetStyle},
+		{"abc", "x", "abc"},
+		{"abc", "", "abc"},
+		// the match is marked on top of the style the text already has
+		{red + "abc" + resetStyle, "b", red + "a" + m + "b" + resetStyle + red + "c" + resetStyle},
+		// escape sequences aren't matched
+		{red + "abc", "31m", red + "abc" + resetStyle},
+	}
+	for _, c := range cases {
+		if got := highlight(c.text, c.term, m); got != c.expected {
+			t.Errorf("Expected %q got %q", c.expected, got)
+		}
+	}
+}
+
+func TestInputHistory(t *testing.T) {
+	var history inputHistory
+	if _, ok := history.prev("draft"); ok {
+		t.Errorf("Expected nothing before the first entry")
+	}
+	for _, entry := range []string{"one", "two", "two", ""} {
+		history.add(entry)
+	}
+	steps := []struct {
+		older    bool
+		expected string
+		ok       bool
+	}{
+		{true, "two", true},
+		{true, "one", true},
+		{true, "", false},
+		{false, "two", true},
+		// the draft comes back after the latest entry
+		{false, "draft", true},
+		{false, "", false},
+		{true, "two", true},
+	}
+	for i, step := range steps {
+		var got string
+		var ok bool
+		if step.older {
+			got, ok = history.prev("draft")
+		} else {
+			got, ok = history.next()
+		}
+		if got != step.expected || ok != step.ok {
+			t.Errorf("Expected %q %v at step %d got %q %v", step.expected, step.ok, i, got, ok)
+		}
+	}
+	// entering something starts from a new draft
+	history.add("three")
+	if got, ok := history.next(); ok {
+		t.Errorf("Expected nothing after the draft got %q", got)
+	}
+	if got, _ := history.prev("new"); got != "three" {
+		t.Errorf("Expected three got %q", got)
+	}
+	if got, _ := history.next(); got != "new" {
+		t.Errorf("Expected new got %q", got)
+	}
+}
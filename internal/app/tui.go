@@ -3,6 +3,9 @@ package app
 import (
 	"fmt"
 	"log"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/cronokirby/ripple/internal/network"
 	"github.com/jroimartin/gocui"
@@ -11,89 +14,416 @@ import (
 // gui represents a graphical ui with a swarm handle as well
 type gui struct {
 	*gocui.Gui
-	swarm *network.SwarmHandle
-	nick  string
+	swarm  Node
+	render *renderer
+	// chat holds the lines in the messages view, so they can be changed in place
+	chat *chatLog
+	// top is the first row shown in the messages view, unless we follow the latest ones
+	top    int
+	follow bool
+	// unread counts the lines that arrived while we weren't following
+	unread int
+	// width is how wide the messages were last wrapped
+	width int
+	// search is the term being looked for, with match counting back from the latest line matching it
+	search string
+	match  int
+	// matches is how many lines matched the last time the messages were drawn
+	matches int
+	// jump is set when the messages view should move to the current match
+	jump    bool
+	history inputHistory
+	// signals sends whether we're typing, without holding up the ui
+	signals *signalSender
+	// input is what's being written, and paste tells if it's being pasted
+	input draft
+	paste pasteDetector
+	// env is what commands run with, and quitting is set by /quit
+	env      *Env
+	quitting bool
 }
 
 func (g *gui) ReceiveContent(user, content string) {
-	g.Update(func(g *gocui.Gui) error {
+	g.chat.add(&chatLine{nick: user, content: content})
+	g.Update(g.arrived)
+}
+
+// notice shows a line to us alone, and can be called from any goroutine
+func (g *gui) notice(text string) {
+	g.chat.add(&chatLine{content: text, notice: true})
+	g.Update(g.arrived)
+}
+
+// ReceiveEvent shows new messages, and updates the lines of the messages they refer to
+func (g *gui) ReceiveEvent(event network.ChatEvent) {
+	line, ok := g.chat.apply(event)
+	if !ok {
+		return
+	}
+	if event.Kind == network.EventMessage || event.Kind == network.EventDirect {
+		g.render.notify(line)
+		g.Update(g.arrived)
+	} else {
+		g.Update(g.redraw)
+	}
+}
+
+// arrived shows a new line, counting it as unread if we're looking further up
+func (g *gui) arrived(gui *gocui.Gui) error {
+	if !g.follow {
+		g.unread++
+	}
+	return g.redraw(gui)
+}
+
+// redraw prints every line of the chat into the messages view again
+func (g *gui) redraw(*gocui.Gui) error {
+	msg, err := g.View("messages")
+	if err != nil {
+		return err
+	}
+	width, height := msg.Size()
+	var texts []string
+	var matching []bool
+	g.matches = 0
+	g.chat.each(func(line *chatLine) {
+		text := g.render.render(line)
+		matches := g.search != "" && containsFold(plainText(text), g.search)
+		if matches {
+			g.matches++
+		}
+		texts = append(texts, text)
+		matching = append(matching, matches)
+	})
+	if g.match >= g.matches {
+		g.match = 0
+	}
+	var rows []string
+	current := -1
+	seen := 0
+	for i, text := range texts {
+		if matching[i] {
+			style := matchStyle
+			// matches are counted back from the latest one
+			if g.matches-1-seen == g.match {
+				style = currentMatchStyle
+				current = len(rows)
+			}
+			seen++
+			text = highlight(text, g.search, style)
+		}
+		rows = append(rows, wrapText(text, width)...)
+	}
+	msg.Clear()
+	fmt.Fprint(msg, strings.Join(rows, "\n"))
+	g.width = width
+	bottom := len(rows) - height
+	if bottom < 0 {
+		bottom = 0
+	}
+	if g.jump && current >= 0 {
+		g.follow = false
+		g.top = current - height/2
+	}
+	g.jump = false
+	if g.follow || g.top > bottom {
+		g.top = bottom
+	}
+	if g.top < 0 {
+		g.top = 0
+	}
+	if g.top == bottom {
+		g.follow = true
+		g.unread = 0
+	}
+	msg.Title = g.title()
+	return msg.SetOrigin(0, g.top)
+}
+
+// title describes the search we're in, and what's left to read below
+func (g *gui) title() string {
+	title := "messages"
+	switch {
+	case g.search == "":
+	case g.matches == 0:
+		title += fmt.Sprintf(" | no matches for %q", g.search)
+	default:
+		title += fmt.Sprintf(" | %q %d/%d (Ctrl-P/Ctrl-N)", g.search, g.matches-g.match, g.matches)
+	}
+	switch {
+	case g.unread > 0:
+		title += fmt.Sprintf(" | %d unread below ↓", g.unread)
+	case !g.follow:
+		title += " | more below ↓"
+	}
+	return title
+}
+
+// scroll moves the messages view by a number of rows, or by pages of it if pages is set
+func (g *gui) scroll(rows int, pages bool) func(*gocui.Gui, *gocui.View) error {
+	return func(gui *gocui.Gui, v *gocui.View) error {
 		msg, err := g.View("messages")
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(msg, "%s: %s\n", user, content)
-		return nil
-	})
+		if pages {
+			_, height := msg.Size()
+			rows *= height - 1
+		}
+		g.follow = false
+		g.top += rows
+		return g.redraw(gui)
+	}
 }
 
-func wrapSwarm(swarm *network.SwarmHandle, f func(*gui) error) func(*gocui.Gui) error {
-	return func(g *gocui.Gui) error {
-		wrapped := &gui{g, swarm, ""}
-		return f(wrapped)
+// step moves to an older match if older is set, or a newer one
+func (g *gui) step(older bool) func(*gocui.Gui, *gocui.View) error {
+	return func(gui *gocui.Gui, v *gocui.View) error {
+		if g.search == "" {
+			return nil
+		}
+		if older && g.match < g.matches-1 {
+			g.match++
+		}
+		if !older && g.match > 0 {
+			g.match--
+		}
+		g.jump = true
+		return g.redraw(gui)
 	}
 }
 
-var defaultEditor = gocui.EditorFunc(simpleEditor)
+// searchCommand runs /search, which only the TUI has
+//
+// A search with no term stops searching, and goes back to the latest messages.
+func (g *gui) searchCommand(env *Env, args []string) error {
+	g.search = ""
+	if len(args) > 0 {
+		g.search = args[0]
+	}
+	g.match = 0
+	g.jump = g.search != ""
+	if g.search == "" {
+		g.follow = true
+	}
+	g.Update(g.redraw)
+	return nil
+}
 
-func simpleEditor(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
-	switch {
-	case ch != 0 && ch != 10 && mod == 0:
-		v.EditWrite(ch)
-	case key == gocui.KeySpace:
-		v.EditWrite(' ')
-	case key == gocui.KeyBackspace || key == gocui.KeyBackspace2:
-		v.EditDelete(true)
+// redrawTyping shows who is typing in the typing view
+func (g *gui) redrawTyping(*gocui.Gui) error {
+	v, err := g.View("typing")
+	if err != nil {
+		return err
+	}
+	v.Clear()
+	fmt.Fprint(v, typingLine(g.swarm.ActiveSignals()))
+	return nil
+}
+
+// redrawSide shows our peers in the sidebar, and how we're doing in the status bar
+func (g *gui) redrawSide(*gocui.Gui) error {
+	peers, err := g.View("peers")
+	if err != nil {
+		return err
+	}
+	peers.Clear()
+	for _, peer := range g.swarm.Peers() {
+		fmt.Fprintln(peers, peerLine(peer))
 	}
+	status, err := g.View("status")
+	if err != nil {
+		return err
+	}
+	status.Clear()
+	fmt.Fprint(status, statusLine(g.swarm, g.render.getNick()))
+	return nil
 }
 
-func inputView(g *gui, maxX, maxY int) error {
-	if v, err := g.SetView("input", 0, 5*maxY/6+1, maxX-1, maxY-1); err != nil {
+// editor edits the input, letting the swarm know whether we're typing
+func (g *gui) editor() gocui.Editor {
+	return gocui.EditorFunc(func(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+		held, ok := g.paste.feed(key, ch, mod)
+		g.input.insert(held...)
+		if ok {
+			g.input.edit(key, ch, mod)
+		}
+		g.input.draw(v)
+		signal := network.SignalTyping
+		if len(g.input.text) == 0 {
+			signal = network.SignalIdle
+		}
+		g.signals.send(signal)
+	})
+}
+
+func inputView(g *gui, x0, y0, x1, y1 int) error {
+	v, err := g.SetView("input", x0, y0, x1, y1)
+	if err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
 		v.Editable = true
-		v.Editor = defaultEditor
+		v.Editor = g.editor()
+	}
+	// the view may have changed size, which changes how it needs to scroll
+	g.input.draw(v)
+	return nil
+}
+
+// recall moves up a line of the input if older is set, or down one,
+// and replaces it with an entry of the history when there's no line to move to
+func (g *gui) recall(older bool) func(*gocui.Gui, *gocui.View) error {
+	return func(gui *gocui.Gui, v *gocui.View) error {
+		if g.input.moveLine(older) {
+			g.input.draw(v)
+			return nil
+		}
+		var text string
+		var ok bool
+		if older {
+			text, ok = g.history.prev(g.input.String())
+		} else {
+			text, ok = g.history.next()
+		}
+		if ok {
+			g.input.set(text)
+			g.input.draw(v)
+		}
+		return nil
 	}
+}
+
+// complete fills in the command or nickname being typed, listing the options if there are several
+//
+// A pasted tab is written as spaces instead.
+func (g *gui) complete(gui *gocui.Gui, v *gocui.View) error {
+	if g.paste.pasting {
+		g.input.insert([]rune("    ")...)
+		g.input.draw(v)
+		return nil
+	}
+	var nicks []string
+	for _, peer := range g.swarm.Peers() {
+		if peer.Nick != "" {
+			nicks = append(nicks, peer.Nick)
+		}
+	}
+	line, pos, options := g.env.commands.complete(g.input.text, g.input.pos, nicks)
+	g.input.text = line
+	g.input.move(pos)
+	g.input.draw(v)
+	if len(options) > 0 {
+		g.notice(strings.Join(options, "  "))
+	}
+	return nil
+}
+
+// keybindings sets up the keys of the ui, which only needs to happen once
+func keybindings(g *gui) error {
 	sendContent := func(gui *gocui.Gui, v *gocui.View) error {
-		content := v.Buffer()
-		if content == "" {
+		// a pasted newline is part of the message, rather than the end of it
+		if g.paste.pasting {
+			g.input.insert('\n')
+			g.input.draw(v)
 			return nil
 		}
-		// trim the newline
-		content = content[:len(content)-1]
-		v.Clear()
-		if err := v.SetCursor(0, 0); err != nil {
-			return err
+		content := strings.TrimRight(g.input.String(), "\n")
+		if content == "" {
+			return nil
 		}
-		var name string
-		_, err := fmt.Sscanf(content, "!nick %s", &name)
-		if err == nil {
-			g.nick = name
-			g.swarm.ChangeNickname(name)
-		} else {
-			g.ReceiveContent("(me) "+g.nick, content)
-			g.swarm.SendContent(content)
+		g.input.set("")
+		g.input.draw(v)
+		g.history.add(content)
+		g.env.commands.handle(g.env, content)
+		if g.quitting {
+			return gocui.ErrQuit
 		}
 		return nil
 	}
-	if err := g.SetKeybinding("input", gocui.KeyEnter, gocui.ModNone, sendContent); err != nil {
-		return err
+	bindings := []struct {
+		view    string
+		key     interface{}
+		handler func(*gocui.Gui, *gocui.View) error
+	}{
+		{"", gocui.KeyCtrlC, quit},
+		{"input", gocui.KeyEnter, sendContent},
+		{"input", gocui.KeyArrowUp, g.recall(true)},
+		{"input", gocui.KeyArrowDown, g.recall(false)},
+		{"input", gocui.KeyTab, g.complete},
+		{"", gocui.KeyPgup, g.scroll(-1, true)},
+		{"", gocui.KeyPgdn, g.scroll(1, true)},
+		{"messages", gocui.MouseWheelUp, g.scroll(-3, false)},
+		{"messages", gocui.MouseWheelDown, g.scroll(3, false)},
+		{"", gocui.KeyCtrlP, g.step(true)},
+		{"", gocui.KeyCtrlN, g.step(false)},
+	}
+	for _, binding := range bindings {
+		if err := g.SetKeybinding(binding.view, binding.key, gocui.ModNone, binding.handler); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 // RunTUI starts the terminal ui for the app
-func RunTUI(swarm *network.SwarmHandle) {
+func RunTUI(swarm Node) {
 	under, err := gocui.NewGui(gocui.OutputNormal)
 	if err != nil {
 		log.Panicln(err)
 	}
 	defer under.Close()
-	g := &gui{Gui: under, swarm: nil}
+	// with bracketed paste, the terminal tells us when text is pasted rather than typed
+	fmt.Fprint(os.Stdout, enablePaste)
+	defer fmt.Fprint(os.Stdout, disablePaste)
+	// gocui reads the escape sequences itself, so colors are always fine here
+	render := &renderer{colors: true, bell: *Bell, code: *CodeBlocks, nick: ownNick(swarm)}
+	g := &gui{Gui: under, swarm: swarm, render: render, chat: newChatLog(), follow: true}
+	g.signals = newSignalSender(swarm)
+	defer g.signals.close()
 	swarm.SetReceiver(g)
+	g.env = &Env{
+		Swarm:  swarm,
+		Print:  g.notice,
+		Quit:   func() { g.quitting = true },
+		chat:   g.chat,
+		render: render,
+		commands: commands.with(Command{
+			Name:   "search",
+			Params: []string{"[term...]"},
+			Help:   "Finds messages with a term, or stops searching without one",
+			Run:    g.searchCommand,
+		}),
+		shown: func() {
+			g.Update(func(gui *gocui.Gui) error {
+				g.follow = true
+				return g.redraw(gui)
+			})
+		},
+	}
+	swarm.HandleFileOffers(func(offer network.FileOffer) {
+		g.notice(describeOffer(swarm, offer))
+	})
+	swarm.HandleSignals(func(network.SignalEvent) {
+		g.Update(g.redrawTyping)
+		g.Update(g.redrawSide)
+	})
+	swarm.HandleRingChanges(func(network.RingChange) {
+		g.Update(g.redrawSide)
+	})
+	// typing stops on its own after a while, and peers come and go, which no handler hears about
+	go func() {
+		for range time.Tick(time.Second) {
+			g.Update(g.redrawTyping)
+			g.Update(g.redrawSide)
+		}
+	}()
 	g.Cursor = true
-	g.SetManagerFunc(wrapSwarm(swarm, layout))
-	if err := g.SetKeybinding("", gocui.KeyCtrlC, gocui.ModNone, quit); err != nil {
+	g.Mouse = true
+	g.SetManagerFunc(func(*gocui.Gui) error {
+		return layout(g)
+	})
+	if err := keybindings(g); err != nil {
 		log.Fatal(err)
 	}
 	if err := g.MainLoop(); err != nil && err != gocui.ErrQuit {
@@ -101,19 +431,60 @@ func RunTUI(swarm *network.SwarmHandle) {
 	}
 }
 
+const (
+	// sidebarWidth is how many columns the peers view takes
+	sidebarWidth = 24
+	// maxInputLines is how tall the input view grows, as we write more lines
+	maxInputLines = 6
+	// enablePaste and disablePaste turn bracketed paste on and off
+	enablePaste  = "\x1b[?2004h"
+	disablePaste = "\x1b[?2004l"
+)
+
 func layout(g *gui) error {
 	maxX, maxY := g.Size()
-	if v, err := g.SetView("messages", 0, 0, maxX-1, 5*maxY/6); err != nil {
+	// the status bar takes the last line, and the sidebar the right side above it,
+	// with the input box above the status bar, and who is typing on the line above it
+	side := maxX - sidebarWidth
+	rows := g.input.lines()
+	if rows > maxInputLines {
+		rows = maxInputLines
+	}
+	input := maxY - 3 - rows
+	// messages are wrapped as they're drawn, which needs doing again if the view changes width
+	v, err := g.SetView("messages", 0, 0, side-1, input-2)
+	if err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	if width, _ := v.Size(); width != g.width {
+		if err := g.redraw(g.Gui); err != nil {
+			return err
+		}
+	}
+	if v, err := g.SetView("typing", 0, input-2, side-1, input); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
-		v.Title = "messages"
-		v.Autoscroll = true
-		v.Wrap = true
+		v.Frame = false
 	}
-	if err := inputView(g, maxX, maxY); err != nil {
+	if err := inputView(g, 0, input, side-1, maxY-2); err != nil {
 		return err
 	}
+	if v, err := g.SetView("peers", side, 0, maxX-1, maxY-2); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Title = "peers"
+	}
+	if v, err := g.SetView("status", -1, maxY-2, maxX, maxY); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Frame = false
+		if err := g.redrawSide(g.Gui); err != nil {
+			return err
+		}
+	}
 	if _, err := g.SetCurrentView("input"); err != nil {
 		return err
 	}
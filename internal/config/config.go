@@ -0,0 +1,130 @@
+// Package config reads the profiles ripple can be started with.
+//
+// The file is TOML, in $XDG_CONFIG_HOME/ripple/config.toml by default, with
+// a table for each profile:
+//
+//	profile = "home"
+//
+//	[profiles.home]
+//	listen = "0.0.0.0:8081"
+//	advertise = "203.0.113.7:8081"
+//	peers = ["203.0.113.9:8080", "203.0.113.10:8080"]
+//	nick = "alice"
+//
+//	[profiles.home.ui]
+//	tui = true
+//	bell = true
+//
+// The profile at the top is used unless another is asked for, and otherwise
+// the one called "default".
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// DefaultProfile is the profile used when neither we nor the file pick one
+const DefaultProfile = "default"
+
+// Profile is what a node is started with
+type Profile struct {
+	// Listen is the address we listen on, and Advertise the one peers contact us with
+	Listen    string `toml:"listen"`
+	Advertise string `toml:"advertise,omitempty"`
+	// Peers are the nodes we try to join the swarm through, in order
+	Peers []string `toml:"peers"`
+	Nick  string   `toml:"nick,omitempty"`
+	// Control is where the control API is served, and Socket where a daemon serves it
+	Control string `toml:"control,omitempty"`
+	Socket  string `toml:"socket,omitempty"`
+	UI      UI     `toml:"ui"`
+}
+
+// UI holds how we like the interface, with nil meaning the usual
+type UI struct {
+	TUI        *bool  `toml:"tui"`
+	Bell       *bool  `toml:"bell"`
+	CodeBlocks *bool  `toml:"code_blocks"`
+	Downloads  string `toml:"downloads,omitempty"`
+}
+
+// File is a config file, with the profiles in it
+type File struct {
+	// Path is where the file was read from, which is empty if there wasn't one
+	Path     string             `toml:"-"`
+	Profile  string             `toml:"profile"`
+	Profiles map[string]Profile `toml:"profiles"`
+}
+
+// DefaultPath is where the config file is, unless we're told otherwise
+func DefaultPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "ripple", "config.toml")
+}
+
+// Load reads a config file, with a missing one being empty unless required
+func Load(path string, required bool) (File, error) {
+	var file File
+	meta, err := toml.DecodeFile(path, &file)
+	if os.IsNotExist(err) && !required {
+		return File{}, nil
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	// a misspelled key would otherwise be ignored without a word
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return File{}, fmt.Errorf("Unexpected key %s in %s", undecoded[0], path)
+	}
+	file.Path = path
+	return file, nil
+}
+
+// Get returns a profile, or the one the file picks if name is empty
+func (f File) Get(name string) (Profile, error) {
+	if name == "" {
+		name = f.Profile
+	}
+	if name == "" {
+		name = DefaultProfile
+	}
+	profile, ok := f.Profiles[name]
+	// without any profiles, we use the usual settings
+	switch {
+	case ok, name == DefaultProfile && len(f.Profiles) == 0:
+	case len(f.Profiles) == 0:
+		return Profile{}, fmt.Errorf("No profile called %s, without any profiles to pick from", name)
+	default:
+		return Profile{}, fmt.Errorf("No profile called %s, the profiles are: %s", name, strings.Join(f.names(), ", "))
+	}
+	return profile, nil
+}
+
+// names returns the names of the profiles in order
+func (f File) names() []string {
+	names := make([]string, 0, len(f.Profiles))
+	for name := range f.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Show writes a profile as TOML
+func (p Profile) Show(w io.Writer) error {
+	return toml.NewEncoder(w).Encode(p)
+}
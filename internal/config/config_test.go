@@ -0,0 +1,102 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes a config file in a new directory, returning its path
+func writeFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "ripple")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	path := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return path
+}
+
+const example = `
+profile = "home"
+
+[profiles.home]
+listen = "0.0.0.0:8081"
+peers = ["203.0.113.9:8080", "203.0.113.10:8080"]
+nick = "alice"
+
+[profiles.home.ui]
+bell = true
+
+[profiles.work]
+listen = "127.0.0.1:9000"
+`
+
+func TestProfiles(t *testing.T) {
+	path := writeFile(t, example)
+	defer os.RemoveAll(filepath.Dir(path))
+	file, err := Load(path, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	home, err := file.Get("")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if home.Listen != "0.0.0.0:8081" || len(home.Peers) != 2 || home.Nick != "alice" {
+		t.Errorf("Expected the home profile got %v", home)
+	}
+	if home.UI.Bell == nil || !*home.UI.Bell || home.UI.TUI != nil {
+		t.Errorf("Expected only the bell to be set got %v", home.UI)
+	}
+	work, err := file.Get("work")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if work.Listen != "127.0.0.1:9000" || work.Nick != "" {
+		t.Errorf("Expected the work profile got %v", work)
+	}
+	if _, err := file.Get("default"); err == nil {
+		t.Errorf("Expected a missing profile to be refused")
+	}
+
+	var shown bytes.Buffer
+	if err := home.Show(&shown); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(shown.String(), `nick = "alice"`) {
+		t.Errorf("Expected the profile got %s", shown.String())
+	}
+}
+
+func TestMissingFiles(t *testing.T) {
+	file, err := Load(filepath.Join(os.TempDir(), "ripple-missing.toml"), false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := file.Get(""); err != nil {
+		t.Errorf("Expected the default profile without a file got %v", err)
+	}
+	if _, err := file.Get("work"); err == nil {
+		t.Errorf("Expected a missing profile to be refused")
+	}
+	if _, err := Load(filepath.Join(os.TempDir(), "ripple-missing.toml"), true); err == nil {
+		t.Errorf("Expected a missing file to be refused when required")
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+	// a secret would look like it protects the swarm, which nothing does yet
+	for _, key := range []string{"nik", "secret", "identity_key"} {
+		path := writeFile(t, "[profiles.home]\n"+key+" = \"alice\"\n")
+		defer os.RemoveAll(filepath.Dir(path))
+		if _, err := Load(path, true); err == nil || !strings.Contains(err.Error(), "profiles.home."+key) {
+			t.Errorf("Expected the key %s to be pointed out got %v", key, err)
+		}
+	}
+}
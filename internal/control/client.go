@@ -0,0 +1,522 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/network"
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+// requestTimeout bounds the requests a client makes, besides streams and downloads
+const requestTimeout = 10 * time.Second
+
+// remoteAddr is the address of a node, as told to us by a server
+type remoteAddr string
+
+func (addr remoteAddr) Network() string {
+	return "ripple"
+}
+
+func (addr remoteAddr) String() string {
+	return string(addr)
+}
+
+// toAddr makes an address out of a string, with nil for an empty one
+func toAddr(text string) net.Addr {
+	if text == "" {
+		return nil
+	}
+	return remoteAddr(text)
+}
+
+func toAddrs(texts []string) []net.Addr {
+	addrs := make([]net.Addr, 0, len(texts))
+	for _, text := range texts {
+		addrs = append(addrs, remoteAddr(text))
+	}
+	return addrs
+}
+
+// Client works like a SwarmHandle, for a node running in another process
+//
+// Events start arriving once a receiver is set, beginning with the history
+// the server kept. Progress isn't reported for downloads, and those are saved
+// by the other process, which needs to be able to write to the directory.
+type Client struct {
+	// short is used for quick requests, and long for streams and downloads
+	short *http.Client
+	long  *http.Client
+	base  string
+	// addr is the address of the node
+	addr net.Addr
+	// token tells the messages we sent apart from those of other clients
+	token string
+	// auth is what a server on a loopback address asks for, see Listen
+	auth string
+	// ctx is cancelled by Close, ending every request
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu            sync.Mutex
+	receiver      protocol.ContentReceiver
+	signalHandler network.SignalHandler
+	offerHandler  network.FileHandler
+	ringHandler   network.RingHandler
+	following     bool
+	done          chan struct{}
+}
+
+// Dial connects to the server listening on a Unix socket or a loopback address
+//
+// For a loopback address, this reads the token the server wrote.
+func Dial(addr string) (*Client, error) {
+	transport := &http.Transport{}
+	// the server only answers requests for a loopback address
+	base := "http://127.0.0.1"
+	auth := ""
+	if isSocket(addr) {
+		path := socketPath(addr)
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		}
+	} else {
+		tcp, token, err := readToken(addr)
+		if err != nil {
+			return nil, err
+		}
+		base, auth = "http://"+tcp.String(), token
+	}
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &Client{
+		ctx:    ctx,
+		cancel: cancel,
+		short:  &http.Client{Transport: transport, Timeout: requestTimeout},
+		long:   &http.Client{Transport: transport},
+		base:   base,
+		token:  hex.EncodeToString(token),
+		auth:   auth,
+		done:   make(chan struct{}),
+	}
+	topology, err := client.Topology()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	client.addr = remoteAddr(topology.Addr)
+	return client, nil
+}
+
+// call makes a request, decoding the JSON of the answer into result if it isn't nil
+func (c *Client) call(client *http.Client, method, path string, body, result interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := c.request(method, path, data)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&failure); err != nil || failure.Error == "" {
+			return fmt.Errorf("Unexpected status %s", res.Status)
+		}
+		return errors.New(failure.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// request makes a request to the server, with the headers it expects
+func (c *Client) request(method, path string, data []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(c.ctx, method, c.base+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.auth != "" {
+		req.Header.Set("Authorization", "Bearer "+c.auth)
+	}
+	return req, nil
+}
+
+// Topology returns the place of the node in the ring
+func (c *Client) Topology() (Topology, error) {
+	var topology Topology
+	err := c.call(c.short, http.MethodGet, "/topology", nil, &topology)
+	return topology, err
+}
+
+// History returns the latest events the server kept, up to limit of them
+func (c *Client) History(limit int) ([]Event, error) {
+	var events []Event
+	err := c.call(c.short, http.MethodGet, "/history?limit="+strconv.Itoa(limit), nil, &events)
+	return events, err
+}
+
+// Events calls f with every event from now on, after the latest history ones,
+// until the server goes away
+//
+// If we fell too far behind, the last event is a "lagged" one, and some were missed.
+func (c *Client) Events(history int, f func(Event)) error {
+	req, err := c.request(http.MethodGet, "/events?history="+strconv.Itoa(history), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.long.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %s", res.Status)
+	}
+	lines := bufio.NewScanner(res.Body)
+	// messages can be as long as the limits allow, which is more than a scanner takes by default
+	lines.Buffer(nil, 1<<24)
+	for lines.Scan() {
+		var event Event
+		if err := json.Unmarshal(lines.Bytes(), &event); err != nil {
+			return err
+		}
+		f(event)
+		if event.Kind == "lagged" {
+			return errLagged
+		}
+	}
+	return lines.Err()
+}
+
+// Done is closed once the stream of events set up by SetReceiver ends
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close ends the stream of events set up by SetReceiver, waiting for it to stop
+//
+// The node itself keeps running, and no more requests can be made.
+func (c *Client) Close() error {
+	c.cancel()
+	c.mu.Lock()
+	following := c.following
+	c.mu.Unlock()
+	if following {
+		<-c.done
+	}
+	return nil
+}
+
+// Addr returns the address of the node
+func (c *Client) Addr() net.Addr {
+	return c.addr
+}
+
+// Predecessor returns the address of the node before ours in the ring, or nil if unknown
+func (c *Client) Predecessor() net.Addr {
+	topology, _ := c.Topology()
+	return toAddr(topology.Predecessor)
+}
+
+// Successor returns the address of the node after ours in the ring, or nil if unknown
+func (c *Client) Successor() net.Addr {
+	topology, _ := c.Topology()
+	return toAddr(topology.Successor)
+}
+
+// ID returns the place of the node on the hash ring
+func (c *Client) ID() protocol.ID {
+	topology, _ := c.Topology()
+	id, _ := strconv.ParseUint(topology.ID, 16, 64)
+	return protocol.ID(id)
+}
+
+// Chords returns the chord links of the node
+func (c *Client) Chords() []net.Addr {
+	topology, _ := c.Topology()
+	return toAddrs(topology.Chords)
+}
+
+// Fingers returns the distinct nodes in the finger table of the node
+func (c *Client) Fingers() []net.Addr {
+	topology, _ := c.Topology()
+	return toAddrs(topology.Fingers)
+}
+
+// QueueStats reports on the send queues of the node
+func (c *Client) QueueStats() []network.QueueStats {
+	topology, _ := c.Topology()
+	stats := make([]network.QueueStats, 0, len(topology.Queues))
+	for _, q := range topology.Queues {
+		stats = append(stats, network.QueueStats{
+			Addr:     toAddr(q.Addr),
+			Role:     q.Role,
+			Depth:    q.Depth,
+			MaxDepth: q.MaxDepth,
+			Sent:     q.Sent,
+			Dropped:  q.Dropped,
+		})
+	}
+	return stats
+}
+
+// Peers returns the other nodes the node knows about
+func (c *Client) Peers() []network.Peer {
+	var peers []Peer
+	if err := c.call(c.short, http.MethodGet, "/peers", nil, &peers); err != nil {
+		return nil
+	}
+	out := make([]network.Peer, 0, len(peers))
+	for _, p := range peers {
+		peer := network.Peer{Addr: remoteAddr(p.Addr), Nick: p.Nick, Linked: p.Linked, Online: p.Online, Away: p.Away}
+		if p.LastSeen != nil {
+			peer.LastSeen = *p.LastSeen
+		}
+		out = append(out, peer)
+	}
+	return out
+}
+
+// Nickname returns the nickname of a node, or its address if it doesn't have one
+func (c *Client) Nickname(addr net.Addr) string {
+	if addr.String() == c.addr.String() {
+		if topology, err := c.Topology(); err == nil {
+			return topology.Nick
+		}
+	}
+	for _, peer := range c.Peers() {
+		if peer.Addr.String() == addr.String() && peer.Nick != "" {
+			return peer.Nick
+		}
+	}
+	return addr.String()
+}
+
+// SetReceiver changes the receiver of the chat events of the node
+//
+// The first call starts following the events of the node, replaying the
+// history the server kept to the receiver first.
+func (c *Client) SetReceiver(receiver protocol.ContentReceiver) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.receiver = receiver
+	if !c.following {
+		c.following = true
+		go c.follow()
+	}
+}
+
+// HandleSignals registers a handler for the signals other nodes send
+func (c *Client) HandleSignals(handler network.SignalHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.signalHandler = handler
+}
+
+// HandleFileOffers registers a handler for the files other nodes offer
+func (c *Client) HandleFileOffers(handler network.FileHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offerHandler = handler
+}
+
+// HandleRingChanges registers a handler called whenever the neighbors of the node change
+func (c *Client) HandleRingChanges(handler network.RingHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ringHandler = handler
+}
+
+// follow passes the events of the node to our receiver and handlers, until the stream ends
+func (c *Client) follow() {
+	err := c.Events(DefaultHistory, c.dispatch)
+	defer close(c.done)
+	// we left on purpose, so there's nothing to tell
+	if c.ctx.Err() != nil {
+		return
+	}
+	c.mu.Lock()
+	receiver := c.receiver
+	c.mu.Unlock()
+	reason := "the server went away"
+	if err != nil {
+		reason = err.Error()
+	}
+	receiver.ReceiveContent("ripple", "Lost the connection to the node: "+reason)
+}
+
+// dispatch passes an event to whoever wants it
+func (c *Client) dispatch(event Event) {
+	c.mu.Lock()
+	receiver := c.receiver
+	signalHandler := c.signalHandler
+	offerHandler := c.offerHandler
+	ringHandler := c.ringHandler
+	c.mu.Unlock()
+	switch event.Kind {
+	case "signal":
+		if signalHandler != nil && event.Expires != nil {
+			signalHandler(network.SignalEvent{
+				From:    remoteAddr(event.From),
+				Nick:    event.Nick,
+				Signal:  network.Signal(event.Content),
+				Expires: *event.Expires,
+			})
+		}
+	case "offer":
+		if offerHandler != nil && event.Offer != nil {
+			if offer, err := toOffer(*event.Offer); err == nil {
+				offerHandler(offer)
+			}
+		}
+	case "ring":
+		if ringHandler != nil && event.Ring != nil {
+			ringHandler(network.RingChange{Predecessor: toAddr(event.Ring.Predecessor), Successor: toAddr(event.Ring.Successor)})
+		}
+	default:
+		// what we did ourselves was shown when we did it
+		if event.Own && event.Client == c.token {
+			return
+		}
+		c.receive(receiver, event)
+	}
+}
+
+// receive passes a chat event to a receiver
+func (c *Client) receive(receiver protocol.ContentReceiver, event Event) {
+	chat, ok := event.ChatEvent()
+	if !ok {
+		return
+	}
+	if r, ok := receiver.(network.EventReceiver); ok {
+		r.ReceiveEvent(chat)
+	} else if chat.Kind == network.EventMessage || chat.Kind == network.EventDirect {
+		receiver.ReceiveContent(chat.Nick, chat.Content)
+	}
+}
+
+// toOffer turns an Offer back into a FileOffer
+func toOffer(o Offer) (network.FileOffer, error) {
+	offer := network.FileOffer{Name: o.Name, Size: o.Size, Sender: remoteAddr(o.Sender)}
+	hash, err := hex.DecodeString(o.Hash)
+	if err != nil || len(hash) != len(offer.Hash) {
+		return offer, fmt.Errorf("Invalid hash %q", o.Hash)
+	}
+	copy(offer.Hash[:], hash)
+	return offer, nil
+}
+
+// SendMessage sends a message to the rest of the swarm, returning a reference to it
+func (c *Client) SendMessage(content string) (network.MessageRef, error) {
+	body := map[string]string{"content": content, "client": c.token}
+	var event Event
+	if err := c.call(c.short, http.MethodPost, "/send", body, &event); err != nil {
+		return network.MessageRef{}, err
+	}
+	return network.MessageRef{Sender: event.Sender, ID: event.ID}, nil
+}
+
+// EditMessage replaces the content of one of the messages of the node
+func (c *Client) EditMessage(id uint64, content string) error {
+	return c.call(c.short, http.MethodPost, "/edit", change{ID: id, Content: content, Client: c.token}, nil)
+}
+
+// RetractMessage hides one of the messages of the node
+func (c *Client) RetractMessage(id uint64) error {
+	return c.call(c.short, http.MethodPost, "/retract", change{ID: id, Client: c.token}, nil)
+}
+
+// React attaches a short reaction to any message
+func (c *Client) React(ref network.MessageRef, reaction string) error {
+	return c.call(c.short, http.MethodPost, "/react", change{Sender: ref.Sender, ID: ref.ID, Content: reaction, Client: c.token}, nil)
+}
+
+// ChangeNickname changes the nickname of the node
+func (c *Client) ChangeNickname(name string) error {
+	return c.call(c.short, http.MethodPost, "/nick", map[string]string{"nick": name}, nil)
+}
+
+// SendDirect sends a message to a single node
+func (c *Client) SendDirect(addr net.Addr, content string) error {
+	return c.call(c.short, http.MethodPost, "/direct", map[string]string{"to": addr.String(), "content": content}, nil)
+}
+
+// SendSignal tells the rest of the swarm that we're typing, away, or neither anymore
+func (c *Client) SendSignal(signal network.Signal) error {
+	return c.call(c.short, http.MethodPost, "/signal", map[string]network.Signal{"signal": signal}, nil)
+}
+
+// ActiveSignals returns the signals of other nodes which haven't expired
+func (c *Client) ActiveSignals() []network.SignalEvent {
+	var signals []Signal
+	if err := c.call(c.short, http.MethodGet, "/signals", nil, &signals); err != nil {
+		return nil
+	}
+	out := make([]network.SignalEvent, 0, len(signals))
+	for _, s := range signals {
+		out = append(out, network.SignalEvent{From: remoteAddr(s.From), Nick: s.Nick, Signal: network.Signal(s.Signal), Expires: s.Expires})
+	}
+	return out
+}
+
+// OfferFile has the node offer a file to the rest of the swarm
+func (c *Client) OfferFile(path string) (network.FileOffer, error) {
+	// the other process may well be running in another directory
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return network.FileOffer{}, err
+	}
+	var offer Offer
+	if err := c.call(c.short, http.MethodPost, "/offer", map[string]string{"path": path}, &offer); err != nil {
+		return network.FileOffer{}, err
+	}
+	return toOffer(offer)
+}
+
+// GetFile has the node download an offered file into a directory, returning its path
+//
+// Progress is never called, and is only there to work like a SwarmHandle.
+func (c *Client) GetFile(id string, dir string, progress func(network.FileProgress)) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Path string `json:"path"`
+	}
+	if err := c.call(c.long, http.MethodPost, "/get", map[string]string{"id": id, "dir": dir}, &result); err != nil {
+		return "", err
+	}
+	return result.Path, nil
+}
@@ -0,0 +1,155 @@
+package control
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/network"
+)
+
+// eventLog is a receiver passing the events it gets along a channel
+type eventLog chan network.ChatEvent
+
+func (e eventLog) ReceiveContent(name, content string) {}
+
+func (e eventLog) ReceiveEvent(event network.ChatEvent) {
+	e <- event
+}
+
+func (e eventLog) next(t *testing.T) network.ChatEvent {
+	t.Helper()
+	select {
+	case event := <-e:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected an event")
+		return network.ChatEvent{}
+	}
+}
+
+func TestClient(t *testing.T) {
+	swarm, other := makePair(t)
+	server := NewServer(swarm, DefaultHistory)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "ripple")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := Listen(filepath.Join(dir, "control.sock"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer l.Close()
+	go server.Serve(l)
+
+	earlier, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := earlier.SendMessage("before"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if client.Addr().String() != "first" || client.Successor().String() != "second" {
+		t.Errorf("Unexpected place in the ring %v %v", client.Addr(), client.Successor())
+	}
+	if err := client.ChangeNickname("alice"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if nick := client.Nickname(client.Addr()); nick != "alice" {
+		t.Errorf("Expected alice got %s", nick)
+	}
+	events := make(eventLog, 8)
+	client.SetReceiver(events)
+	// what happened before we attached comes first, even if another client sent it
+	if event := events.next(t); event.Kind != network.EventMessage || event.Content != "before" {
+		t.Errorf("Expected the earlier message got %v", event)
+	}
+	// the messages we send aren't sent back to us
+	if _, err := client.SendMessage("mine"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ref, err := other.SendMessage("theirs")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if event := events.next(t); event.Content != "theirs" || event.Message != ref || event.From.String() != "second" {
+		t.Errorf("Expected the message of the other node got %v", event)
+	}
+	// but what other clients do is
+	if err := client.React(ref, "👍"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := earlier.React(ref, "🎉"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if event := events.next(t); event.Kind != network.EventReact || event.Message != ref || event.Content != "🎉" {
+		t.Errorf("Expected the reaction of the other client got %v", event)
+	}
+	if err := client.SendSignal("sleeping"); err == nil {
+		t.Errorf("Expected an unknown signal to be refused")
+	}
+
+	server.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the client to notice the server going away")
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	swarm, _ := makePair(t)
+	server := NewServer(swarm, DefaultHistory)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "ripple")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := Listen(filepath.Join(dir, "control.sock"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer l.Close()
+	go server.Serve(l)
+
+	client, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client.SetReceiver(make(eventLog, 8))
+	closed := make(chan struct{})
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Close to end the stream of events")
+	}
+	select {
+	case <-client.Done():
+	default:
+		t.Errorf("Expected the stream of events to be done")
+	}
+	if _, err := client.SendMessage("late"); err == nil {
+		t.Errorf("Expected requests to fail once closed")
+	}
+	// the node itself keeps going
+	other, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := other.SendMessage("still here"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
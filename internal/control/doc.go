@@ -0,0 +1,43 @@
+// Package control lets local programs drive a running node.
+//
+// A Server exposes a SwarmHandle over HTTP, on a Unix socket or a loopback
+// address, so that scripts can send messages, change our nickname, look at
+// our peers and our place in the ring, read the recent history, and follow
+// the events arriving as they happen. Everything is JSON, with the stream
+// of events being a JSON object per line.
+//
+// The endpoints are:
+//
+//	POST /send      {"content": "..."}, answering with the Event sent
+//	POST /nick      {"nick": "..."}
+//	POST /direct    {"to": "...", "content": "..."}
+//	POST /edit      {"id": N, "content": "..."}
+//	POST /retract   {"id": N}
+//	POST /react     {"sender": "...", "id": N, "content": "..."}
+//	POST /signal    {"signal": "typing"}, or "away", or "idle"
+//	GET  /signals   the Signals of other nodes which haven't expired
+//	POST /offer     {"path": "..."}, answering with the Offer made
+//	GET  /offers    the Offers we know about
+//	POST /get       {"id": "...", "dir": "..."}, answering with {"path": "..."}
+//	GET  /peers     the Peers we know about
+//	GET  /topology  our Topology
+//	GET  /history   the latest Events, up to ?limit=N of them
+//	GET  /events    every Event from now on, one per line, after ?history=N old ones
+//
+// A client reading /events too slowly to keep up has its stream ended, with a
+// last Event whose kind is "lagged", rather than having events go missing.
+//
+// Failures are answered with an error status, and {"error": "..."}.
+//
+// Since web pages can make requests to loopback addresses, requests with an
+// Origin header are refused, as are those whose Host isn't a loopback address,
+// like 127.0.0.1, and POST requests without a Content-Type of application/json.
+// On a loopback address, where any local user could connect, requests also
+// need the token written next to the default socket when the server started,
+// passed as "Authorization: Bearer <token>". On a Unix socket, its
+// permissions do that job.
+//
+// A Client works like a SwarmHandle over these endpoints, which is how the UI
+// attaches to a node running as a daemon. Clients pass a token along with what
+// they send, which the Events it causes carry, so that they can leave those out.
+package control
@@ -0,0 +1,174 @@
+package control
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSocket is where a daemon listens unless told otherwise
+//
+// This is in $XDG_RUNTIME_DIR, which only we can use, or the temporary
+// directory otherwise, with our user id in the name.
+func DefaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "ripple.sock")
+	}
+	return filepath.Join(os.TempDir(), "ripple-"+strconv.Itoa(os.Getuid())+".sock")
+}
+
+// isSocket checks if an address names a Unix socket, rather than a loopback address
+//
+// Sockets are paths, like "/run/user/1000/ripple.sock", or start with "unix:".
+func isSocket(addr string) bool {
+	return strings.HasPrefix(addr, "unix:") || strings.ContainsRune(addr, os.PathSeparator)
+}
+
+// socketPath takes the "unix:" prefix out of the address of a socket
+func socketPath(addr string) string {
+	return strings.TrimPrefix(addr, "unix:")
+}
+
+// tokenPath is where the token for a loopback address is kept, next to the default socket
+func tokenPath(tcp *net.TCPAddr) string {
+	ip := strings.Replace(tcp.IP.String(), ":", "_", -1)
+	name := fmt.Sprintf("ripple-%s-%d.token", ip, tcp.Port)
+	return filepath.Join(filepath.Dir(DefaultSocket()), name)
+}
+
+// tokenListener listens on a loopback address, where requests need a token
+//
+// Any local user can connect to a loopback address, so the token is written
+// to a file only we can read, which stands in for the permissions of a socket.
+type tokenListener struct {
+	*net.TCPListener
+	token string
+	path  string
+}
+
+// Close stops listening, and removes the token
+func (l *tokenListener) Close() error {
+	os.Remove(l.path)
+	return l.TCPListener.Close()
+}
+
+// listenTCP listens on a loopback address, writing a new token for it
+func listenTCP(addr string) (net.Listener, error) {
+	tcp, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tcp.IP == nil || !tcp.IP.IsLoopback() {
+		return nil, fmt.Errorf("Refusing to listen on %s, which isn't a loopback address", addr)
+	}
+	l, err := net.ListenTCP("tcp", tcp)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		l.Close()
+		return nil, err
+	}
+	token := hex.EncodeToString(secret)
+	path := tokenPath(l.Addr().(*net.TCPAddr))
+	// a token left behind is replaced, but never written through somebody else's file
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		l.Close()
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		_, err = file.WriteString(token)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		os.Remove(path)
+		l.Close()
+		return nil, fmt.Errorf("Couldn't write the token to %s: %v", path, err)
+	}
+	return &tokenListener{TCPListener: l, token: token, path: path}, nil
+}
+
+// readToken reads the token a server on a loopback address wrote
+func readToken(addr string) (*net.TCPAddr, string, error) {
+	tcp, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, "", err
+	}
+	path := tokenPath(tcp)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("Couldn't read the token of %s: %v", addr, err)
+	}
+	return tcp, strings.TrimSpace(string(data)), nil
+}
+
+// Listen accepts the connections of local programs on a Unix socket or a loopback address
+//
+// Other addresses are refused. The permissions of a socket let only us use it,
+// while a loopback address needs a token, which is written next to the
+// default socket, and removed once the listener is closed. Serve checks it.
+// A socket left behind by a server that's no longer running is replaced.
+func Listen(addr string) (net.Listener, error) {
+	if !isSocket(addr) {
+		return listenTCP(addr)
+	}
+	path := socketPath(addr)
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Something is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// the socket is made in a directory only we can use, and moved into place
+	// once its permissions are set, so that nobody can connect in between
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".ripple-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, "control.sock")
+	l, err := net.Listen("unix", private)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(private, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(private, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &socketListener{Listener: l, path: path}, nil
+}
+
+// socketListener listens on a socket which was moved after being made
+type socketListener struct {
+	net.Listener
+	path string
+}
+
+// Addr returns where the socket was moved to
+func (l *socketListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// Close stops listening, and removes the socket
+func (l *socketListener) Close() error {
+	os.Remove(l.path)
+	return l.Listener.Close()
+}
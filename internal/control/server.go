@@ -0,0 +1,745 @@
+package control
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/network"
+)
+
+// DefaultHistory is how many events a server remembers, unless told otherwise
+const DefaultHistory = 500
+
+// streamBuffer is how many events can wait for a slow stream, before it's ended
+const streamBuffer = 64
+
+// errLagged ends a stream of events the client didn't keep up with
+var errLagged = errors.New("Fell too far behind the events of the node, which were missed")
+
+// kindNames are the names events go by in JSON
+var kindNames = map[network.EventKind]string{
+	network.EventMessage: "message",
+	network.EventEdit:    "edit",
+	network.EventRetract: "retract",
+	network.EventReact:   "react",
+	network.EventDirect:  "direct",
+}
+
+// Event is something that happened in the swarm, as seen by a node
+type Event struct {
+	// Kind is "message", "edit", "retract", "react" or "direct" for chat events,
+	// and "signal", "offer" or "ring" for the others. A stream ends with a
+	// "lagged" event if the client was too slow to keep up with it.
+	Kind string `json:"kind"`
+	// Sender and ID refer to the message, which the event is about
+	// unless it's a new message
+	Sender string `json:"sender,omitempty"`
+	ID     uint64 `json:"id,omitempty"`
+	// From is the node behind the event, and Nick its nickname
+	From    string `json:"from"`
+	Nick    string `json:"nick"`
+	Content string `json:"content,omitempty"`
+	// Own is set for the messages we sent ourselves, with Client being the
+	// one that asked to send it, if it said who it was
+	Own    bool      `json:"own,omitempty"`
+	Client string    `json:"client,omitempty"`
+	At     time.Time `json:"at"`
+	// Expires is when a signal stops applying, with Content being the signal
+	Expires *time.Time `json:"expires,omitempty"`
+	// Offer is the file offered by an offer
+	Offer *Offer `json:"offer,omitempty"`
+	// Ring is how the ring looks around us, after a ring event
+	Ring *Ring `json:"ring,omitempty"`
+}
+
+// ChatEvent turns a chat event back into what a SwarmHandle passes to its receiver
+//
+// Other events, like signals, aren't chat events, and aren't turned into anything.
+func (e Event) ChatEvent() (network.ChatEvent, bool) {
+	for kind, name := range kindNames {
+		if name == e.Kind {
+			return network.ChatEvent{
+				Kind:    kind,
+				Message: network.MessageRef{Sender: e.Sender, ID: e.ID},
+				From:    toAddr(e.From),
+				Nick:    e.Nick,
+				Content: e.Content,
+			}, true
+		}
+	}
+	return network.ChatEvent{}, false
+}
+
+// Offer is a file another node offered
+type Offer struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Hash   string `json:"hash"`
+	Sender string `json:"sender"`
+}
+
+func makeOffer(offer network.FileOffer) Offer {
+	return Offer{
+		ID:     offer.ID(),
+		Name:   offer.Name,
+		Size:   offer.Size,
+		Hash:   offer.Hash.String(),
+		Sender: addrString(offer.Sender),
+	}
+}
+
+// Signal is the latest signal of some kind from another node
+type Signal struct {
+	From    string    `json:"from"`
+	Nick    string    `json:"nick"`
+	Signal  string    `json:"signal"`
+	Expires time.Time `json:"expires"`
+}
+
+// Ring is how the ring looks around us
+type Ring struct {
+	Predecessor string `json:"predecessor"`
+	Successor   string `json:"successor"`
+}
+
+// Peer is another node we know about
+type Peer struct {
+	Addr     string     `json:"addr"`
+	Nick     string     `json:"nick"`
+	Linked   bool       `json:"linked"`
+	Online   bool       `json:"online"`
+	Away     bool       `json:"away"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// Queue describes the send queue to one of our neighbors
+type Queue struct {
+	Addr     string `json:"addr"`
+	Role     string `json:"role"`
+	Depth    int    `json:"depth"`
+	MaxDepth int    `json:"max_depth"`
+	Sent     uint64 `json:"sent"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// Topology is our place in the ring, and the links we hold
+type Topology struct {
+	Addr        string   `json:"addr"`
+	ListenAddr  string   `json:"listen_addr"`
+	Nick        string   `json:"nick"`
+	ID          string   `json:"id"`
+	Predecessor string   `json:"predecessor"`
+	Successor   string   `json:"successor"`
+	SwarmSize   int      `json:"swarm_size"`
+	Chords      []string `json:"chords"`
+	Fingers     []string `json:"fingers"`
+	Queues      []Queue  `json:"queues"`
+}
+
+// statusError is an error with the HTTP status it should be answered with
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e statusError) Error() string {
+	return e.err.Error()
+}
+
+// Server answers the requests of local programs about a node
+//
+// It keeps the latest events as history, starting from when it was made.
+type Server struct {
+	swarm *network.SwarmHandle
+	mux   *http.ServeMux
+	// stop stops us from watching the swarm
+	stop func()
+
+	mu      sync.Mutex
+	size    int
+	history []Event
+	streams map[*eventStream]bool
+	closed  bool
+}
+
+// eventStream passes the events of the node to a client of /events
+type eventStream struct {
+	events chan Event
+	// lagged is set, with the server locked, once the client fell too far behind
+	lagged bool
+}
+
+// NewServer starts watching a swarm, remembering the latest size events
+func NewServer(swarm *network.SwarmHandle, size int) *Server {
+	s := &Server{swarm: swarm, size: size, streams: make(map[*eventStream]bool)}
+	s.mux = http.NewServeMux()
+	s.mux.Handle("/send", s.route(http.MethodPost, s.send))
+	s.mux.Handle("/nick", s.route(http.MethodPost, s.nick))
+	s.mux.Handle("/peers", s.route(http.MethodGet, s.peers))
+	s.mux.Handle("/topology", s.route(http.MethodGet, s.topology))
+	s.mux.Handle("/history", s.route(http.MethodGet, s.recent))
+	s.mux.Handle("/direct", s.route(http.MethodPost, s.direct))
+	s.mux.Handle("/edit", s.route(http.MethodPost, s.edit))
+	s.mux.Handle("/retract", s.route(http.MethodPost, s.retract))
+	s.mux.Handle("/react", s.route(http.MethodPost, s.react))
+	s.mux.Handle("/signal", s.route(http.MethodPost, s.signal))
+	s.mux.Handle("/signals", s.route(http.MethodGet, s.signals))
+	s.mux.Handle("/offer", s.route(http.MethodPost, s.offer))
+	s.mux.Handle("/offers", s.route(http.MethodGet, s.offers))
+	s.mux.Handle("/get", s.route(http.MethodPost, s.get))
+	s.mux.HandleFunc("/events", s.events)
+	s.stop = swarm.Watch(s)
+	return s
+}
+
+// Close stops watching the swarm, ending the streams of events
+func (s *Server) Close() {
+	s.stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for stream := range s.streams {
+		close(stream.events)
+		delete(s.streams, stream)
+	}
+}
+
+// ServeHTTP answers a request to one of the endpoints
+//
+// Browsers can reach a loopback address, so requests coming from a web page,
+// which carry an Origin, are refused, as are those for a Host other than a
+// loopback address, which a page could point a name of its own at.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Origin") != "" {
+		writeError(w, statusError{http.StatusForbidden, errors.New("Requests from web pages are refused")})
+		return
+	}
+	if !loopbackHost(r.Host) {
+		writeError(w, statusError{http.StatusForbidden, fmt.Errorf("Unexpected host %q, use a loopback address", r.Host)})
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// Serve answers the requests arriving on a listener made by Listen
+//
+// On a loopback address, requests need the token Listen wrote, passed as
+// "Authorization: Bearer <token>".
+func (s *Server) Serve(l net.Listener) error {
+	var handler http.Handler = s
+	if tl, ok := l.(*tokenListener); ok {
+		handler = requireToken(tl.token, s)
+	}
+	return http.Serve(l, handler)
+}
+
+// requireToken only lets requests carrying a token through to a handler
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, statusError{http.StatusUnauthorized, errors.New("Missing or wrong token")})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loopbackHost checks that a Host header is a loopback address, like 127.0.0.1:7070
+//
+// Names like localhost aren't enough, since we can't tell who they point to.
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// ReceiveContent ignores text without an event, which watchers never get
+func (s *Server) ReceiveContent(name, content string) {}
+
+// ReceiveEvent remembers an event, and passes it to the streams
+func (s *Server) ReceiveEvent(event network.ChatEvent) {
+	from := ""
+	if event.From != nil {
+		from = event.From.String()
+	}
+	s.add(Event{
+		Kind:    kindNames[event.Kind],
+		Sender:  event.Message.Sender,
+		ID:      event.Message.ID,
+		From:    from,
+		Nick:    event.Nick,
+		Content: event.Content,
+		At:      time.Now(),
+	})
+}
+
+// ReceiveSignal passes a signal to the streams, without remembering it
+//
+// Like ReceiveOffer and ReceiveRingChange, this is only called if the server
+// is registered as the handler, which a node without a UI of its own does.
+func (s *Server) ReceiveSignal(signal network.SignalEvent) {
+	expires := signal.Expires
+	s.publish(Event{
+		Kind:    "signal",
+		From:    addrString(signal.From),
+		Nick:    signal.Nick,
+		Content: string(signal.Signal),
+		At:      time.Now(),
+		Expires: &expires,
+	})
+}
+
+// ReceiveOffer remembers a file offer, and passes it to the streams
+func (s *Server) ReceiveOffer(offer network.FileOffer) {
+	o := makeOffer(offer)
+	s.add(Event{Kind: "offer", From: o.Sender, Nick: s.swarm.Nickname(offer.Sender), At: time.Now(), Offer: &o})
+}
+
+// ReceiveRingChange passes a change of our neighbors to the streams
+func (s *Server) ReceiveRingChange(change network.RingChange) {
+	ring := Ring{Predecessor: addrString(change.Predecessor), Successor: addrString(change.Successor)}
+	s.publish(Event{Kind: "ring", At: time.Now(), Ring: &ring})
+}
+
+// add remembers an event, and passes it to the streams
+func (s *Server) add(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(s.history, event)
+	if len(s.history) > s.size {
+		s.history = s.history[len(s.history)-s.size:]
+	}
+	s.broadcast(event)
+}
+
+// publish passes an event to the streams
+func (s *Server) publish(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.broadcast(event)
+}
+
+// broadcast passes an event to the streams, with the lock held
+//
+// A stream too slow to keep up is ended, rather than holding up the node,
+// or missing events without the client knowing.
+func (s *Server) broadcast(event Event) {
+	for stream := range s.streams {
+		select {
+		case stream.events <- event:
+		default:
+			stream.lagged = true
+			close(stream.events)
+			delete(s.streams, stream)
+		}
+	}
+}
+
+// tail returns the latest events, up to limit of them, with the lock held
+func (s *Server) tail(limit int) []Event {
+	start := len(s.history) - limit
+	if start < 0 {
+		start = 0
+	}
+	return append([]Event{}, s.history[start:]...)
+}
+
+// readLimit reads how many events a request wants from the history, defaulting to all of them
+func (s *Server) readLimit(r *http.Request, name string) (int, error) {
+	text := r.URL.Query().Get(name)
+	if text == "" {
+		return s.size, nil
+	}
+	n, err := strconv.Atoi(text)
+	if err != nil || n < 0 {
+		return 0, statusError{http.StatusBadRequest, fmt.Errorf("Invalid %s %q", name, text)}
+	}
+	return n, nil
+}
+
+// route makes a handler answering with the JSON of what f returns, for a single method
+func (s *Server) route(method string, f func(*http.Request) (interface{}, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeError(w, statusError{http.StatusMethodNotAllowed, fmt.Errorf("Expected %s, not %s", method, r.Method)})
+			return
+		}
+		result, err := f(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(statusError); ok {
+		status = e.status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// readBody decodes the JSON of a request into body
+//
+// The request has to say it's JSON, which a web page can't do without asking first.
+func readBody(r *http.Request, body interface{}) error {
+	if kind, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || kind != "application/json" {
+		return statusError{http.StatusUnsupportedMediaType, errors.New("Expected a Content-Type of application/json")}
+	}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		return statusError{http.StatusBadRequest, fmt.Errorf("Invalid request: %v", err)}
+	}
+	return nil
+}
+
+func (s *Server) send(r *http.Request) (interface{}, error) {
+	var body struct {
+		Content string `json:"content"`
+		Client  string `json:"client"`
+	}
+	if err := readBody(r, &body); err != nil {
+		return nil, err
+	}
+	if body.Content == "" {
+		return nil, statusError{http.StatusBadRequest, errors.New("Nothing to send")}
+	}
+	ref, err := s.swarm.SendMessage(body.Content)
+	if err != nil {
+		return nil, statusError{http.StatusBadGateway, fmt.Errorf("Couldn't send: %v", err)}
+	}
+	return s.addOwn(network.EventMessage, ref, body.Content, body.Client), nil
+}
+
+// addOwn remembers something we did, which never comes back to us like what others do
+func (s *Server) addOwn(kind network.EventKind, ref network.MessageRef, content, client string) Event {
+	event := Event{
+		Kind:    kindNames[kind],
+		Sender:  ref.Sender,
+		ID:      ref.ID,
+		From:    s.swarm.Addr().String(),
+		Nick:    s.swarm.Nickname(s.swarm.Addr()),
+		Content: content,
+		Own:     true,
+		Client:  client,
+		At:      time.Now(),
+	}
+	s.add(event)
+	return event
+}
+
+func (s *Server) nick(r *http.Request) (interface{}, error) {
+	var body struct {
+		Nick string `json:"nick"`
+	}
+	if err := readBody(r, &body); err != nil {
+		return nil, err
+	}
+	if body.Nick == "" {
+		return nil, statusError{http.StatusBadRequest, errors.New("No nickname given")}
+	}
+	if err := s.swarm.ChangeNickname(body.Nick); err != nil {
+		return nil, statusError{http.StatusBadGateway, fmt.Errorf("Couldn't change nickname: %v", err)}
+	}
+	return body, nil
+}
+
+// findAddr finds the address of one of our peers, or reads it otherwise
+func (s *Server) findAddr(text string) (net.Addr, error) {
+	for _, peer := range s.swarm.Peers() {
+		if peer.Addr.String() == text {
+			return peer.Addr, nil
+		}
+	}
+	addr, err := network.ParseAddr(text)
+	if err != nil {
+		return nil, statusError{http.StatusBadRequest, fmt.Errorf("Invalid address %q", text)}
+	}
+	return addr, nil
+}
+
+func (s *Server) direct(r *http.Request) (interface{}, error) {
+	var body struct {
+		To      string `json:"to"`
+		Content string `json:"content"`
+	}
+	if err := readBody(r, &body); err != nil {
+		return nil, err
+	}
+	addr, err := s.findAddr(body.To)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.swarm.SendDirect(addr, body.Content); err != nil {
+		return nil, statusError{http.StatusBadGateway, fmt.Errorf("Couldn't send: %v", err)}
+	}
+	return body, nil
+}
+
+// change is the body of edits, retractions and reactions
+type change struct {
+	// Sender is only needed for reactions, since we can only change our own messages
+	Sender  string `json:"sender"`
+	ID      uint64 `json:"id"`
+	Content string `json:"content"`
+	// Client is passed on to the Event, like with /send
+	Client string `json:"client"`
+}
+
+func (s *Server) edit(r *http.Request) (interface{}, error) {
+	var body change
+	if err := readBody(r, &body); err != nil {
+		return nil, err
+	}
+	if err := s.swarm.EditMessage(body.ID, body.Content); err != nil {
+		return nil, statusError{http.StatusBadGateway, fmt.Errorf("Couldn't send: %v", err)}
+	}
+	s.addOwn(network.EventEdit, network.MessageRef{Sender: s.swarm.Addr().String(), ID: body.ID}, body.Content, body.Client)
+	return body, nil
+}
+
+func (s *Server) retract(r *http.Request) (interface{}, error) {
+	var body change
+	if err := readBody(r, &body); err != nil {
+		return nil, err
+	}
+	if err := s.swarm.RetractMessage(body.ID); err != nil {
+		return nil, statusError{http.StatusBadGateway, fmt.Errorf("Couldn't send: %v", err)}
+	}
+	s.addOwn(network.EventRetract, network.MessageRef{Sender: s.swarm.Addr().String(), ID: body.ID}, body.Content, body.Client)
+	return body, nil
+}
+
+func (s *Server) react(r *http.Request) (interface{}, error) {
+	var body change
+	if err := readBody(r, &body); err != nil {
+		return nil, err
+	}
+	ref := network.MessageRef{Sender: body.Sender, ID: body.ID}
+	if err := s.swarm.React(ref, body.Content); err != nil {
+		return nil, statusError{http.StatusBadGateway, fmt.Errorf("Couldn't send: %v", err)}
+	}
+	s.addOwn(network.EventReact, ref, body.Content, body.Client)
+	return body, nil
+}
+
+func (s *Server) signal(r *http.Request) (interface{}, error) {
+	var body struct {
+		Signal network.Signal `json:"signal"`
+	}
+	if err := readBody(r, &body); err != nil {
+		return nil, err
+	}
+	switch body.Signal {
+	case network.SignalTyping, network.SignalAway, network.SignalIdle:
+	default:
+		return nil, statusError{http.StatusBadRequest, fmt.Errorf("Unknown signal %q", body.Signal)}
+	}
+	if err := s.swarm.SendSignal(body.Signal); err != nil {
+		return nil, statusError{http.StatusBadGateway, fmt.Errorf("Couldn't send: %v", err)}
+	}
+	return body, nil
+}
+
+func (s *Server) signals(*http.Request) (interface{}, error) {
+	signals := []Signal{}
+	for _, signal := range s.swarm.ActiveSignals() {
+		signals = append(signals, Signal{
+			From:    addrString(signal.From),
+			Nick:    signal.Nick,
+			Signal:  string(signal.Signal),
+			Expires: signal.Expires,
+		})
+	}
+	return signals, nil
+}
+
+func (s *Server) offer(r *http.Request) (interface{}, error) {
+	var body struct {
+		Path string `json:"path"`
+	}
+	if err := readBody(r, &body); err != nil {
+		return nil, err
+	}
+	offer, err := s.swarm.OfferFile(body.Path)
+	if err != nil {
+		return nil, statusError{http.StatusBadRequest, fmt.Errorf("Couldn't offer file: %v", err)}
+	}
+	return makeOffer(offer), nil
+}
+
+func (s *Server) offers(*http.Request) (interface{}, error) {
+	offers := []Offer{}
+	for _, offer := range s.swarm.FileOffers() {
+		offers = append(offers, makeOffer(offer))
+	}
+	return offers, nil
+}
+
+// get downloads a file, answering once it's saved
+func (s *Server) get(r *http.Request) (interface{}, error) {
+	var body struct {
+		ID  string `json:"id"`
+		Dir string `json:"dir"`
+	}
+	if err := readBody(r, &body); err != nil {
+		return nil, err
+	}
+	path, err := s.swarm.GetFile(body.ID, body.Dir, nil)
+	if err != nil {
+		return nil, statusError{http.StatusBadGateway, fmt.Errorf("Couldn't get file: %v", err)}
+	}
+	return map[string]string{"path": path}, nil
+}
+
+func (s *Server) peers(*http.Request) (interface{}, error) {
+	peers := []Peer{}
+	for _, peer := range s.swarm.Peers() {
+		p := Peer{Addr: peer.Addr.String(), Nick: peer.Nick, Linked: peer.Linked, Online: peer.Online, Away: peer.Away}
+		if !peer.LastSeen.IsZero() {
+			seen := peer.LastSeen
+			p.LastSeen = &seen
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// addrStrings turns addresses into strings, giving an empty list rather than null
+func addrStrings(addrs []net.Addr) []string {
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		out = append(out, addr.String())
+	}
+	return out
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func (s *Server) topology(*http.Request) (interface{}, error) {
+	topology := Topology{
+		Addr:        addrString(s.swarm.Addr()),
+		ListenAddr:  addrString(s.swarm.ListenAddr()),
+		Nick:        s.swarm.Nickname(s.swarm.Addr()),
+		ID:          s.swarm.ID().String(),
+		Predecessor: addrString(s.swarm.Predecessor()),
+		Successor:   addrString(s.swarm.Successor()),
+		SwarmSize:   s.swarm.SwarmSize(),
+		Chords:      addrStrings(s.swarm.Chords()),
+		Fingers:     addrStrings(s.swarm.Fingers()),
+		Queues:      []Queue{},
+	}
+	for _, q := range s.swarm.QueueStats() {
+		topology.Queues = append(topology.Queues, Queue{
+			Addr:     addrString(q.Addr),
+			Role:     q.Role,
+			Depth:    q.Depth,
+			MaxDepth: q.MaxDepth,
+			Sent:     q.Sent,
+			Dropped:  q.Dropped,
+		})
+	}
+	return topology, nil
+}
+
+func (s *Server) recent(r *http.Request) (interface{}, error) {
+	limit, err := s.readLimit(r, "limit")
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tail(limit), nil
+}
+
+// events streams every event from now on, a line of JSON each, until the client leaves
+//
+// With ?history=N, the latest N events of the history come first, without
+// missing or repeating any event in between.
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, statusError{http.StatusMethodNotAllowed, fmt.Errorf("Expected GET, not %s", r.Method)})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errors.New("Streaming isn't supported here"))
+		return
+	}
+	limit := 0
+	if r.URL.Query().Get("history") != "" {
+		var err error
+		if limit, err = s.readLimit(r, "history"); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	stream := &eventStream{events: make(chan Event, streamBuffer)}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		writeError(w, statusError{http.StatusServiceUnavailable, errors.New("The server is closed")})
+		return
+	}
+	s.streams[stream] = true
+	history := s.tail(limit)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.streams, stream)
+	}()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	encoder := json.NewEncoder(w)
+	for _, event := range history {
+		if err := encoder.Encode(event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case event, ok := <-stream.events:
+			if !ok {
+				s.mu.Lock()
+				lagged := stream.lagged
+				s.mu.Unlock()
+				if lagged {
+					encoder.Encode(Event{Kind: "lagged", At: time.Now(), Content: errLagged.Error()})
+					flusher.Flush()
+				}
+				return
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
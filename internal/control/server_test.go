@@ -0,0 +1,447 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/network"
+)
+
+// makePair starts a swarm of two nodes in memory
+func makePair(t *testing.T) (*network.SwarmHandle, *network.SwarmHandle) {
+	transport := network.NewMemoryTransport()
+	first := network.Config{Transport: transport, ListenAddr: network.MemoryAddr("first")}
+	second := network.Config{Transport: transport, ListenAddr: network.MemoryAddr("second")}
+	created := make(chan *network.SwarmHandle)
+	go func() {
+		swarm, err := network.CreateSwarm(first)
+		if err != nil {
+			t.Errorf("Failed to create swarm: %v", err)
+		}
+		created <- swarm
+	}()
+	var joined *network.SwarmHandle
+	var err error
+	// the first node might not be listening yet
+	for i := 0; i < 100; i++ {
+		if joined, err = network.JoinSwarm(second, first.ListenAddr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to join swarm: %v", err)
+	}
+	return <-created, joined
+}
+
+// call makes a request to a server, decoding the JSON it answers with into result
+func call(t *testing.T, server *httptest.Server, method, path, body string, result interface{}) int {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer res.Body.Close()
+	if result != nil {
+		if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	return res.StatusCode
+}
+
+func TestSendAndHistory(t *testing.T) {
+	swarm, other := makePair(t)
+	server := NewServer(swarm, 2)
+	defer server.Close()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	watcher := NewServer(other, DefaultHistory)
+	defer watcher.Close()
+	wts := httptest.NewServer(watcher)
+	defer wts.Close()
+
+	for _, content := range []string{"one", "two", "three"} {
+		var sent Event
+		if status := call(t, ts, "POST", "/send", `{"content": "`+content+`"}`, &sent); status != 200 {
+			t.Fatalf("Expected 200 got %d", status)
+		}
+		if sent.Content != content || !sent.Own || sent.ID == 0 {
+			t.Errorf("Unexpected event %v", sent)
+		}
+	}
+	var history []Event
+	call(t, ts, "GET", "/history", "", &history)
+	if len(history) != 2 || history[0].Content != "two" || history[1].Content != "three" {
+		t.Errorf("Expected the last 2 messages got %v", history)
+	}
+	call(t, ts, "GET", "/history?limit=1", "", &history)
+	if len(history) != 1 || history[0].Content != "three" {
+		t.Errorf("Expected the last message got %v", history)
+	}
+	// the other node keeps the messages it received
+	var received []Event
+	for deadline := time.Now().Add(5 * time.Second); len(received) < 3 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		call(t, wts, "GET", "/history", "", &received)
+	}
+	if len(received) != 3 || received[0].Own || received[0].From != swarm.Addr().String() {
+		t.Errorf("Expected the messages to arrive got %v", received)
+	}
+}
+
+func TestEventsAreStreamed(t *testing.T) {
+	swarm, other := makePair(t)
+	server := NewServer(swarm, DefaultHistory)
+	defer server.Close()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer res.Body.Close()
+	if err := other.ChangeNickname("bob"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// the nickname needs to arrive before the message for it to be used
+	time.Sleep(50 * time.Millisecond)
+	ref, err := other.SendMessage("hello")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := other.React(ref, "👍"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	lines := bufio.NewScanner(res.Body)
+	expected := []Event{
+		{Kind: "message", Sender: ref.Sender, ID: ref.ID, From: ref.Sender, Nick: "bob", Content: "hello"},
+		{Kind: "react", Sender: ref.Sender, ID: ref.ID, From: ref.Sender, Nick: "bob", Content: "👍"},
+	}
+	for _, e := range expected {
+		if !lines.Scan() {
+			t.Fatalf("Expected an event got %v", lines.Err())
+		}
+		var event Event
+		if err := json.Unmarshal(lines.Bytes(), &event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		event.At = time.Time{}
+		if event != e {
+			t.Errorf("Expected %v got %v", e, event)
+		}
+	}
+}
+
+func TestLaggingStreamsEnd(t *testing.T) {
+	swarm, _ := makePair(t)
+	server := NewServer(swarm, DefaultHistory)
+	defer server.Close()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	client := &Client{long: ts.Client(), base: ts.URL, ctx: context.Background()}
+	var events []Event
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Events(0, func(event Event) { events = append(events, event) })
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		server.mu.Lock()
+		streams := len(server.streams)
+		server.mu.Unlock()
+		if streams == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the stream to start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the events come faster than they can be written out
+	server.mu.Lock()
+	for i := 0; i < 100*streamBuffer; i++ {
+		server.broadcast(Event{Kind: "ring", Content: strconv.Itoa(i)})
+	}
+	server.mu.Unlock()
+	select {
+	case err := <-done:
+		if err != errLagged {
+			t.Errorf("Expected %v got %v", errLagged, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the stream to end")
+	}
+	last := len(events) - 1
+	if last < 0 || events[last].Kind != "lagged" {
+		t.Fatalf("Expected the last event to be lagged got %v", events)
+	}
+	// everything before it arrived in order
+	for i, event := range events[:last] {
+		if event.Content != strconv.Itoa(i) {
+			t.Fatalf("Expected event %d got %v", i, event)
+		}
+	}
+	if last < streamBuffer || last >= 100*streamBuffer {
+		t.Errorf("Expected some events to be missed got %d", last)
+	}
+	server.mu.Lock()
+	if len(server.streams) != 0 {
+		t.Errorf("Expected the stream to be forgotten")
+	}
+	server.mu.Unlock()
+}
+
+func TestPeersAndTopology(t *testing.T) {
+	swarm, other := makePair(t)
+	server := NewServer(swarm, DefaultHistory)
+	defer server.Close()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	if status := call(t, ts, "POST", "/nick", `{"nick": "alice"}`, nil); status != 200 {
+		t.Errorf("Expected 200 got %d", status)
+	}
+	var topology Topology
+	call(t, ts, "GET", "/topology", "", &topology)
+	if topology.Nick != "alice" || topology.Addr != "first" {
+		t.Errorf("Unexpected topology %v", topology)
+	}
+	if topology.Predecessor != "second" || topology.Successor != "second" {
+		t.Errorf("Expected the other node on both sides got %v", topology)
+	}
+	var peers []Peer
+	call(t, ts, "GET", "/peers", "", &peers)
+	if len(peers) != 1 || peers[0].Addr != other.Addr().String() || !peers[0].Linked {
+		t.Errorf("Expected the other node got %v", peers)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	swarm, _ := makePair(t)
+	server := NewServer(swarm, DefaultHistory)
+	defer server.Close()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	requests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"GET", "/send", "", 405},
+		{"POST", "/send", "{}", 400},
+		{"POST", "/send", "not json", 400},
+		{"POST", "/nick", `{"nick": ""}`, 400},
+		{"POST", "/peers", "", 405},
+		{"GET", "/history?limit=many", "", 400},
+	}
+	for _, r := range requests {
+		var answer map[string]string
+		if status := call(t, ts, r.method, r.path, r.body, &answer); status != r.status {
+			t.Errorf("Expected %d for %s %s got %d", r.status, r.method, r.path, status)
+		}
+		if answer["error"] == "" {
+			t.Errorf("Expected an error for %s %s", r.method, r.path)
+		}
+	}
+}
+
+func TestRefusedRequests(t *testing.T) {
+	swarm, _ := makePair(t)
+	server := NewServer(swarm, DefaultHistory)
+	defer server.Close()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	requests := []struct {
+		method, path, body string
+		host, origin, kind string
+		status             int
+	}{
+		// web pages can reach loopback addresses, but can't say where they come from
+		{"GET", "/peers", "", "", "http://evil.example", "", 403},
+		{"POST", "/send", `{"content": "hi"}`, "", "null", "application/json", 403},
+		// nor can they pick the Host, if they point a name of their own at us
+		{"GET", "/peers", "", "evil.example", "", "", 403},
+		{"GET", "/peers", "", "localhost:7070", "", "", 403},
+		{"GET", "/peers", "", "127.0.0.1.evil.example", "", "", 403},
+		{"GET", "/peers", "", "[::1]:7070", "", "", 200},
+		// and they can't send JSON without asking first
+		{"POST", "/send", `{"content": "hi"}`, "", "", "", 415},
+		{"POST", "/send", `{"content": "hi"}`, "", "", "text/plain", 415},
+		{"POST", "/nick", `{"nick": "eve"}`, "", "", "application/x-www-form-urlencoded", 415},
+		{"POST", "/send", `{"content": "hi"}`, "", "", "application/json; charset=utf-8", 200},
+	}
+	for _, r := range requests {
+		req, err := http.NewRequest(r.method, ts.URL+r.path, strings.NewReader(r.body))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if r.host != "" {
+			req.Host = r.host
+		}
+		if r.origin != "" {
+			req.Header.Set("Origin", r.origin)
+		}
+		if r.kind != "" {
+			req.Header.Set("Content-Type", r.kind)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != r.status {
+			t.Errorf("Expected %d for %s %s from %q at %q as %q got %d", r.status, r.method, r.path, r.origin, r.host, r.kind, res.StatusCode)
+		}
+	}
+	if nick := swarm.Nickname(swarm.Addr()); nick == "eve" {
+		t.Errorf("Expected the nickname to stay the same")
+	}
+}
+
+func TestLoopbackToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ripple")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	swarm, _ := makePair(t)
+	server := NewServer(swarm, DefaultHistory)
+	defer server.Close()
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer l.Close()
+	go server.Serve(l)
+
+	path := tokenPath(l.Addr().(*net.TCPAddr))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Mode().Perm() != 0600 || filepath.Dir(path) != dir {
+		t.Errorf("Expected a token only we can read next to the socket got %v at %s", info.Mode(), path)
+	}
+	for _, auth := range []string{"", "Bearer wrong", "Bearer "} {
+		req, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/peers", nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 401 {
+			t.Errorf("Expected 401 with %q got %d", auth, res.StatusCode)
+		}
+	}
+	client, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := client.SendMessage("with the token"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the token to be removed got %v", err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ripple")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	if _, err := Listen("0.0.0.0:0"); err == nil {
+		t.Errorf("Expected listening on every interface to be refused")
+	}
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	l.Close()
+
+	path := filepath.Join(dir, "control.sock")
+	l, err = Listen(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if l.Addr().String() != path {
+		t.Errorf("Expected %s got %s", path, l.Addr())
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected a socket only we can use got %v", info.Mode())
+	}
+	// the directory the socket was made in is gone
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the socket in %s got %d entries", dir, len(entries))
+	}
+	go http.Serve(l, http.NotFoundHandler())
+	if _, err := Listen("unix:" + path); err == nil {
+		t.Errorf("Expected a socket in use to be refused")
+	}
+	l.Close()
+	// a socket left behind gets replaced
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	l, err = Listen(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed got %v", err)
+	}
+}
+
+func TestChatEvent(t *testing.T) {
+	event := Event{Kind: "react", Sender: "first", ID: 3, From: "second", Nick: "bob", Content: "👍"}
+	chat, ok := event.ChatEvent()
+	expected := network.ChatEvent{
+		Kind:    network.EventReact,
+		Message: network.MessageRef{Sender: "first", ID: 3},
+		From:    remoteAddr("second"),
+		Nick:    "bob",
+		Content: "👍",
+	}
+	if !ok || chat != expected {
+		t.Errorf("Expected %v got %v", expected, chat)
+	}
+	if _, ok := (Event{Kind: "ring"}).ChatEvent(); ok {
+		t.Errorf("Expected a ring event not to be a chat event")
+	}
+}
@@ -0,0 +1,455 @@
+package network
+
+import (
+	"fmt"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+const (
+	// maxChordLevels bounds how many chord links we keep, enough for 65536 nodes
+	maxChordLevels = 16
+	// maxSeenCasts bounds how many tree broadcasts we remember, to ignore duplicates
+	maxSeenCasts = 4096
+	// censusTimeout is how long we wait for a census before starting another
+	censusTimeout = 30 * time.Second
+)
+
+// ChordConfig controls the extra links a node keeps to broadcast faster
+//
+// Around the ring, a broadcast takes as many hops as there are nodes.
+// With chord links to the nodes 1, 2, 4, 8... hops after us, a broadcast
+// can instead go down a spanning tree, reaching every node in a logarithmic
+// number of hops. The ring is used whenever the links aren't ready.
+type ChordConfig struct {
+	// Enabled makes us keep chord links, and start broadcasts over them
+	//
+	// Nodes without this still pass along the broadcasts started by others.
+	Enabled bool
+	// Interval is how often we count the swarm and refresh our links
+	//
+	// This defaults to 10 seconds, and a negative interval leaves refreshing
+	// up to SwarmHandle.RefreshChords.
+	Interval time.Duration
+	// tracer is told how broadcasts reach us, if set with TraceBroadcasts
+	tracer Tracer
+}
+
+// Tracer is told how each broadcast reaches a node, which simulations measure
+type Tracer interface {
+	// Hops is called with the number of hops a broadcast took over the tree
+	Hops(origin net.Addr, hops int)
+	// PassedBy is called with the node that passed us a broadcast around the ring
+	PassedBy(origin, from net.Addr)
+}
+
+// TraceBroadcasts makes the nodes using config report their broadcasts to tracer
+//
+// This is meant for simulations, rather than the nodes people run.
+func TraceBroadcasts(config ChordConfig, tracer Tracer) ChordConfig {
+	config.tracer = tracer
+	return config
+}
+
+func (config ChordConfig) withDefaults() ChordConfig {
+	if config.Interval == 0 {
+		config.Interval = 10 * time.Second
+	}
+	return config
+}
+
+// levelsFor returns how many chord links are useful in a swarm of some size
+func levelsFor(size int) int {
+	if size < 2 {
+		return 0
+	}
+	return bits.Len(uint(size - 1))
+}
+
+// castCoverage remembers what part of the swarm we've passed a broadcast to
+type castCoverage struct {
+	budget uint32
+	// limits are those we've been given, as strings
+	limits []string
+}
+
+// covers checks if a broadcast reaching us again would add nothing
+func (coverage castCoverage) covers(cast protocol.TreeCast) bool {
+	if cast.Budget > coverage.budget {
+		return false
+	}
+	limit := cast.Limit.String()
+	for _, l := range coverage.limits {
+		if l == limit {
+			return true
+		}
+	}
+	return false
+}
+
+// chordState holds our chord links, and what we know about the swarm
+type chordState struct {
+	mu sync.Mutex
+	// links[k] is the node 2^k hops after us, links[0] being our Successor
+	links []net.Addr
+	// conns are the connections we opened to our links, by address
+	conns map[string]*outbox
+	// size is how many nodes were in the ring at our last census
+	size int
+	// censusAt is when the census we're waiting for started, if any
+	censusAt time.Time
+	// seq numbers the broadcasts we start
+	seq uint64
+	// seen holds the broadcasts we've received, with order giving their age
+	seen  map[string]castCoverage
+	order []string
+}
+
+func makeChordState() *chordState {
+	return &chordState{
+		conns: make(map[string]*outbox),
+		seen:  make(map[string]castCoverage),
+	}
+}
+
+// getLinks is thread safe
+func (chords *chordState) getLinks() []net.Addr {
+	chords.mu.Lock()
+	defer chords.mu.Unlock()
+	return append([]net.Addr{}, chords.links...)
+}
+
+// getSize is thread safe
+func (chords *chordState) getSize() int {
+	chords.mu.Lock()
+	defer chords.mu.Unlock()
+	return chords.size
+}
+
+// conn returns the connection to one of our links, if it's still usable
+func (chords *chordState) conn(addr net.Addr) *outbox {
+	chords.mu.Lock()
+	defer chords.mu.Unlock()
+	out := chords.conns[addr.String()]
+	if out == nil || !out.usable() {
+		return nil
+	}
+	return out
+}
+
+// receive records a broadcast, and reports if it's new, or covers more of the swarm
+//
+// A broadcast can reach us more than once when the swarm changed since
+// the tree was built. We only pass it along again if we might now be
+// responsible for more nodes than before.
+func (chords *chordState) receive(cast protocol.TreeCast) (first bool, wider bool) {
+	key := fmt.Sprintf("%s/%s/%d", cast.Origin.Network(), cast.Origin, cast.Seq)
+	chords.mu.Lock()
+	defer chords.mu.Unlock()
+	prev, ok := chords.seen[key]
+	if !ok {
+		if len(chords.order) >= maxSeenCasts {
+			delete(chords.seen, chords.order[0])
+			chords.order = chords.order[1:]
+		}
+		chords.order = append(chords.order, key)
+	} else if prev.covers(cast) {
+		return false, false
+	}
+	if cast.Budget > prev.budget {
+		prev.budget = cast.Budget
+	}
+	prev.limits = append(prev.limits, cast.Limit.String())
+	chords.seen[key] = prev
+	return !ok, true
+}
+
+// start creates a broadcast covering the whole swarm, if our links allow it
+func (chords *chordState) start(me net.Addr, msg protocol.Message) (protocol.TreeCast, bool) {
+	chords.mu.Lock()
+	defer chords.mu.Unlock()
+	if chords.size < 2 || len(chords.links) < levelsFor(chords.size) {
+		return protocol.TreeCast{}, false
+	}
+	chords.seq++
+	cast := protocol.TreeCast{
+		Origin:  me,
+		Seq:     chords.seq,
+		Budget:  uint32(chords.size - 1),
+		Limit:   me,
+		Payload: msg,
+	}
+	return cast, true
+}
+
+// chordLoop refreshes our links every so often
+func (client *normalClient) chordLoop() {
+	if client.chordConfig.Interval < 0 {
+		return
+	}
+	for {
+		if err := client.census(); err != nil {
+			client.log.Println("Couldn't count the swarm ", err)
+		}
+		time.Sleep(client.chordConfig.Interval / 2)
+		client.refreshLinks()
+		time.Sleep(client.chordConfig.Interval / 2)
+	}
+}
+
+// census sends a Census around the ring, unless one is already going around
+//
+// A census that never comes back, because the ring broke, is given up on
+// after censusTimeout.
+func (client *normalClient) census() error {
+	chords := client.chords
+	chords.mu.Lock()
+	if !chords.censusAt.IsZero() && time.Since(chords.censusAt) < censusTimeout {
+		chords.mu.Unlock()
+		return nil
+	}
+	chords.censusAt = time.Now()
+	chords.mu.Unlock()
+	census := protocol.Census{Origin: client.advertisedAddr, Count: 1}
+	if err := client.state.getSucc().out.broadcast(census); err != nil {
+		chords.mu.Lock()
+		chords.censusAt = time.Time{}
+		chords.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// HandleCensus counts ourselves, or learns the size of the swarm if we started it
+func (client *originClient) HandleCensus(msg protocol.Census) error {
+	if !isPredRole(client.origin) {
+		return fmt.Errorf(
+			"Unexpected Census %v %s",
+			msg,
+			client.fmtOrigin(),
+		)
+	}
+	under := client.under
+	if sameAddr(under.advertisedAddr, msg.Origin) {
+		under.chords.mu.Lock()
+		under.chords.size = int(msg.Count)
+		under.chords.censusAt = time.Time{}
+		under.chords.mu.Unlock()
+		return nil
+	}
+	msg.Count++
+	return under.state.getSucc().out.broadcast(msg)
+}
+
+// refreshLinks finds our chord links again, and connects to them
+//
+// The link 2^(k+1) hops after us is the link 2^k hops after our link at level k.
+func (client *normalClient) refreshLinks() {
+	me := client.advertisedAddr
+	levels := levelsFor(client.chords.getSize())
+	if levels == 0 {
+		levels = maxChordLevels
+	}
+	links := []net.Addr{client.state.getSucc().addr}
+	for level := 1; level < levels; level++ {
+		addr, err := client.queryLink(links[level-1], level-1)
+		if err != nil {
+			client.log.Println("Couldn't find chord link ", err)
+			break
+		}
+		if addr == nil || sameAddr(addr, me) {
+			break
+		}
+		links = append(links, addr)
+	}
+	conns := make(map[string]*outbox)
+	for _, addr := range links[1:] {
+		key := addr.String()
+		if out := client.chords.conn(addr); out != nil {
+			conns[key] = out
+			continue
+		}
+		if _, ok := conns[key]; ok {
+			continue
+		}
+		out, err := client.openLink(addr)
+		if err != nil {
+			client.log.Println("Couldn't open chord link ", err)
+			continue
+		}
+		conns[key] = out
+	}
+	client.chords.mu.Lock()
+	old := client.chords.conns
+	client.chords.links = links
+	client.chords.conns = conns
+	client.chords.mu.Unlock()
+	for key, out := range old {
+		if conns[key] != out {
+			out.close()
+		}
+	}
+}
+
+// queryLink asks a node for its link at some level
+func (client *normalClient) queryLink(addr net.Addr, level int) (net.Addr, error) {
+	if sameAddr(addr, client.advertisedAddr) {
+		return client.link(level), nil
+	}
+	msg, err := client.dialer().query(addr, protocol.LinkQuery{Level: uint8(level)})
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := msg.(protocol.LinkReply)
+	if !ok || int(reply.Level) != level {
+		return nil, fmt.Errorf("Unexpected answer to LinkQuery from %v: %v", addr, msg)
+	}
+	return reply.Addr, nil
+}
+
+// link returns our link at some level, or nil if we don't have one
+func (client *normalClient) link(level int) net.Addr {
+	if level == 0 {
+		return client.state.getSucc().addr
+	}
+	links := client.chords.getLinks()
+	if level >= len(links) {
+		return nil
+	}
+	return links[level]
+}
+
+// openLink connects to a node we'll send tree broadcasts to
+func (client *normalClient) openLink(addr net.Addr) (*outbox, error) {
+	conn, _, session, err := client.dialer().dial(addr, protocol.FeatureChords)
+	if err != nil {
+		return nil, err
+	}
+	if err := sendMessage(conn, protocol.OpenLink{Addr: client.advertisedAddr}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newOutbox(conn, session, client.queue, client.log), nil
+}
+
+// linkLoop reads the broadcasts arriving over a link another node opened to us
+func (client *normalClient) linkLoop(conn net.Conn, in *protocol.Decoder, open protocol.OpenLink) {
+	defer conn.Close()
+	for {
+		msg, err := in.Decode()
+		if err != nil {
+			client.log.Printf("Lost chord link from %v: %v\n", open.Addr, err)
+			return
+		}
+		if _, ok := msg.(protocol.TreeCast); !ok {
+			client.log.Printf("Unexpected %T over chord link from %v\n", msg, open.Addr)
+			return
+		}
+		client.pool.messages <- originMessage{origin: linkRole, msg: msg}
+	}
+}
+
+// broadcast sends a message to the whole swarm, over the tree if we can
+func (client *normalClient) broadcast(msg protocol.Message) error {
+	if client.chordConfig.Enabled {
+		if cast, ok := client.chords.start(client.advertisedAddr, msg); ok {
+			return client.forwardCast(cast)
+		}
+	}
+	return client.state.getSucc().out.broadcast(msg)
+}
+
+// traceRing reports a broadcast reaching us around the ring, from our predecessor
+func (client *normalClient) traceRing(origin net.Addr) {
+	if client.chordConfig.tracer != nil {
+		client.chordConfig.tracer.PassedBy(origin, client.state.getPred().addr)
+	}
+}
+
+// forwardCast splits the nodes we're responsible for between our links
+//
+// The link 2^k hops after us takes care of the nodes up to our next link,
+// with our furthest link taking care of everything past it. If the ring grew
+// since the tree was built, the end of each part walks the ring up to its limit.
+func (client *normalClient) forwardCast(cast protocol.TreeCast) error {
+	links := client.chords.getLinks()
+	succ := client.state.getSucc()
+	if len(links) == 0 {
+		links = []net.Addr{succ.addr}
+	}
+	links[0] = succ.addr
+	hops := cast.Hops
+	if hops < 0xffff {
+		hops++
+	}
+	budget := int(cast.Budget)
+	var firstErr error
+	send := func(out *outbox, child protocol.TreeCast) {
+		if err := out.broadcast(child); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for level := 0; level < len(links) && 1<<uint(level) <= budget; level++ {
+		if sameAddr(links[level], cast.Limit) {
+			// the ring shrank, and the rest belongs to someone else
+			break
+		}
+		start := 1 << uint(level)
+		end := 2*start - 1
+		child := cast
+		child.Hops = hops
+		if end >= budget || level == len(links)-1 {
+			end = budget
+		} else {
+			child.Limit = links[level+1]
+		}
+		child.Budget = uint32(end - start)
+		out := succ.out
+		if level > 0 {
+			out = client.chords.conn(links[level])
+		}
+		if out == nil || out.broadcast(child) != nil {
+			// our Successor can take care of this part instead, if more slowly
+			child.Budget = uint32(end - 1)
+			send(succ.out, child)
+		}
+	}
+	if budget == 0 && !sameAddr(succ.addr, cast.Limit) {
+		child := cast
+		child.Hops = hops
+		send(succ.out, child)
+	}
+	return firstErr
+}
+
+// HandleTreeCast delivers a broadcast to us, and passes it down the tree
+func (client *originClient) HandleTreeCast(msg protocol.TreeCast) error {
+	if !isPredRole(client.origin) && client.origin != linkRole {
+		return fmt.Errorf(
+			"Unexpected TreeCast %v %s",
+			msg,
+			client.fmtOrigin(),
+		)
+	}
+	under := client.under
+	if sameAddr(under.advertisedAddr, msg.Origin) {
+		return nil
+	}
+	first, wider := under.chords.receive(msg)
+	if first {
+		if !under.deliver(msg.Payload) {
+			return nil
+		}
+		if under.chordConfig.tracer != nil {
+			under.chordConfig.tracer.Hops(msg.Origin, int(msg.Hops))
+		}
+	}
+	if !wider {
+		return nil
+	}
+	return under.forwardCast(msg)
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+func TestLevelsFor(t *testing.T) {
+	for size, expected := range map[int]int{0: 0, 1: 0, 2: 1, 3: 2, 4: 2, 5: 3, 8: 3, 9: 4, 1000: 10} {
+		if got := levelsFor(size); got != expected {
+			t.Errorf("Expected %d levels for %d nodes got %d", expected, size, got)
+		}
+	}
+}
+
+func TestChordStateIgnoresDuplicates(t *testing.T) {
+	chords := makeChordState()
+	origin := MemoryAddr("origin")
+	cast := protocol.TreeCast{Origin: origin, Seq: 1, Budget: 3, Limit: MemoryAddr("limit")}
+	if first, wider := chords.receive(cast); !first || !wider {
+		t.Errorf("Expected a new broadcast to be passed along")
+	}
+	if first, wider := chords.receive(cast); first || wider {
+		t.Errorf("Expected the same broadcast to be ignored")
+	}
+	cast.Budget = 1
+	if _, wider := chords.receive(cast); wider {
+		t.Errorf("Expected a smaller part of the swarm to be ignored")
+	}
+	cast.Budget = 7
+	if first, wider := chords.receive(cast); first || !wider {
+		t.Errorf("Expected a larger part of the swarm to be passed along, but not delivered")
+	}
+	cast.Budget, cast.Limit = 0, origin
+	if _, wider := chords.receive(cast); !wider {
+		t.Errorf("Expected a new limit to be passed along")
+	}
+	cast.Seq = 2
+	if first, _ := chords.receive(cast); !first {
+		t.Errorf("Expected another broadcast from the same origin to be delivered")
+	}
+}
+
+// hopTracer passes along the hops each broadcast took over the tree
+type hopTracer chan int
+
+func (tracer hopTracer) Hops(origin net.Addr, hops int) {
+	tracer <- hops
+}
+
+func (tracer hopTracer) PassedBy(origin, from net.Addr) {}
+
+func TestChordBroadcastReachesEveryone(t *testing.T) {
+	transport := NewMemoryTransport()
+	addrs := memoryAddrs(8)
+	hops := make(chan int, 2*len(addrs))
+	configs := make([]Config, len(addrs))
+	for i, addr := range addrs {
+		configs[i] = Config{Transport: transport, ListenAddr: addr, Chords: ChordConfig{
+			Enabled:  true,
+			Interval: -1,
+			tracer:   hopTracer(hops),
+		}}
+	}
+	swarms := makeSwarmWith(t, configs)
+	waitFor(t, "chord links", func() bool {
+		for _, swarm := range swarms {
+			swarm.RefreshChords()
+		}
+		for _, swarm := range swarms {
+			if swarm.SwarmSize() != len(swarms) || len(swarm.Chords()) != 3 {
+				return false
+			}
+		}
+		return true
+	})
+	checkBroadcast(t, swarms, 3)
+	for i := 0; i < len(swarms)-1; i++ {
+		if h := <-hops; h < 1 || h > 3 {
+			t.Errorf("Expected 1 to 3 hops got %d", h)
+		}
+	}
+	select {
+	case h := <-hops:
+		t.Errorf("Expected the broadcast once per node, got another after %d hops", h)
+	default:
+	}
+}
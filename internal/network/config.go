@@ -0,0 +1,82 @@
+package network
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+// Config holds what a node needs to know to start or join a swarm
+type Config struct {
+	// Log receives information about what the node is doing
+	//
+	// Nothing is logged if this is nil.
+	Log *log.Logger
+	// Transport is used to make and accept connections
+	//
+	// This defaults to NetTransport.
+	Transport Transport
+	// ListenAddr is the address we accept connections on
+	ListenAddr net.Addr
+	// AdvertiseAddr is the address other peers use to contact us
+	//
+	// This defaults to ListenAddr, but needs to be different when
+	// listening on all interfaces, like 0.0.0.0:8080, or when another
+	// port is mapped to ours, like with Docker.
+	AdvertiseAddr net.Addr
+	// Queue controls the queue of messages waiting to be sent to each peer
+	Queue QueueConfig
+	// Limits bounds the size of messages, defaulting to protocol.DefaultLimits
+	//
+	// Every node in a swarm should use the same limits, since a peer
+	// sending a message over our limits gets disconnected.
+	Limits protocol.Limits
+	// NoCompression stops us from offering to compress messages with our peers
+	NoCompression bool
+	// Chords controls the extra links used to broadcast faster than the ring
+	Chords ChordConfig
+	// Fingers controls the finger table used to look up nodes by ID
+	Fingers FingerConfig
+}
+
+// isUnspecified checks if an address means "all interfaces"
+func isUnspecified(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && (tcp.IP == nil || tcp.IP.IsUnspecified())
+}
+
+// withDefaults fills in the missing parts of a config
+func (config Config) withDefaults() (Config, error) {
+	if config.Log == nil {
+		config.Log = log.New(ioutil.Discard, "", 0)
+	}
+	if config.Transport == nil {
+		config.Transport = NetTransport{}
+	}
+	config.Queue = config.Queue.withDefaults()
+	config.Chords = config.Chords.withDefaults()
+	config.Fingers = config.Fingers.withDefaults()
+
+	if config.ListenAddr == nil {
+		return config, errors.New("No address to listen on")
+	}
+	if config.AdvertiseAddr == nil {
+		if isUnspecified(config.ListenAddr) {
+			return config, errors.New("Can't advertise an unspecified address, we need an explicit one")
+		}
+		config.AdvertiseAddr = config.ListenAddr
+	}
+	return config, nil
+}
+
+// hello is what we tell peers we support during the handshake
+func (config Config) hello() protocol.Hello {
+	hello := protocol.LocalHello()
+	if config.NoCompression {
+		hello.Features &^= protocol.FeatureCompression
+	}
+	return hello
+}
@@ -0,0 +1,114 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	listen := MemoryAddr("listen")
+	config, err := Config{ListenAddr: listen}.withDefaults()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.AdvertiseAddr != listen {
+		t.Errorf("Expected to advertise %v got %v", listen, config.AdvertiseAddr)
+	}
+	if _, ok := config.Transport.(NetTransport); !ok {
+		t.Errorf("Expected NetTransport by default got %T", config.Transport)
+	}
+	if config.Log == nil {
+		t.Errorf("Expected a default logger")
+	}
+	if _, err := (Config{}).withDefaults(); err == nil {
+		t.Errorf("Expected a config without listen address to be rejected")
+	}
+	unspecified := &net.TCPAddr{IP: net.IPv4zero, Port: 8080}
+	if _, err := (Config{ListenAddr: unspecified}).withDefaults(); err == nil {
+		t.Errorf("Expected an unspecified address to need an advertised one")
+	}
+}
+
+// TestAdvertiseAddr has every node listen on all interfaces,
+// while advertising the loopback address.
+func TestAdvertiseAddr(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Loopback unavailable: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	configs := make([]Config, 3)
+	for i := range configs {
+		listen, err := ParseAddr(fmt.Sprintf("0.0.0.0:%d", port+i))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		advertise, err := ParseAddr(fmt.Sprintf("127.0.0.1:%d", port+i))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		configs[i] = Config{ListenAddr: listen, AdvertiseAddr: advertise}
+	}
+	swarms := makeSwarmWith(t, configs)
+	for i, swarm := range swarms {
+		if !sameAddr(swarm.Addr(), configs[i].AdvertiseAddr) {
+			t.Errorf("Expected %v got %v", configs[i].AdvertiseAddr, swarm.Addr())
+		}
+	}
+	checkBroadcast(t, swarms, 0)
+}
+
+func TestLimits(t *testing.T) {
+	transport := NewMemoryTransport()
+	addrs := memoryAddrs(2)
+	configs := make([]Config, len(addrs))
+	for i, addr := range addrs {
+		configs[i] = Config{
+			Transport:  transport,
+			ListenAddr: addr,
+			Limits:     protocol.Limits{MaxContent: 8},
+		}
+	}
+	swarms := makeSwarmWith(t, configs)
+	expected := protocol.TooLargeError{What: "Content", Limit: 8}
+	if err := swarms[0].SendContent("far too long"); err != expected {
+		t.Errorf("Expected %v got %v", expected, err)
+	}
+	if err := swarms[0].ChangeNickname("\xffalice"); err != protocol.ErrInvalidUTF8 {
+		t.Errorf("Expected %v got %v", protocol.ErrInvalidUTF8, err)
+	}
+	checkBroadcast(t, swarms, 0)
+}
+
+func TestCompressionInterop(t *testing.T) {
+	transport := NewMemoryTransport()
+	addrs := memoryAddrs(4)
+	configs := make([]Config, len(addrs))
+	for i, addr := range addrs {
+		configs[i] = Config{Transport: transport, ListenAddr: addr}
+	}
+	// with a single node refusing, some links compress and some don't
+	configs[2].NoCompression = true
+	swarms := makeSwarmWith(t, configs)
+	compressing := 0
+	for i, swarm := range swarms {
+		session := swarm.client.state.getSucc().out.session
+		if session.Features.Has(protocol.FeatureCompression) {
+			compressing++
+		} else if i != 2 && !sameAddr(swarm.Successor(), swarms[2].Addr()) {
+			t.Errorf("Expected node %d to compress with its successor", i)
+		}
+	}
+	if compressing != 2 {
+		t.Errorf("Expected 2 compressing links got %d", compressing)
+	}
+	logs := strings.Repeat("INFO build step finished\n", 2000)
+	for from := range swarms {
+		checkBroadcastContent(t, swarms, from, logs)
+	}
+}
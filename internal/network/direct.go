@@ -0,0 +1,60 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+// directKind is the kind of the envelopes carrying a direct message
+//
+// These go straight to their recipient over a connection of their own,
+// which answers with a Ping once the message has arrived.
+const directKind = "direct-message"
+
+// sendDirect sends a message to a single node
+func (client *normalClient) sendDirect(addr net.Addr, content string) error {
+	env := protocol.Envelope{
+		Sender: client.advertisedAddr,
+		Kind:   directKind,
+		Fields: []protocol.Field{protocol.NewStringField("content", content)},
+	}
+	if err := client.limits.CheckEnvelope(env); err != nil {
+		return err
+	}
+	conn, in, _, err := client.dialer().dial(addr, protocol.FeatureEnvelopes|protocol.FeatureDirect)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(queryTimeout))
+	if err := sendMessage(conn, env); err != nil {
+		return err
+	}
+	reply, err := in.Decode()
+	if err != nil {
+		return err
+	}
+	if _, ok := reply.(protocol.Ping); !ok {
+		return fmt.Errorf("Unexpected answer to a direct message from %v: %v", addr, reply)
+	}
+	return nil
+}
+
+// receiveDirect takes a direct message, letting its sender know it arrived
+func (client *normalClient) receiveDirect(conn net.Conn, env protocol.Envelope) {
+	contentField, _ := env.Get("content")
+	content, _ := contentField.AsString()
+	client.peers.saw(env.Sender, time.Now())
+	nick := client.nicks.get(env.Sender)
+	event := ChatEvent{Kind: EventDirect, From: env.Sender, Nick: nick, Content: content}
+	if _, ok := client.receiver.(EventReceiver); ok {
+		client.receiveEvent(event)
+	} else {
+		client.receiver.ReceiveContent(nick+" (direct)", content)
+		client.watchers.notify(event)
+	}
+	client.answer(conn, protocol.Ping{})
+}
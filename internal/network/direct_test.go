@@ -0,0 +1,36 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDirectMessages(t *testing.T) {
+	swarms := makeSwarm(t, NewMemoryTransport(), memoryAddrs(3))
+	receivers := make([]eventReceiver, len(swarms))
+	for i, swarm := range swarms {
+		receivers[i] = make(eventReceiver, 4)
+		swarm.SetReceiver(receivers[i])
+	}
+	if err := swarms[0].SendDirect(swarms[2].Addr(), "psst"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := ChatEvent{Kind: EventDirect, From: swarms[0].Addr(), Nick: swarms[0].Addr().String(), Content: "psst"}
+	// the message has arrived once SendDirect returns
+	select {
+	case event := <-receivers[2]:
+		if event != expected {
+			t.Errorf("Expected %v got %v", expected, event)
+		}
+	default:
+		t.Errorf("Expected the message to have arrived")
+	}
+	select {
+	case event := <-receivers[1]:
+		t.Errorf("Expected nothing to reach the other node, got %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := swarms[0].SendDirect(MemoryAddr("nobody"), "psst"); err == nil {
+		t.Errorf("Expected sending to an unknown node to fail")
+	}
+}
@@ -0,0 +1,43 @@
+package network
+
+import (
+	"sync"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+// EnvelopeHandler reacts to an Envelope broadcast by another node
+//
+// Handlers are called one at a time, as envelopes arrive, so they shouldn't block.
+type EnvelopeHandler func(protocol.Envelope)
+
+// handlerMap holds the EnvelopeHandler registered for each kind of envelope
+type handlerMap struct {
+	mu       sync.RWMutex
+	handlers map[string]EnvelopeHandler
+}
+
+func makeHandlerMap() *handlerMap {
+	return &handlerMap{handlers: make(map[string]EnvelopeHandler)}
+}
+
+// set registers a handler for a kind, with nil removing it
+func (hmap *handlerMap) set(kind string, handler EnvelopeHandler) {
+	hmap.mu.Lock()
+	defer hmap.mu.Unlock()
+	if handler == nil {
+		delete(hmap.handlers, kind)
+	} else {
+		hmap.handlers[kind] = handler
+	}
+}
+
+// handle passes an envelope to the handler for its kind, if there is one
+func (hmap *handlerMap) handle(env protocol.Envelope) {
+	hmap.mu.RLock()
+	handler := hmap.handlers[env.Kind]
+	hmap.mu.RUnlock()
+	if handler != nil {
+		handler(env)
+	}
+}
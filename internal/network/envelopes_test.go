@@ -0,0 +1,53 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+func TestEnvelopesReachHandlers(t *testing.T) {
+	transport := NewMemoryTransport()
+	swarms := makeSwarm(t, transport, memoryAddrs(4))
+	received := make(chan protocol.Envelope, len(swarms))
+	handlers := 0
+	for _, swarm := range swarms[1:] {
+		// our successor has no handler, but must still pass the envelope along
+		if sameAddr(swarm.Addr(), swarms[0].Successor()) {
+			continue
+		}
+		swarm.HandleEnvelopes("build", func(env protocol.Envelope) {
+			received <- env
+		})
+		handlers++
+	}
+	fields := []protocol.Field{
+		protocol.NewStringField("branch", "master"),
+		protocol.NewBoolField("passed", true),
+	}
+	if err := swarms[0].Broadcast("build", fields...); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := protocol.Envelope{Sender: swarms[0].Addr(), Kind: "build", Fields: fields}
+	for i := 0; i < handlers; i++ {
+		select {
+		case env := <-received:
+			if !reflect.DeepEqual(env, expected) {
+				t.Errorf("Expected %v got %v", expected, env)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only %d of %d handlers got the envelope", i, handlers)
+		}
+	}
+	select {
+	case env := <-received:
+		t.Errorf("Expected the envelope once per node, got %v again", env)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := swarms[0].Broadcast(""); err == nil {
+		t.Errorf("Expected an envelope without a kind to be refused")
+	}
+	checkBroadcast(t, swarms, 0)
+}
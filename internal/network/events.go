@@ -0,0 +1,213 @@
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+const (
+	editKind    = "message-edit"
+	retractKind = "message-retract"
+	reactKind   = "message-react"
+	// maxReactionLength bounds the size of a reaction, in bytes
+	maxReactionLength = 32
+)
+
+// EventKind says what happened in a ChatEvent
+type EventKind int
+
+const (
+	// EventMessage is a new message
+	EventMessage EventKind = iota
+	// EventEdit replaces the content of a message
+	EventEdit
+	// EventRetract hides the content of a message
+	EventRetract
+	// EventReact attaches a short reaction to a message
+	EventReact
+	// EventDirect is a message sent to us alone, which has no ID
+	EventDirect
+)
+
+// MessageRef refers to a message, by its sender and ID
+//
+// Messages from nodes that don't support protocol.FeatureMessageIDs
+// have an ID of 0, and can't be referred to.
+type MessageRef struct {
+	// Sender is the address of the node that sent the message
+	Sender string
+	ID     uint64
+}
+
+// ChatEvent is something that happened to a message in the swarm
+type ChatEvent struct {
+	Kind EventKind
+	// Message is the message this event is about
+	Message MessageRef
+	// From is the node behind this event, with Nick its nickname
+	From net.Addr
+	Nick string
+	// Content is the text of a new or edited message, or a reaction
+	Content string
+}
+
+// EventReceiver is a ContentReceiver that also wants to know about edits,
+// retractions and reactions
+//
+// New messages are passed to ReceiveEvent instead of ReceiveContent,
+// so that they come with their ID.
+type EventReceiver interface {
+	protocol.ContentReceiver
+	ReceiveEvent(ChatEvent)
+}
+
+// messageIDs hands out the IDs of the messages we send
+type messageIDs struct {
+	next uint64
+}
+
+// makeMessageIDs starts from a random ID, so that a node coming back
+// at the same address doesn't reuse the IDs of its earlier messages
+func makeMessageIDs() *messageIDs {
+	return &messageIDs{next: uint64(rand.New(rand.NewSource(time.Now().UnixNano())).Int63())}
+}
+
+func (ids *messageIDs) take() uint64 {
+	for {
+		if id := atomic.AddUint64(&ids.next, 1); id != 0 {
+			return id
+		}
+	}
+}
+
+// refFields are the fields an envelope uses to refer to a message
+func refFields(ref MessageRef) []protocol.Field {
+	return []protocol.Field{
+		protocol.NewStringField("author", ref.Sender),
+		protocol.NewUintField("id", ref.ID),
+	}
+}
+
+// checkReaction makes sure a reaction is short, and fits on one line
+func checkReaction(reaction string) error {
+	if reaction == "" || len(reaction) > maxReactionLength || strings.ContainsAny(reaction, "\r\n") {
+		return fmt.Errorf("Invalid reaction: %q", reaction)
+	}
+	return nil
+}
+
+// readEvent reads an edit, retraction or reaction from the Envelope carrying it
+//
+// Only the sender of a message can edit or retract it.
+func (client *normalClient) readEvent(env protocol.Envelope) (ChatEvent, error) {
+	event := ChatEvent{From: env.Sender, Nick: client.nicks.get(env.Sender)}
+	authorField, _ := env.Get("author")
+	author, ok := authorField.AsString()
+	idField, _ := env.Get("id")
+	id, hasID := idField.AsUint()
+	if !ok || !hasID || id == 0 {
+		return ChatEvent{}, fmt.Errorf("Invalid message reference in %s from %v", env.Kind, env.Sender)
+	}
+	event.Message = MessageRef{Sender: author, ID: id}
+	contentField, _ := env.Get("content")
+	event.Content, _ = contentField.AsString()
+	switch env.Kind {
+	case editKind:
+		event.Kind = EventEdit
+	case retractKind:
+		event.Kind = EventRetract
+	default:
+		event.Kind = EventReact
+		if err := checkReaction(event.Content); err != nil {
+			return ChatEvent{}, err
+		}
+		return event, nil
+	}
+	if author != env.Sender.String() {
+		return ChatEvent{}, fmt.Errorf("Refusing %s of a message by %s from %v", env.Kind, author, env.Sender)
+	}
+	return event, nil
+}
+
+// receiveEvent passes an event to our receiver, if it wants events, and to our watchers
+func (client *normalClient) receiveEvent(event ChatEvent) {
+	if receiver, ok := client.receiver.(EventReceiver); ok {
+		receiver.ReceiveEvent(event)
+	}
+	client.watchers.notify(event)
+}
+
+// receiveText passes a new message to our receiver, and to our watchers
+func (client *normalClient) receiveText(sender net.Addr, id uint64, content string) {
+	nick := client.nicks.get(sender)
+	event := ChatEvent{
+		Kind:    EventMessage,
+		Message: MessageRef{Sender: sender.String(), ID: id},
+		From:    sender,
+		Nick:    nick,
+		Content: content,
+	}
+	if _, ok := client.receiver.(EventReceiver); !ok {
+		client.receiver.ReceiveContent(nick, content)
+		client.watchers.notify(event)
+		return
+	}
+	client.receiveEvent(event)
+}
+
+// watcherList holds the receivers told about every event, besides our receiver
+type watcherList struct {
+	mu       sync.Mutex
+	next     int
+	watchers map[int]EventReceiver
+}
+
+func makeWatcherList() *watcherList {
+	return &watcherList{watchers: make(map[int]EventReceiver)}
+}
+
+// add starts telling a watcher about events, returning a function to stop
+func (list *watcherList) add(watcher EventReceiver) func() {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	id := list.next
+	list.next++
+	list.watchers[id] = watcher
+	return func() {
+		list.mu.Lock()
+		defer list.mu.Unlock()
+		delete(list.watchers, id)
+	}
+}
+
+func (list *watcherList) notify(event ChatEvent) {
+	list.mu.Lock()
+	watchers := make([]EventReceiver, 0, len(list.watchers))
+	for _, watcher := range list.watchers {
+		watchers = append(watchers, watcher)
+	}
+	list.mu.Unlock()
+	for _, watcher := range watchers {
+		watcher.ReceiveEvent(event)
+	}
+}
+
+// sendEvent broadcasts an edit, retraction or reaction
+func (client *normalClient) sendEvent(kind string, ref MessageRef, extra ...protocol.Field) error {
+	env := protocol.Envelope{
+		Sender: client.advertisedAddr,
+		Kind:   kind,
+		Fields: append(refFields(ref), extra...),
+	}
+	if err := client.limits.CheckEnvelope(env); err != nil {
+		return err
+	}
+	return client.broadcast(env)
+}
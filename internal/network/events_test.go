@@ -0,0 +1,129 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+// eventReceiver pushes all the events it receives into a channel
+type eventReceiver chan ChatEvent
+
+func (r eventReceiver) ReceiveContent(name, content string) {}
+
+func (r eventReceiver) ReceiveEvent(event ChatEvent) {
+	r <- event
+}
+
+func nextEvent(t *testing.T, r eventReceiver) ChatEvent {
+	select {
+	case event := <-r:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Never received an event")
+		return ChatEvent{}
+	}
+}
+
+func TestMessageEvents(t *testing.T) {
+	swarms := makeSwarm(t, NewMemoryTransport(), memoryAddrs(3))
+	receivers := make([]eventReceiver, len(swarms))
+	for i, swarm := range swarms {
+		receivers[i] = make(eventReceiver, 4)
+		swarm.SetReceiver(receivers[i])
+	}
+	ref, err := swarms[0].SendMessage("helo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Sender != swarms[0].Addr().String() || ref.ID == 0 {
+		t.Errorf("Unexpected reference %v", ref)
+	}
+	if err := swarms[0].EditMessage(ref.ID, "hello"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := swarms[0].RetractMessage(ref.ID); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []ChatEvent{
+		{Kind: EventMessage, Message: ref, From: swarms[0].Addr(), Nick: ref.Sender, Content: "helo"},
+		{Kind: EventEdit, Message: ref, From: swarms[0].Addr(), Nick: ref.Sender, Content: "hello"},
+		{Kind: EventRetract, Message: ref, From: swarms[0].Addr(), Nick: ref.Sender},
+	}
+	for _, r := range receivers[1:] {
+		for _, e := range expected {
+			if event := nextEvent(t, r); event != e {
+				t.Errorf("Expected %v got %v", e, event)
+			}
+		}
+	}
+	if err := swarms[1].React(ref, "👍"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	react := ChatEvent{Kind: EventReact, Message: ref, From: swarms[1].Addr(), Nick: swarms[1].Addr().String(), Content: "👍"}
+	for _, i := range []int{0, 2} {
+		if event := nextEvent(t, receivers[i]); event != react {
+			t.Errorf("Expected %v got %v", react, event)
+		}
+	}
+	if err := swarms[1].React(ref, ""); err == nil {
+		t.Errorf("Expected an empty reaction to be refused")
+	}
+}
+
+func TestOnlySenderCanEdit(t *testing.T) {
+	swarms := makeSwarm(t, NewMemoryTransport(), memoryAddrs(3))
+	r := make(eventReceiver, 4)
+	swarms[2].SetReceiver(r)
+	ref, err := swarms[0].SendMessage("original")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nextEvent(t, r)
+	forged := append(refFields(ref), protocol.NewStringField("content", "forged"))
+	if err := swarms[1].Broadcast(editKind, forged...); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := swarms[1].Broadcast(retractKind, refFields(ref)...); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := swarms[1].SendMessage("after"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if event := nextEvent(t, r); event.Kind != EventMessage || event.Content != "after" {
+		t.Errorf("Expected the forged edit and retraction to be dropped, got %v", event)
+	}
+}
+
+func TestWatchersSeeEvents(t *testing.T) {
+	swarms := makeSwarm(t, NewMemoryTransport(), memoryAddrs(2))
+	// a receiver that doesn't want events shouldn't keep them from watchers
+	swarms[1].SetReceiver(protocol.NilReceiver{})
+	first := make(eventReceiver, 4)
+	second := make(eventReceiver, 4)
+	swarms[1].Watch(first)
+	stop := swarms[1].Watch(second)
+	ref, err := swarms[0].SendMessage("hello")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := ChatEvent{Kind: EventMessage, Message: ref, From: swarms[0].Addr(), Nick: ref.Sender, Content: "hello"}
+	for _, r := range []eventReceiver{first, second} {
+		if event := nextEvent(t, r); event != expected {
+			t.Errorf("Expected %v got %v", expected, event)
+		}
+	}
+	stop()
+	if err := swarms[0].SendDirect(swarms[1].Addr(), "psst"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if event := nextEvent(t, first); event.Kind != EventDirect || event.Content != "psst" {
+		t.Errorf("Expected the direct message got %v", event)
+	}
+	select {
+	case event := <-second:
+		t.Errorf("Expected nothing after stopping, got %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
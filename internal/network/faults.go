@@ -0,0 +1,210 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errDropped is returned when a fault drops a connection
+var errDropped = errors.New("connection dropped by fault injection")
+
+// stepTags maps the name of each protocol step to the type tag of its message
+var stepTags = map[string]byte{
+	"Ping":               1,
+	"JoinSwarm":          2,
+	"Referral":           3,
+	"NewPredecessor":     4,
+	"ConfirmPredecessor": 5,
+	"ConfirmReferral":    6,
+	"NewMessage":         7,
+	"Nickname":           8,
+	"Hello":              9,
+	"HelloAck":           10,
+	"Envelope":           11,
+	"Compressed":         12,
+	"LinkQuery":          13,
+	"LinkReply":          14,
+	"Census":             15,
+	"OpenLink":           16,
+	"TreeCast":           17,
+	"Lookup":             18,
+	"LookupReply":        19,
+	"GetNeighbors":       20,
+	"Neighbors":          21,
+	"FileRequest":        22,
+	"FileChunk":          23,
+	"Post":               24,
+}
+
+// Faults describes the failures a FaultTransport injects into its connections
+//
+// Steps are named after the message being sent, e.g. "ConfirmReferral".
+// Compressed messages all count as the "Compressed" step.
+// Faults only affect the data a node writes, not what it reads.
+type Faults struct {
+	// Delay is waited before every write
+	Delay time.Duration
+	// SplitWrites sends every write one byte at a time
+	SplitWrites bool
+	// DropOn closes the connection instead of sending one of these steps
+	DropOn []string
+	// CorruptOn flips the lowest bit of the last byte sent for one of these steps
+	//
+	// Text stays printable, so the damage gets past the decoder.
+	CorruptOn []string
+}
+
+func hasStep(steps []string, tag byte) bool {
+	for _, step := range steps {
+		if stepTags[step] == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFaults reads faults from a comma separated list
+//
+// The list can contain "delay=<duration>", "split", "drop=<step>",
+// and "corrupt=<step>". Drop and corrupt can be given multiple times.
+func ParseFaults(spec string) (Faults, error) {
+	var faults Faults
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		key := parts[0]
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		switch key {
+		case "delay":
+			delay, err := time.ParseDuration(value)
+			if err != nil {
+				return faults, fmt.Errorf("Invalid delay %q: %v", value, err)
+			}
+			faults.Delay = delay
+		case "split":
+			faults.SplitWrites = true
+		case "drop", "corrupt":
+			if _, ok := stepTags[value]; !ok {
+				return faults, fmt.Errorf("Unknown protocol step %q", value)
+			}
+			if key == "drop" {
+				faults.DropOn = append(faults.DropOn, value)
+			} else {
+				faults.CorruptOn = append(faults.CorruptOn, value)
+			}
+		default:
+			return faults, fmt.Errorf("Unknown fault %q", key)
+		}
+	}
+	return faults, nil
+}
+
+// FaultTransport wraps another Transport, injecting faults into its connections
+//
+// The faults can be changed at any time, and apply to connections
+// that are already open as well.
+type FaultTransport struct {
+	Transport
+	mu     sync.RWMutex
+	faults Faults
+}
+
+// NewFaultTransport wraps a transport with some initial faults
+func NewFaultTransport(under Transport, faults Faults) *FaultTransport {
+	return &FaultTransport{Transport: under, faults: faults}
+}
+
+// SetFaults changes the faults this transport injects
+func (t *FaultTransport) SetFaults(faults Faults) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.faults = faults
+}
+
+func (t *FaultTransport) getFaults() Faults {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.faults
+}
+
+// Dial opens a faulty connection
+func (t *FaultTransport) Dial(addr net.Addr) (net.Conn, error) {
+	conn, err := t.Transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{Conn: conn, transport: t}, nil
+}
+
+// Listen opens a listener whose connections are faulty
+func (t *FaultTransport) Listen(addr net.Addr) (net.Listener, error) {
+	l, err := t.Transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &faultListener{Listener: l, transport: t}, nil
+}
+
+type faultListener struct {
+	net.Listener
+	transport *FaultTransport
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{Conn: conn, transport: l.transport}, nil
+}
+
+// faultConn relies on each message being sent with a single call to Write
+type faultConn struct {
+	net.Conn
+	transport *FaultTransport
+}
+
+// WritesFrames is always true, since faults are applied to whole writes
+func (conn *faultConn) WritesFrames() bool {
+	return true
+}
+
+func (conn *faultConn) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return conn.Conn.Write(data)
+	}
+	faults := conn.transport.getFaults()
+	if faults.Delay > 0 {
+		time.Sleep(faults.Delay)
+	}
+	tag := data[0]
+	if hasStep(faults.DropOn, tag) {
+		conn.Conn.Close()
+		return 0, errDropped
+	}
+	if hasStep(faults.CorruptOn, tag) {
+		corrupted := make([]byte, len(data))
+		copy(corrupted, data)
+		corrupted[len(corrupted)-1] ^= 1
+		data = corrupted
+	}
+	if !faults.SplitWrites {
+		return conn.Conn.Write(data)
+	}
+	for i := range data {
+		if _, err := conn.Conn.Write(data[i : i+1]); err != nil {
+			return i, err
+		}
+	}
+	return len(data), nil
+}
@@ -0,0 +1,356 @@
+package network
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+func TestParseFaults(t *testing.T) {
+	faults, err := ParseFaults("delay=5ms, split,drop=ConfirmReferral,corrupt=JoinSwarm,drop=Ping")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := Faults{
+		Delay:       5 * time.Millisecond,
+		SplitWrites: true,
+		DropOn:      []string{"ConfirmReferral", "Ping"},
+		CorruptOn:   []string{"JoinSwarm"},
+	}
+	if !reflect.DeepEqual(faults, expected) {
+		t.Errorf("Expected %v got %v", expected, faults)
+	}
+	for _, spec := range []string{"delay=soon", "drop=Goodbye", "explode"} {
+		if _, err := ParseFaults(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestStepTags(t *testing.T) {
+	addr := MemoryAddr("node")
+	messages := []protocol.Message{
+		protocol.Ping{},
+		protocol.JoinSwarm{Addr: addr},
+		protocol.Referral{Addr: addr},
+		protocol.NewPredecessor{Addr: addr},
+		protocol.ConfirmPredecessor{Addr: addr},
+		protocol.ConfirmReferral{},
+		protocol.NewMessage{Sender: addr, Content: "hi"},
+		protocol.Nickname{Sender: addr, Name: "alice"},
+		protocol.LocalHello(),
+		protocol.HelloAck(protocol.LocalHello()),
+		protocol.Envelope{Sender: addr, Kind: "test"},
+		protocol.LinkQuery{Level: 1},
+		protocol.LinkReply{Level: 1, Addr: addr},
+		protocol.Census{Origin: addr, Count: 2},
+		protocol.OpenLink{Addr: addr},
+		protocol.TreeCast{Origin: addr, Limit: addr, Payload: protocol.NewMessage{Sender: addr, Content: "hi"}},
+		protocol.Lookup{ID: 1},
+		protocol.LookupReply{Done: true, Addr: addr},
+		protocol.GetNeighbors{},
+		protocol.Neighbors{Pred: addr, Succ: addr},
+		protocol.FileRequest{Offset: 1},
+		protocol.FileChunk{Offset: 1, Data: []byte("data")},
+		protocol.Post{Sender: addr, ID: 1, Content: "hi"},
+	}
+	for _, msg := range messages {
+		step := reflect.TypeOf(msg).Name()
+		if tag := msg.MessageBytes()[0]; stepTags[step] != tag {
+			t.Errorf("Expected %s to have the tag %d got %d", step, tag, stepTags[step])
+		}
+	}
+	// every message the decoder knows can be faulted
+	known := make(map[byte]bool)
+	for _, tag := range stepTags {
+		known[tag] = true
+	}
+	for tag := 0; tag < 256; tag++ {
+		in := protocol.NewDecoder(bytes.NewReader([]byte{byte(tag)}), NewMemoryTransport().ResolveAddr)
+		_, err := in.Decode()
+		_, unknown := err.(protocol.UnknownTypeError)
+		if unknown == known[byte(tag)] {
+			t.Errorf("Expected the tag %d to be a step only if the decoder knows it got %v", tag, err)
+		}
+	}
+}
+
+// faultyPair returns both ends of a connection, the first one being faulty
+func faultyPair(t *testing.T, faults Faults) (net.Conn, net.Conn) {
+	transport := NewFaultTransport(NewMemoryTransport(), faults)
+	l, err := transport.Transport.Listen(MemoryAddr("server"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer l.Close()
+	client, err := transport.Dial(MemoryAddr("server"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return client, server
+}
+
+func TestFaultConnSplitsWrites(t *testing.T) {
+	client, server := faultyPair(t, Faults{SplitWrites: true})
+	msg := protocol.JoinSwarm{Addr: MemoryAddr("joining")}
+	go sendMessage(client, msg)
+	buf := make([]byte, 64)
+	amount, err := server.Read(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if amount != 1 {
+		t.Errorf("Expected to read 1 byte got %d", amount)
+	}
+	expected := msg.MessageBytes()
+	got := append(buf[:1], readAll(t, server, len(expected)-1)...)
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Expected %v got %v", expected, got)
+	}
+}
+
+func readAll(t *testing.T, conn net.Conn, amount int) []byte {
+	data := make([]byte, 0, amount)
+	buf := make([]byte, amount)
+	for len(data) < amount {
+		read, err := conn.Read(buf[:amount-len(data)])
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		data = append(data, buf[:read]...)
+	}
+	return data
+}
+
+func TestFaultConnCorrupts(t *testing.T) {
+	client, server := faultyPair(t, Faults{CorruptOn: []string{"Referral"}})
+	msg := protocol.Referral{Addr: MemoryAddr("abc")}
+	go sendMessage(client, msg)
+	expected := msg.MessageBytes()
+	expected[len(expected)-1] ^= 1
+	if got := readAll(t, server, len(expected)); !bytes.Equal(got, expected) {
+		t.Errorf("Expected %v got %v", expected, got)
+	}
+}
+
+func TestFaultConnDrops(t *testing.T) {
+	client, server := faultyPair(t, Faults{DropOn: []string{"ConfirmReferral"}})
+	if err := sendMessage(client, protocol.ConfirmReferral{}); err == nil {
+		t.Errorf("Expected the connection to be dropped")
+	}
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected the other side to see the connection closing")
+	}
+}
+
+// TestFaultsApplyToEveryFrame queues messages while the outbox is stuck writing,
+// which would otherwise send them with a single write
+func TestFaultsApplyToEveryFrame(t *testing.T) {
+	client, server := faultyPair(t, Faults{CorruptOn: []string{"Referral"}})
+	out := newOutbox(client, protocol.Session{}, QueueConfig{}, log.New(ioutil.Discard, "", 0))
+	defer out.close()
+	if err := out.broadcast(textMessage("first")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waitFor(t, "writer to pick up the first message", func() bool {
+		depth, _, _, _ := out.stats()
+		return depth == 0
+	})
+	referral := protocol.Referral{Addr: MemoryAddr("abc")}
+	if err := out.control(protocol.Ping{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := out.control(referral); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	readAll(t, server, len(textMessage("first").MessageBytes()))
+	if got := readAll(t, server, 1); got[0] != 1 {
+		t.Errorf("Expected a Ping got %v", got)
+	}
+	expected := referral.MessageBytes()
+	expected[len(expected)-1] ^= 1
+	if got := readAll(t, server, len(expected)); !bytes.Equal(got, expected) {
+		t.Errorf("Expected %v got %v", expected, got)
+	}
+}
+
+func TestFaultsOnCompressedFrames(t *testing.T) {
+	faults, err := ParseFaults("drop=Compressed")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client, server := faultyPair(t, faults)
+	session := protocol.Session{Features: protocol.FeatureCompression}
+	out := newOutbox(client, session, QueueConfig{}, log.New(ioutil.Discard, "", 0))
+	defer out.close()
+	if err := out.broadcast(textMessage(strings.Repeat("a", 2*protocol.CompressionThreshold))); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected the compressed message to be dropped")
+	}
+}
+
+// greetedConn dials addr, and performs the handshake
+func greetedConn(t *testing.T, transport Transport, addr net.Addr) (net.Conn, *protocol.Decoder) {
+	conn, err := transport.Dial(addr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	in := newDecoder(conn, transport, protocol.DefaultLimits)
+	if _, err := greet(conn, in, protocol.LocalHello()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return conn, in
+}
+
+// TestMismatchedPredecessorRecovers plays the part of a joining node by hand,
+// first confirming with the wrong address, and then the right one.
+func TestMismatchedPredecessorRecovers(t *testing.T) {
+	transport := NewMemoryTransport()
+	swarms := makeSwarm(t, transport, memoryAddrs(3))
+	start := swarms[0]
+	var succ *SwarmHandle
+	for _, swarm := range swarms {
+		if sameAddr(swarm.Addr(), start.Successor()) {
+			succ = swarm
+		}
+	}
+	joining := MemoryAddr("joining")
+	predConn, predIn := greetedConn(t, transport, start.Addr())
+	if err := sendMessage(predConn, protocol.JoinSwarm{Addr: joining}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msg, err := predIn.Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if referral := msg.(protocol.Referral); !sameAddr(referral.Addr, succ.Addr()) {
+		t.Fatalf("Expected referral to %v got %v", succ.Addr(), referral.Addr)
+	}
+	waitFor(t, "predecessor announcement", func() bool {
+		newPred := succ.client.state.getNewPred()
+		return newPred != nil && sameAddr(newPred, joining)
+	})
+	wrongConn, wrongIn := greetedConn(t, transport, succ.Addr())
+	if err := sendMessage(wrongConn, protocol.ConfirmPredecessor{Addr: MemoryAddr("impostor")}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := wrongIn.Decode(); err == nil {
+		t.Fatalf("Expected the mismatched connection to be closed")
+	}
+	succConn, _ := greetedConn(t, transport, succ.Addr())
+	if err := sendMessage(succConn, protocol.ConfirmPredecessor{Addr: joining}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waitFor(t, "join to complete", func() bool {
+		return sameAddr(start.Successor(), joining) && sameAddr(succ.Predecessor(), joining)
+	})
+}
+
+// joinByHand plays the part of a node joining right after start, returning
+// the connection its successor now treats as its predecessor
+func joinByHand(t *testing.T, transport Transport, start, succ *SwarmHandle, joining net.Addr) net.Conn {
+	predConn, predIn := greetedConn(t, transport, start.Addr())
+	if err := sendMessage(predConn, protocol.JoinSwarm{Addr: joining}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := predIn.Decode(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	succConn, _ := greetedConn(t, transport, succ.Addr())
+	if err := sendMessage(succConn, protocol.ConfirmPredecessor{Addr: joining}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waitFor(t, "join to complete", func() bool {
+		return sameAddr(start.Successor(), joining) && sameAddr(succ.Predecessor(), joining)
+	})
+	return succConn
+}
+
+// TestEarlyConfirmAfterJoin has a second node confirm with its successor before
+// being announced, which used to clash with the announcement of the first one.
+func TestEarlyConfirmAfterJoin(t *testing.T) {
+	transport := NewMemoryTransport()
+	swarms := makeSwarm(t, transport, memoryAddrs(2))
+	start, succ := swarms[0], swarms[1]
+	first := MemoryAddr("first")
+	predConn := joinByHand(t, transport, start, succ, first)
+
+	second := MemoryAddr("second")
+	secondConn, secondIn := greetedConn(t, transport, succ.Addr())
+	if err := sendMessage(secondConn, protocol.ConfirmPredecessor{Addr: second}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// the second node should be kept waiting for its announcement, rather than refused
+	secondConn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := secondIn.Decode(); !timedOut(err) {
+		t.Fatalf("Expected the connection of the second node to stay open got %v", err)
+	}
+	// as the predecessor of succ, we're the one announcing the second node
+	if err := sendMessage(predConn, protocol.NewPredecessor{Addr: second}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waitFor(t, "second join to complete", func() bool {
+		return sameAddr(succ.Predecessor(), second)
+	})
+}
+
+func timedOut(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// lineCounter counts the lines logged with some text in them
+type lineCounter struct {
+	mu    sync.Mutex
+	text  string
+	count int
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if bytes.Contains(p, []byte(c.text)) {
+		c.count++
+	}
+	return len(p), nil
+}
+
+func (c *lineCounter) get() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count
+}
+
+func TestClosedPredecessorIsReportedOnce(t *testing.T) {
+	transport := NewMemoryTransport()
+	counter := &lineCounter{text: "EOF"}
+	addrs := memoryAddrs(2)
+	swarms := makeSwarmWith(t, []Config{
+		{Transport: transport, ListenAddr: addrs[0]},
+		{Transport: transport, ListenAddr: addrs[1], Log: log.New(counter, "", 0)},
+	})
+	predConn := joinByHand(t, transport, swarms[0], swarms[1], MemoryAddr("joining"))
+	predConn.Close()
+	waitFor(t, "the closed connection to be noticed", func() bool {
+		return counter.get() > 0
+	})
+	// nothing more can be read from the connection, which shouldn't be tried forever
+	time.Sleep(50 * time.Millisecond)
+	if count := counter.get(); count != 1 {
+		t.Errorf("Expected the closed connection to be reported once got %d", count)
+	}
+}
@@ -0,0 +1,410 @@
+package network
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+const (
+	// fileOfferKind is the kind of the envelopes announcing a file
+	fileOfferKind = "file-offer"
+	// fileChunkSize is the most we send in a single FileChunk
+	fileChunkSize = 64 * 1024
+	// maxFileOffers bounds how many offers from other nodes we remember
+	maxFileOffers = 1024
+	// maxFileRetries is how many times in a row a download can fail to make progress
+	maxFileRetries = 3
+	// fileIDLength is how many hexadecimal digits of the hash make up the ID of an offer
+	fileIDLength = 12
+)
+
+// FileOffer describes a file a node is willing to send to the others
+type FileOffer struct {
+	// Name is the name of the file, without any directories
+	Name string
+	// Size is the length of the file, in bytes
+	Size int64
+	// Hash lets the node downloading the file check that it arrived intact
+	Hash protocol.FileHash
+	// Sender is the node offering the file
+	Sender net.Addr
+}
+
+// ID is a short name for an offer, made of the start of its hash
+func (offer FileOffer) ID() string {
+	return offer.Hash.String()[:fileIDLength]
+}
+
+// fields turns an offer into the fields of an Envelope
+func (offer FileOffer) fields() []protocol.Field {
+	return []protocol.Field{
+		protocol.NewStringField("name", offer.Name),
+		protocol.NewUintField("size", uint64(offer.Size)),
+		protocol.NewBytesField("hash", offer.Hash[:]),
+	}
+}
+
+// validFileName checks that a name can't escape the directory we save files in
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// readFileOffer reads an offer from the Envelope announcing it
+func readFileOffer(env protocol.Envelope) (FileOffer, error) {
+	offer := FileOffer{Sender: env.Sender}
+	nameField, _ := env.Get("name")
+	name, ok := nameField.AsString()
+	if !ok || !validFileName(name) {
+		return FileOffer{}, fmt.Errorf("Invalid file name in offer from %v: %q", env.Sender, name)
+	}
+	offer.Name = name
+	sizeField, _ := env.Get("size")
+	size, ok := sizeField.AsUint()
+	if !ok || size > 1<<62 {
+		return FileOffer{}, fmt.Errorf("Invalid file size in offer from %v", env.Sender)
+	}
+	offer.Size = int64(size)
+	hashField, _ := env.Get("hash")
+	if hashField.Type != protocol.FieldBytes || len(hashField.Value) != len(offer.Hash) {
+		return FileOffer{}, fmt.Errorf("Invalid file hash in offer from %v", env.Sender)
+	}
+	copy(offer.Hash[:], hashField.Value)
+	return offer, nil
+}
+
+// FileHandler reacts to a file offered by another node
+//
+// Like EnvelopeHandler, it shouldn't block.
+type FileHandler func(FileOffer)
+
+// FileProgress reports on a download, every time a chunk arrives
+type FileProgress struct {
+	Offer FileOffer
+	// Received is how many bytes of the file we have so far
+	Received int64
+}
+
+// fileState holds the files we offer, and those offered to us
+type fileState struct {
+	mu sync.Mutex
+	// shared maps the hash of each file we offer to its path
+	shared map[protocol.FileHash]string
+	// offers holds the offers of other nodes by ID, oldest first in order
+	offers map[string]FileOffer
+	order  []string
+	// downloading holds the files we're downloading right now
+	downloading map[protocol.FileHash]bool
+	handler     FileHandler
+}
+
+func makeFileState() *fileState {
+	return &fileState{
+		shared:      make(map[protocol.FileHash]string),
+		offers:      make(map[string]FileOffer),
+		downloading: make(map[protocol.FileHash]bool),
+	}
+}
+
+func (files *fileState) share(hash protocol.FileHash, path string) {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	files.shared[hash] = path
+}
+
+func (files *fileState) path(hash protocol.FileHash) (string, bool) {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	path, ok := files.shared[hash]
+	return path, ok
+}
+
+func (files *fileState) setHandler(handler FileHandler) {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	files.handler = handler
+}
+
+// receive remembers an offer, and passes it to our handler
+func (files *fileState) receive(offer FileOffer) {
+	files.mu.Lock()
+	id := offer.ID()
+	if _, ok := files.offers[id]; !ok {
+		files.order = append(files.order, id)
+	}
+	files.offers[id] = offer
+	if len(files.order) > maxFileOffers {
+		delete(files.offers, files.order[0])
+		files.order = files.order[1:]
+	}
+	handler := files.handler
+	files.mu.Unlock()
+	if handler != nil {
+		handler(offer)
+	}
+}
+
+// find returns the offer with some ID, which can be shortened as long as it stays unique
+func (files *fileState) find(id string) (FileOffer, error) {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	if offer, ok := files.offers[id]; ok {
+		return offer, nil
+	}
+	var found []FileOffer
+	for full, offer := range files.offers {
+		if id != "" && strings.HasPrefix(full, id) {
+			found = append(found, offer)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return FileOffer{}, fmt.Errorf("No file offer with ID %q", id)
+	case 1:
+		return found[0], nil
+	default:
+		return FileOffer{}, fmt.Errorf("Several file offers start with %q", id)
+	}
+}
+
+// list returns the offers we know about, oldest first
+func (files *fileState) list() []FileOffer {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	offers := make([]FileOffer, 0, len(files.order))
+	for _, id := range files.order {
+		offers = append(offers, files.offers[id])
+	}
+	return offers
+}
+
+// startDownload marks a file as being downloaded, unless it already is
+func (files *fileState) startDownload(hash protocol.FileHash) bool {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	if files.downloading[hash] {
+		return false
+	}
+	files.downloading[hash] = true
+	return true
+}
+
+func (files *fileState) stopDownload(hash protocol.FileHash) {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	delete(files.downloading, hash)
+}
+
+// hashFile finds the size and hash of a file
+func hashFile(f *os.File) (int64, protocol.FileHash, error) {
+	var hash protocol.FileHash
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, hash, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, hash, err
+	}
+	copy(hash[:], h.Sum(nil))
+	return size, hash, nil
+}
+
+// chunkSize is how much of a file we send at once, staying under our limits
+func (client *normalClient) chunkSize() int {
+	size := fileChunkSize
+	if max := client.limits.MaxContent; max > 0 && max < size {
+		size = max
+	}
+	return size
+}
+
+// serveFile answers a FileRequest with the rest of the file, one chunk at a time
+func (client *normalClient) serveFile(conn net.Conn, req protocol.FileRequest) {
+	defer conn.Close()
+	path, ok := client.files.path(req.Hash)
+	if !ok {
+		client.log.Println("Refusing request for a file we don't offer ", req.Hash)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		client.log.Println("Couldn't open offered file ", err)
+		return
+	}
+	defer f.Close()
+	buf := make([]byte, client.chunkSize())
+	offset := req.Offset
+	for {
+		n, err := f.ReadAt(buf, int64(offset))
+		if n > 0 {
+			conn.SetWriteDeadline(time.Now().Add(queryTimeout))
+			if err := sendMessage(conn, protocol.FileChunk{Offset: offset, Data: buf[:n]}); err != nil {
+				client.log.Println("Error sending file chunk ", err)
+				return
+			}
+			offset += uint64(n)
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			client.log.Println("Error reading offered file ", err)
+			return
+		}
+	}
+}
+
+// fetch downloads as much of a file as it can into f, starting at offset
+//
+// It returns how many bytes it got, even if the transfer failed half way.
+func (d dialer) fetch(offer FileOffer, f *os.File, offset int64, progress func(FileProgress)) (int64, error) {
+	conn, in, _, err := d.dial(offer.Sender, protocol.FeatureFiles)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(queryTimeout))
+	if err := sendMessage(conn, protocol.FileRequest{Hash: offer.Hash, Offset: uint64(offset)}); err != nil {
+		return 0, err
+	}
+	received := int64(0)
+	for offset+received < offer.Size {
+		conn.SetReadDeadline(time.Now().Add(queryTimeout))
+		msg, err := in.Decode()
+		if err == io.EOF && received == 0 {
+			return 0, fmt.Errorf("%v isn't offering %s anymore", offer.Sender, offer.Name)
+		}
+		if err != nil {
+			return received, err
+		}
+		chunk, ok := msg.(protocol.FileChunk)
+		if !ok {
+			return received, fmt.Errorf("Unexpected %T while downloading from %v", msg, offer.Sender)
+		}
+		at := offset + received
+		if chunk.Offset != uint64(at) || int64(len(chunk.Data)) > offer.Size-at {
+			return received, fmt.Errorf("Unexpected chunk at %d while downloading from %v", chunk.Offset, offer.Sender)
+		}
+		if _, err := f.WriteAt(chunk.Data, at); err != nil {
+			return received, err
+		}
+		received += int64(len(chunk.Data))
+		if progress != nil {
+			progress(FileProgress{Offer: offer, Received: at + int64(len(chunk.Data))})
+		}
+	}
+	return received, nil
+}
+
+// download saves a file to path, going through a partial file next to it
+//
+// A partial file left by an earlier download is picked up where it stopped,
+// and dropped if the whole file doesn't match the hash of the offer.
+func (d dialer) download(offer FileOffer, path string, progress func(FileProgress)) error {
+	part := path + ".part"
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	received := info.Size()
+	if received > offer.Size {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		received = 0
+	}
+	failures := 0
+	for received < offer.Size {
+		got, err := d.fetch(offer, f, received, progress)
+		received += got
+		if err == nil {
+			continue
+		}
+		if got > 0 {
+			failures = 0
+		}
+		failures++
+		if failures >= maxFileRetries {
+			return err
+		}
+	}
+	_, hash, err := hashFile(f)
+	if err != nil {
+		return err
+	}
+	if hash != offer.Hash {
+		f.Close()
+		os.Remove(part)
+		return fmt.Errorf("%s doesn't match the hash it was offered with", offer.Name)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, path)
+}
+
+// getFile downloads an offered file into a directory, returning where it was saved
+func (client *normalClient) getFile(id string, dir string, progress func(FileProgress)) (string, error) {
+	offer, err := client.files.find(id)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, offer.Name)
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("%s already exists", path)
+	}
+	if !client.files.startDownload(offer.Hash) {
+		return "", fmt.Errorf("Already downloading %s", offer.Name)
+	}
+	defer client.files.stopDownload(offer.Hash)
+	if err := client.dialer().download(offer, path, progress); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// offerFile shares a file with the rest of the swarm
+func (client *normalClient) offerFile(path string) (FileOffer, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return FileOffer{}, err
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return FileOffer{}, err
+	}
+	defer f.Close()
+	size, hash, err := hashFile(f)
+	if err != nil {
+		return FileOffer{}, err
+	}
+	offer := FileOffer{
+		Name:   filepath.Base(abs),
+		Size:   size,
+		Hash:   hash,
+		Sender: client.advertisedAddr,
+	}
+	if !validFileName(offer.Name) {
+		return FileOffer{}, fmt.Errorf("Can't offer %q", path)
+	}
+	env := protocol.Envelope{Sender: client.advertisedAddr, Kind: fileOfferKind, Fields: offer.fields()}
+	if err := client.limits.CheckEnvelope(env); err != nil {
+		return FileOffer{}, err
+	}
+	client.files.share(hash, abs)
+	return offer, client.broadcast(env)
+}
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// offerTestFile offers a file of some size from the first node, and waits for the others to see it
+func offerTestFile(t *testing.T, swarms []*SwarmHandle, dir string, size int) ([]byte, FileOffer) {
+	contents := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(contents)
+	path := filepath.Join(dir, "screenshot.png")
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	offers := make(chan FileOffer, len(swarms))
+	for _, swarm := range swarms[1:] {
+		swarm.HandleFileOffers(func(offer FileOffer) {
+			offers <- offer
+		})
+	}
+	sent, err := swarms[0].OfferFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 1; i < len(swarms); i++ {
+		select {
+		case offer := <-offers:
+			if offer != sent {
+				t.Errorf("Expected %v got %v", sent, offer)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only %d of %d nodes got the offer", i-1, len(swarms)-1)
+		}
+	}
+	return contents, sent
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ripple")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return dir
+}
+
+func TestGetFile(t *testing.T) {
+	swarms := makeSwarm(t, NewMemoryTransport(), memoryAddrs(3))
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	contents, offer := offerTestFile(t, swarms, dir, 3*fileChunkSize+100)
+	if offer.Name != "screenshot.png" || offer.Size != int64(len(contents)) {
+		t.Errorf("Unexpected offer %v", offer)
+	}
+	downloads := filepath.Join(dir, "downloads")
+	os.Mkdir(downloads, 0755)
+	var events []FileProgress
+	path, err := swarms[2].GetFile(offer.ID()[:6], downloads, func(p FileProgress) {
+		events = append(events, p)
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("Expected the downloaded file to match the offered one")
+	}
+	if len(events) != 4 || events[3].Received != offer.Size {
+		t.Errorf("Expected 4 progress events ending at %d got %v", offer.Size, events)
+	}
+	if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial file to be gone, got %v", err)
+	}
+	if _, err := swarms[2].GetFile(offer.ID(), downloads, nil); err == nil {
+		t.Errorf("Expected a file that already exists not to be overwritten")
+	}
+	if _, err := swarms[1].GetFile("nothing", downloads, nil); err == nil {
+		t.Errorf("Expected an unknown ID to be refused")
+	}
+}
+
+func TestGetFileResumes(t *testing.T) {
+	swarms := makeSwarm(t, NewMemoryTransport(), memoryAddrs(2))
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	contents, offer := offerTestFile(t, swarms, dir, 2*fileChunkSize)
+	downloads := filepath.Join(dir, "downloads")
+	os.Mkdir(downloads, 0755)
+	part := filepath.Join(downloads, offer.Name+".part")
+	if err := ioutil.WriteFile(part, contents[:fileChunkSize+10], 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var first int64
+	path, err := swarms[1].GetFile(offer.ID(), downloads, func(p FileProgress) {
+		if first == 0 {
+			first = p.Received
+		}
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first != 2*fileChunkSize {
+		t.Errorf("Expected the download to resume in a single chunk, got %d bytes first", first)
+	}
+	if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, contents) {
+		t.Errorf("Expected the resumed file to match the offered one")
+	}
+}
+
+func TestGetFileChecksHash(t *testing.T) {
+	swarms := makeSwarm(t, NewMemoryTransport(), memoryAddrs(2))
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	_, offer := offerTestFile(t, swarms, dir, 1000)
+	downloads := filepath.Join(dir, "downloads")
+	os.Mkdir(downloads, 0755)
+	part := filepath.Join(downloads, offer.Name+".part")
+	if err := ioutil.WriteFile(part, []byte("corrupted"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := swarms[1].GetFile(offer.ID(), downloads, nil); err == nil {
+		t.Errorf("Expected a corrupted download to fail")
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Errorf("Expected the corrupted partial file to be removed, got %v", err)
+	}
+	// the next attempt starts over
+	if _, err := swarms[1].GetFile(offer.ID(), downloads, nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+const (
+	// idBits is the size of an ID, and so how many fingers we have
+	idBits = 64
+	// maxLookupHops bounds how many nodes a lookup asks before giving up
+	maxLookupHops = 256
+)
+
+// FingerConfig controls the finger table a node keeps for lookups
+//
+// Nodes have an ID on a hash ring, derived from their address, and join
+// the swarm in the order of their IDs. With fingers pointing to the nodes
+// responsible for the IDs 1, 2, 4, 8... after ours, finding the node
+// responsible for any ID takes a logarithmic number of hops.
+type FingerConfig struct {
+	// Interval is how often we check our neighbors and fix our fingers
+	//
+	// This defaults to 10 seconds, and a negative interval leaves this
+	// up to SwarmHandle.FixFingers.
+	Interval time.Duration
+}
+
+func (config FingerConfig) withDefaults() FingerConfig {
+	if config.Interval == 0 {
+		config.Interval = 10 * time.Second
+	}
+	return config
+}
+
+// finger is a node in our finger table, along with its ID
+type finger struct {
+	addr net.Addr
+	id   protocol.ID
+}
+
+func makeFinger(addr net.Addr) finger {
+	return finger{addr: addr, id: protocol.IDOf(addr)}
+}
+
+// fingerTable holds the fingers of a node
+type fingerTable struct {
+	mu sync.RWMutex
+	// fingers[i] is responsible for our ID + 2^i, with a nil addr if unknown
+	fingers [idBits]finger
+}
+
+func (table *fingerTable) get(i int) finger {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	return table.fingers[i]
+}
+
+func (table *fingerTable) set(i int, f finger) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.fingers[i] = f
+}
+
+// clear forgets every finger, since they can't be trusted anymore
+func (table *fingerTable) clear() {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.fingers = [idBits]finger{}
+}
+
+// closestPreceding returns the finger closest before an ID, if we have one
+func (table *fingerTable) closestPreceding(me protocol.ID, id protocol.ID) (net.Addr, bool) {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	for i := idBits - 1; i >= 0; i-- {
+		f := table.fingers[i]
+		if f.addr != nil && f.id != id && f.id.Between(me, id) {
+			return f.addr, true
+		}
+	}
+	return nil, false
+}
+
+// lookupStep answers a Lookup with what we know
+func (client *normalClient) lookupStep(id protocol.ID) protocol.LookupReply {
+	succ := client.state.getSucc().addr
+	if id.Between(client.id, protocol.IDOf(succ)) {
+		return protocol.LookupReply{Done: true, Addr: succ}
+	}
+	if addr, ok := client.fingers.closestPreceding(client.id, id); ok {
+		return protocol.LookupReply{Addr: addr}
+	}
+	return protocol.LookupReply{Addr: succ}
+}
+
+// resolve finds the node responsible for an ID, by asking nodes closer and closer to it
+//
+// It also returns the node that knew the answer, which comes right before
+// the responsible node in the ring, and how many nodes were asked.
+func (d dialer) resolve(reply protocol.LookupReply, from net.Addr, id protocol.ID) (net.Addr, net.Addr, int, error) {
+	hops := 0
+	for !reply.Done {
+		if hops >= maxLookupHops {
+			return nil, nil, hops, fmt.Errorf("Lookup of %v took more than %d hops", id, maxLookupHops)
+		}
+		from = reply.Addr
+		msg, err := d.query(from, protocol.Lookup{ID: id})
+		if err != nil {
+			return nil, nil, hops, err
+		}
+		hops++
+		var ok bool
+		if reply, ok = msg.(protocol.LookupReply); !ok {
+			return nil, nil, hops, fmt.Errorf("Unexpected answer to Lookup from %v: %v", from, msg)
+		}
+	}
+	return reply.Addr, from, hops, nil
+}
+
+// lookup finds the node responsible for an ID, starting with our own fingers
+func (client *normalClient) lookup(id protocol.ID) (net.Addr, int, error) {
+	addr, _, hops, err := client.dialer().resolve(client.lookupStep(id), client.advertisedAddr, id)
+	return addr, hops, err
+}
+
+// fingerLoop fixes our fingers every so often
+func (client *normalClient) fingerLoop() {
+	if client.fingerConfig.Interval < 0 {
+		return
+	}
+	for {
+		time.Sleep(client.fingerConfig.Interval)
+		if err := client.stabilize(); err != nil {
+			client.log.Println("Stabilization failed ", err)
+			continue
+		}
+		if err := client.fixFingers(); err != nil {
+			client.log.Println("Couldn't fix fingers ", err)
+		}
+	}
+}
+
+// stabilize checks that our Successor agrees that we're its Predecessor,
+// and that we're in the right place on the ring
+//
+// The ring itself is maintained by the join protocol, but a node that joined
+// at the same time as another may end up out of order. Our fingers can't
+// be trusted then, so we forget them, and lookups fall back to the ring.
+func (client *normalClient) stabilize() error {
+	succ := client.state.getSucc().addr
+	msg, err := client.dialer().query(succ, protocol.GetNeighbors{})
+	if err != nil {
+		return err
+	}
+	neighbors, ok := msg.(protocol.Neighbors)
+	if !ok {
+		return fmt.Errorf("Unexpected answer to GetNeighbors from %v: %v", succ, msg)
+	}
+	if !sameAddr(neighbors.Pred, client.advertisedAddr) {
+		return fmt.Errorf("Our Successor %v has %v as its Predecessor", succ, neighbors.Pred)
+	}
+	pred := client.state.getPred().addr
+	if !client.id.Between(protocol.IDOf(pred), protocol.IDOf(succ)) {
+		client.fingers.clear()
+		return fmt.Errorf("Out of order between %v and %v", pred, succ)
+	}
+	return nil
+}
+
+// fixFingers looks up the node responsible for each of our fingers
+//
+// Consecutive fingers are often the same node, which we can tell without
+// a lookup. Each finger is used as soon as it's found, to find the next one.
+func (client *normalClient) fixFingers() error {
+	prev := finger{}
+	for i := 0; i < idBits; i++ {
+		start := client.id + 1<<uint(i)
+		if prev.addr != nil && start.Between(client.id, prev.id) {
+			client.fingers.set(i, prev)
+			continue
+		}
+		addr, _, err := client.lookup(start)
+		if err != nil {
+			return err
+		}
+		prev = makeFinger(addr)
+		client.fingers.set(i, prev)
+	}
+	return nil
+}
+
+// findPlace finds the node a new node should join through, to keep the ring in order
+//
+// That's the node right before the one responsible for its ID.
+func (d dialer) findPlace(start net.Addr, me net.Addr) (net.Addr, error) {
+	_, place, _, err := d.resolve(protocol.LookupReply{Addr: start}, start, protocol.IDOf(me))
+	return place, err
+}
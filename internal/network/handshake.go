@@ -0,0 +1,61 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+// handshakeTimeout bounds how long a peer can take to introduce itself
+const handshakeTimeout = 10 * time.Second
+
+// greet performs the handshake on a connection we dialed
+//
+// We send a Hello, and find out what the other end supports from its HelloAck.
+func greet(conn net.Conn, in *protocol.Decoder, hello protocol.Hello) (protocol.Session, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := sendMessage(conn, hello); err != nil {
+		return protocol.Session{}, err
+	}
+	msg, err := in.Decode()
+	if err != nil {
+		return protocol.Session{}, err
+	}
+	ack, ok := msg.(protocol.HelloAck)
+	if !ok {
+		return protocol.Session{}, fmt.Errorf("Expected HelloAck from %v, got %T", conn.RemoteAddr(), msg)
+	}
+	session, err := hello.Negotiate(protocol.Hello(ack))
+	if err != nil {
+		return protocol.Session{}, fmt.Errorf("Refusing %v: %v", conn.RemoteAddr(), err)
+	}
+	return session, nil
+}
+
+// welcome performs the handshake on a connection we accepted
+//
+// We always answer with our HelloAck, even to an incompatible peer,
+// so that it can tell why we're hanging up.
+func welcome(conn net.Conn, in *protocol.Decoder, hello protocol.Hello) (protocol.Session, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	msg, err := in.Decode()
+	if err != nil {
+		return protocol.Session{}, err
+	}
+	peerHello, ok := msg.(protocol.Hello)
+	if !ok {
+		return protocol.Session{}, fmt.Errorf("Expected Hello from %v, got %T", conn.RemoteAddr(), msg)
+	}
+	if err := sendMessage(conn, protocol.HelloAck(hello)); err != nil {
+		return protocol.Session{}, err
+	}
+	session, err := hello.Negotiate(peerHello)
+	if err != nil {
+		return protocol.Session{}, fmt.Errorf("Refusing %v: %v", conn.RemoteAddr(), err)
+	}
+	return session, nil
+}
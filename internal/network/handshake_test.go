@@ -0,0 +1,77 @@
+package network
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+func TestIncompatiblePeerIsRefused(t *testing.T) {
+	transport := NewMemoryTransport()
+	swarms := makeSwarm(t, transport, memoryAddrs(2))
+	conn, err := transport.Dial(swarms[0].Addr())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	future := protocol.Hello{Version: protocol.Version + 10, MinVersion: protocol.Version + 10}
+	if err := sendMessage(conn, future); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	in := newDecoder(conn, transport, protocol.DefaultLimits)
+	msg, err := in.Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := protocol.HelloAck(protocol.LocalHello())
+	if msg != expected {
+		t.Errorf("Expected %v got %v", expected, msg)
+	}
+	if msg, err := in.Decode(); err == nil {
+		t.Errorf("Expected the connection to be closed, got %v", msg)
+	}
+	checkBroadcast(t, swarms, 1)
+}
+
+func TestHandshakeIsRequired(t *testing.T) {
+	transport := NewMemoryTransport()
+	swarms := makeSwarm(t, transport, memoryAddrs(2))
+	conn, err := transport.Dial(swarms[0].Addr())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := sendMessage(conn, protocol.JoinSwarm{Addr: MemoryAddr("rude")}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	in := newDecoder(conn, transport, protocol.DefaultLimits)
+	if msg, err := in.Decode(); err == nil {
+		t.Errorf("Expected the connection to be closed, got %v", msg)
+	}
+	checkBroadcast(t, swarms, 0)
+}
+
+func TestJoiningIncompatibleSwarmFails(t *testing.T) {
+	transport := NewMemoryTransport()
+	l, err := transport.Listen(MemoryAddr("old"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer l.Close()
+	// an old node refuses every connection, including our lookup
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			in := newDecoder(conn, transport, protocol.DefaultLimits)
+			in.Decode()
+			sendMessage(conn, protocol.HelloAck{Version: 0, MinVersion: 0})
+		}
+	}()
+	config := Config{Transport: transport, ListenAddr: MemoryAddr("new")}
+	_, err = JoinSwarm(config, MemoryAddr("old"))
+	if err == nil || !strings.Contains(err.Error(), "Incompatible peer") {
+		t.Errorf("Expected an incompatible peer error got %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// memoryBacklog is how many connections can wait to be accepted
+const memoryBacklog = 16
+
+var (
+	errMemoryRefused = errors.New("connection refused")
+	errMemoryInUse   = errors.New("address already in use")
+	errMemoryClosed  = errors.New("listener closed")
+)
+
+// MemoryAddr is the address of a node using a MemoryTransport
+type MemoryAddr string
+
+// Network returns the name of the memory network
+func (addr MemoryAddr) Network() string {
+	return "memory"
+}
+
+// String returns the address itself
+func (addr MemoryAddr) String() string {
+	return string(addr)
+}
+
+// MemoryTransport connects nodes living in the same process
+//
+// Connections are made with net.Pipe, so no ports are ever opened.
+// All of the nodes that want to talk to each other need to share
+// the same MemoryTransport.
+type MemoryTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*memoryListener
+	// dials lets us give a unique local address to each dialed connection
+	dials int
+}
+
+// NewMemoryTransport creates a new in memory network, with no listeners
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{listeners: make(map[string]*memoryListener)}
+}
+
+// Dial connects to a listener in this transport
+func (t *MemoryTransport) Dial(addr net.Addr) (net.Conn, error) {
+	t.mu.Lock()
+	l, ok := t.listeners[addr.String()]
+	t.dials++
+	local := MemoryAddr(fmt.Sprintf("dial-%d", t.dials))
+	t.mu.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: addr.Network(), Addr: addr, Err: errMemoryRefused}
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &memoryConn{Conn: server, local: l.addr, remote: local}:
+		return &memoryConn{Conn: client, local: local, remote: l.addr}, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: addr.Network(), Addr: addr, Err: errMemoryRefused}
+	}
+}
+
+// Listen registers a new listener at an address
+func (t *MemoryTransport) Listen(addr net.Addr) (net.Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.listeners[addr.String()]; ok {
+		return nil, &net.OpError{Op: "listen", Net: addr.Network(), Addr: addr, Err: errMemoryInUse}
+	}
+	l := &memoryListener{
+		transport: t,
+		addr:      MemoryAddr(addr.String()),
+		conns:     make(chan net.Conn, memoryBacklog),
+		done:      make(chan struct{}),
+	}
+	t.listeners[addr.String()] = l
+	return l, nil
+}
+
+// ResolveAddr accepts any non empty address on the memory network
+func (t *MemoryTransport) ResolveAddr(network, address string) (net.Addr, error) {
+	if network != "memory" {
+		return nil, fmt.Errorf("Unsupported network: %q", network)
+	}
+	if address == "" {
+		return nil, errors.New("empty memory address")
+	}
+	return MemoryAddr(address), nil
+}
+
+// memoryListener implements net.Listener for a MemoryTransport
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      MemoryAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept waits for the next connection to this listener
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: l.addr.Network(), Addr: l.addr, Err: errMemoryClosed}
+	}
+}
+
+// Close stops the listener, and frees up its address
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.transport.mu.Lock()
+		delete(l.transport.listeners, l.addr.String())
+		l.transport.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns the address this listener was registered at
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memoryConn gives the pipes created by net.Pipe meaningful addresses
+type memoryConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (conn *memoryConn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+func (conn *memoryConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
@@ -0,0 +1,280 @@
+package network
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+var (
+	errOutboxClosed = errors.New("connection is closed")
+	errQueueFull    = errors.New("send queue is full")
+	errUnsupported  = errors.New("peer doesn't support this message")
+)
+
+// Backpressure decides what happens when a peer's send queue is full
+type Backpressure int
+
+const (
+	// Block waits until there's room in the queue
+	Block Backpressure = iota
+	// DropOldest throws away the oldest broadcast in the queue
+	DropOldest
+	// Disconnect gives up on the peer, closing the connection
+	Disconnect
+)
+
+// String returns the name of a policy
+func (policy Backpressure) String() string {
+	switch policy {
+	case Block:
+		return "block"
+	case DropOldest:
+		return "drop-oldest"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// QueueConfig controls the queue of messages waiting to be sent to each peer
+//
+// Only broadcasts, like text messages, are subject to the limit. Messages
+// maintaining the ring are always queued, since losing them would break it.
+type QueueConfig struct {
+	// Size is how many broadcasts can wait to be sent, defaulting to 256
+	Size int
+	// Policy decides what to do with a broadcast when the queue is full
+	Policy Backpressure
+	// WriteTimeout is how long a single write can take, defaulting to 10 seconds
+	WriteTimeout time.Duration
+}
+
+func (config QueueConfig) withDefaults() QueueConfig {
+	if config.Size <= 0 {
+		config.Size = 256
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = 10 * time.Second
+	}
+	return config
+}
+
+// QueueStats describes the send queue of one of our peers
+type QueueStats struct {
+	// Addr is the address of the peer
+	Addr net.Addr
+	// Role is what this peer is to us, e.g. "pred" or "succ"
+	Role string
+	// Depth is how many messages are waiting to be sent
+	Depth int
+	// MaxDepth is the deepest the queue has ever been
+	MaxDepth int
+	// Sent is how many messages have been written
+	Sent uint64
+	// Dropped is how many broadcasts were thrown away because the queue was full
+	Dropped uint64
+}
+
+// queued is a message waiting in an outbox
+type queued struct {
+	msg       protocol.Message
+	broadcast bool
+}
+
+// outbox owns the writing side of a connection
+//
+// Messages are queued, and a dedicated goroutine writes them in order,
+// so that a slow peer never blocks the rest of the node.
+type outbox struct {
+	conn net.Conn
+	// encoder buffers writes to conn, until the queue runs dry
+	encoder *protocol.Encoder
+	// perFrame flushes after every message, for connections that need them apart
+	perFrame bool
+	// session is what we agreed on with the peer during the handshake
+	session protocol.Session
+	config  QueueConfig
+	log     *log.Logger
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []queued
+	// broadcasts is how many of the queued messages are broadcasts
+	broadcasts int
+	// closing is set once no more messages will be queued
+	closing bool
+	// failed is set once the connection can no longer be written to
+	failed   bool
+	maxDepth int
+	sent     uint64
+	dropped  uint64
+}
+
+// framedConn is a connection that needs each message written with a call to Write of its own
+//
+// Otherwise, messages are buffered, and written together when several are queued.
+type framedConn interface {
+	net.Conn
+	// WritesFrames reports whether each message needs its own Write
+	WritesFrames() bool
+}
+
+// newOutbox starts a goroutine writing the messages queued for conn
+func newOutbox(conn net.Conn, session protocol.Session, config QueueConfig, log *log.Logger) *outbox {
+	out := &outbox{
+		conn:    conn,
+		encoder: protocol.NewEncoder(conn),
+		session: session,
+		config:  config.withDefaults(),
+		log:     log,
+	}
+	out.encoder.SetSession(session)
+	if framed, ok := conn.(framedConn); ok {
+		out.perFrame = framed.WritesFrames()
+	}
+	out.cond = sync.NewCond(&out.mu)
+	go out.writeLoop()
+	return out
+}
+
+// control queues a message used to maintain the ring
+//
+// These are never dropped, and never wait for room in the queue.
+func (out *outbox) control(msg protocol.Message) error {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.closing || out.failed {
+		return errOutboxClosed
+	}
+	out.push(queued{msg, false})
+	return nil
+}
+
+// broadcast queues a message, following the backpressure policy when full
+func (out *outbox) broadcast(msg protocol.Message) error {
+	msg = protocol.Downgrade(msg, out.session.Features)
+	if !out.session.Features.Has(protocol.RequiredFeatures(msg)) {
+		return errUnsupported
+	}
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	for !out.closing && !out.failed && out.broadcasts >= out.config.Size {
+		switch out.config.Policy {
+		case DropOldest:
+			out.dropOldest()
+		case Disconnect:
+			out.fail()
+			return errQueueFull
+		default:
+			out.cond.Wait()
+		}
+	}
+	if out.closing || out.failed {
+		return errOutboxClosed
+	}
+	out.push(queued{msg, true})
+	return nil
+}
+
+// push must be called under a lock
+func (out *outbox) push(q queued) {
+	out.queue = append(out.queue, q)
+	if q.broadcast {
+		out.broadcasts++
+	}
+	if len(out.queue) > out.maxDepth {
+		out.maxDepth = len(out.queue)
+	}
+	out.cond.Broadcast()
+}
+
+// dropOldest must be called under a lock
+func (out *outbox) dropOldest() {
+	for i, q := range out.queue {
+		if q.broadcast {
+			out.queue = append(out.queue[:i], out.queue[i+1:]...)
+			out.broadcasts--
+			out.dropped++
+			return
+		}
+	}
+}
+
+// fail must be called under a lock
+func (out *outbox) fail() {
+	out.failed = true
+	out.queue = nil
+	out.broadcasts = 0
+	out.conn.Close()
+	out.cond.Broadcast()
+}
+
+// close lets the queued messages be written, and then closes the connection
+func (out *outbox) close() {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	out.closing = true
+	out.cond.Broadcast()
+}
+
+// usable checks if messages can still be queued
+func (out *outbox) usable() bool {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	return !out.closing && !out.failed
+}
+
+func (out *outbox) stats() (depth, maxDepth int, sent, dropped uint64) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	return len(out.queue), out.maxDepth, out.sent, out.dropped
+}
+
+func (out *outbox) writeLoop() {
+	for {
+		out.mu.Lock()
+		for len(out.queue) == 0 && !out.closing && !out.failed {
+			out.cond.Wait()
+		}
+		if out.failed || len(out.queue) == 0 {
+			// either we've failed, or we're closing with nothing left to write
+			if !out.failed {
+				out.conn.Close()
+			}
+			out.mu.Unlock()
+			return
+		}
+		next := out.queue[0]
+		out.queue = out.queue[1:]
+		if next.broadcast {
+			out.broadcasts--
+		}
+		// only the writer takes things out, so more messages are sure to follow
+		more := len(out.queue) > 0
+		// there's room for blocked broadcasts now
+		out.cond.Broadcast()
+		out.mu.Unlock()
+
+		out.conn.SetWriteDeadline(time.Now().Add(out.config.WriteTimeout))
+		err := out.encoder.Encode(next.msg)
+		if err == nil && (!more || out.perFrame) {
+			err = out.encoder.Flush()
+		}
+		out.mu.Lock()
+		if err != nil {
+			if !out.failed {
+				out.log.Printf("Error writing to %v: %v\n", out.conn.RemoteAddr(), err)
+				out.fail()
+			}
+			out.mu.Unlock()
+			return
+		}
+		out.sent++
+		out.mu.Unlock()
+	}
+}
@@ -0,0 +1,281 @@
+package network
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+// stuckOutbox returns an outbox whose writer is blocked sending a first message
+//
+// Nothing is read from the other end until the test does it.
+func stuckOutbox(t *testing.T, config QueueConfig) (*outbox, net.Conn) {
+	ours, theirs := net.Pipe()
+	out := newOutbox(ours, protocol.Session{}, config, log.New(ioutil.Discard, "", 0))
+	if err := out.broadcast(textMessage("first")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waitFor(t, "writer to pick up the first message", func() bool {
+		depth, _, _, _ := out.stats()
+		return depth == 0
+	})
+	return out, theirs
+}
+
+func textMessage(content string) protocol.Message {
+	return protocol.NewMessage{Sender: MemoryAddr("sender"), Content: content}
+}
+
+// readContents reads text messages until the connection is closed
+func readContents(t *testing.T, conn net.Conn) []string {
+	var contents []string
+	for {
+		msg, err := protocol.ReadMessageWith(conn, NewMemoryTransport().ResolveAddr)
+		if err == io.EOF {
+			return contents
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		newMsg, ok := msg.(protocol.NewMessage)
+		if !ok {
+			t.Fatalf("Expected a NewMessage got %v", msg)
+		}
+		contents = append(contents, newMsg.Content)
+	}
+}
+
+func sameContents(expected, got []string) bool {
+	if len(expected) != len(got) {
+		return false
+	}
+	for i := range expected {
+		if expected[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOutboxDrainsOnClose(t *testing.T) {
+	out, theirs := stuckOutbox(t, QueueConfig{})
+	for _, content := range []string{"second", "third"} {
+		if err := out.broadcast(textMessage(content)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	out.close()
+	if err := out.broadcast(textMessage("late")); err != errOutboxClosed {
+		t.Errorf("Expected %v got %v", errOutboxClosed, err)
+	}
+	expected := []string{"first", "second", "third"}
+	got := readContents(t, theirs)
+	if !sameContents(expected, got) {
+		t.Errorf("Expected %v got %v", expected, got)
+	}
+	_, maxDepth, sent, _ := out.stats()
+	if maxDepth != 2 {
+		t.Errorf("Expected max depth 2 got %d", maxDepth)
+	}
+	if sent != 3 {
+		t.Errorf("Expected 3 sent got %d", sent)
+	}
+}
+
+func TestOutboxDropOldest(t *testing.T) {
+	out, theirs := stuckOutbox(t, QueueConfig{Size: 2, Policy: DropOldest})
+	for _, content := range []string{"second", "third", "fourth"} {
+		if err := out.broadcast(textMessage(content)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	out.close()
+	expected := []string{"first", "third", "fourth"}
+	got := readContents(t, theirs)
+	if !sameContents(expected, got) {
+		t.Errorf("Expected %v got %v", expected, got)
+	}
+	if _, _, _, dropped := out.stats(); dropped != 1 {
+		t.Errorf("Expected 1 dropped got %d", dropped)
+	}
+}
+
+func TestOutboxDisconnect(t *testing.T) {
+	out, theirs := stuckOutbox(t, QueueConfig{Size: 1, Policy: Disconnect})
+	if err := out.broadcast(textMessage("second")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := out.broadcast(textMessage("third")); err != errQueueFull {
+		t.Errorf("Expected %v got %v", errQueueFull, err)
+	}
+	if err := out.control(protocol.Ping{}); err != errOutboxClosed {
+		t.Errorf("Expected %v got %v", errOutboxClosed, err)
+	}
+	buf := make([]byte, 1)
+	theirs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := theirs.Read(buf); err != nil {
+			if err != io.EOF {
+				t.Errorf("Expected %v got %v", io.EOF, err)
+			}
+			break
+		}
+	}
+}
+
+func TestOutboxBlocks(t *testing.T) {
+	out, theirs := stuckOutbox(t, QueueConfig{Size: 1, Policy: Block})
+	if err := out.broadcast(textMessage("second")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	queued := make(chan error, 1)
+	go func() {
+		queued <- out.broadcast(textMessage("third"))
+	}()
+	select {
+	case err := <-queued:
+		t.Fatalf("Expected broadcast to block, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	// control messages skip the limit
+	if err := out.control(protocol.Ping{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	first, err := protocol.ReadMessageWith(theirs, NewMemoryTransport().ResolveAddr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first != textMessage("first") {
+		t.Errorf("Expected %v got %v", textMessage("first"), first)
+	}
+	select {
+	case err := <-queued:
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Broadcast still blocked after room was made")
+	}
+	out.close()
+	theirs.Close()
+}
+
+func TestOutboxWriteTimeout(t *testing.T) {
+	out, _ := stuckOutbox(t, QueueConfig{WriteTimeout: 10 * time.Millisecond})
+	waitFor(t, "outbox to fail", func() bool {
+		return out.broadcast(textMessage("again")) == errOutboxClosed
+	})
+}
+
+func TestQueueStats(t *testing.T) {
+	transport := NewMemoryTransport()
+	swarms := makeSwarm(t, transport, memoryAddrs(3))
+	for _, swarm := range swarms {
+		stats := swarm.QueueStats()
+		if len(stats) != 2 {
+			t.Fatalf("Expected 2 queues got %v", stats)
+		}
+		if !sameAddr(stats[0].Addr, swarm.Predecessor()) {
+			t.Errorf("Expected %v got %v", swarm.Predecessor(), stats[0].Addr)
+		}
+		if stats[1].Role != "succ" {
+			t.Errorf("Expected %q got %q", "succ", stats[1].Role)
+		}
+	}
+	checkBroadcast(t, swarms, 0)
+	waitFor(t, "broadcast to be sent", func() bool {
+		stats := swarms[0].QueueStats()
+		return stats[1].Sent > 0 && stats[1].Depth == 0
+	})
+}
+
+func TestOutboxNeedsFeatures(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	out := newOutbox(ours, protocol.Session{}, QueueConfig{}, log.New(ioutil.Discard, "", 0))
+	defer out.close()
+	env := protocol.Envelope{Sender: MemoryAddr("sender"), Kind: "kind"}
+	if err := out.broadcast(env); err != errUnsupported {
+		t.Errorf("Expected %v got %v", errUnsupported, err)
+	}
+}
+
+func TestOutboxDowngradesPosts(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	out := newOutbox(ours, protocol.Session{}, QueueConfig{}, log.New(ioutil.Discard, "", 0))
+	defer out.close()
+	sender := MemoryAddr("sender")
+	if err := out.broadcast(protocol.Post{Sender: sender, ID: 1, Content: "hi"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	in := protocol.NewDecoder(theirs, NewMemoryTransport().ResolveAddr)
+	msg, err := in.Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := protocol.NewMessage{Sender: sender, Content: "hi"}
+	if msg != protocol.Message(expected) {
+		t.Errorf("Expected %v got %v", expected, msg)
+	}
+}
+
+// countingConn counts the calls to Write, asking for one per message if framed is set
+type countingConn struct {
+	net.Conn
+	framed bool
+	mu     sync.Mutex
+	writes int
+}
+
+func (conn *countingConn) Write(data []byte) (int, error) {
+	conn.mu.Lock()
+	conn.writes++
+	conn.mu.Unlock()
+	return conn.Conn.Write(data)
+}
+
+func (conn *countingConn) WritesFrames() bool {
+	return conn.framed
+}
+
+func TestOutboxFrames(t *testing.T) {
+	cases := []struct {
+		framed bool
+		writes int
+	}{
+		// the two messages queued behind the first are written together
+		{false, 2},
+		{true, 3},
+	}
+	for _, c := range cases {
+		ours, theirs := net.Pipe()
+		conn := &countingConn{Conn: ours, framed: c.framed}
+		out := newOutbox(conn, protocol.Session{}, QueueConfig{}, log.New(ioutil.Discard, "", 0))
+		if err := out.broadcast(textMessage("first")); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		waitFor(t, "writer to pick up the first message", func() bool {
+			depth, _, _, _ := out.stats()
+			return depth == 0
+		})
+		for _, content := range []string{"second", "third"} {
+			if err := out.broadcast(textMessage(content)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		out.close()
+		readContents(t, theirs)
+		conn.mu.Lock()
+		if conn.writes != c.writes {
+			t.Errorf("Expected %d writes with framed %v got %d", c.writes, c.framed, conn.writes)
+		}
+		conn.mu.Unlock()
+	}
+}
@@ -12,6 +12,8 @@ const (
 	newRole  = 0
 	predRole = 1 << iota
 	succRole
+	// linkRole is for chord links other nodes opened to us, outside of the pool
+	linkRole
 )
 
 func isNewRole(role int) bool {
@@ -40,6 +42,8 @@ func originString(role int) string {
 		return "pred"
 	case succRole:
 		return "succ"
+	case linkRole:
+		return "link"
 	default:
 		return "unknown"
 	}
@@ -52,6 +56,23 @@ type peer struct {
 	addr net.Addr
 	// conn is the connection we currently have with it
 	conn net.Conn
+	// in reads the messages arriving over conn
+	in *protocol.Decoder
+	// out queues the messages we send over conn
+	out *outbox
+}
+
+// queueStats describes the send queue of this peer
+func (peer peer) queueStats(role string) QueueStats {
+	depth, maxDepth, sent, dropped := peer.out.stats()
+	return QueueStats{
+		Addr:     peer.addr,
+		Role:     role,
+		Depth:    depth,
+		MaxDepth: maxDepth,
+		Sent:     sent,
+		Dropped:  dropped,
+	}
 }
 
 // originMessage wrapes a message with an origin
@@ -142,7 +163,8 @@ func (pool *peerPool) remove(peer peer, pred bool) {
 	}
 	pool.mu.Unlock()
 	if shouldClose {
-		peer.conn.Close()
+		// the messages we've already queued still need to go out
+		peer.out.close()
 	}
 }
 
@@ -154,7 +176,7 @@ func (pool *peerPool) getRole(peer peer) int {
 
 func poolLoop(pool *peerPool, peer peer) {
 	for {
-		msg, err := protocol.ReadMessage(peer.conn)
+		msg, err := peer.in.Decode()
 		// an error can also indicate a closed connection, our signal to die
 		if err != nil {
 			role := pool.getRole(peer)
@@ -162,8 +184,9 @@ func poolLoop(pool *peerPool, peer peer) {
 			if isUselessRole(role) {
 				break
 			}
+			// we can't know where the next message starts, so the connection is lost
 			pool.errors <- originError{origin: role, err: err}
-			continue
+			break
 		}
 		role := pool.getRole(peer)
 		pool.messages <- originMessage{origin: role, msg: msg}
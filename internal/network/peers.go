@@ -0,0 +1,140 @@
+package network
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+// peerTimeout is how long a peer we don't hold a link to counts as online after we last heard from it
+const peerTimeout = 10 * time.Minute
+
+// Peer is another node we know about
+type Peer struct {
+	Addr net.Addr
+	Nick string
+	// Linked is set for the nodes we hold a connection to, like our Successor
+	Linked bool
+	// Online is set for linked nodes, and for those we heard from lately
+	Online bool
+	// Away is set while the node has an away signal
+	Away bool
+	// LastSeen is when a broadcast from the node last arrived, if ever
+	LastSeen time.Time
+}
+
+// RingChange is how the ring looks around us, after our Predecessor or Successor changed
+type RingChange struct {
+	Predecessor net.Addr
+	Successor   net.Addr
+}
+
+// RingHandler reacts to changes of our Predecessor or Successor
+//
+// Like EnvelopeHandler, it shouldn't block.
+type RingHandler func(RingChange)
+
+// peerBook remembers the nodes we've heard from, and who to tell about ring changes
+type peerBook struct {
+	mu sync.Mutex
+	// seen holds the address and last broadcast of each node, by address
+	seen    map[string]Peer
+	handler RingHandler
+}
+
+func makePeerBook() *peerBook {
+	return &peerBook{seen: make(map[string]Peer)}
+}
+
+// saw notes that a broadcast from a node arrived
+func (book *peerBook) saw(addr net.Addr, now time.Time) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	book.seen[addr.String()] = Peer{Addr: addr, LastSeen: now}
+}
+
+// broadcastSender returns the node a broadcast came from, or nil for other messages
+func broadcastSender(msg protocol.Message) net.Addr {
+	switch msg := msg.(type) {
+	case protocol.NewMessage:
+		return msg.Sender
+	case protocol.Post:
+		return msg.Sender
+	case protocol.Nickname:
+		return msg.Sender
+	case protocol.Envelope:
+		return msg.Sender
+	}
+	return nil
+}
+
+func (book *peerBook) setHandler(handler RingHandler) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	book.handler = handler
+}
+
+// ringChanged tells our handler about a new Predecessor or Successor
+//
+// This may be called with the state locked, so the handler runs on its own,
+// reading the ring once the change is over.
+func (client *normalClient) ringChanged() {
+	client.peers.mu.Lock()
+	handler := client.peers.handler
+	client.peers.mu.Unlock()
+	if handler == nil {
+		return
+	}
+	go func() {
+		handler(RingChange{
+			Predecessor: client.state.getPred().addr,
+			Successor:   client.state.getSucc().addr,
+		})
+	}()
+}
+
+// listPeers returns the nodes we know about, except for us, sorted by nickname
+func (client *normalClient) listPeers(now time.Time) []Peer {
+	byAddr := make(map[string]Peer)
+	client.peers.mu.Lock()
+	for key, peer := range client.peers.seen {
+		byAddr[key] = peer
+	}
+	client.peers.mu.Unlock()
+	linked := append(client.chords.getLinks(), client.state.getPred().addr, client.state.getSucc().addr)
+	for _, addr := range linked {
+		if addr == nil {
+			continue
+		}
+		peer, ok := byAddr[addr.String()]
+		if !ok {
+			peer.Addr = addr
+		}
+		peer.Linked = true
+		byAddr[addr.String()] = peer
+	}
+	away := make(map[string]bool)
+	for _, event := range client.signals.list(now) {
+		if event.Signal == SignalAway {
+			away[event.From.String()] = true
+		}
+	}
+	delete(byAddr, client.advertisedAddr.String())
+	peers := make([]Peer, 0, len(byAddr))
+	for key, peer := range byAddr {
+		peer.Nick = client.nicks.get(peer.Addr)
+		peer.Online = peer.Linked || now.Sub(peer.LastSeen) < peerTimeout
+		peer.Away = away[key]
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Nick != peers[j].Nick {
+			return peers[i].Nick < peers[j].Nick
+		}
+		return peers[i].Addr.String() < peers[j].Addr.String()
+	})
+	return peers
+}
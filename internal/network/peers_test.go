@@ -0,0 +1,83 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeersAreListed(t *testing.T) {
+	swarms := makeSwarm(t, NewMemoryTransport(), memoryAddrs(4))
+	// node-2 isn't linked to node-0, which only learns about it from a broadcast
+	for i, nick := range []string{"alice", "bob"} {
+		if err := swarms[i+1].ChangeNickname(nick); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	waitFor(t, "nicknames to arrive", func() bool {
+		return swarms[0].Nickname(swarms[1].Addr()) == "alice" && swarms[0].Nickname(swarms[2].Addr()) == "bob"
+	})
+	if err := swarms[1].SendSignal(SignalAway); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waitFor(t, "away signal to arrive", func() bool {
+		return len(swarms[0].ActiveSignals()) == 1
+	})
+	peers := swarms[0].Peers()
+	if len(peers) != 3 {
+		t.Fatalf("Expected 3 peers got %v", peers)
+	}
+	for _, peer := range peers {
+		if sameAddr(peer.Addr, swarms[0].Addr()) {
+			t.Errorf("Expected ourselves not to be listed")
+		}
+		if !peer.Online {
+			t.Errorf("Expected %v to be online", peer.Addr)
+		}
+	}
+	alice := peers[0]
+	if !sameAddr(alice.Addr, swarms[1].Addr()) || alice.Nick != "alice" {
+		t.Errorf("Expected alice to come first got %v", alice)
+	}
+	if !alice.Away || alice.LastSeen.IsZero() {
+		t.Errorf("Expected alice to be away and seen got %v", alice)
+	}
+	for _, peer := range peers[1:] {
+		if peer.Away {
+			t.Errorf("Expected %v not to be away", peer.Addr)
+		}
+	}
+}
+
+func TestRingChangesAreReported(t *testing.T) {
+	transport := NewMemoryTransport()
+	addrs := memoryAddrs(3)
+	swarms := makeSwarm(t, transport, addrs[:2])
+	changes := make(chan RingChange, 4)
+	for _, swarm := range swarms {
+		swarm.HandleRingChanges(func(change RingChange) {
+			changes <- change
+		})
+	}
+	joined, err := JoinSwarm(Config{Transport: transport, ListenAddr: addrs[2]}, addrs[0])
+	if err != nil {
+		t.Fatalf("Failed to join swarm: %v", err)
+	}
+	swarms = append(swarms, joined)
+	waitFor(t, "ring to stabilize", func() bool {
+		return ringIsStable(swarms)
+	})
+	sawJoin := false
+	for i := 0; i < 2; i++ {
+		select {
+		case change := <-changes:
+			if sameAddr(change.Predecessor, joined.Addr()) || sameAddr(change.Successor, joined.Addr()) {
+				sawJoin = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 ring changes, got %d", i)
+		}
+	}
+	if !sawJoin {
+		t.Errorf("Expected the ring changes to include %v", joined.Addr())
+	}
+}
@@ -0,0 +1,65 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+// queryTimeout bounds how long a node can take to answer a query
+const queryTimeout = 5 * time.Second
+
+// dialer opens connections to nodes outside of the ring, like chord links
+type dialer struct {
+	transport Transport
+	limits    protocol.Limits
+	hello     protocol.Hello
+}
+
+// dialer returns what we need to open connections of our own
+func (client *normalClient) dialer() dialer {
+	return dialer{transport: client.transport, limits: client.limits, hello: client.hello}
+}
+
+// dial connects to a node, making sure it supports some features
+func (d dialer) dial(addr net.Addr, features protocol.Features) (net.Conn, *protocol.Decoder, protocol.Session, error) {
+	conn, err := d.transport.Dial(addr)
+	if err != nil {
+		return nil, nil, protocol.Session{}, err
+	}
+	in := newDecoder(conn, d.transport, d.limits)
+	session, err := greet(conn, in, d.hello)
+	if err == nil && !session.Features.Has(features) {
+		err = fmt.Errorf("%v doesn't support features %b", addr, features&^session.Features)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, protocol.Session{}, err
+	}
+	return conn, in, session, nil
+}
+
+// query sends a message to a node over a new connection, and reads its answer
+func (d dialer) query(addr net.Addr, msg protocol.Message) (protocol.Message, error) {
+	conn, in, _, err := d.dial(addr, protocol.RequiredFeatures(msg))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(queryTimeout))
+	if err := sendMessage(conn, msg); err != nil {
+		return nil, err
+	}
+	return in.Decode()
+}
+
+// answer replies to a query, and then hangs up
+func (client *normalClient) answer(conn net.Conn, reply protocol.Message) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(queryTimeout))
+	if err := sendMessage(conn, reply); err != nil {
+		client.log.Printf("Error answering with %T: %v\n", reply, err)
+	}
+}
@@ -0,0 +1,257 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+const (
+	// signalKind is the kind of the envelopes carrying a Signal
+	signalKind = "signal"
+	// signalWindow and signalBurst limit each sender to a few signals at a time
+	signalWindow = 2 * time.Second
+	signalBurst  = 4
+	// signalRepeat is how long we wait before sending the same signal again
+	signalRepeat = 3 * time.Second
+	// maxSignalTTL bounds how long a signal from another node lasts
+	maxSignalTTL = time.Hour
+	// maxSignalSenders bounds how many nodes we keep the signals of
+	maxSignalSenders = 1024
+)
+
+// Signal is a short lived state of a node, like typing or being away
+//
+// Signals are never kept, and each one expires on its own after a while.
+type Signal string
+
+const (
+	// SignalTyping means someone is writing a message, and lasts a few seconds
+	SignalTyping Signal = "typing"
+	// SignalIdle cancels the signals of a node
+	SignalIdle Signal = "idle"
+	// SignalAway means someone isn't at their keyboard
+	SignalAway Signal = "away"
+)
+
+// ttl is how long a signal lasts, unless it's replaced by another
+func (signal Signal) ttl() time.Duration {
+	switch signal {
+	case SignalTyping:
+		return 6 * time.Second
+	case SignalAway:
+		return maxSignalTTL
+	default:
+		return 0
+	}
+}
+
+// SignalEvent is the latest signal from another node
+type SignalEvent struct {
+	// From is the node that sent the signal, with Nick its nickname
+	From   net.Addr
+	Nick   string
+	Signal Signal
+	// Expires is when the signal stops applying
+	Expires time.Time
+}
+
+// SignalHandler reacts to the signals of other nodes
+//
+// Like EnvelopeHandler, it shouldn't block.
+type SignalHandler func(SignalEvent)
+
+// signalState holds the signals of other nodes, and the last one we sent
+type signalState struct {
+	mu sync.Mutex
+	// active holds the latest signal of each node, by address and then kind
+	active map[string]map[Signal]SignalEvent
+	// recent holds when the latest signals of each node arrived, within signalWindow
+	recent map[string][]time.Time
+	// swept is when we last forgot the nodes that stopped sending signals
+	swept   time.Time
+	handler SignalHandler
+	// sent is the last signal we sent, at sentAt
+	sent   Signal
+	sentAt time.Time
+}
+
+func makeSignalState() *signalState {
+	return &signalState{
+		active: make(map[string]map[Signal]SignalEvent),
+		recent: make(map[string][]time.Time),
+	}
+}
+
+func (signals *signalState) setHandler(handler SignalHandler) {
+	signals.mu.Lock()
+	defer signals.mu.Unlock()
+	signals.handler = handler
+}
+
+// allow checks if a node can send another signal now, keeping track of it
+//
+// Once we keep track of maxSignalSenders nodes, new ones are refused until
+// some of them stop sending signals.
+func (signals *signalState) allow(sender net.Addr, now time.Time) bool {
+	signals.mu.Lock()
+	defer signals.mu.Unlock()
+	signals.sweep(now)
+	key := sender.String()
+	if _, ok := signals.recent[key]; !ok && len(signals.recent) >= maxSignalSenders {
+		return false
+	}
+	var kept []time.Time
+	for _, at := range signals.recent[key] {
+		if now.Sub(at) < signalWindow {
+			kept = append(kept, at)
+		}
+	}
+	if len(kept) >= signalBurst {
+		signals.recent[key] = kept
+		return false
+	}
+	signals.recent[key] = append(kept, now)
+	return true
+}
+
+// sweep forgets the nodes that stopped sending signals, with the lock held
+//
+// This goes through every node, so it's done once per signalWindow at most.
+func (signals *signalState) sweep(now time.Time) {
+	if now.Sub(signals.swept) < signalWindow {
+		return
+	}
+	signals.swept = now
+	for key, times := range signals.recent {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= signalWindow {
+			delete(signals.recent, key)
+		}
+	}
+	signals.expire(now)
+}
+
+// expire forgets the signals that no longer apply, with the lock held
+func (signals *signalState) expire(now time.Time) {
+	for key, bySignal := range signals.active {
+		for signal, event := range bySignal {
+			if now.After(event.Expires) {
+				delete(bySignal, signal)
+			}
+		}
+		if len(bySignal) == 0 {
+			delete(signals.active, key)
+		}
+	}
+}
+
+// receive remembers the latest signal of a node, and passes it to our handler
+//
+// The signals of new nodes are ignored once we keep those of maxSignalSenders.
+func (signals *signalState) receive(event SignalEvent) {
+	signals.mu.Lock()
+	key := event.From.String()
+	if event.Signal == SignalIdle {
+		delete(signals.active, key)
+	} else {
+		if signals.active[key] == nil {
+			if len(signals.active) >= maxSignalSenders {
+				signals.mu.Unlock()
+				return
+			}
+			signals.active[key] = make(map[Signal]SignalEvent)
+		}
+		signals.active[key][event.Signal] = event
+	}
+	handler := signals.handler
+	signals.mu.Unlock()
+	if handler != nil {
+		handler(event)
+	}
+}
+
+// stopTyping forgets that a node is typing, once its message arrived
+func (signals *signalState) stopTyping(sender net.Addr) {
+	signals.mu.Lock()
+	defer signals.mu.Unlock()
+	delete(signals.active[sender.String()], SignalTyping)
+}
+
+// list returns the signals that haven't expired yet
+func (signals *signalState) list(now time.Time) []SignalEvent {
+	signals.mu.Lock()
+	defer signals.mu.Unlock()
+	signals.expire(now)
+	var events []SignalEvent
+	for _, bySignal := range signals.active {
+		for _, event := range bySignal {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// shouldSend checks if a signal is worth sending, since we don't repeat the same one too often
+func (signals *signalState) shouldSend(signal Signal, now time.Time) bool {
+	signals.mu.Lock()
+	defer signals.mu.Unlock()
+	if signal == signals.sent && now.Sub(signals.sentAt) < signalRepeat {
+		return false
+	}
+	signals.sent = signal
+	signals.sentAt = now
+	return true
+}
+
+// sentMessage lets us signal typing again right away, since our message stopped it
+func (signals *signalState) sentMessage() {
+	signals.mu.Lock()
+	defer signals.mu.Unlock()
+	if signals.sent == SignalTyping {
+		signals.sent = ""
+	}
+}
+
+// readSignal reads a signal from the Envelope carrying it
+func (client *normalClient) readSignal(env protocol.Envelope, now time.Time) (SignalEvent, error) {
+	stateField, _ := env.Get("state")
+	state, _ := stateField.AsString()
+	signal := Signal(state)
+	if signal != SignalIdle && signal.ttl() == 0 {
+		return SignalEvent{}, fmt.Errorf("Unknown signal from %v: %q", env.Sender, state)
+	}
+	ttlField, _ := env.Get("ttl")
+	seconds, ok := ttlField.AsUint()
+	ttl := time.Duration(seconds) * time.Second
+	if !ok || seconds > uint64(maxSignalTTL/time.Second) {
+		ttl = signal.ttl()
+	}
+	return SignalEvent{
+		From:    env.Sender,
+		Nick:    client.nicks.get(env.Sender),
+		Signal:  signal,
+		Expires: now.Add(ttl),
+	}, nil
+}
+
+// sendSignal broadcasts one of our signals, unless we just sent the same one
+func (client *normalClient) sendSignal(signal Signal) error {
+	if signal != SignalIdle && signal.ttl() == 0 {
+		return fmt.Errorf("Unknown signal: %q", signal)
+	}
+	if !client.signals.shouldSend(signal, time.Now()) {
+		return nil
+	}
+	env := protocol.Envelope{
+		Sender: client.advertisedAddr,
+		Kind:   signalKind,
+		Fields: []protocol.Field{
+			protocol.NewStringField("state", string(signal)),
+			protocol.NewUintField("ttl", uint64(signal.ttl()/time.Second)),
+		},
+	}
+	return client.broadcast(env)
+}
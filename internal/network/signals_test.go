@@ -0,0 +1,140 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func nextSignal(t *testing.T, signals chan SignalEvent) SignalEvent {
+	select {
+	case event := <-signals:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Never received a signal")
+		return SignalEvent{}
+	}
+}
+
+func TestSignalsReachOthers(t *testing.T) {
+	swarms := makeSwarm(t, NewMemoryTransport(), memoryAddrs(3))
+	signals := make(chan SignalEvent, 4)
+	swarms[2].HandleSignals(func(event SignalEvent) {
+		signals <- event
+	})
+	before := time.Now()
+	if err := swarms[0].SendSignal(SignalTyping); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	event := nextSignal(t, signals)
+	if event.Signal != SignalTyping || !sameAddr(event.From, swarms[0].Addr()) {
+		t.Errorf("Unexpected signal %v", event)
+	}
+	if event.Expires.Before(before.Add(SignalTyping.ttl())) {
+		t.Errorf("Expected the signal to last %v, it expires at %v", SignalTyping.ttl(), event.Expires)
+	}
+	if active := swarms[2].ActiveSignals(); len(active) != 1 || active[0] != event {
+		t.Errorf("Expected %v to be active got %v", event, active)
+	}
+	checkBroadcast(t, swarms, 0)
+	if active := swarms[2].ActiveSignals(); len(active) != 0 {
+		t.Errorf("Expected typing to stop with a message, got %v", active)
+	}
+	if err := swarms[0].SendSignal("dancing"); err == nil {
+		t.Errorf("Expected an unknown signal to be refused")
+	}
+}
+
+func TestSignalRateLimit(t *testing.T) {
+	signals := makeSignalState()
+	sender := MemoryAddr("sender")
+	now := time.Now()
+	for i := 0; i < signalBurst; i++ {
+		if !signals.allow(sender, now) {
+			t.Fatalf("Expected signal %d to be allowed", i)
+		}
+	}
+	if signals.allow(sender, now) {
+		t.Errorf("Expected too many signals to be refused")
+	}
+	if !signals.allow(MemoryAddr("other"), now) {
+		t.Errorf("Expected other senders to be allowed")
+	}
+	if !signals.allow(sender, now.Add(signalWindow)) {
+		t.Errorf("Expected signals to be allowed again later")
+	}
+}
+
+func TestSignalSendersAreForgotten(t *testing.T) {
+	signals := makeSignalState()
+	now := time.Now()
+	for i := 0; i < maxSignalSenders; i++ {
+		if !signals.allow(MemoryAddr(fmt.Sprint(i)), now) {
+			t.Fatalf("Expected sender %d to be allowed", i)
+		}
+	}
+	if signals.allow(MemoryAddr("new"), now) {
+		t.Errorf("Expected a new sender to be refused once we keep track of %d", maxSignalSenders)
+	}
+	if !signals.allow(MemoryAddr("0"), now) {
+		t.Errorf("Expected a known sender to be allowed")
+	}
+	later := now.Add(signalWindow)
+	if !signals.allow(MemoryAddr("new"), later) {
+		t.Errorf("Expected a new sender to be allowed once the others stopped")
+	}
+	if len(signals.recent) != 1 {
+		t.Errorf("Expected the senders that stopped to be forgotten got %d", len(signals.recent))
+	}
+
+	for i := 0; i < maxSignalSenders; i++ {
+		signals.receive(SignalEvent{From: MemoryAddr(fmt.Sprint(i)), Signal: SignalAway, Expires: now.Add(time.Minute)})
+	}
+	signals.receive(SignalEvent{From: MemoryAddr("new"), Signal: SignalAway, Expires: now.Add(time.Minute)})
+	if active := signals.list(now); len(active) != maxSignalSenders {
+		t.Errorf("Expected %d active signals got %d", maxSignalSenders, len(active))
+	}
+	// expired signals are forgotten as senders come and go, without listing them
+	signals.allow(MemoryAddr("new"), now.Add(2*time.Minute))
+	if len(signals.active) != 0 {
+		t.Errorf("Expected the expired signals to be forgotten got %d", len(signals.active))
+	}
+}
+
+func TestSignalsExpire(t *testing.T) {
+	signals := makeSignalState()
+	now := time.Now()
+	signals.receive(SignalEvent{From: MemoryAddr("a"), Signal: SignalTyping, Expires: now.Add(time.Second)})
+	signals.receive(SignalEvent{From: MemoryAddr("b"), Signal: SignalAway, Expires: now.Add(time.Hour)})
+	if active := signals.list(now); len(active) != 2 {
+		t.Errorf("Expected 2 active signals got %v", active)
+	}
+	if active := signals.list(now.Add(2 * time.Second)); len(active) != 1 || active[0].Signal != SignalAway {
+		t.Errorf("Expected only away to be left got %v", active)
+	}
+	signals.receive(SignalEvent{From: MemoryAddr("b"), Signal: SignalTyping, Expires: now.Add(time.Second)})
+	if active := signals.list(now); len(active) != 2 {
+		t.Errorf("Expected typing not to replace away, got %v", active)
+	}
+	signals.receive(SignalEvent{From: MemoryAddr("b"), Signal: SignalIdle})
+	if active := signals.list(now); len(active) != 0 {
+		t.Errorf("Expected idle to cancel everything from b got %v", active)
+	}
+}
+
+func TestSignalsAreNotRepeated(t *testing.T) {
+	signals := makeSignalState()
+	now := time.Now()
+	if !signals.shouldSend(SignalTyping, now) {
+		t.Errorf("Expected the first signal to be sent")
+	}
+	if signals.shouldSend(SignalTyping, now.Add(time.Second)) {
+		t.Errorf("Expected the same signal not to be sent again right away")
+	}
+	if !signals.shouldSend(SignalIdle, now.Add(time.Second)) {
+		t.Errorf("Expected a different signal to be sent")
+	}
+	if !signals.shouldSend(SignalIdle, now.Add(time.Second+signalRepeat)) {
+		t.Errorf("Expected the same signal to be sent again later")
+	}
+}
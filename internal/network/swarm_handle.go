@@ -6,13 +6,14 @@ import (
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/cronokirby/ripple/internal/protocol"
 )
 
-// sameAddr checks if 2 nodes are the same, by string equality
+// sameAddr checks if 2 nodes are the same, by network and string equality
 func sameAddr(a net.Addr, b net.Addr) bool {
-	return a.String() == b.String()
+	return a.Network() == b.Network() && a.String() == b.String()
 }
 
 // clientState holds the state a client needs in normal operation
@@ -68,14 +69,43 @@ func (state *clientState) getLatestPredAddr() net.Addr {
 // normalClient contains the information needed in normal operation
 type normalClient struct {
 	log *log.Logger
-	// me is the address of this client
-	me net.Addr
+	// listenAddr is where this client accepts connections
+	listenAddr net.Addr
+	// advertisedAddr is the address other peers know this client by
+	advertisedAddr net.Addr
+	// transport is used to make and accept connections
+	transport Transport
+	// queue controls the send queue of each connection
+	queue QueueConfig
+	// limits bounds the size of the messages we read and send
+	limits protocol.Limits
+	// hello is what we tell peers we support during the handshake
+	hello protocol.Hello
 	// broadcaster lets us print the text messages
 	receiver protocol.ContentReceiver
 	// state represents the mutable state under a single lock
 	state *clientState
 	// nicks allows us to hold a map from address to nick
 	nicks *nickMap
+	// handlers react to the envelopes we receive
+	handlers *handlerMap
+	// chordConfig controls our chord links, which are held in chords
+	chordConfig ChordConfig
+	chords      *chordState
+	// id is our place on the hash ring, with fingers helping us find others
+	id           protocol.ID
+	fingerConfig FingerConfig
+	fingers      *fingerTable
+	// files holds the files we offer, and those offered to us
+	files *fileState
+	// ids hands out the IDs of the messages we send
+	ids *messageIDs
+	// signals holds the signals of other nodes
+	signals *signalState
+	// peers remembers the nodes we've heard from
+	peers *peerBook
+	// watchers are told about every event, besides receiver
+	watchers *watcherList
 	// pool holds the connection pool for our peers
 	pool *peerPool
 	// latest has its own locking mechanism
@@ -83,40 +113,94 @@ type normalClient struct {
 }
 
 func (client *normalClient) listenLoop(l net.Listener) {
-	if l == nil {
-		newL, err := net.Listen("tcp", client.me.String())
-		if err != nil {
-			log.Fatalln("Couldn't start listener ", err)
-		}
-		l = newL
-	}
 	defer l.Close()
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			log.Fatalln("Error accepting conn ", err)
+			// the listener is gone, so nobody else can join through us
+			client.log.Println("Stopped accepting connections ", err)
+			return
 		}
-		client.latest.fill(conn)
-		msg, err := protocol.ReadMessage(conn)
-		if err != nil {
-			log.Println("Error reading message ", err)
-			conn.Close()
+		go client.accept(conn)
+	}
+}
+
+// accept handles a new connection, depending on the first message sent over it
+//
+// Queries, file transfers and chord links are handled right away,
+// but nodes joining the swarm have to wait their turn to become the latest connection.
+func (client *normalClient) accept(conn net.Conn) {
+	in := newDecoder(conn, client.transport, client.limits)
+	session, err := welcome(conn, in, client.hello)
+	if err != nil {
+		client.log.Println("Handshake failed ", err)
+		conn.Close()
+		return
+	}
+	msg, err := in.Decode()
+	if err != nil {
+		client.log.Println("Error reading message ", err)
+		conn.Close()
+		return
+	}
+	switch msg := msg.(type) {
+	case protocol.LinkQuery:
+		client.answer(conn, protocol.LinkReply{Level: msg.Level, Addr: client.link(int(msg.Level))})
+		return
+	case protocol.Lookup:
+		client.answer(conn, client.lookupStep(msg.ID))
+		return
+	case protocol.GetNeighbors:
+		neighbors := protocol.Neighbors{
+			Pred: client.state.getPred().addr,
+			Succ: client.state.getSucc().addr,
 		}
-		wrappedClient := client.withOrigin(newRole)
-		if err := msg.PassToClient(wrappedClient); err != nil {
-			log.Println(err)
-			conn.Close()
+		client.answer(conn, neighbors)
+		return
+	case protocol.FileRequest:
+		client.serveFile(conn, msg)
+		return
+	case protocol.Envelope:
+		if msg.Kind == directKind {
+			client.receiveDirect(conn, msg)
+			return
 		}
+	case protocol.OpenLink:
+		client.linkLoop(conn, in, msg)
+		return
+	}
+	out := newOutbox(conn, session, client.queue, client.log)
+	client.latest.fill(conn, in, out)
+	wrappedClient := client.withOrigin(newRole)
+	if err := msg.PassToClient(wrappedClient); err != nil {
+		client.log.Println(err)
+		client.releaseLatest(out)
 	}
 }
 
+// releaseLatest gives up on a new connection after it misbehaved
+//
+// Otherwise, latest would stay filled forever, and nobody else could join.
+// An announced Predecessor is kept, since it may still connect properly.
+func (client *normalClient) releaseLatest(out *outbox) {
+	client.state.mu.Lock()
+	defer client.state.mu.Unlock()
+	out.close()
+	if _, _, latestOut := client.latest.get(); latestOut != out {
+		return
+	}
+	client.state.latestPredAddr = nil
+	client.state.latestSuccAddr = nil
+	client.latest.empty()
+}
+
 func (client *normalClient) messageLoop() {
 	for {
 		select {
 		case oMsg := <-client.pool.messages:
 			wrappedClient := client.withOrigin(oMsg.origin)
 			if err := oMsg.msg.PassToClient(wrappedClient); err != nil {
-				log.Println(err)
+				client.log.Println(err)
 			}
 		case err := <-client.pool.errors:
 			client.log.Println(err)
@@ -159,17 +243,21 @@ func (client *originClient) HandleJoinSwarm(msg protocol.JoinSwarm) error {
 			client.fmtOrigin(),
 		)
 	}
-	client.under.state.mu.Lock()
-	client.under.state.latestSuccAddr = msg.Addr
-	client.under.state.mu.Unlock()
-	client.under.state.mu.RLock()
-	defer client.under.state.mu.RUnlock()
-	referral := protocol.Referral{Addr: client.under.state.succ.addr}
-	if err := sendMessage(client.under.latest.conn, referral); err != nil {
+	under := client.under
+	under.state.mu.Lock()
+	under.state.latestSuccAddr = msg.Addr
+	succ := under.state.succ
+	under.state.mu.Unlock()
+	referral := protocol.Referral{Addr: succ.addr}
+	_, _, latestOut := under.latest.get()
+	if latestOut == nil {
+		return fmt.Errorf("Unexpected JoinSwarm message without a connection")
+	}
+	if err := latestOut.control(referral); err != nil {
 		return err
 	}
 	newPred := protocol.NewPredecessor{Addr: msg.Addr}
-	if err := sendMessage(client.under.state.getSucc().conn, newPred); err != nil {
+	if err := succ.out.control(newPred); err != nil {
 		return err
 	}
 	return nil
@@ -193,7 +281,8 @@ func (client *originClient) clearLatest() {
 
 func (client *originClient) swapPredecessorsIfReady() error {
 	under := client.under
-	noLatest := under.latest.isEmpty()
+	conn, in, out := under.latest.get()
+	noLatest := conn == nil
 	noPred := under.state.latestPredAddr == nil
 	noPredAnnounce := under.state.newPred == nil
 	if noLatest || noPred || noPredAnnounce {
@@ -209,16 +298,21 @@ func (client *originClient) swapPredecessorsIfReady() error {
 		)
 	}
 	confirm := protocol.ConfirmReferral{}
-	if err := sendMessage(under.state.pred.conn, confirm); err != nil {
+	if err := under.state.pred.out.control(confirm); err != nil {
 		return err
 	}
 	under.pool.remove(under.state.pred, true)
 	under.state.pred = peer{
-		addr: client.under.state.latestPredAddr,
-		conn: client.under.latest.conn,
+		addr: under.state.latestPredAddr,
+		conn: conn,
+		in:   in,
+		out:  out,
 	}
 	under.pool.submit(under.state.pred, true)
+	// the announcement has been used up, keeping it would clash with the next one
+	under.state.newPred = nil
 	client.clearLatest()
+	under.ringChanged()
 	return nil
 }
 
@@ -278,16 +372,73 @@ func (client *originClient) HandleConfirmReferral() error {
 	}
 	under.state.mu.Lock()
 	defer under.state.mu.Unlock()
+	conn, in, out := under.latest.get()
+	if conn == nil {
+		return fmt.Errorf("Unexpected ConfirmReferral message without a connection")
+	}
 	under.pool.remove(under.state.succ, false)
 	under.state.succ = peer{
 		addr: under.state.latestSuccAddr,
-		conn: under.latest.conn,
+		conn: conn,
+		in:   in,
+		out:  out,
 	}
 	under.pool.submit(under.state.succ, false)
 	client.clearLatest()
+	under.ringChanged()
 	return nil
 }
 
+// deliver reacts to a broadcast from another node, without passing it along
+//
+// It returns false if the broadcast shouldn't be passed along either,
+// like a signal from a node sending too many of them.
+func (client *normalClient) deliver(msg protocol.Message) bool {
+	if sender := broadcastSender(msg); sender != nil {
+		client.peers.saw(sender, time.Now())
+	}
+	switch msg := msg.(type) {
+	case protocol.NewMessage:
+		client.signals.stopTyping(msg.Sender)
+		client.receiveText(msg.Sender, 0, msg.Content)
+	case protocol.Post:
+		client.signals.stopTyping(msg.Sender)
+		client.receiveText(msg.Sender, msg.ID, msg.Content)
+	case protocol.Nickname:
+		client.nicks.set(msg.Sender, msg.Name)
+	case protocol.Envelope:
+		switch msg.Kind {
+		case fileOfferKind:
+			offer, err := readFileOffer(msg)
+			if err != nil {
+				client.log.Println(err)
+			} else {
+				client.files.receive(offer)
+			}
+		case editKind, retractKind, reactKind:
+			event, err := client.readEvent(msg)
+			if err != nil {
+				client.log.Println(err)
+			} else {
+				client.receiveEvent(event)
+			}
+		case signalKind:
+			now := time.Now()
+			if !client.signals.allow(msg.Sender, now) {
+				return false
+			}
+			event, err := client.readSignal(msg, now)
+			if err != nil {
+				client.log.Println(err)
+			} else {
+				client.signals.receive(event)
+			}
+		}
+		client.handlers.handle(msg)
+	}
+	return true
+}
+
 // HandleNewMessage allows us to handle text messages
 func (client *originClient) HandleNewMessage(msg protocol.NewMessage) error {
 	if !isPredRole(client.origin) {
@@ -297,11 +448,54 @@ func (client *originClient) HandleNewMessage(msg protocol.NewMessage) error {
 			client.fmtOrigin(),
 		)
 	}
-	if sameAddr(client.under.me, msg.Sender) {
+	if sameAddr(client.under.advertisedAddr, msg.Sender) {
+		return nil
+	}
+	if !client.under.deliver(msg) {
+		return nil
+	}
+	client.under.traceRing(msg.Sender)
+	return client.under.state.getSucc().out.broadcast(msg)
+}
+
+// HandlePost allows us to handle text messages with an ID
+func (client *originClient) HandlePost(msg protocol.Post) error {
+	if !isPredRole(client.origin) {
+		return fmt.Errorf(
+			"Unexpected Post %v %s",
+			msg,
+			client.fmtOrigin(),
+		)
+	}
+	if sameAddr(client.under.advertisedAddr, msg.Sender) {
+		return nil
+	}
+	if !client.under.deliver(msg) {
+		return nil
+	}
+	client.under.traceRing(msg.Sender)
+	return client.under.state.getSucc().out.broadcast(msg)
+}
+
+// HandleEnvelope passes envelopes to their handler, and along the swarm
+//
+// Envelopes nobody here has a handler for are still passed along.
+func (client *originClient) HandleEnvelope(msg protocol.Envelope) error {
+	if !isPredRole(client.origin) {
+		return fmt.Errorf(
+			"Unexpected Envelope %v %s",
+			msg,
+			client.fmtOrigin(),
+		)
+	}
+	if sameAddr(client.under.advertisedAddr, msg.Sender) {
 		return nil
 	}
-	client.under.receiver.ReceiveContent(client.under.nicks.get(msg.Sender), msg.Content)
-	return sendMessage(client.under.state.getSucc().conn, msg)
+	if !client.under.deliver(msg) {
+		return nil
+	}
+	client.under.traceRing(msg.Sender)
+	return client.under.state.getSucc().out.broadcast(msg)
 }
 
 // HandleNickname allows us to change people's nicknames
@@ -313,16 +507,20 @@ func (client *originClient) HandleNickname(msg protocol.Nickname) error {
 			client.fmtOrigin(),
 		)
 	}
-	if sameAddr(client.under.me, msg.Sender) {
+	if sameAddr(client.under.advertisedAddr, msg.Sender) {
+		return nil
+	}
+	if !client.under.deliver(msg) {
 		return nil
 	}
-	client.under.nicks.set(msg.Sender, msg.Name)
-	return sendMessage(client.under.state.getSucc().conn, msg)
+	client.under.traceRing(msg.Sender)
+	return client.under.state.getSucc().out.broadcast(msg)
 }
 
 // joiningClient is a client trying to join a swarm
 type joiningClient struct {
-	referral net.Addr
+	referral  net.Addr
+	transport Transport
 }
 
 func (client *joiningClient) HandlePing() error {
@@ -354,20 +552,60 @@ func (client *joiningClient) HandleNewMessage(msg protocol.NewMessage) error {
 	return fmt.Errorf("Unexpected NewMessage: %v", msg)
 }
 
+func (client *joiningClient) HandlePost(msg protocol.Post) error {
+	return fmt.Errorf("Unexpected Post: %v", msg)
+}
+
 func (client *joiningClient) HandleNickname(msg protocol.Nickname) error {
 	return fmt.Errorf("Unexpected Nickname: %v", msg)
 }
 
-// joinSwarm can't and won't complete the logging and receiever fields of client
-func (client *joiningClient) joinSwarm(log *log.Logger, start, me net.Addr) (*normalClient, error) {
-	predConn, err := net.Dial(start.Network(), start.String())
+func (client *joiningClient) HandleEnvelope(msg protocol.Envelope) error {
+	return fmt.Errorf("Unexpected Envelope: %v", msg)
+}
+
+func (client *joiningClient) HandleCensus(msg protocol.Census) error {
+	return fmt.Errorf("Unexpected Census: %v", msg)
+}
+
+func (client *joiningClient) HandleTreeCast(msg protocol.TreeCast) error {
+	return fmt.Errorf("Unexpected TreeCast: %v", msg)
+}
+
+// joinSwarm can't and won't complete the receiever field of client
+func (client *joiningClient) joinSwarm(config Config, start net.Addr) (*normalClient, error) {
+	me := config.AdvertiseAddr
+	// we need to be reachable as soon as we've joined
+	l, err := client.transport.Listen(config.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	joined := false
+	defer func() {
+		if !joined {
+			l.Close()
+		}
+	}()
+	d := dialer{transport: client.transport, limits: config.Limits, hello: config.hello()}
+	if place, err := d.findPlace(start, me); err != nil {
+		config.Log.Printf("Couldn't find our place in the ring, joining through %v: %v\n", start, err)
+	} else {
+		start = place
+	}
+	predConn, err := client.transport.Dial(start)
 	if err != nil {
 		return nil, err
 	}
+	predIn := newDecoder(predConn, client.transport, config.Limits)
+	predSession, err := greet(predConn, predIn, config.hello())
+	if err != nil {
+		predConn.Close()
+		return nil, err
+	}
 	if err := sendMessage(predConn, protocol.JoinSwarm{Addr: me}); err != nil {
 		return nil, err
 	}
-	msg, err := protocol.ReadMessage(predConn)
+	msg, err := predIn.Decode()
 	if err != nil {
 		return nil, err
 	}
@@ -375,36 +613,68 @@ func (client *joiningClient) joinSwarm(log *log.Logger, start, me net.Addr) (*no
 		return nil, err
 	}
 	succAddr := client.referral
-	succConn := predConn
+	succConn, succIn, succSession := predConn, predIn, predSession
 	// this is usually the case
 	if !sameAddr(succAddr, start) {
-		conn, err := net.Dial(succAddr.Network(), succAddr.String())
+		conn, err := client.transport.Dial(succAddr)
 		if err != nil {
 			return nil, err
 		}
 		succConn = conn
+		succIn = newDecoder(succConn, client.transport, config.Limits)
+		succSession, err = greet(succConn, succIn, config.hello())
+		if err != nil {
+			succConn.Close()
+			return nil, err
+		}
 	}
 	confirmPredecessor := protocol.ConfirmPredecessor{Addr: me}
 	if err := sendMessage(succConn, confirmPredecessor); err != nil {
 		return nil, err
 	}
-	predPeer := peer{addr: start, conn: predConn}
-	succPeer := peer{addr: succAddr, conn: succConn}
+	predOut := newOutbox(predConn, predSession, config.Queue, config.Log)
+	succOut := predOut
+	if succConn != predConn {
+		succOut = newOutbox(succConn, succSession, config.Queue, config.Log)
+	}
+	predPeer := peer{addr: start, conn: predConn, in: predIn, out: predOut}
+	succPeer := peer{addr: succAddr, conn: succConn, in: succIn, out: succOut}
 	state := &clientState{pred: predPeer, succ: succPeer}
 	normal := &normalClient{
-		log:      log,
-		me:       me,
-		receiver: protocol.NilReceiver{},
-		pool:     makePeerPool(),
-		nicks:    makeNickMap(),
-		state:    state,
-		latest:   makeSyncConn(),
+		log:            config.Log,
+		listenAddr:     config.ListenAddr,
+		advertisedAddr: me,
+		transport:      client.transport,
+		queue:          config.Queue,
+		limits:         config.Limits,
+		hello:          config.hello(),
+		receiver:       protocol.NilReceiver{},
+		pool:           makePeerPool(),
+		nicks:          makeNickMap(),
+		handlers:       makeHandlerMap(),
+		chordConfig:    config.Chords,
+		chords:         makeChordState(),
+		id:             protocol.IDOf(me),
+		fingerConfig:   config.Fingers,
+		fingers:        &fingerTable{},
+		files:          makeFileState(),
+		ids:            makeMessageIDs(),
+		signals:        makeSignalState(),
+		peers:          makePeerBook(),
+		watchers:       makeWatcherList(),
+		state:          state,
+		latest:         makeSyncConn(),
 	}
 	normal.log.Println("Starting loops...")
 	normal.pool.submit(normal.state.pred, true)
 	normal.pool.submit(normal.state.succ, false)
-	go normal.listenLoop(nil)
+	joined = true
+	go normal.listenLoop(l)
 	go normal.messageLoop()
+	if normal.chordConfig.Enabled {
+		go normal.chordLoop()
+	}
+	go normal.fingerLoop()
 	return normal, nil
 }
 
@@ -413,13 +683,25 @@ func (client *joiningClient) joinSwarm(log *log.Logger, start, me net.Addr) (*no
 // we need to treat this case slightly differently from a normalClient.
 // The case with just 2 peers should "just work" with the normalClient code.
 type lonelyClient struct {
-	// me is the address of this client
-	me net.Addr
+	// listenAddr is where this client accepts connections
+	listenAddr net.Addr
+	// advertisedAddr is the address other peers know this client by
+	advertisedAddr net.Addr
 	// nil indicates no joinSwarm message yet
 	firstAddr net.Addr
 	// first starts off nil, and becomes filled as we try and get our first peer
 	first net.Conn
-	log   *log.Logger
+	// in reads the messages arriving over first
+	in *protocol.Decoder
+	// session is what we agreed on with first during the handshake
+	session   protocol.Session
+	log       *log.Logger
+	transport Transport
+	queue     QueueConfig
+	limits    protocol.Limits
+	hello     protocol.Hello
+	chords    ChordConfig
+	fingers   FingerConfig
 }
 
 // HandlePing is unexpected
@@ -434,7 +716,7 @@ func (client *lonelyClient) HandleJoinSwarm(msg protocol.JoinSwarm) error {
 	if client.firstAddr != nil {
 		return fmt.Errorf("Unexpected JoinSwarm in lonelyClient (already received)")
 	}
-	referral := protocol.Referral{Addr: client.me}
+	referral := protocol.Referral{Addr: client.advertisedAddr}
 	if err := sendMessage(client.first, referral); err != nil {
 		return err
 	}
@@ -479,12 +761,29 @@ func (client *lonelyClient) HandleNewMessage(protocol.NewMessage) error {
 	return fmt.Errorf("Unexpected NewMessage in lonelyClient")
 }
 
+// HandlePost is unexpected at this time
+func (client *lonelyClient) HandlePost(protocol.Post) error {
+	return fmt.Errorf("Unexpected Post in lonelyClient")
+}
+
 func (client *lonelyClient) HandleNickname(protocol.Nickname) error {
 	return fmt.Errorf("Unexpected Nickname in lonelyClient")
 }
 
-func (client *lonelyClient) receiveMsg(conn net.Conn) error {
-	msg, err := protocol.ReadMessage(conn)
+func (client *lonelyClient) HandleEnvelope(protocol.Envelope) error {
+	return fmt.Errorf("Unexpected Envelope in lonelyClient")
+}
+
+func (client *lonelyClient) HandleCensus(protocol.Census) error {
+	return fmt.Errorf("Unexpected Census in lonelyClient")
+}
+
+func (client *lonelyClient) HandleTreeCast(protocol.TreeCast) error {
+	return fmt.Errorf("Unexpected TreeCast in lonelyClient")
+}
+
+func (client *lonelyClient) receiveMsg() error {
+	msg, err := client.in.Decode()
 	if err != nil {
 		return err
 	}
@@ -494,11 +793,35 @@ func (client *lonelyClient) receiveMsg(conn net.Conn) error {
 	return nil
 }
 
+// receiveFirst reads the messages a peer sends to join us
+//
+// A peer looking for its place in the ring is told that it's with us,
+// and has to connect again to actually join.
+func (client *lonelyClient) receiveFirst() error {
+	msg, err := client.in.Decode()
+	if err != nil {
+		return err
+	}
+	if _, ok := msg.(protocol.Lookup); ok {
+		reply := protocol.LookupReply{Done: true, Addr: client.advertisedAddr}
+		if err := sendMessage(client.first, reply); err != nil {
+			return err
+		}
+		client.first.Close()
+		client.first = nil
+		return nil
+	}
+	if err := msg.PassToClient(client); err != nil {
+		return err
+	}
+	return client.receiveMsg()
+}
+
 // startSwarm starts a new swarm
 //
 // make sure to reuse the listener we set in lonelyClient after this though
 func (client *lonelyClient) startSwarm() (*normalClient, error) {
-	l, err := net.Listen(client.me.Network(), client.me.String())
+	l, err := client.transport.Listen(client.listenAddr)
 	if err != nil {
 		return nil, err
 	}
@@ -509,35 +832,59 @@ func (client *lonelyClient) startSwarm() (*normalClient, error) {
 			client.log.Println(err)
 			continue
 		}
-		client.first = conn
-		if err := client.receiveMsg(conn); err != nil {
-			client.log.Println(err)
-			client.first = nil
+		client.in = newDecoder(conn, client.transport, client.limits)
+		session, err := welcome(conn, client.in, client.hello)
+		if err != nil {
+			client.log.Println("Handshake failed ", err)
+			conn.Close()
 			continue
 		}
-		sendMessage(conn, protocol.Referral{Addr: client.me})
-		if err := client.receiveMsg(conn); err != nil {
+		client.first = conn
+		client.session = session
+		if err := client.receiveFirst(); err != nil {
 			client.log.Println(err)
+			conn.Close()
 			client.first = nil
 			continue
 		}
 	}
-	peer := peer{addr: client.firstAddr, conn: client.first}
+	out := newOutbox(client.first, client.session, client.queue, client.log)
+	peer := peer{addr: client.firstAddr, conn: client.first, in: client.in, out: out}
 	state := &clientState{pred: peer, succ: peer}
 	normal := &normalClient{
-		log:      client.log,
-		me:       client.me,
-		receiver: protocol.NilReceiver{},
-		pool:     makePeerPool(),
-		nicks:    makeNickMap(),
-		state:    state,
-		latest:   makeSyncConn(),
+		log:            client.log,
+		listenAddr:     client.listenAddr,
+		advertisedAddr: client.advertisedAddr,
+		transport:      client.transport,
+		queue:          client.queue,
+		limits:         client.limits,
+		hello:          client.hello,
+		receiver:       protocol.NilReceiver{},
+		pool:           makePeerPool(),
+		nicks:          makeNickMap(),
+		handlers:       makeHandlerMap(),
+		chordConfig:    client.chords,
+		chords:         makeChordState(),
+		id:             protocol.IDOf(client.advertisedAddr),
+		fingerConfig:   client.fingers,
+		fingers:        &fingerTable{},
+		files:          makeFileState(),
+		ids:            makeMessageIDs(),
+		signals:        makeSignalState(),
+		peers:          makePeerBook(),
+		watchers:       makeWatcherList(),
+		state:          state,
+		latest:         makeSyncConn(),
 	}
 	normal.log.Println("Starting loops...")
 	normal.pool.submit(peer, true)
 	normal.pool.submit(peer, false)
 	go normal.listenLoop(l)
 	go normal.messageLoop()
+	if normal.chordConfig.Enabled {
+		go normal.chordLoop()
+	}
+	go normal.fingerLoop()
 	return normal, nil
 }
 
@@ -551,11 +898,15 @@ type SwarmHandle struct {
 
 // JoinSwarm creates a new SwarmHandle by joining an existing swarm
 //
-// It takes a node to enter the swarm with, and an address to listen on
-// after joining.
-func JoinSwarm(log *log.Logger, you, start net.Addr) (*SwarmHandle, error) {
-	joining := &joiningClient{}
-	normal, err := joining.joinSwarm(log, start, you)
+// It takes a node to enter the swarm with, and a config describing
+// how to listen for, and make, connections after joining.
+func JoinSwarm(config Config, start net.Addr) (*SwarmHandle, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	joining := &joiningClient{transport: config.Transport}
+	normal, err := joining.joinSwarm(config, start)
 	if err != nil {
 		return nil, err
 	}
@@ -565,8 +916,22 @@ func JoinSwarm(log *log.Logger, you, start net.Addr) (*SwarmHandle, error) {
 // CreateSwarm starts a new swarm by listening at an address
 //
 // This will block until the first peer joins the swarm.
-func CreateSwarm(log *log.Logger, you net.Addr) (*SwarmHandle, error) {
-	lonely := &lonelyClient{me: you, log: log}
+func CreateSwarm(config Config) (*SwarmHandle, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	lonely := &lonelyClient{
+		listenAddr:     config.ListenAddr,
+		advertisedAddr: config.AdvertiseAddr,
+		log:            config.Log,
+		transport:      config.Transport,
+		queue:          config.Queue,
+		limits:         config.Limits,
+		hello:          config.hello(),
+		chords:         config.Chords,
+		fingers:        config.Fingers,
+	}
 	normal, err := lonely.startSwarm()
 	if err != nil {
 		return nil, err
@@ -574,21 +939,261 @@ func CreateSwarm(log *log.Logger, you net.Addr) (*SwarmHandle, error) {
 	return &SwarmHandle{normal}, nil
 }
 
+// Addr returns the address this node is known by in the swarm
+func (swarm *SwarmHandle) Addr() net.Addr {
+	return swarm.client.advertisedAddr
+}
+
+// ListenAddr returns the address this node accepts connections on
+func (swarm *SwarmHandle) ListenAddr() net.Addr {
+	return swarm.client.listenAddr
+}
+
+// Predecessor returns the address of the node before us in the ring
+func (swarm *SwarmHandle) Predecessor() net.Addr {
+	return swarm.client.state.getPred().addr
+}
+
+// Successor returns the address of the node after us in the ring
+func (swarm *SwarmHandle) Successor() net.Addr {
+	return swarm.client.state.getSucc().addr
+}
+
 // SetReceiver changes the receiever in a swarm handle to do something useful
+//
+// A receiver that is also an EventReceiver gets told about edits,
+// retractions and reactions as well.
 func (swarm *SwarmHandle) SetReceiver(receiver protocol.ContentReceiver) {
 	swarm.client.receiver = receiver
 }
 
+// Watch tells watcher about every event the receiver gets, returning a function to stop
+//
+// Unlike SetReceiver, this can be called any number of times, with each
+// watcher getting the events. Watchers should return quickly, since the
+// node waits on them.
+func (swarm *SwarmHandle) Watch(watcher EventReceiver) func() {
+	return swarm.client.watchers.add(watcher)
+}
+
+// Nickname returns the nickname of a node, or its address if it doesn't have one
+//
+// This works for our own address as well, once we've changed our nickname.
+func (swarm *SwarmHandle) Nickname(addr net.Addr) string {
+	return swarm.client.nicks.get(addr)
+}
+
 // SendContent allows us to send a piece of text to the rest of the swarm
-func (swarm *SwarmHandle) SendContent(content string) {
-	msg := protocol.NewMessage{Sender: swarm.client.me, Content: content}
-	// ignore errors
-	sendMessage(swarm.client.state.getSucc().conn, msg)
+//
+// Text that our peers wouldn't accept is refused.
+func (swarm *SwarmHandle) SendContent(content string) error {
+	_, err := swarm.SendMessage(content)
+	return err
+}
+
+// SendMessage works like SendContent, but returns a reference to the message we sent
+//
+// This reference can be used to edit or retract the message later.
+func (swarm *SwarmHandle) SendMessage(content string) (MessageRef, error) {
+	if err := swarm.client.limits.CheckText(content); err != nil {
+		return MessageRef{}, err
+	}
+	swarm.client.signals.sentMessage()
+	sender := swarm.client.advertisedAddr
+	msg := protocol.Post{Sender: sender, ID: swarm.client.ids.take(), Content: content}
+	return MessageRef{Sender: sender.String(), ID: msg.ID}, swarm.client.broadcast(msg)
+}
+
+// EditMessage replaces the content of one of our messages for the rest of the swarm
+func (swarm *SwarmHandle) EditMessage(id uint64, content string) error {
+	ref := MessageRef{Sender: swarm.client.advertisedAddr.String(), ID: id}
+	return swarm.client.sendEvent(editKind, ref, protocol.NewStringField("content", content))
+}
+
+// RetractMessage hides one of our messages for the rest of the swarm
+func (swarm *SwarmHandle) RetractMessage(id uint64) error {
+	ref := MessageRef{Sender: swarm.client.advertisedAddr.String(), ID: id}
+	return swarm.client.sendEvent(retractKind, ref)
+}
+
+// React attaches a short reaction, like an emoji, to any message
+func (swarm *SwarmHandle) React(ref MessageRef, reaction string) error {
+	if err := checkReaction(reaction); err != nil {
+		return err
+	}
+	return swarm.client.sendEvent(reactKind, ref, protocol.NewStringField("content", reaction))
 }
 
 // ChangeNickname allows us to change our nickname in the rest of the swarm
-func (swarm *SwarmHandle) ChangeNickname(name string) {
-	msg := protocol.Nickname{Sender: swarm.client.me, Name: name}
-	// ignore errors
-	sendMessage(swarm.client.state.getSucc().conn, msg)
+func (swarm *SwarmHandle) ChangeNickname(name string) error {
+	if err := swarm.client.limits.CheckText(name); err != nil {
+		return err
+	}
+	msg := protocol.Nickname{Sender: swarm.client.advertisedAddr, Name: name}
+	if err := swarm.client.broadcast(msg); err != nil {
+		return err
+	}
+	// our own broadcasts never come back to us, so this is the only way we learn our nickname
+	swarm.client.nicks.set(swarm.client.advertisedAddr, name)
+	return nil
+}
+
+// Broadcast sends an envelope of some kind to every other node in the swarm
+func (swarm *SwarmHandle) Broadcast(kind string, fields ...protocol.Field) error {
+	env := protocol.Envelope{Sender: swarm.client.advertisedAddr, Kind: kind, Fields: fields}
+	if err := swarm.client.limits.CheckEnvelope(env); err != nil {
+		return err
+	}
+	return swarm.client.broadcast(env)
+}
+
+// HandleEnvelopes registers a handler for the envelopes of some kind we receive
+//
+// This replaces the previous handler for that kind, and a nil handler
+// removes it. Envelopes are passed along the swarm whether or not
+// we have a handler for them.
+func (swarm *SwarmHandle) HandleEnvelopes(kind string, handler EnvelopeHandler) {
+	swarm.client.handlers.set(kind, handler)
+}
+
+// QueueStats reports on the send queues of our Predecessor and Successor
+func (swarm *SwarmHandle) QueueStats() []QueueStats {
+	pred := swarm.client.state.getPred()
+	succ := swarm.client.state.getSucc()
+	if pred.out == succ.out {
+		return []QueueStats{pred.queueStats(originString(predRole | succRole))}
+	}
+	return []QueueStats{
+		pred.queueStats(originString(predRole)),
+		succ.queueStats(originString(succRole)),
+	}
+}
+
+// RefreshChords finds our chord links again, counting the swarm first if needed
+//
+// This is done every ChordConfig.Interval already, unless it's negative.
+func (swarm *SwarmHandle) RefreshChords() error {
+	if swarm.client.chords.getSize() == 0 {
+		if err := swarm.client.census(); err != nil {
+			return err
+		}
+	}
+	swarm.client.refreshLinks()
+	return nil
+}
+
+// Chords returns our chord links, the first being our Successor
+func (swarm *SwarmHandle) Chords() []net.Addr {
+	return swarm.client.chords.getLinks()
+}
+
+// SwarmSize returns how many nodes were in the swarm at our last census
+//
+// This is 0 until a census has gone around the ring.
+func (swarm *SwarmHandle) SwarmSize() int {
+	return swarm.client.chords.getSize()
+}
+
+// ID returns our place on the hash ring
+func (swarm *SwarmHandle) ID() protocol.ID {
+	return swarm.client.id
+}
+
+// Lookup finds the node responsible for an ID, and how many nodes we had to ask
+//
+// That's the first node whose ID comes at or after the one we're looking for.
+func (swarm *SwarmHandle) Lookup(id protocol.ID) (net.Addr, int, error) {
+	return swarm.client.lookup(id)
+}
+
+// FixFingers checks our neighbors, and then finds each of our fingers again
+//
+// This is done every FingerConfig.Interval already, unless it's negative.
+func (swarm *SwarmHandle) FixFingers() error {
+	if err := swarm.client.stabilize(); err != nil {
+		return err
+	}
+	return swarm.client.fixFingers()
+}
+
+// Fingers returns the distinct nodes in our finger table, closest first
+func (swarm *SwarmHandle) Fingers() []net.Addr {
+	var fingers []net.Addr
+	for i := 0; i < idBits; i++ {
+		f := swarm.client.fingers.get(i)
+		if f.addr != nil && (len(fingers) == 0 || !sameAddr(fingers[len(fingers)-1], f.addr)) {
+			fingers = append(fingers, f.addr)
+		}
+	}
+	return fingers
+}
+
+// OfferFile announces a file to the rest of the swarm, and lets other nodes download it
+//
+// The file is read again for every download, so it should stay where it is.
+func (swarm *SwarmHandle) OfferFile(path string) (FileOffer, error) {
+	return swarm.client.offerFile(path)
+}
+
+// HandleFileOffers registers a handler for the files other nodes offer us
+//
+// This replaces the previous handler, and a nil handler removes it.
+func (swarm *SwarmHandle) HandleFileOffers(handler FileHandler) {
+	swarm.client.files.setHandler(handler)
+}
+
+// FileOffers returns the files other nodes have offered us, oldest first
+func (swarm *SwarmHandle) FileOffers() []FileOffer {
+	return swarm.client.files.list()
+}
+
+// GetFile downloads an offered file into a directory, returning its path
+//
+// The ID of the offer can be shortened, as long as no other offer starts
+// the same way. Downloads are saved to a partial file first, so that a
+// failed download can be picked up later by calling GetFile again.
+// Progress is called every time part of the file arrives, if it isn't nil.
+func (swarm *SwarmHandle) GetFile(id string, dir string, progress func(FileProgress)) (string, error) {
+	return swarm.client.getFile(id, dir, progress)
+}
+
+// SendSignal tells the rest of the swarm that we're typing, away, or neither anymore
+//
+// Sending the same signal again right away does nothing, so this can be
+// called on every key press.
+func (swarm *SwarmHandle) SendSignal(signal Signal) error {
+	return swarm.client.sendSignal(signal)
+}
+
+// HandleSignals registers a handler for the signals other nodes send
+//
+// This replaces the previous handler, and a nil handler removes it.
+// Signals are also dropped once they expire, without calling the handler,
+// so ActiveSignals should be checked every so often.
+func (swarm *SwarmHandle) HandleSignals(handler SignalHandler) {
+	swarm.client.signals.setHandler(handler)
+}
+
+// ActiveSignals returns the latest signal of each kind from each node, unless it expired
+func (swarm *SwarmHandle) ActiveSignals() []SignalEvent {
+	return swarm.client.signals.list(time.Now())
+}
+
+// SendDirect sends a message to a single node, without it going around the ring
+func (swarm *SwarmHandle) SendDirect(addr net.Addr, content string) error {
+	return swarm.client.sendDirect(addr, content)
+}
+
+// Peers returns the other nodes we know about, sorted by nickname
+//
+// These are the nodes we hold links to, and those we've heard from.
+func (swarm *SwarmHandle) Peers() []Peer {
+	return swarm.client.listPeers(time.Now())
+}
+
+// HandleRingChanges registers a handler called whenever our Predecessor or Successor changes
+//
+// This replaces the previous handler, and a nil handler removes it.
+func (swarm *SwarmHandle) HandleRingChanges(handler RingHandler) {
+	swarm.client.peers.setHandler(handler)
 }
@@ -0,0 +1,94 @@
+package network
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+// Transport abstracts over the way we establish connections with peers
+//
+// The protocol itself only needs streams of bytes between nodes,
+// so anything that can produce a net.Conn can be used to run a swarm.
+// NetTransport is the usual choice, but MemoryTransport allows
+// running many nodes inside the same process, without any ports.
+type Transport interface {
+	// Dial opens a new connection to the node listening at addr
+	Dial(addr net.Addr) (net.Conn, error)
+	// Listen starts accepting connections at addr
+	Listen(addr net.Addr) (net.Listener, error)
+	// ResolveAddr converts an address we've received from a peer
+	//
+	// The network is the one the address was created with.
+	ResolveAddr(network, address string) (net.Addr, error)
+}
+
+// NetTransport is a Transport using the net package
+//
+// Both TCP, over IPv4 and IPv6, and Unix sockets are supported.
+type NetTransport struct{}
+
+// Dial connects to a peer over the network
+func (NetTransport) Dial(addr net.Addr) (net.Conn, error) {
+	return net.Dial(addr.Network(), addr.String())
+}
+
+// Listen opens a listener on the network
+//
+// A Unix socket left behind by a node that crashed is replaced.
+func (NetTransport) Listen(addr net.Addr) (net.Listener, error) {
+	l, err := net.Listen(addr.Network(), addr.String())
+	if err == nil || addr.Network() != "unix" {
+		return l, err
+	}
+	if conn, dialErr := net.Dial("unix", addr.String()); dialErr == nil {
+		// somebody is still using it
+		conn.Close()
+		return nil, err
+	}
+	if removeErr := os.Remove(addr.String()); removeErr != nil {
+		return nil, err
+	}
+	return net.Listen(addr.Network(), addr.String())
+}
+
+// ResolveAddr resolves TCP and Unix addresses
+func (NetTransport) ResolveAddr(network, address string) (net.Addr, error) {
+	return protocol.ResolveAddr(network, address)
+}
+
+// userNetworks are the networks a user can prefix an address with
+var userNetworks = []string{"tcp", "tcp4", "tcp6", "unix"}
+
+// ParseAddr reads an address given by a user, for use with a NetTransport
+//
+// Addresses can be prefixed with their network, as in "unix:/tmp/ripple.sock"
+// or "tcp6:[fe80::1%eth0]:8080". Without a prefix, TCP is assumed.
+func ParseAddr(s string) (net.Addr, error) {
+	network := "tcp"
+	address := s
+	for _, prefix := range userNetworks {
+		if strings.HasPrefix(s, prefix+":") {
+			network = prefix
+			address = s[len(prefix)+1:]
+			break
+		}
+	}
+	var addr net.Addr
+	var err error
+	// unlike addresses from peers, we're happy to look up host names here
+	if network == "unix" {
+		addr, err = net.ResolveUnixAddr(network, address)
+	} else {
+		addr, err = net.ResolveTCPAddr(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := protocol.CheckAddr(addr); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
@@ -0,0 +1,253 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+func TestMemoryTransportDial(t *testing.T) {
+	transport := NewMemoryTransport()
+	addr := MemoryAddr("a")
+	l, err := transport.Listen(addr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := transport.Dial(addr)
+		if err != nil {
+			return
+		}
+		sendMessage(conn, protocol.Ping{})
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if conn.LocalAddr().String() != "a" {
+		t.Errorf("Expected local address a got %v", conn.LocalAddr())
+	}
+	msg, err := protocol.ReadMessageWith(conn, transport.ResolveAddr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if msg != (protocol.Ping{}) {
+		t.Errorf("Expected %v got %v", protocol.Ping{}, msg)
+	}
+}
+
+func TestMemoryTransportRefused(t *testing.T) {
+	transport := NewMemoryTransport()
+	if _, err := transport.Dial(MemoryAddr("nobody")); err == nil {
+		t.Errorf("Expected dialing an unknown address to fail")
+	}
+	l, err := transport.Listen(MemoryAddr("a"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := transport.Listen(MemoryAddr("a")); err == nil {
+		t.Errorf("Expected listening twice on an address to fail")
+	}
+	l.Close()
+	if _, err := transport.Dial(MemoryAddr("a")); err == nil {
+		t.Errorf("Expected dialing a closed listener to fail")
+	}
+}
+
+// chanReceiver pushes all the content it receives into a channel
+type chanReceiver chan string
+
+func (r chanReceiver) ReceiveContent(name, content string) {
+	r <- content
+}
+
+// ringIsStable checks that following successors visits every node once,
+// and that each node is the predecessor of its successor
+func ringIsStable(swarms []*SwarmHandle) bool {
+	byAddr := make(map[string]*SwarmHandle)
+	for _, swarm := range swarms {
+		byAddr[swarm.Addr().String()] = swarm
+	}
+	current := swarms[0]
+	for i := 0; i < len(swarms); i++ {
+		succ, ok := byAddr[current.client.state.getSucc().addr.String()]
+		if !ok {
+			return false
+		}
+		if !sameAddr(succ.client.state.getPred().addr, current.Addr()) {
+			return false
+		}
+		current = succ
+		if current == swarms[0] && i < len(swarms)-1 {
+			return false
+		}
+	}
+	return current == swarms[0]
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// memoryAddrs returns n addresses: node-0, node-1, ...
+func memoryAddrs(n int) []net.Addr {
+	addrs := make([]net.Addr, n)
+	for i := range addrs {
+		addrs[i] = MemoryAddr(fmt.Sprintf("node-%d", i))
+	}
+	return addrs
+}
+
+// makeSwarm joins a node at each address into a swarm, through the first one
+func makeSwarm(t *testing.T, transport Transport, addrs []net.Addr) []*SwarmHandle {
+	configs := make([]Config, len(addrs))
+	for i, addr := range addrs {
+		configs[i] = Config{Transport: transport, ListenAddr: addr}
+	}
+	return makeSwarmWith(t, configs)
+}
+
+// makeSwarmWith joins a node for each config into a swarm, through the first one
+func makeSwarmWith(t *testing.T, configs []Config) []*SwarmHandle {
+	created := make(chan *SwarmHandle)
+	go func() {
+		swarm, err := CreateSwarm(configs[0])
+		if err != nil {
+			t.Errorf("Failed to create swarm: %v", err)
+		}
+		created <- swarm
+	}()
+	start := configs[0].AdvertiseAddr
+	if start == nil {
+		start = configs[0].ListenAddr
+	}
+	swarms := make([]*SwarmHandle, 0, len(configs))
+	for i := 1; i < len(configs); i++ {
+		var swarm *SwarmHandle
+		var err error
+		// the first node might not be listening yet
+		waitFor(t, "first node to accept joins", func() bool {
+			swarm, err = JoinSwarm(configs[i], start)
+			return err == nil || i > 1
+		})
+		if err != nil {
+			t.Fatalf("Failed to join swarm: %v", err)
+		}
+		if i == 1 {
+			swarms = append(swarms, <-created)
+		}
+		swarms = append(swarms, swarm)
+		waitFor(t, "ring to stabilize", func() bool {
+			return ringIsStable(swarms)
+		})
+	}
+	return swarms
+}
+
+// checkBroadcast sends a message from one node, making sure all others receive it
+func checkBroadcast(t *testing.T, swarms []*SwarmHandle, from int) {
+	checkBroadcastContent(t, swarms, from, "hello")
+}
+
+func checkBroadcastContent(t *testing.T, swarms []*SwarmHandle, from int, expected string) {
+	receivers := make([]chanReceiver, len(swarms))
+	for i, swarm := range swarms {
+		receivers[i] = make(chanReceiver, 1)
+		swarm.SetReceiver(receivers[i])
+	}
+	if err := swarms[from].SendContent(expected); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i, receiver := range receivers {
+		if i == from {
+			continue
+		}
+		select {
+		case content := <-receiver:
+			if content != expected {
+				t.Errorf("Expected %.20q got %.20q", expected, content)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Node %d never received the message", i)
+		}
+	}
+}
+
+func TestSwarmOverMemoryTransport(t *testing.T) {
+	swarms := makeSwarm(t, NewMemoryTransport(), memoryAddrs(50))
+	checkBroadcast(t, swarms, 7)
+}
+
+func TestSwarmOverUnixSockets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ripple")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	addrs := make([]net.Addr, 4)
+	for i := range addrs {
+		addr, err := ParseAddr("unix:" + filepath.Join(dir, fmt.Sprintf("node-%d.sock", i)))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		addrs[i] = addr
+	}
+	swarms := makeSwarm(t, NetTransport{}, addrs)
+	checkBroadcast(t, swarms, 2)
+}
+
+func TestSwarmOverIPv6(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	addrs := make([]net.Addr, 3)
+	for i := range addrs {
+		addr, err := ParseAddr(fmt.Sprintf("tcp6:[::1]:%d", port+i))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		addrs[i] = addr
+	}
+	swarms := makeSwarm(t, NetTransport{}, addrs)
+	checkBroadcast(t, swarms, 1)
+}
+
+func TestParseAddr(t *testing.T) {
+	cases := map[string]string{
+		"127.0.0.1:8080":           "tcp 127.0.0.1:8080",
+		"tcp:127.0.0.1:8080":       "tcp 127.0.0.1:8080",
+		"tcp6:[fe80::1%eth0]:8080": "tcp [fe80::1%eth0]:8080",
+		"unix:/tmp/ripple.sock":    "unix /tmp/ripple.sock",
+		"[2001:db8::68]:9000":      "tcp [2001:db8::68]:9000",
+	}
+	for input, expected := range cases {
+		addr, err := ParseAddr(input)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", input, err)
+			continue
+		}
+		if got := addr.Network() + " " + addr.String(); got != expected {
+			t.Errorf("Expected %q got %q", expected, got)
+		}
+	}
+	if _, err := ParseAddr("unix:/" + strings.Repeat("a", 300)); err == nil {
+		t.Errorf("Expected an overly long address to be rejected")
+	}
+}
@@ -10,9 +10,15 @@ import (
 
 // syncConn lets us manage access to an arriving peer
 //
-// the inner conn is safe to read, but not to modify
+// the inner conn should be read through get, since it's filled from other goroutines
 type syncConn struct {
-	conn    net.Conn
+	// mu guards conn, in, and out
+	mu   sync.Mutex
+	conn net.Conn
+	// in reads the messages arriving over conn
+	in *protocol.Decoder
+	// out queues the messages we send over conn
+	out     *outbox
 	muEmpty sync.Mutex
 	muFill  sync.Mutex
 }
@@ -26,26 +32,47 @@ func makeSyncConn() *syncConn {
 
 // String formats a syncConn by printing the undlerying connection
 func (conn *syncConn) String() string {
-	return conn.conn.RemoteAddr().String()
+	inner, _, _ := conn.get()
+	if inner == nil {
+		return "empty"
+	}
+	return inner.RemoteAddr().String()
 }
 
 // empty will block until the connection is full
 func (conn *syncConn) empty() {
 	conn.muEmpty.Lock()
+	conn.mu.Lock()
 	conn.conn = nil
+	conn.in = nil
+	conn.out = nil
+	conn.mu.Unlock()
 	conn.muFill.Unlock()
 }
 
 // fill will block until the connection is empty
-func (conn *syncConn) fill(newConn net.Conn) {
+func (conn *syncConn) fill(newConn net.Conn, in *protocol.Decoder, out *outbox) {
 	conn.muFill.Lock()
+	conn.mu.Lock()
 	conn.conn = newConn
+	conn.in = in
+	conn.out = out
+	conn.mu.Unlock()
 	conn.muEmpty.Unlock()
 }
 
-// isEmpty checks if a syncConn contains nothing
-func (conn *syncConn) isEmpty() bool {
-	return conn.conn == nil
+// get returns what the syncConn currently holds, which may be nothing
+func (conn *syncConn) get() (net.Conn, *protocol.Decoder, *outbox) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.conn, conn.in, conn.out
+}
+
+// newDecoder reads messages from conn, with addresses parsed by transport
+func newDecoder(conn net.Conn, transport Transport, limits protocol.Limits) *protocol.Decoder {
+	in := protocol.NewDecoder(conn, transport.ResolveAddr)
+	in.SetLimits(limits)
+	return in
 }
 
 func sendMessage(w io.Writer, msg protocol.Message) error {
@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxAddrLength is the longest address string, or network name, we can encode
+const MaxAddrLength = 255
+
+// CheckAddr makes sure that an address can be sent over the wire
+func CheckAddr(addr net.Addr) error {
+	if len(addr.Network()) > MaxAddrLength {
+		return fmt.Errorf("Network name too long: %q", addr.Network())
+	}
+	if len(addr.String()) > MaxAddrLength {
+		return fmt.Errorf("Address too long: %q", addr.String())
+	}
+	return nil
+}
+
+// appendAddr encodes an address as its network, followed by the address itself
+//
+// Both parts are prefixed by a single byte length.
+func appendAddr(bytes []byte, addr net.Addr) []byte {
+	network := addr.Network()
+	addrString := addr.String()
+	bytes = append(bytes, byte(len(network)))
+	bytes = append(bytes, network...)
+	bytes = append(bytes, byte(len(addrString)))
+	return append(bytes, addrString...)
+}
+
+// AddrParser converts an address read from the wire back into an address
+//
+// Addresses are sent as the name of their network, and their string form.
+// The right way of interpreting them depends on the transport the swarm
+// is running over.
+type AddrParser func(network, address string) (net.Addr, error)
+
+// ResolveAddr is the AddrParser used by ReadMessage
+//
+// It understands TCP addresses, over IPv4 or IPv6, as well as Unix sockets.
+// Since these addresses come from other peers, TCP addresses must be IP
+// literals: we never look up host names on behalf of somebody else.
+func ResolveAddr(network, address string) (net.Addr, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return parseTCPAddr(network, address)
+	case "unix":
+		if address == "" || strings.IndexByte(address, 0) >= 0 {
+			return nil, fmt.Errorf("Invalid unix address: %q", address)
+		}
+		return &net.UnixAddr{Name: address, Net: network}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported network: %q", network)
+	}
+}
+
+// parseTCPAddr parses an IP address and port, with an optional IPv6 zone
+func parseTCPAddr(network, address string) (net.Addr, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	zone := ""
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("Expected an IP address, got %q", host)
+	}
+	isIPv4 := ip.To4() != nil
+	if (network == "tcp4" && !isIPv4) || (isIPv4 && zone != "") {
+		return nil, fmt.Errorf("Invalid %s address: %q", network, address)
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port: %q", portString)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port), Zone: zone}, nil
+}
+
+// printable checks that some bytes are UTF-8 text, without control characters
+func printable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, c := range b {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,239 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// FeatureChords lets peers broadcast over chord links, as well as the ring
+//
+// A node with this feature answers LinkQuery, accepts OpenLink, takes part
+// in a Census, and passes a TreeCast along to the right part of the swarm.
+const FeatureChords Features = 1 << 2
+
+const (
+	linkQueryTag = 13
+	linkReplyTag = 14
+	censusTag    = 15
+	openLinkTag  = 16
+	treeCastTag  = 17
+)
+
+// errTreeCastPayload is returned when a TreeCast carries something other than a broadcast
+var errTreeCastPayload = errors.New("TreeCast can only carry NewMessage, Post, Nickname or Envelope")
+
+// LinkQuery asks a node for one of its chord links
+//
+// A chord link at some level points to the node 2^level hops
+// further along the ring. This is the only message sent over its connection,
+// which is closed once the LinkReply arrives.
+type LinkQuery struct {
+	Level uint8
+}
+
+// MessageBytes serializes a LinkQuery
+func (r LinkQuery) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized LinkQuery to dst
+func (r LinkQuery) AppendBytes(dst []byte) []byte {
+	return append(dst, linkQueryTag, r.Level)
+}
+
+// PassToClient refuses a LinkQuery, since it's answered as soon as it arrives
+func (r LinkQuery) PassToClient(client Client) error {
+	return fmt.Errorf("Unexpected LinkQuery on an established connection")
+}
+
+// LinkReply answers a LinkQuery
+type LinkReply struct {
+	Level uint8
+	// Addr is nil if the node doesn't have a link at that level yet
+	Addr net.Addr
+}
+
+// MessageBytes serializes a LinkReply
+func (r LinkReply) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized LinkReply to dst
+func (r LinkReply) AppendBytes(dst []byte) []byte {
+	if r.Addr == nil {
+		return append(dst, linkReplyTag, r.Level, 0)
+	}
+	return appendAddr(append(dst, linkReplyTag, r.Level, 1), r.Addr)
+}
+
+// PassToClient refuses a LinkReply, since it's read by whoever sent the LinkQuery
+func (r LinkReply) PassToClient(client Client) error {
+	return fmt.Errorf("Unexpected LinkReply on an established connection")
+}
+
+// Census travels around the ring once, counting the nodes in it
+type Census struct {
+	// Origin is the node that started the census, and wants the result
+	Origin net.Addr
+	// Count is how many nodes the census has gone through, including Origin
+	Count uint32
+}
+
+// MessageBytes serializes a Census
+func (r Census) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized Census to dst
+func (r Census) AppendBytes(dst []byte) []byte {
+	dst = appendAddr(append(dst, censusTag), r.Origin)
+	return append(dst, byte(r.Count>>24), byte(r.Count>>16), byte(r.Count>>8), byte(r.Count))
+}
+
+// PassToClient implements the visitor pattern for Census
+func (r Census) PassToClient(client Client) error {
+	return client.HandleCensus(r)
+}
+
+// OpenLink starts a connection used as a chord link
+//
+// Only TreeCast messages follow it, from the node that dialed.
+type OpenLink struct {
+	// Addr is the address of the node that dialed
+	Addr net.Addr
+}
+
+// MessageBytes serializes an OpenLink
+func (r OpenLink) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized OpenLink to dst
+func (r OpenLink) AppendBytes(dst []byte) []byte {
+	return appendAddr(append(dst, openLinkTag), r.Addr)
+}
+
+// PassToClient refuses an OpenLink, since it can only start a connection
+func (r OpenLink) PassToClient(client Client) error {
+	return fmt.Errorf("Unexpected OpenLink on an established connection")
+}
+
+// TreeCast carries a broadcast down a spanning tree built from chord links
+//
+// The node receiving it is responsible for the nodes following it in the ring,
+// up to Limit, and splits them between its own links. Budget says how many
+// nodes that should be, but the ring may have changed since then.
+type TreeCast struct {
+	// Origin is the node that started the broadcast
+	Origin net.Addr
+	// Seq tells apart the broadcasts started by Origin
+	Seq uint64
+	// Budget is how many of the nodes after this one still need the broadcast
+	Budget uint32
+	// Hops is how many links the broadcast has gone through so far
+	Hops uint16
+	// Limit is the first node after this one that someone else is responsible for
+	Limit net.Addr
+	// Payload is a NewMessage, Post, Nickname or Envelope
+	Payload Message
+}
+
+// MessageBytes serializes a TreeCast
+func (r TreeCast) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized TreeCast to dst
+func (r TreeCast) AppendBytes(dst []byte) []byte {
+	dst = appendAddr(append(dst, treeCastTag), r.Origin)
+	dst = appendUint64(dst, r.Seq)
+	dst = append(dst, byte(r.Budget>>24), byte(r.Budget>>16), byte(r.Budget>>8), byte(r.Budget))
+	dst = append(dst, byte(r.Hops>>8), byte(r.Hops))
+	dst = appendAddr(dst, r.Limit)
+	return r.Payload.AppendBytes(dst)
+}
+
+// PassToClient implements the visitor pattern for TreeCast
+func (r TreeCast) PassToClient(client Client) error {
+	return client.HandleTreeCast(r)
+}
+
+// isTreeCastPayload checks if a message can be carried by a TreeCast
+func isTreeCastPayload(tag byte) bool {
+	return tag == 7 || tag == 8 || tag == 11 || tag == postTag
+}
+
+// readLinkReply reads the rest of a LinkReply, after its tag
+func (d *Decoder) readLinkReply() (LinkReply, error) {
+	d.buf = d.buf[:0]
+	if err := d.readFull(2); err != nil {
+		return LinkReply{}, err
+	}
+	reply := LinkReply{Level: d.buf[0]}
+	switch d.buf[1] {
+	case 0:
+		return reply, nil
+	case 1:
+		addr, err := d.readAddr()
+		reply.Addr = addr
+		return reply, err
+	default:
+		return LinkReply{}, fmt.Errorf("Invalid LinkReply flag: %d", d.buf[1])
+	}
+}
+
+// readCensus reads the rest of a Census, after its tag
+func (d *Decoder) readCensus() (Census, error) {
+	origin, err := d.readAddr()
+	if err != nil {
+		return Census{}, err
+	}
+	d.buf = d.buf[:0]
+	if err := d.readFull(4); err != nil {
+		return Census{}, err
+	}
+	b := d.buf
+	count := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	return Census{Origin: origin, Count: count}, nil
+}
+
+// readTreeCast reads the rest of a TreeCast, after its tag, including its payload
+func (d *Decoder) readTreeCast() (TreeCast, error) {
+	origin, err := d.readAddr()
+	if err != nil {
+		return TreeCast{}, err
+	}
+	d.buf = d.buf[:0]
+	if err := d.readFull(14); err != nil {
+		return TreeCast{}, err
+	}
+	b := d.buf
+	var seq uint64
+	for _, c := range b[:8] {
+		seq = seq<<8 | uint64(c)
+	}
+	cast := TreeCast{
+		Origin: origin,
+		Seq:    seq,
+		Budget: uint32(b[8])<<24 | uint32(b[9])<<16 | uint32(b[10])<<8 | uint32(b[11]),
+		Hops:   uint16(b[12])<<8 | uint16(b[13]),
+	}
+	if cast.Limit, err = d.readAddr(); err != nil {
+		return TreeCast{}, err
+	}
+	d.buf = d.buf[:0]
+	if err := d.readFull(1); err != nil {
+		return TreeCast{}, err
+	}
+	tag := d.buf[0]
+	if !isTreeCastPayload(tag) {
+		return TreeCast{}, errTreeCastPayload
+	}
+	payload, err := d.decodeBody(tag)
+	if err != nil {
+		return TreeCast{}, err
+	}
+	cast.Payload = payload
+	return cast, nil
+}
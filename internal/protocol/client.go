@@ -17,6 +17,14 @@ type Client interface {
 	HandleConfirmReferral() error
 	// Handle a NewMessage message
 	HandleNewMessage(NewMessage) error
+	// Handle a Post message
+	HandlePost(Post) error
 	// Handle a Nickname message
 	HandleNickname(Nickname) error
+	// Handle an Envelope message
+	HandleEnvelope(Envelope) error
+	// Handle a Census message
+	HandleCensus(Census) error
+	// Handle a TreeCast message
+	HandleTreeCast(TreeCast) error
 }
@@ -0,0 +1,378 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"unicode/utf8"
+)
+
+const (
+	// maxCachedAddrs bounds how many parsed addresses a Decoder remembers
+	maxCachedAddrs = 256
+	// maxScratch is the largest scratch buffer a Decoder holds on to
+	maxScratch = 64 * 1024
+)
+
+// Encoder writes messages to a stream, buffering them until flushed
+//
+// The same buffer is reused for every message, so encoding doesn't allocate,
+// apart from whatever formatting the addresses in messages takes.
+type Encoder struct {
+	w   *bufio.Writer
+	buf []byte
+	// compress is set once both ends agreed on compression
+	compress   bool
+	deflater   *flate.Writer
+	compressed bytes.Buffer
+}
+
+// NewEncoder creates an Encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Encode buffers a message, which will be written by the next Flush
+//
+// Large messages may be written right away.
+func (e *Encoder) Encode(msg Message) error {
+	e.buf = msg.AppendBytes(e.buf[:0])
+	if e.compress && len(e.buf) > CompressionThreshold {
+		if frame, ok := e.compressFrame(); ok {
+			_, err := e.w.Write(frame)
+			return err
+		}
+	}
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// Flush writes out all the buffered messages
+func (e *Encoder) Flush() error {
+	return e.w.Flush()
+}
+
+// Decoder reads a stream of messages
+//
+// It does the same thing as calling ReadMessageWith repeatedly, but reads
+// ahead into a buffer, and reuses its scratch space and parsed addresses
+// between messages. Since it reads ahead, once a Decoder has been used on a
+// stream, everything else must be read through it.
+//
+// A message that ends early fails with io.ErrUnexpectedEOF, while io.EOF
+// means that the stream ended cleanly between two messages.
+type Decoder struct {
+	r      io.Reader
+	parse  AddrParser
+	limits Limits
+	buf    []byte
+	// frame is how many bytes of the current message we've read
+	frame int
+	// addrs remembers parsed addresses, if not nil
+	addrs map[string]net.Addr
+	// these are used to decompress compressed frames
+	compressed bytes.Reader
+	inflater   io.ReadCloser
+	inflated   bytes.Buffer
+}
+
+// NewDecoder creates a Decoder reading from r, and parsing addresses with parse
+func NewDecoder(r io.Reader, parse AddrParser) *Decoder {
+	d := newDecoder(bufio.NewReader(r), parse)
+	d.addrs = make(map[string]net.Addr)
+	return d
+}
+
+// newDecoder creates a Decoder reading exactly what it needs from r
+func newDecoder(r io.Reader, parse AddrParser) *Decoder {
+	return &Decoder{
+		r:      r,
+		parse:  parse,
+		limits: DefaultLimits,
+		buf:    make([]byte, 0, 2*(MaxAddrLength+1)),
+	}
+}
+
+// SetLimits changes how large the messages we accept can be
+//
+// Zero fields are replaced with those in DefaultLimits.
+func (d *Decoder) SetLimits(limits Limits) {
+	d.limits = limits.withDefaults()
+}
+
+// Decode reads the next message from the stream
+func (d *Decoder) Decode() (Message, error) {
+	d.frame = 0
+	d.buf = d.buf[:0]
+	if err := d.readFull(1); err != nil {
+		return nil, err
+	}
+	msg, err := d.decodeBody(d.buf[0])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return msg, err
+}
+
+func (d *Decoder) decodeBody(tag byte) (Message, error) {
+	switch tag {
+	case 1:
+		return Ping{}, nil
+	case 6:
+		return ConfirmReferral{}, nil
+	case 2, 3, 4, 5:
+		addr, err := d.readAddr()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 2:
+			return JoinSwarm{Addr: addr}, nil
+		case 3:
+			return Referral{Addr: addr}, nil
+		case 4:
+			return NewPredecessor{Addr: addr}, nil
+		default:
+			return ConfirmPredecessor{Addr: addr}, nil
+		}
+	case 7, 8:
+		addr, err := d.readAddr()
+		if err != nil {
+			return nil, err
+		}
+		text, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if tag == 7 {
+			return NewMessage{Sender: addr, Content: text}, nil
+		}
+		return Nickname{Sender: addr, Name: text}, nil
+	case 9, 10:
+		hello, err := d.readHello()
+		if err != nil {
+			return nil, err
+		}
+		if tag == 9 {
+			return hello, nil
+		}
+		return HelloAck(hello), nil
+	case 11:
+		return d.readEnvelope()
+	case compressedTag:
+		return d.readCompressed()
+	case linkQueryTag:
+		d.buf = d.buf[:0]
+		if err := d.readFull(1); err != nil {
+			return nil, err
+		}
+		return LinkQuery{Level: d.buf[0]}, nil
+	case linkReplyTag:
+		return d.readLinkReply()
+	case censusTag:
+		return d.readCensus()
+	case openLinkTag:
+		addr, err := d.readAddr()
+		if err != nil {
+			return nil, err
+		}
+		return OpenLink{Addr: addr}, nil
+	case treeCastTag:
+		return d.readTreeCast()
+	case lookupTag:
+		d.buf = d.buf[:0]
+		if err := d.readFull(8); err != nil {
+			return nil, err
+		}
+		var id ID
+		for _, c := range d.buf {
+			id = id<<8 | ID(c)
+		}
+		return Lookup{ID: id}, nil
+	case lookupReplyTag:
+		return d.readLookupReply()
+	case getNeighborsTag:
+		return GetNeighbors{}, nil
+	case neighborsTag:
+		return d.readNeighbors()
+	case fileRequestTag:
+		return d.readFileRequest()
+	case fileChunkTag:
+		return d.readFileChunk()
+	case postTag:
+		return d.readPost()
+	default:
+		return nil, UnknownTypeError(tag)
+	}
+}
+
+// readHello reads the fields shared by Hello and HelloAck
+func (d *Decoder) readHello() (Hello, error) {
+	d.buf = d.buf[:0]
+	if err := d.readFull(12); err != nil {
+		return Hello{}, err
+	}
+	b := d.buf
+	var features Features
+	for _, c := range b[4:12] {
+		features = features<<8 | Features(c)
+	}
+	return Hello{
+		Version:    uint16(b[0])<<8 | uint16(b[1]),
+		MinVersion: uint16(b[2])<<8 | uint16(b[3]),
+		Features:   features,
+	}, nil
+}
+
+// readFull appends exactly amount bytes from the stream to the scratch buffer
+func (d *Decoder) readFull(amount int) error {
+	d.frame += amount
+	if d.frame > d.limits.MaxFrame {
+		return TooLargeError{What: "Message", Limit: d.limits.MaxFrame}
+	}
+	start := len(d.buf)
+	if cap(d.buf)-start < amount {
+		grown := make([]byte, start, start+amount)
+		copy(grown, d.buf)
+		d.buf = grown
+	}
+	d.buf = d.buf[:start+amount]
+	_, err := io.ReadFull(d.r, d.buf[start:])
+	return err
+}
+
+// readAddr reads an address, as written by appendAddr
+//
+// The raw bytes of the address are used to look up addresses we've
+// already parsed, since the same few senders show up over and over.
+func (d *Decoder) readAddr() (net.Addr, error) {
+	d.buf = d.buf[:0]
+	if err := d.readFull(1); err != nil {
+		return nil, err
+	}
+	networkEnd := 1 + int(d.buf[0])
+	if err := d.readFull(int(d.buf[0]) + 1); err != nil {
+		return nil, err
+	}
+	if err := d.readFull(int(d.buf[networkEnd])); err != nil {
+		return nil, err
+	}
+	if addr, ok := d.addrs[string(d.buf)]; ok {
+		return addr, nil
+	}
+	networkBytes := d.buf[1:networkEnd]
+	addrBytes := d.buf[networkEnd+1:]
+	if !printable(networkBytes) || !printable(addrBytes) {
+		return nil, fmt.Errorf("Invalid address: %q %q", networkBytes, addrBytes)
+	}
+	addr, err := d.parse(string(networkBytes), string(addrBytes))
+	if err != nil {
+		return nil, err
+	}
+	if d.addrs != nil {
+		if len(d.addrs) >= maxCachedAddrs {
+			d.addrs = make(map[string]net.Addr)
+		}
+		d.addrs[string(d.buf)] = addr
+	}
+	return addr, nil
+}
+
+// readShortString reads printable text, prefixed by a single byte length
+func (d *Decoder) readShortString() (string, error) {
+	d.buf = d.buf[:0]
+	if err := d.readFull(1); err != nil {
+		return "", err
+	}
+	if err := d.readFull(int(d.buf[0])); err != nil {
+		return "", err
+	}
+	if d.buf[0] == 0 || !printable(d.buf[1:]) {
+		return "", fmt.Errorf("Invalid name: %q", d.buf[1:])
+	}
+	return string(d.buf[1:]), nil
+}
+
+// readEnvelope reads the rest of an Envelope, after its tag
+func (d *Decoder) readEnvelope() (Envelope, error) {
+	sender, err := d.readAddr()
+	if err != nil {
+		return Envelope{}, err
+	}
+	kind, err := d.readShortString()
+	if err != nil {
+		return Envelope{}, err
+	}
+	d.buf = d.buf[:0]
+	if err := d.readFull(2); err != nil {
+		return Envelope{}, err
+	}
+	count := int(d.buf[0])<<8 | int(d.buf[1])
+	var fields []Field
+	for i := 0; i < count; i++ {
+		key, err := d.readShortString()
+		if err != nil {
+			return Envelope{}, err
+		}
+		d.buf = d.buf[:0]
+		if err := d.readFull(5); err != nil {
+			return Envelope{}, err
+		}
+		fieldType := FieldType(d.buf[0])
+		value, err := d.readBytes()
+		if err != nil {
+			return Envelope{}, err
+		}
+		field := Field{Key: key, Type: fieldType, Value: append([]byte{}, value...)}
+		if err := field.check(); err != nil {
+			return Envelope{}, err
+		}
+		fields = append(fields, field)
+	}
+	d.shrink()
+	return Envelope{Sender: sender, Kind: kind, Fields: fields}, nil
+}
+
+// readBytes reads a value whose 4 byte length is at the end of the scratch buffer
+//
+// The value is only valid until the scratch buffer is used again.
+func (d *Decoder) readBytes() ([]byte, error) {
+	b := d.buf[len(d.buf)-4:]
+	length := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	if uint64(length) > uint64(d.limits.MaxContent) {
+		return nil, TooLargeError{What: "Content", Limit: d.limits.MaxContent}
+	}
+	d.buf = d.buf[:0]
+	if err := d.readFull(int(length)); err != nil {
+		return nil, err
+	}
+	return d.buf, nil
+}
+
+// shrink lets go of a scratch buffer grown by a large message
+func (d *Decoder) shrink() {
+	if cap(d.buf) > maxScratch {
+		d.buf = make([]byte, 0, 2*(MaxAddrLength+1))
+	}
+}
+
+// readString reads UTF-8 text, prefixed by a 4 byte length
+func (d *Decoder) readString() (string, error) {
+	d.buf = d.buf[:0]
+	if err := d.readFull(4); err != nil {
+		return "", err
+	}
+	value, err := d.readBytes()
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(value) {
+		return "", ErrInvalidUTF8
+	}
+	text := string(value)
+	d.shrink()
+	return text, nil
+}
@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// FeatureCompression lets peers compress large messages sent to each other
+const FeatureCompression Features = 1 << 1
+
+// CompressionThreshold is the size above which messages get compressed
+//
+// Smaller messages aren't worth the effort.
+const CompressionThreshold = 512
+
+// compressedTag starts a frame wrapping a compressed message
+const compressedTag = 12
+
+// errNestedCompression is returned when a compressed frame contains another one
+var errNestedCompression = errors.New("Compressed frame inside a compressed frame")
+
+// SetSession lets the Encoder use what was agreed on during the handshake
+//
+// With FeatureCompression, messages above CompressionThreshold are compressed.
+func (e *Encoder) SetSession(session Session) {
+	e.compress = session.Features.Has(FeatureCompression)
+}
+
+// compressFrame wraps the message in the scratch buffer into a compressed frame
+//
+// This fails if compression wouldn't make the message any smaller.
+func (e *Encoder) compressFrame() ([]byte, bool) {
+	e.compressed.Reset()
+	e.compressed.Write([]byte{compressedTag, 0, 0, 0, 0})
+	if e.deflater == nil {
+		// this can't fail with a valid level
+		e.deflater, _ = flate.NewWriter(&e.compressed, flate.BestSpeed)
+	} else {
+		e.deflater.Reset(&e.compressed)
+	}
+	e.deflater.Write(e.buf)
+	e.deflater.Close()
+	frame := e.compressed.Bytes()
+	length := len(frame) - 5
+	if length >= len(e.buf) {
+		return nil, false
+	}
+	frame[1], frame[2], frame[3], frame[4] = byte(length>>24), byte(length>>16), byte(length>>8), byte(length)
+	return frame, true
+}
+
+// readCompressed reads a compressed frame, and then the message inside it
+//
+// The message inside is held to the same limits as any other.
+func (d *Decoder) readCompressed() (Message, error) {
+	d.buf = d.buf[:0]
+	if err := d.readFull(4); err != nil {
+		return nil, err
+	}
+	compressed, err := d.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	d.compressed.Reset(compressed)
+	if d.inflater == nil {
+		d.inflater = flate.NewReader(&d.compressed)
+	} else {
+		d.inflater.(flate.Resetter).Reset(&d.compressed, nil)
+	}
+	d.inflated.Reset()
+	limited := io.LimitReader(d.inflater, int64(d.limits.MaxFrame)+1)
+	if _, err := d.inflated.ReadFrom(limited); err != nil {
+		return nil, err
+	}
+	if d.inflated.Len() > d.limits.MaxFrame {
+		return nil, TooLargeError{What: "Message", Limit: d.limits.MaxFrame}
+	}
+	outer := d.r
+	d.r = &d.inflated
+	defer func() {
+		d.r = outer
+		if d.inflated.Cap() > maxScratch {
+			d.inflated = bytes.Buffer{}
+		}
+	}()
+	d.frame = 0
+	d.buf = d.buf[:0]
+	if err := d.readFull(1); err != nil {
+		return nil, err
+	}
+	if d.buf[0] == compressedTag {
+		return nil, errNestedCompression
+	}
+	msg, err := d.decodeBody(d.buf[0])
+	if err != nil {
+		return nil, err
+	}
+	if d.inflated.Len() > 0 {
+		return nil, errors.New("Trailing data in compressed frame")
+	}
+	return msg, nil
+}
@@ -0,0 +1,213 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"unicode/utf8"
+)
+
+// FeatureEnvelopes lets peers send each other Envelope messages
+const FeatureEnvelopes Features = 1 << 0
+
+// FeatureDirect lets a peer take an Envelope over a connection of its own,
+// like a message meant for it alone, instead of one going around the ring
+const FeatureDirect Features = 1 << 6
+
+// FieldType says how the value of a Field should be interpreted
+//
+// Nodes pass along fields with types they don't know as they are.
+type FieldType byte
+
+const (
+	// FieldBytes holds arbitrary bytes
+	FieldBytes FieldType = iota
+	// FieldString holds UTF-8 text
+	FieldString
+	// FieldUint holds an unsigned 64 bit integer, in network order
+	FieldUint
+	// FieldBool holds a single byte, either 0 or 1
+	FieldBool
+)
+
+// Field is a single typed key and value inside an Envelope
+type Field struct {
+	// Key names this field, and is at most 255 bytes of printable text
+	Key   string
+	Type  FieldType
+	Value []byte
+}
+
+// NewBytesField creates a field holding some bytes
+func NewBytesField(key string, value []byte) Field {
+	return Field{Key: key, Type: FieldBytes, Value: append([]byte{}, value...)}
+}
+
+// NewStringField creates a field holding some text
+func NewStringField(key string, value string) Field {
+	return Field{Key: key, Type: FieldString, Value: []byte(value)}
+}
+
+// NewUintField creates a field holding an integer
+func NewUintField(key string, value uint64) Field {
+	return Field{Key: key, Type: FieldUint, Value: appendUint64(nil, value)}
+}
+
+// NewBoolField creates a field holding a boolean
+func NewBoolField(key string, value bool) Field {
+	b := byte(0)
+	if value {
+		b = 1
+	}
+	return Field{Key: key, Type: FieldBool, Value: []byte{b}}
+}
+
+// AsString returns the text in a field, if it holds text
+func (field Field) AsString() (string, bool) {
+	if field.Type != FieldString {
+		return "", false
+	}
+	return string(field.Value), true
+}
+
+// AsUint returns the integer in a field, if it holds one
+func (field Field) AsUint() (uint64, bool) {
+	if field.Type != FieldUint || len(field.Value) != 8 {
+		return 0, false
+	}
+	var value uint64
+	for _, b := range field.Value {
+		value = value<<8 | uint64(b)
+	}
+	return value, true
+}
+
+// AsBool returns the boolean in a field, if it holds one
+func (field Field) AsBool() (bool, bool) {
+	if field.Type != FieldBool || len(field.Value) != 1 {
+		return false, false
+	}
+	return field.Value[0] == 1, true
+}
+
+// check makes sure the value of a field matches its type
+func (field Field) check() error {
+	if field.Key == "" || len(field.Key) > 255 || !printable([]byte(field.Key)) {
+		return fmt.Errorf("Invalid field key: %q", field.Key)
+	}
+	valid := true
+	switch field.Type {
+	case FieldString:
+		valid = utf8.Valid(field.Value)
+	case FieldUint:
+		valid = len(field.Value) == 8
+	case FieldBool:
+		valid = len(field.Value) == 1 && field.Value[0] <= 1
+	}
+	if !valid {
+		return fmt.Errorf("Invalid value for field %q of type %d", field.Key, field.Type)
+	}
+	return nil
+}
+
+// Envelope is a broadcast carrying a payload the core protocol doesn't know about
+//
+// Applications define their own kinds of envelopes, and nodes pass
+// envelopes of every kind around the swarm, whether or not they understand them.
+// Envelopes are only sent to peers that negotiated FeatureEnvelopes.
+type Envelope struct {
+	// Sender is the node that sent this envelope
+	Sender net.Addr
+	// Kind names the type of payload, and is at most 255 bytes of printable text
+	Kind string
+	// Fields hold the payload, with at most 65535 of them
+	Fields []Field
+}
+
+// Get returns the first field with a given key
+func (r Envelope) Get(key string) (Field, bool) {
+	for _, field := range r.Fields {
+		if field.Key == key {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+// MessageBytes serializes an Envelope
+func (r Envelope) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized Envelope to dst
+func (r Envelope) AppendBytes(dst []byte) []byte {
+	dst = appendAddr(append(dst, 11), r.Sender)
+	dst = append(dst, byte(len(r.Kind)))
+	dst = append(dst, r.Kind...)
+	dst = append(dst, byte(len(r.Fields)>>8), byte(len(r.Fields)))
+	for _, field := range r.Fields {
+		dst = append(dst, byte(len(field.Key)))
+		dst = append(dst, field.Key...)
+		dst = append(dst, byte(field.Type))
+		length := len(field.Value)
+		dst = append(dst, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+		dst = append(dst, field.Value...)
+	}
+	return dst
+}
+
+// PassToClient implements the visitor pattern for Envelope
+func (r Envelope) PassToClient(client Client) error {
+	return client.HandleEnvelope(r)
+}
+
+// CheckEnvelope makes sure that an envelope can be sent to peers with these limits
+func (limits Limits) CheckEnvelope(env Envelope) error {
+	limits = limits.withDefaults()
+	if env.Kind == "" || len(env.Kind) > 255 || !printable([]byte(env.Kind)) {
+		return fmt.Errorf("Invalid envelope kind: %q", env.Kind)
+	}
+	if len(env.Fields) > 0xffff {
+		return fmt.Errorf("Too many fields in envelope: %d", len(env.Fields))
+	}
+	size := 1 + 2*(MaxAddrLength+1) + 1 + len(env.Kind) + 2
+	for _, field := range env.Fields {
+		if len(field.Value) > limits.MaxContent {
+			return TooLargeError{What: "Content", Limit: limits.MaxContent}
+		}
+		if err := field.check(); err != nil {
+			return err
+		}
+		size += 1 + len(field.Key) + 1 + 4 + len(field.Value)
+	}
+	if size > limits.MaxFrame {
+		return TooLargeError{What: "Message", Limit: limits.MaxFrame}
+	}
+	return nil
+}
+
+func appendUint64(dst []byte, value uint64) []byte {
+	return append(dst,
+		byte(value>>56), byte(value>>48), byte(value>>40), byte(value>>32),
+		byte(value>>24), byte(value>>16), byte(value>>8), byte(value),
+	)
+}
+
+// RequiredFeatures returns the features a peer needs to understand a message
+func RequiredFeatures(msg Message) Features {
+	switch m := msg.(type) {
+	case Envelope:
+		return FeatureEnvelopes
+	case TreeCast:
+		return FeatureChords | RequiredFeatures(m.Payload)
+	case LinkQuery, LinkReply, Census, OpenLink:
+		return FeatureChords
+	case Lookup, LookupReply, GetNeighbors, Neighbors:
+		return FeatureFingers
+	case FileRequest, FileChunk:
+		return FeatureFiles
+	case Post:
+		return FeatureMessageIDs
+	default:
+		return 0
+	}
+}
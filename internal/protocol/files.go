@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// FeatureFiles lets peers download the files other nodes offer
+const FeatureFiles Features = 1 << 4
+
+const (
+	fileRequestTag = 22
+	fileChunkTag   = 23
+)
+
+// FileHash identifies the contents of a file, by their SHA-256 hash
+type FileHash [sha256.Size]byte
+
+// String formats a FileHash in hexadecimal
+func (hash FileHash) String() string {
+	return fmt.Sprintf("%x", hash[:])
+}
+
+// FileRequest asks a node for a file it offered, starting at some offset
+//
+// This is the only message sent by the node asking over its connection.
+// The other node answers with FileChunk messages until the end of the file,
+// and then hangs up. A node not offering the file hangs up right away.
+type FileRequest struct {
+	Hash   FileHash
+	Offset uint64
+}
+
+// MessageBytes serializes a FileRequest
+func (r FileRequest) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized FileRequest to dst
+func (r FileRequest) AppendBytes(dst []byte) []byte {
+	dst = append(append(dst, fileRequestTag), r.Hash[:]...)
+	return appendUint64(dst, r.Offset)
+}
+
+// PassToClient refuses a FileRequest, since it's answered as soon as it arrives
+func (r FileRequest) PassToClient(client Client) error {
+	return fmt.Errorf("Unexpected FileRequest on an established connection")
+}
+
+// FileChunk carries part of a file, answering a FileRequest
+type FileChunk struct {
+	// Offset is where this chunk starts in the file
+	Offset uint64
+	Data   []byte
+}
+
+// MessageBytes serializes a FileChunk
+func (r FileChunk) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized FileChunk to dst
+func (r FileChunk) AppendBytes(dst []byte) []byte {
+	dst = appendUint64(append(dst, fileChunkTag), r.Offset)
+	length := len(r.Data)
+	dst = append(dst, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	return append(dst, r.Data...)
+}
+
+// PassToClient refuses a FileChunk, since it's read by whoever sent the FileRequest
+func (r FileChunk) PassToClient(client Client) error {
+	return fmt.Errorf("Unexpected FileChunk on an established connection")
+}
+
+// readFileRequest reads the rest of a FileRequest, after its tag
+func (d *Decoder) readFileRequest() (FileRequest, error) {
+	d.buf = d.buf[:0]
+	if err := d.readFull(len(FileHash{}) + 8); err != nil {
+		return FileRequest{}, err
+	}
+	var req FileRequest
+	copy(req.Hash[:], d.buf)
+	for _, c := range d.buf[len(req.Hash):] {
+		req.Offset = req.Offset<<8 | uint64(c)
+	}
+	return req, nil
+}
+
+// readFileChunk reads the rest of a FileChunk, after its tag
+func (d *Decoder) readFileChunk() (FileChunk, error) {
+	d.buf = d.buf[:0]
+	if err := d.readFull(12); err != nil {
+		return FileChunk{}, err
+	}
+	var chunk FileChunk
+	for _, c := range d.buf[:8] {
+		chunk.Offset = chunk.Offset<<8 | uint64(c)
+	}
+	data, err := d.readBytes()
+	if err != nil {
+		return FileChunk{}, err
+	}
+	chunk.Data = append([]byte{}, data...)
+	d.shrink()
+	return chunk, nil
+}
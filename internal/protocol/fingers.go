@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+)
+
+// FeatureFingers lets peers ask each other which node is responsible for an ID
+const FeatureFingers Features = 1 << 3
+
+const (
+	lookupTag       = 18
+	lookupReplyTag  = 19
+	getNeighborsTag = 20
+	neighborsTag    = 21
+)
+
+// ID places a node, or anything else, on a hash ring
+//
+// The node responsible for an ID is the first one whose own ID
+// comes at or after it, going around the ring.
+type ID uint64
+
+// HashID places some data on the ring
+func HashID(data []byte) ID {
+	sum := sha1.Sum(data)
+	var id ID
+	for _, b := range sum[:8] {
+		id = id<<8 | ID(b)
+	}
+	return id
+}
+
+// IDOf returns the ID of the node with some address
+func IDOf(addr net.Addr) ID {
+	return HashID([]byte(addr.Network() + " " + addr.String()))
+}
+
+// Between checks if an ID is after from, and at most to, going around the ring
+//
+// When from and to are the same, this covers the whole ring.
+func (id ID) Between(from, to ID) bool {
+	if from < to {
+		return from < id && id <= to
+	}
+	return from < id || id <= to
+}
+
+// String formats an ID in hexadecimal
+func (id ID) String() string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// Lookup asks a node which node is responsible for an ID
+//
+// Like LinkQuery, it's the only message sent over its connection.
+type Lookup struct {
+	ID ID
+}
+
+// MessageBytes serializes a Lookup
+func (r Lookup) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized Lookup to dst
+func (r Lookup) AppendBytes(dst []byte) []byte {
+	return appendUint64(append(dst, lookupTag), uint64(r.ID))
+}
+
+// PassToClient refuses a Lookup, since it's answered as soon as it arrives
+func (r Lookup) PassToClient(client Client) error {
+	return fmt.Errorf("Unexpected Lookup on an established connection")
+}
+
+// LookupReply answers a Lookup
+//
+// Either the node knows who's responsible for the ID, because it's
+// its Successor, or it points to a node closer to the ID to ask next.
+type LookupReply struct {
+	// Done is set if Addr is responsible for the ID
+	Done bool
+	Addr net.Addr
+}
+
+// MessageBytes serializes a LookupReply
+func (r LookupReply) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized LookupReply to dst
+func (r LookupReply) AppendBytes(dst []byte) []byte {
+	done := byte(0)
+	if r.Done {
+		done = 1
+	}
+	return appendAddr(append(dst, lookupReplyTag, done), r.Addr)
+}
+
+// PassToClient refuses a LookupReply, since it's read by whoever sent the Lookup
+func (r LookupReply) PassToClient(client Client) error {
+	return fmt.Errorf("Unexpected LookupReply on an established connection")
+}
+
+// GetNeighbors asks a node for its Predecessor and Successor
+type GetNeighbors struct{}
+
+// MessageBytes serializes a GetNeighbors
+func (r GetNeighbors) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized GetNeighbors to dst
+func (r GetNeighbors) AppendBytes(dst []byte) []byte {
+	return append(dst, getNeighborsTag)
+}
+
+// PassToClient refuses a GetNeighbors, since it's answered as soon as it arrives
+func (r GetNeighbors) PassToClient(client Client) error {
+	return fmt.Errorf("Unexpected GetNeighbors on an established connection")
+}
+
+// Neighbors answers a GetNeighbors
+type Neighbors struct {
+	Pred net.Addr
+	Succ net.Addr
+}
+
+// MessageBytes serializes a Neighbors
+func (r Neighbors) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized Neighbors to dst
+func (r Neighbors) AppendBytes(dst []byte) []byte {
+	return appendAddr(appendAddr(append(dst, neighborsTag), r.Pred), r.Succ)
+}
+
+// PassToClient refuses a Neighbors, since it's read by whoever sent the GetNeighbors
+func (r Neighbors) PassToClient(client Client) error {
+	return fmt.Errorf("Unexpected Neighbors on an established connection")
+}
+
+// readLookupReply reads the rest of a LookupReply, after its tag
+func (d *Decoder) readLookupReply() (LookupReply, error) {
+	d.buf = d.buf[:0]
+	if err := d.readFull(1); err != nil {
+		return LookupReply{}, err
+	}
+	if d.buf[0] > 1 {
+		return LookupReply{}, fmt.Errorf("Invalid LookupReply flag: %d", d.buf[0])
+	}
+	done := d.buf[0] == 1
+	addr, err := d.readAddr()
+	if err != nil {
+		return LookupReply{}, err
+	}
+	return LookupReply{Done: done, Addr: addr}, nil
+}
+
+// readNeighbors reads the rest of a Neighbors, after its tag
+func (d *Decoder) readNeighbors() (Neighbors, error) {
+	pred, err := d.readAddr()
+	if err != nil {
+		return Neighbors{}, err
+	}
+	succ, err := d.readAddr()
+	if err != nil {
+		return Neighbors{}, err
+	}
+	return Neighbors{Pred: pred, Succ: succ}, nil
+}
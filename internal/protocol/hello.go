@@ -0,0 +1,110 @@
+package protocol
+
+import "fmt"
+
+const (
+	// Version is the version of the protocol we speak
+	Version uint16 = 1
+	// MinVersion is the oldest version of the protocol we can still speak
+	MinVersion uint16 = 1
+)
+
+// Features is a set of optional protocol features, one bit per feature
+//
+// A feature is only used on a connection if both ends support it.
+type Features uint64
+
+// SupportedFeatures are the optional features this implementation has
+const SupportedFeatures = FeatureEnvelopes | FeatureCompression | FeatureChords | FeatureFingers | FeatureFiles | FeatureMessageIDs | FeatureDirect
+
+// Has checks if all the features in other are part of this set
+func (features Features) Has(other Features) bool {
+	return features&other == other
+}
+
+// Session is what both ends of a connection agreed on during the handshake
+type Session struct {
+	// Version is the version of the protocol used on the connection
+	Version uint16
+	// Features are the optional features both ends support
+	Features Features
+}
+
+// Hello is the first message sent on every connection, by the end that dialed
+//
+// It announces which versions of the protocol and features we support.
+// The other end answers with a HelloAck, after which both know what they can
+// use with each other.
+type Hello struct {
+	// Version is the newest version of the protocol the sender speaks
+	Version uint16
+	// MinVersion is the oldest version of the protocol the sender speaks
+	MinVersion uint16
+	// Features are the optional features the sender supports
+	Features Features
+}
+
+// LocalHello describes what this implementation supports
+func LocalHello() Hello {
+	return Hello{Version: Version, MinVersion: MinVersion, Features: SupportedFeatures}
+}
+
+// Negotiate finds the Session we can have with a peer, given its greeting
+//
+// Peers without a version in common are incompatible.
+func (hello Hello) Negotiate(peer Hello) (Session, error) {
+	if peer.Version < hello.MinVersion || hello.Version < peer.MinVersion {
+		return Session{}, fmt.Errorf(
+			"Incompatible peer: it speaks protocol versions %d to %d, we speak %d to %d",
+			peer.MinVersion, peer.Version, hello.MinVersion, hello.Version,
+		)
+	}
+	version := hello.Version
+	if peer.Version < version {
+		version = peer.Version
+	}
+	return Session{Version: version, Features: hello.Features & peer.Features}, nil
+}
+
+// appendHello appends the fields shared by Hello and HelloAck
+func appendHello(dst []byte, hello Hello) []byte {
+	dst = append(dst, byte(hello.Version>>8), byte(hello.Version))
+	dst = append(dst, byte(hello.MinVersion>>8), byte(hello.MinVersion))
+	return appendUint64(dst, uint64(hello.Features))
+}
+
+// MessageBytes serializes a Hello
+func (r Hello) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized Hello to dst
+func (r Hello) AppendBytes(dst []byte) []byte {
+	return appendHello(append(dst, 9), r)
+}
+
+// PassToClient refuses a Hello, since it only makes sense during the handshake
+func (r Hello) PassToClient(client Client) error {
+	return fmt.Errorf("Unexpected Hello after the handshake")
+}
+
+// HelloAck answers a Hello, with what the other end of the connection supports
+//
+// It's sent even if the versions are incompatible, so that both ends can
+// explain why they're giving up on the connection.
+type HelloAck Hello
+
+// MessageBytes serializes a HelloAck
+func (r HelloAck) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized HelloAck to dst
+func (r HelloAck) AppendBytes(dst []byte) []byte {
+	return appendHello(append(dst, 10), Hello(r))
+}
+
+// PassToClient refuses a HelloAck, since it only makes sense during the handshake
+func (r HelloAck) PassToClient(client Client) error {
+	return fmt.Errorf("Unexpected HelloAck after the handshake")
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ErrInvalidUTF8 is returned when a message contains text that isn't UTF-8
+var ErrInvalidUTF8 = errors.New("Invalid UTF-8 in message")
+
+// UnknownTypeError is returned when a message starts with a tag we don't know
+type UnknownTypeError byte
+
+func (tag UnknownTypeError) Error() string {
+	return fmt.Sprintf("Unknown message type: %d", byte(tag))
+}
+
+// TooLargeError is returned when a message goes over our Limits
+type TooLargeError struct {
+	// What is the part of the message that was too large
+	What string
+	// Limit is the number of bytes it went over
+	Limit int
+}
+
+func (err TooLargeError) Error() string {
+	return fmt.Sprintf("%s larger than %d bytes", err.What, err.Limit)
+}
+
+// Limits bounds the size of the messages we're willing to read
+//
+// Lengths in messages are checked before anything is allocated, so a peer
+// can't make us run out of memory by announcing a huge message.
+type Limits struct {
+	// MaxContent is the longest text a message can carry, in bytes
+	MaxContent int
+	// MaxFrame is the largest a whole message can be, in bytes
+	MaxFrame int
+}
+
+// DefaultLimits are used when no other limits are given
+var DefaultLimits = Limits{
+	MaxContent: 1 << 20,
+	MaxFrame:   1<<20 + 1<<12,
+}
+
+func (limits Limits) withDefaults() Limits {
+	if limits.MaxContent <= 0 {
+		limits.MaxContent = DefaultLimits.MaxContent
+	}
+	if limits.MaxFrame <= 0 {
+		limits.MaxFrame = DefaultLimits.MaxFrame
+	}
+	return limits
+}
+
+// CheckText makes sure that some text can be sent to peers with these limits
+func (limits Limits) CheckText(text string) error {
+	limits = limits.withDefaults()
+	if len(text) > limits.MaxContent {
+		return TooLargeError{What: "Content", Limit: limits.MaxContent}
+	}
+	if !utf8.ValidString(text) {
+		return ErrInvalidUTF8
+	}
+	return nil
+}
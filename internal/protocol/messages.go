@@ -10,6 +10,8 @@ import (
 // by a peer
 type Message interface {
 	MessageBytes() []byte
+	// AppendBytes appends the serialized message to dst, returning the result
+	AppendBytes(dst []byte) []byte
 	PassToClient(Client) error
 }
 
@@ -19,7 +21,12 @@ type Ping struct{}
 
 // MessageBytes serializes a ping message
 func (p Ping) MessageBytes() []byte {
-	return []byte{1}
+	return p.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized Ping to dst
+func (p Ping) AppendBytes(dst []byte) []byte {
+	return append(dst, 1)
 }
 
 // PassToClient implements the visitor pattern for Ping
@@ -35,9 +42,12 @@ type JoinSwarm struct {
 
 // MessageBytes serializes a JoinSwarm into a byte slice
 func (r JoinSwarm) MessageBytes() []byte {
-	addrString := r.Addr.String()
-	header := []byte{2, byte(len(addrString))}
-	return append(header, []byte(addrString)...)
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized JoinSwarm to dst
+func (r JoinSwarm) AppendBytes(dst []byte) []byte {
+	return appendAddr(append(dst, 2), r.Addr)
 }
 
 // PassToClient implements the visitor pattern for JoinSwarm
@@ -56,9 +66,12 @@ type Referral struct {
 
 // MessageBytes serializes a Refferal into a byte slice
 func (r Referral) MessageBytes() []byte {
-	addrString := r.Addr.String()
-	header := []byte{3, byte(len(addrString))}
-	return append(header, []byte(addrString)...)
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized Referral to dst
+func (r Referral) AppendBytes(dst []byte) []byte {
+	return appendAddr(append(dst, 3), r.Addr)
 }
 
 // PassToClient implements the visitor pattern for Refferal
@@ -79,9 +92,12 @@ type NewPredecessor struct {
 
 // MessageBytes serializes a NewPredecessor
 func (r NewPredecessor) MessageBytes() []byte {
-	addrString := r.Addr.String()
-	header := []byte{4, byte(len(addrString))}
-	return append(header, []byte(addrString)...)
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized NewPredecessor to dst
+func (r NewPredecessor) AppendBytes(dst []byte) []byte {
+	return appendAddr(append(dst, 4), r.Addr)
 }
 
 // PassToClient implements the visitor pattern for NewPredecessor
@@ -101,9 +117,12 @@ type ConfirmPredecessor struct {
 
 // MessageBytes serializes a ConfirmPredecessor
 func (r ConfirmPredecessor) MessageBytes() []byte {
-	addrString := r.Addr.String()
-	header := []byte{5, byte(len(addrString))}
-	return append(header, []byte(addrString)...)
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized ConfirmPredecessor to dst
+func (r ConfirmPredecessor) AppendBytes(dst []byte) []byte {
+	return appendAddr(append(dst, 5), r.Addr)
 }
 
 // PassToClient implements the visitor pattern for ConfirmPredecessor
@@ -118,7 +137,12 @@ type ConfirmReferral struct{}
 
 // MessageBytes serializes a ConfirmReferral
 func (r ConfirmReferral) MessageBytes() []byte {
-	return []byte{6}
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized ConfirmReferral to dst
+func (r ConfirmReferral) AppendBytes(dst []byte) []byte {
+	return append(dst, 6)
 }
 
 // PassToClient implements the visitor pattern for ConfirmReferral
@@ -136,13 +160,13 @@ type NewMessage struct {
 
 // MessageBytes serializes a NewMessage
 func (r NewMessage) MessageBytes() []byte {
-	senderString := r.Sender.String()
-	bytes := []byte{7, byte(len(senderString))}
-	bytes = append(bytes, []byte(senderString)...)
-	cLen := len(r.Content)
-	bytes = append(bytes, byte(cLen>>24), byte(cLen>>16), byte(cLen>>8), byte(cLen))
-	bytes = append(bytes, []byte(r.Content)...)
-	return bytes
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized NewMessage to dst
+func (r NewMessage) AppendBytes(dst []byte) []byte {
+	dst = appendAddr(append(dst, 7), r.Sender)
+	return appendString(dst, r.Content)
 }
 
 // PassToClient implements the visitor pattern for NewMessage
@@ -160,13 +184,13 @@ type Nickname struct {
 
 // MessageBytes serializes a Nickname
 func (r Nickname) MessageBytes() []byte {
-	senderString := r.Sender.String()
-	bytes := []byte{8, byte(len(senderString))}
-	bytes = append(bytes, []byte(senderString)...)
-	len := len(r.Name)
-	bytes = append(bytes, byte(len>>24), byte(len>>16), byte(len>>8), byte(len))
-	bytes = append(bytes, []byte(r.Name)...)
-	return bytes
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized Nickname to dst
+func (r Nickname) AppendBytes(dst []byte) []byte {
+	dst = appendAddr(append(dst, 8), r.Sender)
+	return appendString(dst, r.Name)
 }
 
 // PassToClient implements the visitor pattern for Nickname
@@ -174,129 +198,28 @@ func (r Nickname) PassToClient(client Client) error {
 	return client.HandleNickname(r)
 }
 
-func readAddr(r io.Reader, addrLen byte, slice []byte, buf []byte) (net.Addr, error) {
-	addrBuf := make([]byte, 0, addrLen)
-	addrBuf = append(addrBuf, slice[:addrLen]...)
-	for byte(len(addrBuf)) < addrLen {
-		amount, err := r.Read(buf)
-		if err != nil {
-			return nil, err
-		}
-		addrBuf = append(addrBuf, buf[:amount]...)
-	}
-	addrString := string(addrBuf[:addrLen])
-	addr, err := net.ResolveTCPAddr("tcp", addrString)
-	if err != nil {
-		return nil, err
-	}
-	return addr, nil
-}
-
-func readAddrAndString(r io.Reader, addrLen byte, slice []byte, buf []byte) (net.Addr, string, error) {
-	// We can't reuse the function because we need to modify slice
-	addrBuf := make([]byte, 0, addrLen)
-	addrBuf = append(addrBuf, slice[:addrLen]...)
-	slice = slice[addrLen:]
-	overwrite := byte(len(addrBuf)) < addrLen
-	for byte(len(addrBuf)) < addrLen {
-		amount, err := r.Read(buf)
-		if err != nil {
-			return nil, "", err
-		}
-		addrBuf = append(addrBuf, buf[:amount]...)
-	}
-	addrString := string(addrBuf[:addrLen])
-	if overwrite {
-		slice = addrBuf[addrLen:]
-	}
-	addr, err := net.ResolveTCPAddr("tcp", addrString)
-	if err != nil {
-		return nil, "", err
-	}
-	length := uint(slice[0]) << 24
-	length |= uint(slice[1]) << 16
-	length |= uint(slice[2]) << 8
-	length |= uint(slice[3])
-	slice = slice[4:]
-	stringBuf := make([]byte, 0, length)
-	stringBuf = append(stringBuf, slice...)
-	for uint(len(stringBuf)) < length {
-		amount, err := r.Read(buf)
-		if err != nil {
-			return nil, "", err
-		}
-		stringBuf = append(stringBuf, buf[:amount]...)
-	}
-	content := string(stringBuf[:length])
-	return addr, content, nil
+// appendString appends a string, prefixed by a 4 byte length
+func appendString(dst []byte, s string) []byte {
+	length := len(s)
+	dst = append(dst, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	return append(dst, s...)
 }
 
 // ReadMessage reads bytes into a Message
 // It does the opposite of MessageBytes.
-// If the byte slice is misformatted, or not long enough, this will fail
+// If the byte slice is misformatted, or not long enough, this will fail.
+// Addresses are interpreted with ResolveAddr, and sizes are bounded by
+// DefaultLimits.
+//
+// Exactly the bytes of one message are consumed, no matter how the reader
+// splits them up, so this can be called repeatedly on the same stream.
 func ReadMessage(r io.Reader) (Message, error) {
-	buf := make([]byte, 1024)
-	amount, err := r.Read(buf)
-	if err != nil {
-		return nil, err
-	}
-	slice := buf[:amount]
-	var res Message
-	switch slice[0] {
-	case 1:
-		res = Ping{}
-	case 2:
-		addrLen := slice[1]
-		slice = slice[2:]
-		addr, err := readAddr(r, addrLen, slice, buf)
-		if err != nil {
-			return nil, err
-		}
-		res = JoinSwarm{Addr: addr}
-	case 3:
-		addrLen := slice[1]
-		slice = slice[2:]
-		addr, err := readAddr(r, addrLen, slice, buf)
-		if err != nil {
-			return nil, err
-		}
-		res = Referral{Addr: addr}
-	case 4:
-		addrLen := slice[1]
-		slice = slice[2:]
-		addr, err := readAddr(r, addrLen, slice, buf)
-		if err != nil {
-			return nil, err
-		}
-		res = NewPredecessor{Addr: addr}
-	case 5:
-		addrLen := slice[1]
-		slice = slice[2:]
-		addr, err := readAddr(r, addrLen, slice, buf)
-		if err != nil {
-			return nil, err
-		}
-		res = ConfirmPredecessor{Addr: addr}
-	case 6:
-		res = ConfirmReferral{}
-	case 7:
-		addrLen := slice[1]
-		slice = slice[2:]
-		addr, content, err := readAddrAndString(r, addrLen, slice, buf)
-		if err != nil {
-			return nil, err
-		}
-		res = NewMessage{Sender: addr, Content: content}
-	case 8:
-		addrLen := slice[1]
-		slice = slice[2:]
-		addr, name, err := readAddrAndString(r, addrLen, slice, buf)
-		if err != nil {
-			return nil, err
-		}
-		res = Nickname{Sender: addr, Name: name}
-	}
-	return res, nil
+	return ReadMessageWith(r, ResolveAddr)
+}
+
+// ReadMessageWith works like ReadMessage, but with a custom way of parsing addresses
+func ReadMessageWith(r io.Reader, parse AddrParser) (Message, error) {
+	return newDecoder(r, parse).Decode()
 }
 
 // ContentReceiver is some type that can do something when new content arrives
@@ -2,9 +2,18 @@ package protocol
 
 import (
 	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"unicode/utf8"
 )
 
 func TestPingMessageBytes(t *testing.T) {
@@ -32,7 +41,7 @@ func TestJoinSwarmMessageBytes(t *testing.T) {
 		Addr: &net.TCPAddr{IP: net.ParseIP("100.0.0.0"), Port: 2002},
 	}
 	addrString := "100.0.0.0:2002"
-	expected := []byte{2, byte(len(addrString))}
+	expected := []byte{2, 3, 't', 'c', 'p', byte(len(addrString))}
 	expected = append(expected, []byte(addrString)...)
 	result := r.MessageBytes()
 	if !bytes.Equal(result, expected) {
@@ -58,7 +67,7 @@ func TestReferralMessageBytes(t *testing.T) {
 		Addr: &net.TCPAddr{IP: net.ParseIP("100.0.0.0"), Port: 2002},
 	}
 	addrString := "100.0.0.0:2002"
-	expected := []byte{3, byte(len(addrString))}
+	expected := []byte{3, 3, 't', 'c', 'p', byte(len(addrString))}
 	expected = append(expected, []byte(addrString)...)
 	result := r.MessageBytes()
 	if !bytes.Equal(result, expected) {
@@ -84,7 +93,7 @@ func TestNewPredecessorMessageBytes(t *testing.T) {
 		Addr: &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: 99},
 	}
 	addrString := "0.0.0.0:99"
-	expected := []byte{4, byte(len(addrString))}
+	expected := []byte{4, 3, 't', 'c', 'p', byte(len(addrString))}
 	expected = append(expected, []byte(addrString)...)
 	result := r.MessageBytes()
 	if !bytes.Equal(result, expected) {
@@ -110,7 +119,7 @@ func TestConfirmPredecessorMessageBytes(t *testing.T) {
 		Addr: &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: 99},
 	}
 	addrString := "0.0.0.0:99"
-	expected := []byte{5, byte(len(addrString))}
+	expected := []byte{5, 3, 't', 'c', 'p', byte(len(addrString))}
 	expected = append(expected, []byte(addrString)...)
 	result := r.MessageBytes()
 	if !bytes.Equal(result, expected) {
@@ -147,7 +156,7 @@ func TestNewMessageMessageBytes(t *testing.T) {
 	}
 	addrString := "127.0.0.1:1234"
 	content := "Hello World!"
-	expected := []byte{7, byte(len(addrString))}
+	expected := []byte{7, 3, 't', 'c', 'p', byte(len(addrString))}
 	expected = append(expected, []byte(addrString)...)
 	contentLen := len(content)
 	expected = append(
@@ -177,3 +186,935 @@ func TestNewMessageRoundTrip(t *testing.T) {
 		t.Errorf("Expected %v got %v", expected, r)
 	}
 }
+
+func TestNicknameRoundTrip(t *testing.T) {
+	r := Nickname{
+		Sender: &net.TCPAddr{IP: net.ParseIP("127.0.120.1"), Port: 8090},
+		Name:   "alice",
+	}
+	expected, err := ReadMessage(bytes.NewReader(r.MessageBytes()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("Expected %v got %v", expected, r)
+	}
+}
+
+func TestReadMessageOneByteAtATime(t *testing.T) {
+	r := NewMessage{
+		Sender:  &net.TCPAddr{IP: net.ParseIP("127.0.120.1"), Port: 8090},
+		Content: "Split up!",
+	}
+	expected, err := ReadMessage(iotest.OneByteReader(bytes.NewReader(r.MessageBytes())))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("Expected %v got %v", expected, r)
+	}
+}
+
+func TestReadMessageConsumesOneMessage(t *testing.T) {
+	first := JoinSwarm{
+		Addr: &net.TCPAddr{IP: net.ParseIP("128.125.44.20"), Port: 8008},
+	}
+	second := NewMessage{
+		Sender:  &net.TCPAddr{IP: net.ParseIP("127.0.120.1"), Port: 8090},
+		Content: "Second",
+	}
+	data := append(first.MessageBytes(), second.MessageBytes()...)
+	r := bytes.NewReader(data)
+	for _, expected := range []Message{first, second} {
+		msg, err := ReadMessage(r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(msg, expected) {
+			t.Errorf("Expected %v got %v", expected, msg)
+		}
+	}
+	if _, err := ReadMessage(r); err != io.EOF {
+		t.Errorf("Expected EOF got %v", err)
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	r := Nickname{
+		Sender: &net.TCPAddr{IP: net.ParseIP("127.0.120.1"), Port: 8090},
+		Name:   "alice",
+	}
+	data := r.MessageBytes()
+	_, err := ReadMessage(bytes.NewReader(data[:len(data)-1]))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected %v got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestReadMessageTruncatedAnywhere(t *testing.T) {
+	for _, msg := range sampleMessages() {
+		data := msg.MessageBytes()
+		// cutting the big message everywhere would take too long
+		if len(data) > 512 {
+			data = data[:512]
+		}
+		for end := 1; end < len(data); end++ {
+			_, err := ReadMessage(bytes.NewReader(data[:end]))
+			if err != io.ErrUnexpectedEOF {
+				t.Fatalf("Expected %v for %v cut at %d got %v", io.ErrUnexpectedEOF, msg, end, err)
+			}
+		}
+	}
+}
+
+func TestReadMessageUnknownType(t *testing.T) {
+	for _, tag := range []byte{0, 0xff} {
+		_, err := ReadMessage(bytes.NewReader([]byte{tag}))
+		if err != UnknownTypeError(tag) {
+			t.Errorf("Expected %v got %v", UnknownTypeError(tag), err)
+		}
+	}
+}
+
+func TestReadMessageHugeContent(t *testing.T) {
+	data := appendAddr([]byte{7}, &net.UnixAddr{Name: "/tmp/ripple.sock", Net: "unix"})
+	data = append(data, 0xff, 0xff, 0xff, 0xff)
+	expected := TooLargeError{What: "Content", Limit: DefaultLimits.MaxContent}
+	if _, err := ReadMessage(bytes.NewReader(data)); err != expected {
+		t.Errorf("Expected %v got %v", expected, err)
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	sender := &net.UnixAddr{Name: "/tmp/ripple.sock", Net: "unix"}
+	long := NewMessage{Sender: sender, Content: "too long"}
+	decoder := NewDecoder(bytes.NewReader(long.MessageBytes()), ResolveAddr)
+	decoder.SetLimits(Limits{MaxContent: 4})
+	expected := TooLargeError{What: "Content", Limit: 4}
+	if _, err := decoder.Decode(); err != expected {
+		t.Errorf("Expected %v got %v", expected, err)
+	}
+	decoder = NewDecoder(bytes.NewReader(long.MessageBytes()), ResolveAddr)
+	decoder.SetLimits(Limits{MaxFrame: 10})
+	expected = TooLargeError{What: "Message", Limit: 10}
+	if _, err := decoder.Decode(); err != expected {
+		t.Errorf("Expected %v got %v", expected, err)
+	}
+}
+
+func TestReadMessageInvalidUTF8(t *testing.T) {
+	r := Nickname{
+		Sender: &net.UnixAddr{Name: "/tmp/ripple.sock", Net: "unix"},
+		Name:   "\xffalice",
+	}
+	if _, err := ReadMessage(bytes.NewReader(r.MessageBytes())); err != ErrInvalidUTF8 {
+		t.Errorf("Expected %v got %v", ErrInvalidUTF8, err)
+	}
+}
+
+func TestReadMessageInvalidAddrs(t *testing.T) {
+	addrs := []struct{ network, address string }{
+		{"tcp", "localhost:8080"},
+		{"tcp", ":8080"},
+		{"tcp", "127.0.0.1:65536"},
+		{"tcp", "127.0.0.1%eth0:80"},
+		{"tcp4", "[::1]:80"},
+		{"tcp", "127.0.0.1:80\n"},
+		{"unix", ""},
+		{"unix", "/tmp/\x00"},
+		{"t\xffp", "127.0.0.1:80"},
+	}
+	for _, addr := range addrs {
+		data := []byte{2, byte(len(addr.network))}
+		data = append(data, addr.network...)
+		data = append(data, byte(len(addr.address)))
+		data = append(data, addr.address...)
+		if msg, err := ReadMessage(bytes.NewReader(data)); err == nil {
+			t.Errorf("Expected %q %q to be rejected, got %v", addr.network, addr.address, msg)
+		}
+	}
+}
+
+func TestCheckText(t *testing.T) {
+	limits := Limits{MaxContent: 4}
+	if err := limits.CheckText("four"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	expected := TooLargeError{What: "Content", Limit: 4}
+	if err := limits.CheckText("fives"); err != expected {
+		t.Errorf("Expected %v got %v", expected, err)
+	}
+	if err := limits.CheckText("\xff"); err != ErrInvalidUTF8 {
+		t.Errorf("Expected %v got %v", ErrInvalidUTF8, err)
+	}
+}
+
+func TestUnixAddrRoundTrip(t *testing.T) {
+	r := JoinSwarm{
+		Addr: &net.UnixAddr{Name: "/tmp/ripple.sock", Net: "unix"},
+	}
+	expected := []byte{2, 4, 'u', 'n', 'i', 'x', byte(len("/tmp/ripple.sock"))}
+	expected = append(expected, []byte("/tmp/ripple.sock")...)
+	if result := r.MessageBytes(); !bytes.Equal(result, expected) {
+		t.Errorf("Expected %v got %v", expected, result)
+	}
+	msg, err := ReadMessage(bytes.NewReader(r.MessageBytes()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(r, msg) {
+		t.Errorf("Expected %v got %v", r, msg)
+	}
+}
+
+func TestIPv6RoundTrip(t *testing.T) {
+	r := NewMessage{
+		Sender:  &net.TCPAddr{IP: net.ParseIP("2001:db8::68"), Port: 8080},
+		Content: "Hello IPv6",
+	}
+	msg, err := ReadMessage(bytes.NewReader(r.MessageBytes()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(r, msg) {
+		t.Errorf("Expected %v got %v", r, msg)
+	}
+}
+
+func TestIPv6ZoneRoundTrip(t *testing.T) {
+	r := ConfirmPredecessor{
+		Addr: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 8080, Zone: "eth0"},
+	}
+	addrString := "[fe80::1%eth0]:8080"
+	expected := []byte{5, 3, 't', 'c', 'p', byte(len(addrString))}
+	expected = append(expected, []byte(addrString)...)
+	if result := r.MessageBytes(); !bytes.Equal(result, expected) {
+		t.Errorf("Expected %v got %v", expected, result)
+	}
+	msg, err := ReadMessage(bytes.NewReader(r.MessageBytes()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(r, msg) {
+		t.Errorf("Expected %v got %v", r, msg)
+	}
+}
+
+func TestUnsupportedNetwork(t *testing.T) {
+	data := []byte{2, 3, 'u', 'd', 'p', 4, 'a', ':', '8', '0'}
+	if _, err := ReadMessage(bytes.NewReader(data)); err == nil {
+		t.Errorf("Expected an error for an unsupported network")
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	long := &net.UnixAddr{Name: "/" + strings.Repeat("a", MaxAddrLength), Net: "unix"}
+	if err := CheckAddr(long); err == nil {
+		t.Errorf("Expected %d byte address to be rejected", len(long.Name))
+	}
+	short := &net.UnixAddr{Name: "/tmp/ripple.sock", Net: "unix"}
+	if err := CheckAddr(short); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestHelloMessageBytes(t *testing.T) {
+	r := Hello{Version: 0x0102, MinVersion: 1, Features: 0x0a0b}
+	expected := []byte{9, 1, 2, 0, 1, 0, 0, 0, 0, 0, 0, 0x0a, 0x0b}
+	if result := r.MessageBytes(); !bytes.Equal(result, expected) {
+		t.Errorf("Expected %v got %v", expected, result)
+	}
+}
+
+func TestHelloRoundTrip(t *testing.T) {
+	for _, r := range []Message{LocalHello(), HelloAck{Version: 3, MinVersion: 2, Features: 1 << 63}} {
+		msg, err := ReadMessage(bytes.NewReader(r.MessageBytes()))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if msg != r {
+			t.Errorf("Expected %v got %v", r, msg)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	ours := Hello{Version: 3, MinVersion: 2, Features: 0x3}
+	session, err := ours.Negotiate(Hello{Version: 5, MinVersion: 3, Features: 0x6})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := Session{Version: 3, Features: 0x2}
+	if session != expected {
+		t.Errorf("Expected %v got %v", expected, session)
+	}
+	if !session.Features.Has(0x2) || session.Features.Has(0x1) {
+		t.Errorf("Expected only feature 0x2 got %v", session.Features)
+	}
+	for _, peer := range []Hello{{Version: 1, MinVersion: 1}, {Version: 5, MinVersion: 4}} {
+		if _, err := ours.Negotiate(peer); err == nil {
+			t.Errorf("Expected %v to be incompatible with %v", peer, ours)
+		}
+	}
+}
+
+func TestEnvelopeMessageBytes(t *testing.T) {
+	r := Envelope{
+		Sender: &net.UnixAddr{Name: "/a", Net: "unix"},
+		Kind:   "ci",
+		Fields: []Field{NewBoolField("ok", true)},
+	}
+	expected := []byte{11, 4, 'u', 'n', 'i', 'x', 2, '/', 'a', 2, 'c', 'i', 0, 1}
+	expected = append(expected, 2, 'o', 'k', byte(FieldBool), 0, 0, 0, 1, 1)
+	if result := r.MessageBytes(); !bytes.Equal(result, expected) {
+		t.Errorf("Expected %v got %v", expected, result)
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	r := Envelope{
+		Sender: &net.TCPAddr{IP: net.ParseIP("127.0.120.1"), Port: 8090},
+		Kind:   "build-result",
+		Fields: []Field{
+			NewStringField("branch", "master"),
+			NewUintField("number", 1234),
+			NewBoolField("passed", false),
+			NewBytesField("log", nil),
+			// a type from the future is passed along untouched
+			{Key: "future", Type: 42, Value: []byte{1, 2, 3}},
+		},
+	}
+	msg, err := ReadMessage(bytes.NewReader(r.MessageBytes()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(r, msg) {
+		t.Errorf("Expected %v got %v", r, msg)
+	}
+}
+
+func TestFieldAccessors(t *testing.T) {
+	env := Envelope{Fields: []Field{
+		NewStringField("name", "alice"),
+		NewUintField("count", 1<<40),
+		NewBoolField("admin", true),
+	}}
+	nameField, _ := env.Get("name")
+	if name, ok := nameField.AsString(); !ok || name != "alice" {
+		t.Errorf("Expected alice got %q", name)
+	}
+	if _, ok := nameField.AsUint(); ok {
+		t.Errorf("Expected a string field not to be an integer")
+	}
+	countField, _ := env.Get("count")
+	if count, ok := countField.AsUint(); !ok || count != 1<<40 {
+		t.Errorf("Expected %d got %d", uint64(1<<40), count)
+	}
+	adminField, _ := env.Get("admin")
+	if admin, ok := adminField.AsBool(); !ok || !admin {
+		t.Errorf("Expected true got %v", admin)
+	}
+	if _, ok := env.Get("missing"); ok {
+		t.Errorf("Expected a missing field not to be found")
+	}
+}
+
+func TestInvalidEnvelopes(t *testing.T) {
+	sender := &net.UnixAddr{Name: "/a", Net: "unix"}
+	invalid := []Envelope{
+		{Sender: sender, Kind: ""},
+		{Sender: sender, Kind: "bad\n"},
+		{Sender: sender, Kind: "k", Fields: []Field{{Key: "", Type: FieldBytes}}},
+		{Sender: sender, Kind: "k", Fields: []Field{{Key: "s", Type: FieldString, Value: []byte{0xff}}}},
+		{Sender: sender, Kind: "k", Fields: []Field{{Key: "u", Type: FieldUint, Value: []byte{1, 2}}}},
+		{Sender: sender, Kind: "k", Fields: []Field{{Key: "b", Type: FieldBool, Value: []byte{2}}}},
+	}
+	for _, env := range invalid {
+		if err := DefaultLimits.CheckEnvelope(env); err == nil {
+			t.Errorf("Expected %v to be refused", env)
+		}
+		if msg, err := ReadMessage(bytes.NewReader(env.MessageBytes())); err == nil {
+			t.Errorf("Expected %v to be rejected, got %v", env, msg)
+		}
+	}
+	big := Envelope{Sender: sender, Kind: "k", Fields: []Field{
+		NewBytesField("a", make([]byte, 6)),
+		NewBytesField("b", make([]byte, 6)),
+	}}
+	expected := TooLargeError{What: "Message", Limit: 520}
+	if err := (Limits{MaxFrame: 520}).CheckEnvelope(big); err != expected {
+		t.Errorf("Expected %v got %v", expected, err)
+	}
+}
+
+func TestEncoderCompresses(t *testing.T) {
+	sender := &net.UnixAddr{Name: "/tmp/ripple.sock", Net: "unix"}
+	big := NewMessage{Sender: sender, Content: strings.Repeat("INFO step passed\n", 500)}
+	small := NewMessage{Sender: sender, Content: "short"}
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	encoder.SetSession(Session{Version: Version, Features: FeatureCompression})
+	for _, msg := range []Message{big, small} {
+		if err := encoder.Encode(msg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	encoder.Flush()
+	data := buf.Bytes()
+	if data[0] != compressedTag {
+		t.Errorf("Expected a compressed frame got tag %d", data[0])
+	}
+	if expected := len(big.MessageBytes()) + len(small.MessageBytes()); len(data) >= expected {
+		t.Errorf("Expected fewer than %d bytes got %d", expected, len(data))
+	}
+	if tail := small.MessageBytes(); !bytes.HasSuffix(data, tail) {
+		t.Errorf("Expected the small message to be left alone")
+	}
+	decoder := NewDecoder(&buf, ResolveAddr)
+	for _, expected := range []Message{big, small} {
+		msg, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(msg, expected) {
+			t.Errorf("Expected %.40v got %.40v", expected, msg)
+		}
+	}
+}
+
+func TestEncoderNeedsCompressionFeature(t *testing.T) {
+	msg := NewMessage{
+		Sender:  &net.UnixAddr{Name: "/tmp/ripple.sock", Net: "unix"},
+		Content: strings.Repeat("a", 2*CompressionThreshold),
+	}
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	encoder.SetSession(Session{Version: Version, Features: FeatureEnvelopes})
+	encoder.Encode(msg)
+	encoder.Flush()
+	if !bytes.Equal(buf.Bytes(), msg.MessageBytes()) {
+		t.Errorf("Expected the message to be sent uncompressed")
+	}
+}
+
+// compressedFrame wraps some data in a compressed frame by hand
+func compressedFrame(tb testing.TB, data []byte) []byte {
+	var compressed bytes.Buffer
+	w, err := flate.NewWriter(&compressed, flate.BestSpeed)
+	if err != nil {
+		tb.Fatalf("Unexpected error: %v", err)
+	}
+	w.Write(data)
+	w.Close()
+	length := compressed.Len()
+	frame := []byte{compressedTag, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)}
+	return append(frame, compressed.Bytes()...)
+}
+
+func TestCompressedFrameLimits(t *testing.T) {
+	sender := &net.UnixAddr{Name: "/tmp/ripple.sock", Net: "unix"}
+	// a small frame inflating into a huge message
+	bomb := NewMessage{Sender: sender, Content: strings.Repeat("a", 1<<16)}
+	decoder := NewDecoder(bytes.NewReader(compressedFrame(t, bomb.MessageBytes())), ResolveAddr)
+	decoder.SetLimits(Limits{MaxFrame: 1 << 12})
+	expected := TooLargeError{What: "Message", Limit: 1 << 12}
+	if _, err := decoder.Decode(); err != expected {
+		t.Errorf("Expected %v got %v", expected, err)
+	}
+	nested := compressedFrame(t, compressedFrame(t, Ping{}.MessageBytes()))
+	if _, err := ReadMessage(bytes.NewReader(nested)); err != errNestedCompression {
+		t.Errorf("Expected %v got %v", errNestedCompression, err)
+	}
+	trailing := compressedFrame(t, []byte{1, 1})
+	if msg, err := ReadMessage(bytes.NewReader(trailing)); err == nil {
+		t.Errorf("Expected trailing data to be rejected, got %v", msg)
+	}
+	truncated := compressedFrame(t, Nickname{Sender: sender, Name: "alice"}.MessageBytes()[:10])
+	if _, err := ReadMessage(bytes.NewReader(truncated)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected %v got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestTreeCastMessageBytes(t *testing.T) {
+	sender := &net.UnixAddr{Name: "/a", Net: "unix"}
+	r := TreeCast{Origin: sender, Seq: 1, Budget: 0x0102, Hops: 3, Limit: sender, Payload: Ping{}}
+	expected := []byte{17, 4, 'u', 'n', 'i', 'x', 2, '/', 'a', 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 1, 2, 0, 3}
+	expected = append(expected, 4, 'u', 'n', 'i', 'x', 2, '/', 'a', 1)
+	if result := r.MessageBytes(); !bytes.Equal(result, expected) {
+		t.Errorf("Expected %v got %v", expected, result)
+	}
+	// only broadcasts can go down the tree
+	if _, err := ReadMessage(bytes.NewReader(expected)); err != errTreeCastPayload {
+		t.Errorf("Expected %v got %v", errTreeCastPayload, err)
+	}
+	r.Payload = NewMessage{Sender: sender, Content: "hi"}
+	msg, err := ReadMessage(bytes.NewReader(r.MessageBytes()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(msg, r) {
+		t.Errorf("Expected %v got %v", r, msg)
+	}
+}
+
+func TestChordsRequiredFeatures(t *testing.T) {
+	sender := &net.UnixAddr{Name: "/a", Net: "unix"}
+	cast := TreeCast{Origin: sender, Limit: sender, Payload: Envelope{Sender: sender, Kind: "k"}}
+	expected := FeatureChords | FeatureEnvelopes
+	if got := RequiredFeatures(cast); got != expected {
+		t.Errorf("Expected %v got %v", expected, got)
+	}
+	if got := RequiredFeatures(Census{Origin: sender}); got != FeatureChords {
+		t.Errorf("Expected %v got %v", FeatureChords, got)
+	}
+}
+
+func TestLookupMessageBytes(t *testing.T) {
+	r := Lookup{ID: 0x0102030405060708}
+	expected := []byte{18, 1, 2, 3, 4, 5, 6, 7, 8}
+	if result := r.MessageBytes(); !bytes.Equal(result, expected) {
+		t.Errorf("Expected %v got %v", expected, result)
+	}
+}
+
+func TestIDBetween(t *testing.T) {
+	cases := []struct {
+		id, from, to ID
+		expected     bool
+	}{
+		{5, 1, 9, true},
+		{9, 1, 9, true},
+		{1, 1, 9, false},
+		{0, 9, 1, true},
+		{10, 9, 1, true},
+		{5, 9, 1, false},
+		{5, 3, 3, true},
+		{3, 3, 3, true},
+	}
+	for _, c := range cases {
+		if got := c.id.Between(c.from, c.to); got != c.expected {
+			t.Errorf("Expected %v.Between(%v, %v) to be %v got %v", c.id, c.from, c.to, c.expected, got)
+		}
+	}
+}
+
+func TestIDOf(t *testing.T) {
+	a := IDOf(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080})
+	b := IDOf(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8081})
+	if a == b {
+		t.Errorf("Expected different addresses to have different IDs, got %v twice", a)
+	}
+	if again := IDOf(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}); again != a {
+		t.Errorf("Expected %v got %v", a, again)
+	}
+}
+
+func TestFileChunkMessageBytes(t *testing.T) {
+	r := FileChunk{Offset: 258, Data: []byte{7, 8}}
+	expected := []byte{23, 0, 0, 0, 0, 0, 0, 1, 2, 0, 0, 0, 2, 7, 8}
+	if result := r.MessageBytes(); !bytes.Equal(result, expected) {
+		t.Errorf("Expected %v got %v", expected, result)
+	}
+}
+
+func TestFileChunkLimits(t *testing.T) {
+	chunk := FileChunk{Data: []byte("too long")}
+	decoder := NewDecoder(bytes.NewReader(chunk.MessageBytes()), ResolveAddr)
+	decoder.SetLimits(Limits{MaxContent: 4})
+	expected := TooLargeError{What: "Content", Limit: 4}
+	if _, err := decoder.Decode(); err != expected {
+		t.Errorf("Expected %v got %v", expected, err)
+	}
+}
+
+func TestPostMessageBytes(t *testing.T) {
+	r := Post{Sender: &net.UnixAddr{Name: "/a", Net: "unix"}, ID: 258, Content: "hi"}
+	expected := []byte{24, 4, 'u', 'n', 'i', 'x', 2, '/', 'a', 0, 0, 0, 0, 0, 0, 1, 2, 0, 0, 0, 2, 'h', 'i'}
+	if result := r.MessageBytes(); !bytes.Equal(result, expected) {
+		t.Errorf("Expected %v got %v", expected, result)
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	sender := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+	post := Post{Sender: sender, ID: 3, Content: "hi"}
+	old := NewMessage{Sender: sender, Content: "hi"}
+	if got := Downgrade(post, FeatureMessageIDs); got != Message(post) {
+		t.Errorf("Expected %v got %v", post, got)
+	}
+	if got := Downgrade(post, FeatureEnvelopes); got != Message(old) {
+		t.Errorf("Expected %v got %v", old, got)
+	}
+	cast := TreeCast{Origin: sender, Limit: sender, Payload: post}
+	expected := cast
+	expected.Payload = old
+	if got := Downgrade(cast, FeatureChords); got != Message(expected) {
+		t.Errorf("Expected %v got %v", expected, got)
+	}
+}
+
+func TestAppendBytesKeepsPrefix(t *testing.T) {
+	r := NewMessage{
+		Sender:  &net.TCPAddr{IP: net.ParseIP("127.0.120.1"), Port: 8090},
+		Content: "Appended",
+	}
+	prefix := []byte{42, 43}
+	expected := append([]byte{42, 43}, r.MessageBytes()...)
+	if result := r.AppendBytes(prefix); !bytes.Equal(result, expected) {
+		t.Errorf("Expected %v got %v", expected, result)
+	}
+}
+
+// sampleMessages contains one of each kind of message
+func sampleMessages() []Message {
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.120.1"), Port: 8090}
+	return []Message{
+		Ping{},
+		JoinSwarm{Addr: addr},
+		Referral{Addr: addr},
+		NewPredecessor{Addr: addr},
+		ConfirmPredecessor{Addr: &net.UnixAddr{Name: "/tmp/ripple.sock", Net: "unix"}},
+		ConfirmReferral{},
+		NewMessage{Sender: addr, Content: "Hello"},
+		NewMessage{Sender: addr, Content: strings.Repeat("big", 10000)},
+		Nickname{Sender: addr, Name: "alice"},
+		LocalHello(),
+		HelloAck(LocalHello()),
+		Envelope{Sender: addr, Kind: "poll", Fields: []Field{
+			NewStringField("question", "Lunch?"),
+			NewUintField("options", 2),
+		}},
+		LinkQuery{Level: 3},
+		LinkReply{Level: 3, Addr: addr},
+		LinkReply{Level: 4},
+		Census{Origin: addr, Count: 1000},
+		OpenLink{Addr: addr},
+		TreeCast{Origin: addr, Seq: 7, Budget: 15, Hops: 2, Limit: addr, Payload: Nickname{Sender: addr, Name: "bob"}},
+		Lookup{ID: 0x0102030405060708},
+		LookupReply{Done: true, Addr: addr},
+		GetNeighbors{},
+		Neighbors{Pred: addr, Succ: &net.UnixAddr{Name: "/tmp/ripple.sock", Net: "unix"}},
+		FileRequest{Hash: FileHash{1, 2, 3}, Offset: 1 << 40},
+		FileChunk{Offset: 4096, Data: []byte("some of a file")},
+		Post{Sender: addr, ID: 1 << 50, Content: "Edit me"},
+	}
+}
+
+func TestEncoderDecoderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	for _, msg := range sampleMessages() {
+		if err := encoder.Encode(msg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	decoder := NewDecoder(iotest.OneByteReader(&buf), ResolveAddr)
+	for _, expected := range sampleMessages() {
+		msg, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(msg, expected) {
+			t.Errorf("Expected %v got %v", expected, msg)
+		}
+	}
+	if _, err := decoder.Decode(); err != io.EOF {
+		t.Errorf("Expected EOF got %v", err)
+	}
+}
+
+func TestDecoderReusesAddrs(t *testing.T) {
+	parsed := 0
+	parse := func(network, address string) (net.Addr, error) {
+		parsed++
+		return ResolveAddr(network, address)
+	}
+	r := NewMessage{
+		Sender:  &net.TCPAddr{IP: net.ParseIP("127.0.120.1"), Port: 8090},
+		Content: "Again",
+	}
+	data := bytes.Repeat(r.MessageBytes(), 3)
+	decoder := NewDecoder(bytes.NewReader(data), parse)
+	for i := 0; i < 3; i++ {
+		msg, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(msg, r) {
+			t.Errorf("Expected %v got %v", r, msg)
+		}
+	}
+	if parsed != 1 {
+		t.Errorf("Expected 1 address to be parsed got %d", parsed)
+	}
+}
+
+func TestEncoderDoesNotAllocate(t *testing.T) {
+	encoder := NewEncoder(ioutil.Discard)
+	// unlike TCP addresses, formatting a unix address doesn't allocate
+	var msg Message = NewMessage{
+		Sender:  &net.UnixAddr{Name: "/tmp/ripple.sock", Net: "unix"},
+		Content: "No garbage",
+	}
+	// warm up the buffer
+	encoder.Encode(msg)
+	allocs := testing.AllocsPerRun(100, func() {
+		encoder.Encode(msg)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations got %v", allocs)
+	}
+}
+
+// errNotReference is returned by referenceRead for messages it doesn't know
+var errNotReference = errors.New("Not understood by the reference parser")
+
+// referenceRead parses a message at the start of data, returning what's left
+//
+// This is written separately from the Decoder, working on the whole input at
+// once, so that the two can be checked against each other. Only the messages
+// of the original protocol are understood.
+func referenceRead(data []byte) (Message, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, io.EOF
+	}
+	tag, rest := data[0], data[1:]
+	var sender net.Addr
+	switch tag {
+	case 1:
+		return Ping{}, rest, nil
+	case 6:
+		return ConfirmReferral{}, rest, nil
+	case 9, 10:
+		if len(rest) < 12 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		hello := Hello{
+			Version:    binary.BigEndian.Uint16(rest[0:]),
+			MinVersion: binary.BigEndian.Uint16(rest[2:]),
+			Features:   Features(binary.BigEndian.Uint64(rest[4:])),
+		}
+		if tag == 9 {
+			return hello, rest[12:], nil
+		}
+		return HelloAck(hello), rest[12:], nil
+	case 2, 3, 4, 5, 7, 8:
+		var parts [2]string
+		for i := range parts {
+			if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+			part := rest[1 : 1+int(rest[0])]
+			if !printable(part) {
+				return nil, nil, fmt.Errorf("Invalid address part: %q", part)
+			}
+			parts[i], rest = string(part), rest[1+len(part):]
+		}
+		addr, err := ResolveAddr(parts[0], parts[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		sender = addr
+	default:
+		return nil, nil, errNotReference
+	}
+	switch tag {
+	case 2:
+		return JoinSwarm{Addr: sender}, rest, nil
+	case 3:
+		return Referral{Addr: sender}, rest, nil
+	case 4:
+		return NewPredecessor{Addr: sender}, rest, nil
+	case 5:
+		return ConfirmPredecessor{Addr: sender}, rest, nil
+	}
+	if len(rest) < 4 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	length := uint64(binary.BigEndian.Uint32(rest))
+	rest = rest[4:]
+	if length > uint64(len(rest)) {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	text := rest[:length]
+	if !utf8.Valid(text) {
+		return nil, nil, ErrInvalidUTF8
+	}
+	if tag == 7 {
+		return NewMessage{Sender: sender, Content: string(text)}, rest[length:], nil
+	}
+	return Nickname{Sender: sender, Name: string(text)}, rest[length:], nil
+}
+
+func TestReferenceRead(t *testing.T) {
+	for _, msg := range sampleMessages() {
+		read, rest, err := referenceRead(msg.MessageBytes())
+		if err == errNotReference {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(read, msg) || len(rest) != 0 {
+			t.Errorf("Expected %v got %v with %d bytes left", msg, read, len(rest))
+		}
+	}
+}
+
+func FuzzDecoderMatchesReference(f *testing.F) {
+	for _, msg := range sampleMessages() {
+		if data := msg.MessageBytes(); len(data) < 512 {
+			f.Add(data)
+		}
+	}
+	f.Add(append(Ping{}.MessageBytes(), 0xff))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoder := NewDecoder(bytes.NewReader(data), ResolveAddr)
+		rest := data
+		for {
+			expected, left, expectedErr := referenceRead(rest)
+			if expectedErr == errNotReference {
+				return
+			}
+			got, err := decoder.Decode()
+			if expectedErr != nil || err != nil {
+				// the errors can differ, but both parsers need to fail, at the same place
+				if (expectedErr == nil) != (err == nil) || (expectedErr == io.EOF) != (err == io.EOF) {
+					t.Errorf("Expected %v got %v", expectedErr, err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(expected, got) {
+				t.Errorf("Expected %v got %v", expected, got)
+			}
+			rest = left
+		}
+	})
+}
+
+func FuzzAppendBytesRoundTrip(f *testing.F) {
+	f.Add(uint16(8090), "Hello", "alice")
+	f.Add(uint16(0), "", "")
+	f.Fuzz(func(t *testing.T, port uint16, content string, name string) {
+		// messages can only carry valid text, which reading them checks
+		if !utf8.ValidString(content) || !utf8.ValidString(name) {
+			t.Skip()
+		}
+		sender := &net.TCPAddr{IP: net.ParseIP("127.0.120.1"), Port: int(port)}
+		msgs := []Message{
+			NewMessage{Sender: sender, Content: content},
+			Nickname{Sender: sender, Name: name},
+		}
+		var buf bytes.Buffer
+		encoder := NewEncoder(&buf)
+		for _, msg := range msgs {
+			if err := encoder.Encode(msg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		encoder.Flush()
+		data := buf.Bytes()
+		expected := append(msgs[0].MessageBytes(), msgs[1].MessageBytes()...)
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("Expected %v got %v", expected, data)
+		}
+		r := bytes.NewReader(data)
+		for _, msg := range msgs {
+			read, err := ReadMessage(r)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(read, msg) {
+				t.Errorf("Expected %v got %v", msg, read)
+			}
+		}
+	})
+}
+
+func FuzzReadMessage(f *testing.F) {
+	for _, msg := range sampleMessages() {
+		// big seeds slow the fuzzer down for nothing
+		if data := msg.MessageBytes(); len(data) < 512 {
+			f.Add(data)
+		}
+	}
+	f.Add([]byte{7, 3, 't', 'c', 'p', 0, 0xff, 0xff, 0xff, 0xff})
+	f.Add(compressedFrame(f, sampleMessages()[6].MessageBytes()))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		again, err := ReadMessage(bytes.NewReader(msg.MessageBytes()))
+		if err != nil {
+			t.Fatalf("Failed to read %v back: %v", msg, err)
+		}
+		if !reflect.DeepEqual(msg, again) {
+			t.Errorf("Expected %v got %v", msg, again)
+		}
+	})
+}
+
+// repeatReader endlessly repeats the same data
+type repeatReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.pos:])
+	r.pos = (r.pos + n) % len(r.data)
+	return n, nil
+}
+
+func benchmarkMessage() Message {
+	return NewMessage{
+		Sender:  &net.TCPAddr{IP: net.ParseIP("127.0.120.1"), Port: 8090},
+		Content: "Build #1234 passed on master in 3m12s",
+	}
+}
+
+func BenchmarkMessageBytes(b *testing.B) {
+	msg := benchmarkMessage()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sendTo(ioutil.Discard, msg.MessageBytes())
+	}
+}
+
+func sendTo(w io.Writer, data []byte) {
+	w.Write(data)
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	msg := benchmarkMessage()
+	encoder := NewEncoder(ioutil.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encoder.Encode(msg)
+	}
+	encoder.Flush()
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	r := &repeatReader{data: benchmarkMessage().MessageBytes()}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadMessage(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	decoder := NewDecoder(&repeatReader{data: benchmarkMessage().MessageBytes()}, ResolveAddr)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decoder.Decode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import "net"
+
+// FeatureMessageIDs lets peers send each other Post messages
+const FeatureMessageIDs Features = 1 << 5
+
+const postTag = 24
+
+// Post is a NewMessage with an ID, so that later messages can refer to it
+//
+// IDs are chosen by the sender, and are only unique among its own messages.
+// Peers without FeatureMessageIDs get a NewMessage instead, see Downgrade.
+type Post struct {
+	// Sender is the node that sent this message
+	Sender net.Addr
+	// ID tells apart the messages of Sender
+	ID uint64
+	// Content is the actual text content of the message
+	Content string
+}
+
+// MessageBytes serializes a Post
+func (r Post) MessageBytes() []byte {
+	return r.AppendBytes(nil)
+}
+
+// AppendBytes appends a serialized Post to dst
+func (r Post) AppendBytes(dst []byte) []byte {
+	dst = appendUint64(appendAddr(append(dst, postTag), r.Sender), r.ID)
+	return appendString(dst, r.Content)
+}
+
+// PassToClient implements the visitor pattern for Post
+func (r Post) PassToClient(client Client) error {
+	return client.HandlePost(r)
+}
+
+// Downgrade replaces a message with one a peer with some features understands
+//
+// Messages that have no replacement are returned as they are.
+func Downgrade(msg Message, features Features) Message {
+	switch m := msg.(type) {
+	case Post:
+		if !features.Has(FeatureMessageIDs) {
+			return NewMessage{Sender: m.Sender, Content: m.Content}
+		}
+	case TreeCast:
+		m.Payload = Downgrade(m.Payload, features)
+		return m
+	}
+	return msg
+}
+
+// readPost reads the rest of a Post, after its tag
+func (d *Decoder) readPost() (Post, error) {
+	sender, err := d.readAddr()
+	if err != nil {
+		return Post{}, err
+	}
+	d.buf = d.buf[:0]
+	if err := d.readFull(8); err != nil {
+		return Post{}, err
+	}
+	var id uint64
+	for _, c := range d.buf {
+		id = id<<8 | uint64(c)
+	}
+	content, err := d.readString()
+	if err != nil {
+		return Post{}, err
+	}
+	return Post{Sender: sender, ID: id, Content: content}, nil
+}
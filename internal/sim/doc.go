@@ -0,0 +1,13 @@
+// Package sim runs whole swarms inside a single process.
+//
+// The simulated network lets us control latency, reorder messages
+// between different links, partition nodes from each other, and
+// crash nodes outright. On top of this, a Sim builds swarms of
+// arbitrary size, and checks the invariants the protocol should
+// maintain: the ring forms a single cycle, each node is the predecessor
+// of its successor, and every broadcast reaches each node exactly once.
+//
+// All of the random choices a simulation makes come from a single seed,
+// so a failing run can be replayed by reusing that seed. The scheduling
+// of goroutines is still up to the runtime though.
+package sim
@@ -0,0 +1,496 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/network"
+)
+
+// backlog is how many connections can wait to be accepted
+const backlog = 16
+
+var (
+	errRefused = errors.New("connection refused")
+	errInUse   = errors.New("address already in use")
+	errClosed  = errors.New("use of closed connection")
+	errReset   = errors.New("connection reset by peer")
+	errTimeout = timeoutError{}
+)
+
+// timeoutError is returned when a deadline passes, like the net package does
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Network is an in process network, with controllable faults
+//
+// Each node gets its own Transport from the network, so that we know
+// who is on each end of a connection. Nodes are identified by the address
+// they listen on.
+type Network struct {
+	mu        sync.Mutex
+	rng       *rand.Rand
+	latency   time.Duration
+	jitter    time.Duration
+	listeners map[string]*listener
+	links     map[*link]struct{}
+	// groups holds the partition each node is in, nodes not present are in 0
+	groups  map[string]int
+	crashed map[string]bool
+}
+
+// NewNetwork creates an empty network, using seed for all of its random choices
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rng:       rand.New(rand.NewSource(seed)),
+		listeners: make(map[string]*listener),
+		links:     make(map[*link]struct{}),
+		groups:    make(map[string]int),
+		crashed:   make(map[string]bool),
+	}
+}
+
+// SetLatency changes how long data takes to go through a link
+//
+// Each write is delayed by latency, plus a random amount up to jitter.
+// Data on a single connection stays in order, like with TCP, but jitter
+// will reorder messages travelling over different connections.
+func (n *Network) SetLatency(latency, jitter time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency = latency
+	n.jitter = jitter
+}
+
+// Transport returns the Transport a node should use to join the network
+func (n *Network) Transport(node string) network.Transport {
+	return &transport{n, node}
+}
+
+// Partition splits the network into groups that can't reach each other
+//
+// Like with TCP, connections between different groups stay open, but what's
+// written to them is held back until the partition heals, while new ones are
+// refused. Nodes not mentioned are put in a group of their own.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, node := range group {
+			n.groups[node] = i + 1
+		}
+	}
+	for l := range n.links {
+		held := !n.reachable(l.a.owner, l.b.owner)
+		l.a.in.hold(held)
+		l.b.in.hold(held)
+	}
+}
+
+// Heal removes any partition, delivering what was held back
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = make(map[string]int)
+	for l := range n.links {
+		l.a.in.hold(false)
+		l.b.in.hold(false)
+	}
+}
+
+// Crash abruptly stops a node from talking to anybody else
+//
+// Its listener is closed, and all of its connections are cut.
+func (n *Network) Crash(node string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.crashed[node] = true
+	if l, ok := n.listeners[node]; ok {
+		delete(n.listeners, node)
+		l.stop()
+	}
+	for l := range n.links {
+		if l.a.owner == node || l.b.owner == node {
+			n.cut(l)
+		}
+	}
+}
+
+// Listening checks whether or not a node is accepting connections
+func (n *Network) Listening(node string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.listeners[node]
+	return ok
+}
+
+// reachable must be called under a lock
+func (n *Network) reachable(a, b string) bool {
+	if n.crashed[a] || n.crashed[b] {
+		return false
+	}
+	groupA, inA := n.groups[a]
+	groupB, inB := n.groups[b]
+	if len(n.groups) > 0 && (!inA || !inB) {
+		return a == b
+	}
+	return groupA == groupB
+}
+
+// cut must be called under a lock
+func (n *Network) cut(l *link) {
+	delete(n.links, l)
+	l.a.in.reset()
+	l.b.in.reset()
+}
+
+// delay calculates when a write made now should arrive
+func (n *Network) delay() time.Time {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	d := n.latency
+	if n.jitter > 0 {
+		d += time.Duration(n.rng.Int63n(int64(n.jitter)))
+	}
+	return time.Now().Add(d)
+}
+
+func (n *Network) dial(from string, addr net.Addr) (net.Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	to := addr.String()
+	l, ok := n.listeners[to]
+	if !ok || !n.reachable(from, to) {
+		return nil, &net.OpError{Op: "dial", Net: addr.Network(), Addr: addr, Err: errRefused}
+	}
+	ab := newBuffer()
+	ba := newBuffer()
+	l2 := &link{}
+	l2.a = &conn{n: n, link: l2, owner: from, local: network.MemoryAddr(from), remote: l.addr, in: ba, out: ab}
+	l2.b = &conn{n: n, link: l2, owner: to, local: l.addr, remote: network.MemoryAddr(from), in: ab, out: ba}
+	select {
+	case l.conns <- l2.b:
+	default:
+		return nil, &net.OpError{Op: "dial", Net: addr.Network(), Addr: addr, Err: errRefused}
+	}
+	n.links[l2] = struct{}{}
+	return l2.a, nil
+}
+
+func (n *Network) listen(node string, addr net.Addr) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr.String()]; ok || n.crashed[node] {
+		return nil, &net.OpError{Op: "listen", Net: addr.Network(), Addr: addr, Err: errInUse}
+	}
+	l := &listener{
+		n:     n,
+		addr:  network.MemoryAddr(addr.String()),
+		conns: make(chan net.Conn, backlog),
+		done:  make(chan struct{}),
+	}
+	n.listeners[addr.String()] = l
+	return l, nil
+}
+
+// closeLink forgets about a link once both sides have closed it
+func (n *Network) closeLink(l *link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.links, l)
+}
+
+// transport implements network.Transport for a single node
+type transport struct {
+	n    *Network
+	node string
+}
+
+func (t *transport) Dial(addr net.Addr) (net.Conn, error) {
+	return t.n.dial(t.node, addr)
+}
+
+func (t *transport) Listen(addr net.Addr) (net.Listener, error) {
+	return t.n.listen(t.node, addr)
+}
+
+func (t *transport) ResolveAddr(netName, address string) (net.Addr, error) {
+	if netName != "memory" {
+		return nil, fmt.Errorf("Unsupported network: %q", netName)
+	}
+	if address == "" {
+		return nil, errors.New("empty address")
+	}
+	return network.MemoryAddr(address), nil
+}
+
+type listener struct {
+	n     *Network
+	addr  network.MemoryAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: l.addr.Network(), Addr: l.addr, Err: errClosed}
+	default:
+	}
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: l.addr.Network(), Addr: l.addr, Err: errClosed}
+	}
+}
+
+func (l *listener) Close() error {
+	l.n.mu.Lock()
+	if l.n.listeners[l.addr.String()] == l {
+		delete(l.n.listeners, l.addr.String())
+	}
+	l.n.mu.Unlock()
+	l.stop()
+	return nil
+}
+
+func (l *listener) stop() {
+	l.once.Do(func() { close(l.done) })
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// link holds both ends of a connection
+type link struct {
+	a *conn
+	b *conn
+}
+
+// conn is one end of a link, implementing net.Conn
+type conn struct {
+	n      *Network
+	link   *link
+	owner  string
+	local  net.Addr
+	remote net.Addr
+	in     *buffer
+	out    *buffer
+	once   sync.Once
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	return c.in.read(p)
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if err := c.out.write(p, c.n.delay()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close lets the other side read what we've already written, and then EOF
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		c.in.close()
+		c.out.closeWrite()
+		other := c.link.a
+		if other == c {
+			other = c.link.b
+		}
+		if other.in.isClosed() {
+			c.n.closeLink(c.link)
+		}
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, since writes never block
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// chunk is a single write, waiting to be delivered
+type chunk struct {
+	data []byte
+	at   time.Time
+}
+
+// buffer holds the data flowing in one direction of a link
+type buffer struct {
+	mu     sync.Mutex
+	chunks []chunk
+	// last is the latest delivery time, which keeps the stream in order
+	last time.Time
+	// eof is set once the writer has closed its end
+	eof bool
+	// closed is set once the reader has closed its end
+	closed bool
+	// broken is set once the link has been cut
+	broken bool
+	// held is set while a partition keeps the data from arriving
+	held     bool
+	deadline time.Time
+	wake     chan struct{}
+}
+
+func newBuffer() *buffer {
+	return &buffer{wake: make(chan struct{}, 1)}
+}
+
+func (b *buffer) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (b *buffer) write(data []byte, at time.Time) error {
+	b.mu.Lock()
+	if b.broken {
+		b.mu.Unlock()
+		return errReset
+	}
+	if b.eof {
+		b.mu.Unlock()
+		return errClosed
+	}
+	if at.Before(b.last) {
+		at = b.last
+	}
+	b.last = at
+	copied := make([]byte, len(data))
+	copy(copied, data)
+	b.chunks = append(b.chunks, chunk{copied, at})
+	b.mu.Unlock()
+	b.signal()
+	return nil
+}
+
+func (b *buffer) read(p []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return 0, errClosed
+		}
+		if b.broken {
+			b.mu.Unlock()
+			return 0, errReset
+		}
+		now := time.Now()
+		if !b.deadline.IsZero() && !now.Before(b.deadline) {
+			b.mu.Unlock()
+			return 0, errTimeout
+		}
+		var wait time.Duration = -1
+		if b.held {
+			// nothing gets through until the partition heals, not even the end
+		} else if len(b.chunks) > 0 {
+			head := &b.chunks[0]
+			if !now.Before(head.at) {
+				n := copy(p, head.data)
+				head.data = head.data[n:]
+				if len(head.data) == 0 {
+					b.chunks = b.chunks[1:]
+				}
+				b.mu.Unlock()
+				return n, nil
+			}
+			wait = head.at.Sub(now)
+		} else if b.eof {
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+		if !b.deadline.IsZero() {
+			untilDeadline := b.deadline.Sub(now)
+			if wait < 0 || untilDeadline < wait {
+				wait = untilDeadline
+			}
+		}
+		b.mu.Unlock()
+		if wait < 0 {
+			<-b.wake
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-b.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (b *buffer) setDeadline(t time.Time) {
+	b.mu.Lock()
+	b.deadline = t
+	b.mu.Unlock()
+	b.signal()
+}
+
+func (b *buffer) closeWrite() {
+	b.mu.Lock()
+	b.eof = true
+	b.mu.Unlock()
+	b.signal()
+}
+
+func (b *buffer) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.chunks = nil
+	b.mu.Unlock()
+	b.signal()
+}
+
+func (b *buffer) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+func (b *buffer) hold(held bool) {
+	b.mu.Lock()
+	b.held = held
+	b.mu.Unlock()
+	b.signal()
+}
+
+func (b *buffer) reset() {
+	b.mu.Lock()
+	b.broken = true
+	b.chunks = nil
+	b.mu.Unlock()
+	b.signal()
+}
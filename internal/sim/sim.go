@@ -0,0 +1,639 @@
+package sim
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/bits"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/network"
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+// Config controls how a simulation behaves
+type Config struct {
+	// Seed is used for every random choice in the simulation
+	Seed int64
+	// Latency is the minimum time data takes to go through a link
+	Latency time.Duration
+	// Jitter is the maximum random delay added on top of Latency
+	Jitter time.Duration
+	// Timeout is how long we wait for the swarm to reach a good state
+	Timeout time.Duration
+	// Log receives the logs of every node, each line starting with its name,
+	// and nothing is logged if nil
+	Log *log.Logger
+	// Faults are injected into the connections of every node
+	Faults network.Faults
+	// Chords makes every node broadcast over chord links, see BuildChords
+	Chords bool
+}
+
+// Node is a single member of a simulated swarm
+type Node struct {
+	// Name is the address this node listens on
+	Name string
+	// Swarm is the handle for this node, once it has joined
+	Swarm    *network.SwarmHandle
+	received *recorder
+	crashed  bool
+}
+
+// Received returns how many times this node has received some content
+func (node *Node) Received(content string) int {
+	return node.received.count(content)
+}
+
+// Crashed tells us if this node has been crashed
+func (node *Node) Crashed() bool {
+	return node.crashed
+}
+
+// recorder is a ContentReceiver counting everything it receives
+type recorder struct {
+	mu     sync.Mutex
+	counts map[string]int
+	// hops holds how many hops each broadcast over the tree took to reach us
+	hops []int
+	// passedBy holds the node that passed us each broadcast around the ring
+	passedBy []net.Addr
+}
+
+func newRecorder() *recorder {
+	return &recorder{counts: make(map[string]int)}
+}
+
+func (r *recorder) ReceiveContent(name, content string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[content]++
+}
+
+// Hops records how many hops a broadcast took over the tree
+func (r *recorder) Hops(origin net.Addr, hops int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hops = append(r.hops, hops)
+}
+
+// takeHops returns the hops recorded since the last call
+func (r *recorder) takeHops() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hops := r.hops
+	r.hops = nil
+	return hops
+}
+
+// PassedBy records who passed us a broadcast around the ring
+func (r *recorder) PassedBy(origin, from net.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.passedBy = append(r.passedBy, from)
+}
+
+// takePassedBy returns the nodes that passed us broadcasts since the last call
+func (r *recorder) takePassedBy() []net.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	passedBy := r.passedBy
+	r.passedBy = nil
+	return passedBy
+}
+
+func (r *recorder) count(content string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts[content]
+}
+
+// Sim holds a simulated swarm, and the network it runs on
+type Sim struct {
+	config Config
+	rng    *rand.Rand
+	// Net is the network the nodes are connected through
+	Net   *Network
+	nodes []*Node
+	// faults holds the fault injecting transport of each node
+	faults map[string]*network.FaultTransport
+}
+
+// New creates a simulation with no nodes yet
+func New(config Config) *Sim {
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.Log == nil {
+		config.Log = log.New(ioutil.Discard, "", 0)
+	}
+	net := NewNetwork(config.Seed)
+	net.SetLatency(config.Latency, config.Jitter)
+	return &Sim{
+		config: config,
+		rng:    rand.New(rand.NewSource(config.Seed)),
+		Net:    net,
+		faults: make(map[string]*network.FaultTransport),
+	}
+}
+
+// transport returns the transport a node should use
+func (s *Sim) transport(name string) network.Transport {
+	t, ok := s.faults[name]
+	if !ok {
+		t = network.NewFaultTransport(s.Net.Transport(name), s.config.Faults)
+		s.faults[name] = t
+	}
+	return t
+}
+
+// SetFaults changes the faults injected into the connections of a node
+//
+// The node doesn't need to exist yet, which lets us make a join fail.
+func (s *Sim) SetFaults(name string, faults network.Faults) {
+	s.transport(name).(*network.FaultTransport).SetFaults(faults)
+}
+
+// Nodes returns every node in the simulation, including crashed ones
+func (s *Sim) Nodes() []*Node {
+	return s.nodes
+}
+
+// Live returns the nodes that haven't been crashed
+func (s *Sim) Live() []*Node {
+	live := make([]*Node, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		if !node.crashed {
+			live = append(live, node)
+		}
+	}
+	return live
+}
+
+func (s *Sim) newNode() *Node {
+	node := &Node{
+		Name:     fmt.Sprintf("node-%d", len(s.nodes)),
+		received: newRecorder(),
+	}
+	s.nodes = append(s.nodes, node)
+	return node
+}
+
+// waitFor polls a condition until it's true, or we time out
+func (s *Sim) waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(s.config.Timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// chordConfig returns the chord config of a node, refreshed by BuildChords only
+func (s *Sim) chordConfig(node *Node) network.ChordConfig {
+	config := network.ChordConfig{
+		Enabled:  s.config.Chords,
+		Interval: -1,
+	}
+	return network.TraceBroadcasts(config, node.received)
+}
+
+// logger returns the logger of a node, which tells its lines apart with its name
+func (s *Sim) logger(node *Node) *log.Logger {
+	return log.New(s.config.Log.Writer(), node.Name+": ", s.config.Log.Flags())
+}
+
+// start creates the swarm with its first 2 nodes
+func (s *Sim) start() error {
+	first := s.newNode()
+	created := make(chan error, 1)
+	transport := s.transport(first.Name)
+	go func() {
+		swarm, err := network.CreateSwarm(network.Config{
+			Log:        s.logger(first),
+			Transport:  transport,
+			ListenAddr: network.MemoryAddr(first.Name),
+			Chords:     s.chordConfig(first),
+			Fingers:    network.FingerConfig{Interval: -1},
+		})
+		if err == nil {
+			swarm.SetReceiver(first.received)
+			first.Swarm = swarm
+		}
+		created <- err
+	}()
+	if !s.waitFor(func() bool { return s.Net.Listening(first.Name) }) {
+		return fmt.Errorf("%s never started listening", first.Name)
+	}
+	if err := s.join(s.newNode(), first); err != nil {
+		return err
+	}
+	return <-created
+}
+
+// join adds a node to the swarm, by contacting via
+func (s *Sim) join(node, via *Node) error {
+	config := network.Config{
+		Log:        s.logger(node),
+		Transport:  s.transport(node.Name),
+		ListenAddr: network.MemoryAddr(node.Name),
+		Chords:     s.chordConfig(node),
+		Fingers:    network.FingerConfig{Interval: -1},
+	}
+	swarm, err := network.JoinSwarm(config, network.MemoryAddr(via.Name))
+	if err != nil {
+		return fmt.Errorf("%s failed to join via %s: %v", node.Name, via.Name, err)
+	}
+	swarm.SetReceiver(node.received)
+	node.Swarm = swarm
+	return nil
+}
+
+// Grow adds n nodes to the swarm, one at a time
+//
+// Each node joins through a random live node, and we wait for the ring
+// to become stable before adding the next one. Since a swarm needs 2 nodes
+// to exist, growing an empty simulation needs n to be at least 2.
+func (s *Sim) Grow(n int) error {
+	if len(s.nodes) == 0 {
+		if n < 2 {
+			return fmt.Errorf("a swarm needs at least 2 nodes, got %d", n)
+		}
+		if err := s.start(); err != nil {
+			return err
+		}
+		n -= 2
+		if err := s.WaitStable(); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < n; i++ {
+		live := s.Live()
+		if len(live) == 0 {
+			return fmt.Errorf("no live node to join through")
+		}
+		via := live[s.rng.Intn(len(live))]
+		if err := s.join(s.newNode(), via); err != nil {
+			return err
+		}
+		if err := s.WaitStable(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckRing verifies that the live nodes form a single, consistent ring
+//
+// Every node must be the predecessor of its successor, and following
+// successors from any node must visit every live node exactly once.
+func (s *Sim) CheckRing() error {
+	live := s.Live()
+	byAddr := make(map[string]*Node, len(live))
+	for _, node := range live {
+		if node.Swarm == nil {
+			return fmt.Errorf("%s hasn't joined the swarm", node.Name)
+		}
+		byAddr[node.Name] = node
+	}
+	for _, node := range live {
+		succAddr := node.Swarm.Successor().String()
+		succ, ok := byAddr[succAddr]
+		if !ok {
+			return fmt.Errorf("%s has successor %s, which isn't live", node.Name, succAddr)
+		}
+		if pred := succ.Swarm.Predecessor().String(); pred != node.Name {
+			return fmt.Errorf(
+				"%s has successor %s, but its predecessor is %s",
+				node.Name, succ.Name, pred,
+			)
+		}
+	}
+	if len(live) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool, len(live))
+	current := live[0]
+	for !seen[current.Name] {
+		seen[current.Name] = true
+		current = byAddr[current.Swarm.Successor().String()]
+	}
+	if current != live[0] || len(seen) != len(live) {
+		return fmt.Errorf("ring is not a single cycle: %d of %d nodes reachable", len(seen), len(live))
+	}
+	return nil
+}
+
+// WaitStable waits until CheckRing succeeds, returning the last error on timeout
+func (s *Sim) WaitStable() error {
+	var err error
+	s.waitFor(func() bool {
+		err = s.CheckRing()
+		return err == nil
+	})
+	return err
+}
+
+// Broadcast sends some content to the swarm from a node
+func (s *Sim) Broadcast(from *Node, content string) {
+	from.Swarm.SendContent(content)
+}
+
+// WaitDelivered checks that a broadcast reaches every other live node exactly once
+//
+// The sender itself should never receive its own content.
+func (s *Sim) WaitDelivered(from *Node, content string) error {
+	live := s.Live()
+	delivered := s.waitFor(func() bool {
+		for _, node := range live {
+			if node != from && node.Received(content) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+	// give duplicates some time to show up
+	time.Sleep(2*(s.config.Latency+s.config.Jitter) + 10*time.Millisecond)
+	for _, node := range live {
+		expected := 1
+		if node == from {
+			expected = 0
+		}
+		if got := node.Received(content); got != expected && (delivered || got > expected) {
+			return fmt.Errorf("%s received %q %d times, expected %d", node.Name, content, got, expected)
+		}
+	}
+	if !delivered {
+		return fmt.Errorf("%q from %s was not delivered to every node", content, from.Name)
+	}
+	return nil
+}
+
+// Crash abruptly disconnects a node from the rest of the swarm
+func (s *Sim) Crash(node *Node) {
+	node.crashed = true
+	s.Net.Crash(node.Name)
+}
+
+// Partition splits the nodes into groups that can't talk to each other
+func (s *Sim) Partition(groups ...[]*Node) {
+	names := make([][]string, len(groups))
+	for i, group := range groups {
+		for _, node := range group {
+			names[i] = append(names[i], node.Name)
+		}
+	}
+	s.Net.Partition(names...)
+}
+
+// Heal removes any partition between nodes
+func (s *Sim) Heal() {
+	s.Net.Heal()
+}
+
+// ring returns the live nodes in the order of the ring, starting from a node
+func (s *Sim) ring(from *Node) ([]*Node, error) {
+	if err := s.CheckRing(); err != nil {
+		return nil, err
+	}
+	byAddr := make(map[string]*Node)
+	for _, node := range s.Live() {
+		byAddr[node.Name] = node
+	}
+	ring := []*Node{from}
+	for next := byAddr[from.Swarm.Successor().String()]; next != from; {
+		ring = append(ring, next)
+		next = byAddr[next.Swarm.Successor().String()]
+	}
+	return ring, nil
+}
+
+// CheckChords verifies that every live node knows the size of the swarm,
+// and has a chord link to the nodes 1, 2, 4... hops after it
+func (s *Sim) CheckChords() error {
+	live := s.Live()
+	levels := bits.Len(uint(len(live) - 1))
+	for _, node := range live {
+		if size := node.Swarm.SwarmSize(); size != len(live) {
+			return fmt.Errorf("%s thinks there are %d nodes, not %d", node.Name, size, len(live))
+		}
+		ring, err := s.ring(node)
+		if err != nil {
+			return err
+		}
+		links := node.Swarm.Chords()
+		if len(links) < levels {
+			return fmt.Errorf("%s has %d chord links, expected %d", node.Name, len(links), levels)
+		}
+		for level := 0; level < levels; level++ {
+			if expected := ring[1<<uint(level)].Name; links[level].String() != expected {
+				return fmt.Errorf(
+					"%s has %s as chord link %d, expected %s",
+					node.Name, links[level], level, expected,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// BuildChords refreshes the chord links of every live node until CheckChords succeeds
+//
+// Each round of refreshes lets nodes find links twice as far away,
+// so this takes a logarithmic number of rounds.
+func (s *Sim) BuildChords() error {
+	live := s.Live()
+	var err error
+	for round := 0; round <= bits.Len(uint(len(live)))+1; round++ {
+		var wg sync.WaitGroup
+		for _, node := range live {
+			wg.Add(1)
+			go func(node *Node) {
+				defer wg.Done()
+				node.Swarm.RefreshChords()
+			}(node)
+		}
+		wg.Wait()
+		s.waitFor(func() bool {
+			for _, node := range live {
+				if node.Swarm.SwarmSize() == 0 {
+					return false
+				}
+			}
+			return true
+		})
+		if err = s.CheckChords(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// HopStats summarizes how many hops a broadcast took to reach every other node
+type HopStats struct {
+	// Nodes is how many nodes the broadcast reached
+	Nodes int
+	// Max is the most hops it took to reach a node
+	Max int
+	// Mean is the average number of hops it took to reach a node
+	Mean float64
+}
+
+func hopStats(hops []int) HopStats {
+	stats := HopStats{Nodes: len(hops)}
+	total := 0
+	for _, h := range hops {
+		total += h
+		if h > stats.Max {
+			stats.Max = h
+		}
+	}
+	if len(hops) > 0 {
+		stats.Mean = float64(total) / float64(len(hops))
+	}
+	return stats
+}
+
+// RingHops broadcasts some content from a node around the ring, and measures the hops it took
+//
+// Every other live node needs to have received it once around the ring,
+// so this needs to happen before chord links are built, see BuildChords.
+// The hops are counted by following the nodes that passed it along back to the sender.
+func (s *Sim) RingHops(from *Node, content string) (HopStats, error) {
+	live := s.Live()
+	for _, node := range live {
+		node.received.takePassedBy()
+	}
+	s.Broadcast(from, content)
+	if err := s.WaitDelivered(from, content); err != nil {
+		return HopStats{}, err
+	}
+	passedBy := make(map[string]string)
+	for _, node := range live {
+		taken := node.received.takePassedBy()
+		if node == from {
+			continue
+		}
+		if len(taken) != 1 {
+			return HopStats{}, fmt.Errorf("%s received %d broadcasts around the ring, expected 1", node.Name, len(taken))
+		}
+		passedBy[node.Name] = taken[0].String()
+	}
+	hops := make([]int, 0, len(passedBy))
+	for name := range passedBy {
+		d := 0
+		for at := name; at != from.Name; d++ {
+			previous, ok := passedBy[at]
+			if !ok || d >= len(passedBy) {
+				return HopStats{}, fmt.Errorf("Unexpected path of the broadcast to %s, through %s", name, at)
+			}
+			at = previous
+		}
+		hops = append(hops, d)
+	}
+	return hopStats(hops), nil
+}
+
+// TreeHops broadcasts some content from a node, and measures the hops it took
+//
+// Every other live node needs to have received it once over the tree,
+// which needs chord links, see BuildChords.
+func (s *Sim) TreeHops(from *Node, content string) (HopStats, error) {
+	live := s.Live()
+	for _, node := range live {
+		node.received.takeHops()
+	}
+	s.Broadcast(from, content)
+	if err := s.WaitDelivered(from, content); err != nil {
+		return HopStats{}, err
+	}
+	var hops []int
+	for _, node := range live {
+		taken := node.received.takeHops()
+		if node != from && len(taken) != 1 {
+			return HopStats{}, fmt.Errorf("%s received %d broadcasts over the tree, expected 1", node.Name, len(taken))
+		}
+		hops = append(hops, taken...)
+	}
+	return hopStats(hops), nil
+}
+
+// Responsible returns the live node responsible for an ID
+//
+// That's the first one whose ID comes at or after it, going around the ring.
+func (s *Sim) Responsible(id protocol.ID) *Node {
+	var best *Node
+	for _, node := range s.Live() {
+		nodeID := node.Swarm.ID()
+		if best == nil || nodeID-id < best.Swarm.ID()-id {
+			best = node
+		}
+	}
+	return best
+}
+
+// CheckOrder verifies that following successors visits nodes in the order of their IDs
+func (s *Sim) CheckOrder() error {
+	live := s.Live()
+	ring, err := s.ring(live[0])
+	if err != nil {
+		return err
+	}
+	for i, node := range ring {
+		pred := ring[(i+len(ring)-1)%len(ring)].Swarm.ID()
+		succ := ring[(i+1)%len(ring)].Swarm.ID()
+		if !node.Swarm.ID().Between(pred, succ) {
+			return fmt.Errorf("%s is out of order in the ring", node.Name)
+		}
+	}
+	return nil
+}
+
+// CheckFingers verifies that every finger of every live node is responsible for its ID
+func (s *Sim) CheckFingers() error {
+	for _, node := range s.Live() {
+		var expected []string
+		for i := uint(0); i < 64; i++ {
+			name := s.Responsible(node.Swarm.ID() + 1<<i).Name
+			if len(expected) == 0 || expected[len(expected)-1] != name {
+				expected = append(expected, name)
+			}
+		}
+		fingers := node.Swarm.Fingers()
+		if len(fingers) != len(expected) {
+			return fmt.Errorf("%s has %d distinct fingers, expected %d", node.Name, len(fingers), len(expected))
+		}
+		for i, f := range fingers {
+			if f.String() != expected[i] {
+				return fmt.Errorf("%s has %s as finger %d, expected %s", node.Name, f, i, expected[i])
+			}
+		}
+	}
+	return nil
+}
+
+// FixFingers fixes the fingers of every live node, until CheckFingers succeeds
+func (s *Sim) FixFingers() error {
+	live := s.Live()
+	var err error
+	for round := 0; round < 3; round++ {
+		var wg sync.WaitGroup
+		for _, node := range live {
+			wg.Add(1)
+			go func(node *Node) {
+				defer wg.Done()
+				node.Swarm.FixFingers()
+			}(node)
+		}
+		wg.Wait()
+		if err = s.CheckFingers(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,381 @@
+package sim
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"math/bits"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/ripple/internal/network"
+	"github.com/cronokirby/ripple/internal/protocol"
+)
+
+func TestRingForms(t *testing.T) {
+	s := New(Config{Seed: 1})
+	if err := s.Grow(40); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	if err := s.CheckRing(); err != nil {
+		t.Errorf("Unexpected broken ring: %v", err)
+	}
+}
+
+func TestRingFormsWithLatency(t *testing.T) {
+	s := New(Config{Seed: 2, Latency: time.Millisecond, Jitter: 3 * time.Millisecond})
+	if err := s.Grow(15); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	if err := s.CheckRing(); err != nil {
+		t.Errorf("Unexpected broken ring: %v", err)
+	}
+}
+
+func TestBroadcastDeliveredOnce(t *testing.T) {
+	s := New(Config{Seed: 3, Jitter: 2 * time.Millisecond})
+	if err := s.Grow(12); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	nodes := s.Nodes()
+	for i := 0; i < 5; i++ {
+		from := nodes[(i*5)%len(nodes)]
+		content := fmt.Sprintf("message %d", i)
+		s.Broadcast(from, content)
+		if err := s.WaitDelivered(from, content); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestCrashBreaksRing checks that only the neighbors of a crashed node notice it
+//
+// There's no repair in the protocol yet, so the ring stays broken where it was.
+func TestCrashBreaksRing(t *testing.T) {
+	logs := &syncBuffer{}
+	s := New(Config{Seed: 4, Timeout: 100 * time.Millisecond, Log: log.New(logs, "", 0)})
+	if err := s.Grow(6); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	crashed := s.Nodes()[3]
+	ring, err := s.ring(crashed)
+	if err != nil {
+		t.Fatalf("Unexpected broken ring: %v", err)
+	}
+	succ, pred := ring[1], ring[len(ring)-1]
+	// joining logs a few things, which aren't what we're after
+	logs.Reset()
+	s.Crash(crashed)
+	noticed := []string{
+		pred.Name + ": Error reading from succ: ",
+		succ.Name + ": Error reading from pred: ",
+	}
+	var lines []string
+	s.waitFor(func() bool {
+		lines = strings.Split(strings.TrimSpace(logs.String()), "\n")
+		return countLines(lines, noticed[0]) > 0 && countLines(lines, noticed[1]) > 0
+	})
+	// give other nodes some time to notice something, which they shouldn't
+	time.Sleep(20 * time.Millisecond)
+	lines = strings.Split(strings.TrimSpace(logs.String()), "\n")
+	for _, prefix := range noticed {
+		if count := countLines(lines, prefix); count != 1 {
+			t.Errorf("Expected %q to be logged once got %d, logs:\n%s", prefix, count, logs)
+		}
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, crashed.Name+": ") {
+			continue
+		}
+		if !strings.HasPrefix(line, noticed[0]) && !strings.HasPrefix(line, noticed[1]) {
+			t.Errorf("Expected only the neighbors of %s to notice it got %q", crashed.Name, line)
+		}
+	}
+	// both still point at the crashed node, breaking the ring on either side
+	if addr := pred.Swarm.Successor().String(); addr != crashed.Name {
+		t.Errorf("Expected %s to keep %s as its successor got %s", pred.Name, crashed.Name, addr)
+	}
+	if addr := succ.Swarm.Predecessor().String(); addr != crashed.Name {
+		t.Errorf("Expected %s to keep %s as its predecessor got %s", succ.Name, crashed.Name, addr)
+	}
+	expected := fmt.Sprintf("%s has successor %s, which isn't live", pred.Name, crashed.Name)
+	if err := s.CheckRing(); err == nil || err.Error() != expected {
+		t.Errorf("Expected %q got %v", expected, err)
+	}
+	// broadcasts go around until the gap, and no further
+	from := ring[2]
+	s.Broadcast(from, "after")
+	if err := s.WaitDelivered(from, "after"); err == nil {
+		t.Errorf("Expected the crash to stop delivery")
+	}
+	for _, node := range ring[3:] {
+		if got := node.Received("after"); got != 1 {
+			t.Errorf("Expected %s before the gap to receive it once got %d", node.Name, got)
+		}
+	}
+	if got := succ.Received("after"); got != 0 {
+		t.Errorf("Expected %s past the gap not to receive it got %d", succ.Name, got)
+	}
+}
+
+// countLines counts the lines starting with prefix
+func countLines(lines []string, prefix string) int {
+	count := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestPartitionStopsDelivery(t *testing.T) {
+	s := New(Config{Seed: 5, Timeout: 100 * time.Millisecond})
+	if err := s.Grow(6); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	from := s.Nodes()[0]
+	ring, err := s.ring(from)
+	if err != nil {
+		t.Fatalf("Unexpected broken ring: %v", err)
+	}
+	// broadcasts follow the ring, so this one stops where it crosses the partition
+	s.Partition(ring[:3], ring[3:])
+	s.Broadcast(from, "split")
+	if err := s.WaitDelivered(from, "split"); err == nil {
+		t.Errorf("Expected a partition to stop delivery")
+	}
+	for _, node := range ring[1:3] {
+		if got := node.Received("split"); got != 1 {
+			t.Errorf("Expected %s on our side to receive it once got %d", node.Name, got)
+		}
+	}
+	for _, node := range ring[3:] {
+		if got := node.Received("split"); got != 0 {
+			t.Errorf("Expected %s on the other side not to receive it got %d", node.Name, got)
+		}
+	}
+	s.Heal()
+	if err := s.WaitDelivered(from, "split"); err != nil {
+		t.Errorf("Expected the broadcast to arrive after healing: %v", err)
+	}
+}
+
+func TestPartitionRefusesJoin(t *testing.T) {
+	s := New(Config{Seed: 6})
+	if err := s.Grow(3); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	s.Partition(s.Nodes())
+	if err := s.Grow(1); err == nil {
+		t.Errorf("Expected joining across a partition to fail")
+	}
+}
+
+func TestSplitAndDelayedWrites(t *testing.T) {
+	faults := network.Faults{Delay: 100 * time.Microsecond, SplitWrites: true}
+	s := New(Config{Seed: 7, Jitter: time.Millisecond, Faults: faults})
+	if err := s.Grow(8); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	from := s.Nodes()[5]
+	s.Broadcast(from, "one byte at a time")
+	if err := s.WaitDelivered(from, "one byte at a time"); err != nil {
+		t.Error(err)
+	}
+}
+
+// syncBuffer lets us collect logs from many goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCorruptedConfirmPredecessor(t *testing.T) {
+	logs := &syncBuffer{}
+	s := New(Config{Seed: 8, Timeout: 200 * time.Millisecond, Log: log.New(logs, "", 0)})
+	if err := s.Grow(4); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	s.SetFaults("node-4", network.Faults{CorruptOn: []string{"ConfirmPredecessor"}})
+	if err := s.Grow(1); err == nil {
+		t.Fatalf("Expected a corrupted join to fail")
+	}
+	if !strings.Contains(logs.String(), "Mismatched Predecessors") {
+		t.Errorf("Expected the corrupted address to be noticed, logs:\n%s", logs)
+	}
+}
+
+func TestDroppedConfirmReferral(t *testing.T) {
+	s := New(Config{Seed: 9, Timeout: 200 * time.Millisecond})
+	if err := s.Grow(4); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	for _, node := range s.Nodes() {
+		s.SetFaults(node.Name, network.Faults{DropOn: []string{"ConfirmReferral"}})
+	}
+	if err := s.Grow(1); err == nil {
+		t.Errorf("Expected a join without ConfirmReferral to fail")
+	}
+}
+
+func TestChordBroadcast(t *testing.T) {
+	s := New(Config{Seed: 9, Chords: true, Jitter: time.Millisecond})
+	if err := s.Grow(20); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	// until the links are built, the ring is used
+	nodes := s.Nodes()
+	s.Broadcast(nodes[0], "before")
+	if err := s.WaitDelivered(nodes[0], "before"); err != nil {
+		t.Error(err)
+	}
+	if err := s.BuildChords(); err != nil {
+		t.Fatalf("Failed to build chord links: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		from := nodes[(i*7)%len(nodes)]
+		stats, err := s.TreeHops(from, fmt.Sprintf("tree %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 20 nodes are at most 5 links away from each other
+		if stats.Nodes != 19 || stats.Max > 5 {
+			t.Errorf("Expected 19 nodes within 5 hops got %+v", stats)
+		}
+	}
+}
+
+func TestChordBroadcastAfterGrowth(t *testing.T) {
+	s := New(Config{Seed: 10, Chords: true})
+	if err := s.Grow(9); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	if err := s.BuildChords(); err != nil {
+		t.Fatalf("Failed to build chord links: %v", err)
+	}
+	// the new nodes aren't counted by the census yet, so the tree has to reach them anyway
+	if err := s.Grow(4); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	nodes := s.Nodes()
+	for i, from := range nodes[:3] {
+		content := fmt.Sprintf("grown %d", i)
+		s.Broadcast(from, content)
+		if err := s.WaitDelivered(from, content); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// large also measures a swarm of 1000 nodes, which takes a while
+var large = flag.Bool("large", false, "Measure hop counts in a swarm of 1000 nodes too")
+
+// TestChordHopCounts compares the hops a broadcast takes around the ring and down the tree
+//
+// Run with -v to see the measurements, and -large to include 1000 nodes.
+func TestChordHopCounts(t *testing.T) {
+	sizes := []int{10, 100}
+	if *large {
+		sizes = append(sizes, 1000)
+	}
+	for _, size := range sizes {
+		s := New(Config{Seed: int64(size), Chords: true, Timeout: 30 * time.Second})
+		if err := s.Grow(size); err != nil {
+			t.Fatalf("Failed to grow swarm: %v", err)
+		}
+		from := s.Nodes()[size/2]
+		ring, err := s.RingHops(from, "around")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.BuildChords(); err != nil {
+			t.Fatalf("Failed to build chord links: %v", err)
+		}
+		tree, err := s.TreeHops(from, "measure")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf(
+			"%4d nodes: ring max %4d mean %6.1f, tree max %2d mean %4.1f",
+			size, ring.Max, ring.Mean, tree.Max, tree.Mean,
+		)
+		if ring.Nodes != size-1 || ring.Max != size-1 {
+			t.Errorf("Expected %d nodes within %d hops around the ring got %+v", size-1, size-1, ring)
+		}
+		levels := bits.Len(uint(size - 1))
+		if tree.Nodes != size-1 || tree.Max > levels {
+			t.Errorf("Expected %d nodes within %d hops got %+v", size-1, levels, tree)
+		}
+	}
+}
+
+func TestJoinsKeepRingInOrder(t *testing.T) {
+	s := New(Config{Seed: 11, Jitter: time.Millisecond})
+	if err := s.Grow(30); err != nil {
+		t.Fatalf("Failed to grow swarm: %v", err)
+	}
+	if err := s.CheckOrder(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestLookupHops checks that lookups find the right node, measuring how many hops they take
+//
+// Run with -v to see the measurements.
+func TestLookupHops(t *testing.T) {
+	for _, size := range []int{10, 100} {
+		s := New(Config{Seed: int64(size) + 1, Timeout: 30 * time.Second})
+		if err := s.Grow(size); err != nil {
+			t.Fatalf("Failed to grow swarm: %v", err)
+		}
+		if err := s.FixFingers(); err != nil {
+			t.Fatalf("Failed to fix fingers: %v", err)
+		}
+		rng := rand.New(rand.NewSource(int64(size)))
+		nodes := s.Nodes()
+		total, most := 0, 0
+		const lookups = 200
+		for i := 0; i < lookups; i++ {
+			from := nodes[rng.Intn(len(nodes))]
+			id := protocol.ID(rng.Uint64())
+			addr, hops, err := from.Swarm.Lookup(id)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if expected := s.Responsible(id).Name; addr.String() != expected {
+				t.Errorf("Expected %v to be responsible for %v got %v", expected, id, addr)
+			}
+			total += hops
+			if hops > most {
+				most = hops
+			}
+		}
+		t.Logf("%4d nodes: lookup max %2d mean %4.1f hops", size, most, float64(total)/lookups)
+		if levels := bits.Len(uint(size - 1)); most > levels {
+			t.Errorf("Expected at most %d hops got %d", levels, most)
+		}
+	}
+}
@@ -2,53 +2,165 @@ package main
 
 import (
 	"log"
-	"net"
 	"os"
+	"strings"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/cronokirby/ripple/internal/app"
+	"github.com/cronokirby/ripple/internal/control"
 	"github.com/cronokirby/ripple/internal/network"
 	"github.com/cronokirby/ripple/internal/protocol"
 )
 
-func startUI(swarm *network.SwarmHandle) {
+// serveControl starts the local control server, if we were asked to
+func serveControl(swarm *network.SwarmHandle, logger *log.Logger) {
+	if *app.Control == "" {
+		return
+	}
+	l, err := control.Listen(*app.Control)
+	if err != nil {
+		logger.Fatalln("Failed to start the control server: ", err)
+	}
+	logger.Println("Serving the control API on", l.Addr())
+	go control.NewServer(swarm, control.DefaultHistory).Serve(l)
+}
+
+// joinSwarm joins the swarm through the first peer that lets us, or starts a new one without any
+func joinSwarm(config network.Config, listen string, peers []string, nick string, logger *log.Logger) *network.SwarmHandle {
+	if listen == "" {
+		logger.Fatalln("No address to listen on, in the arguments or the profile")
+	}
+	me, err := network.ParseAddr(listen)
+	if err != nil {
+		logger.Fatalln("Failed to resolve own address: ", err)
+	}
+	config.ListenAddr = me
+	var swarm *network.SwarmHandle
+	if len(peers) == 0 {
+		logger.Println("Starting new swarm...")
+		if swarm, err = network.CreateSwarm(config); err != nil {
+			logger.Fatalln("Failed to join swarm: ", err)
+		}
+	}
+	for _, peer := range peers {
+		them, err := network.ParseAddr(peer)
+		if err != nil {
+			logger.Println("Failed to resolve peer address: ", err)
+			continue
+		}
+		logger.Println("Joining swarm through", peer)
+		if swarm, err = network.JoinSwarm(config, them); err == nil {
+			break
+		}
+		logger.Println("Failed to join swarm: ", err)
+	}
+	if swarm == nil {
+		logger.Fatalln("Failed to join swarm through any of the peers")
+	}
+	if nick != "" {
+		if err := swarm.ChangeNickname(nick); err != nil {
+			logger.Println("Failed to change nickname: ", err)
+		}
+	}
+	return swarm
+}
+
+// runDaemon keeps a node running without a ui, serving the clients attaching to it
+func runDaemon(swarm *network.SwarmHandle, logger *log.Logger) {
+	server := control.NewServer(swarm, control.DefaultHistory)
+	swarm.HandleSignals(server.ReceiveSignal)
+	swarm.HandleFileOffers(server.ReceiveOffer)
+	swarm.HandleRingChanges(server.ReceiveRingChange)
+	l, err := control.Listen(*app.DaemonSocket)
+	if err != nil {
+		logger.Fatalln("Failed to start the control server: ", err)
+	}
+	logger.Println("Waiting for clients on", l.Addr())
+	logger.Fatalln(server.Serve(l))
+}
+
+// attach runs the ui for a node running as a daemon, which keeps running once we leave
+func attach(logger *log.Logger) {
+	client, err := control.Dial(*app.AttachSocket)
+	if err != nil {
+		logger.Fatalln("Failed to attach to the daemon: ", err)
+	}
+	if *app.TUI {
+		app.RunTUI(client)
+		return
+	}
+	finished := make(chan struct{})
+	go func() {
+		app.Interact(client)
+		close(finished)
+	}()
+	// the line ui has nothing left to do once the daemon goes away
+	select {
+	case <-client.Done():
+		os.Exit(1)
+	case <-finished:
+	}
+	client.Close()
+}
+
+func startUI(swarm *network.SwarmHandle, logger *log.Logger) {
+	swarm.SetReceiver(protocol.PrintReceiver{})
+	serveControl(swarm, logger)
 	if *app.TUI {
 		app.RunTUI(swarm)
-	} else {
-		app.Interact(swarm)
+		return
+	}
+	// without any more input, we keep relaying messages for the others
+	if !app.Interact(swarm) {
+		select {}
 	}
 }
 
 func main() {
 	logger := log.New(os.Stderr, "", log.Flags())
-	switch kingpin.MustParse(app.App.Parse(os.Args[1:])) {
-	case app.Start.FullCommand():
-		me, err := net.ResolveTCPAddr("tcp", *app.StartAddr)
-		if err != nil {
-			logger.Fatalln("Failed to resolve own address: ", err)
+	command := kingpin.MustParse(app.App.Parse(os.Args[1:]))
+	profile, err := app.ApplyConfig(command)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	if command == app.ConfigShow.FullCommand() {
+		if err := profile.Show(os.Stdout); err != nil {
+			logger.Fatalln(err)
 		}
-		logger.Println("Starting new swarm...")
-		swarm, err := network.CreateSwarm(logger, me)
+		return
+	}
+	config := network.Config{Log: logger, Transport: network.NetTransport{}}
+	if *app.Faults != "" {
+		faults, err := network.ParseFaults(*app.Faults)
 		if err != nil {
-			logger.Fatalln("Failed to join swarm: ", err)
+			logger.Fatalln("Invalid faults: ", err)
 		}
-		swarm.SetReceiver(protocol.PrintReceiver{})
-		startUI(swarm)
-	case app.Connect.FullCommand():
-		me, err := net.ResolveTCPAddr("tcp", *app.ConnectListenAddr)
+		config.Transport = network.NewFaultTransport(config.Transport, faults)
+	}
+	if *app.Advertise != "" {
+		advertised, err := network.ParseAddr(*app.Advertise)
 		if err != nil {
-			logger.Fatalln("Failed to resolve own address: ", err)
+			logger.Fatalln("Failed to resolve advertised address: ", err)
 		}
-		them, err := net.ResolveTCPAddr("tcp", *app.ConnectAddr)
-		if err != nil {
-			logger.Fatalln("Failed to resolve peer address: ", err)
+		config.AdvertiseAddr = advertised
+	}
+	switch command {
+	case app.Start.FullCommand():
+		startUI(joinSwarm(config, profile.Listen, nil, profile.Nick, logger), logger)
+	case app.Connect.FullCommand():
+		if len(profile.Peers) == 0 {
+			logger.Fatalln("No peer to connect to, in the arguments or the profile")
 		}
-		logger.Println("Joining swarm...")
-		swarm, err := network.JoinSwarm(logger, me, them)
-		if err != nil {
-			logger.Fatalln("Failed to join swarm: ", err)
+		startUI(joinSwarm(config, profile.Listen, profile.Peers, profile.Nick, logger), logger)
+	case app.Daemon.FullCommand():
+		runDaemon(joinSwarm(config, profile.Listen, profile.Peers, profile.Nick, logger), logger)
+	case app.Attach.FullCommand():
+		attach(logger)
+	case app.Send.FullCommand():
+		if err := app.SendOnce(*app.SendVia, strings.Join(*app.SendText, " ")); err != nil {
+			logger.Fatalln("Failed to send: ", err)
 		}
-		swarm.SetReceiver(protocol.PrintReceiver{})
-		startUI(swarm)
+	case app.Tail.FullCommand():
+		logger.Fatalln("Stopped following the node: ", app.Follow(*app.TailVia, *app.TailJSON))
 	}
 }